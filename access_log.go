@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every cast ballot, and every submission with an unknown code, leaves an
+// access log row for fraud investigations, e.g. 200 ballots from one
+// address. The row holds keyed hashes of the client IP, its network (/24,
+// or /64 for IPv6) and the user agent, and no reference to the voter or the
+// ballot. The hashes are HMAC-SHA256 under ACCESS_LOG_KEY, so the table
+// can't be reversed by hashing every IPv4 address. Rows are purged with
+// ACCESS_LOG_RETENTION_DAYS.
+
+// Access log kinds
+const (
+	AccessVote        = "vote"         // ballot cast by the voter
+	AccessProxy       = "proxy"        // ballot cast by a proxy holder
+	AccessInvalidCode = "invalid_code" // code not on the roll
+)
+
+// defaultAnomalyMin is how many ballots from one address the anomaly report
+// lists by default
+const defaultAnomalyMin = 5
+
+// loadAccessLogKey reads ACCESS_LOG_KEY; ACCESS_LOG=off turns the access log
+// off and returns nil. Without a key the hashes are keyed per server run and
+// only match within it.
+func loadAccessLogKey() []byte {
+	if strings.EqualFold(os.Getenv("ACCESS_LOG"), "off") {
+		return nil
+	}
+	if key := os.Getenv("ACCESS_LOG_KEY"); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	log.Println("ACCESS_LOG_KEY not set: access log hashes only match within this server run")
+	return key
+}
+
+// clientIP is the address a request came from. Behind the bundled nginx the
+// peer is the proxy, so X-Real-IP, which nginx overwrites, is taken when the
+// peer is a loopback or private address.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && (ip.IsLoopback() || ip.IsPrivate()) {
+		if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+			return real
+		}
+	}
+	return ip
+}
+
+// accessHash is the keyed hash of one attribute of a request
+func (a *App) accessHash(attr, v string) string {
+	mac := hmac.New(sha256.New, a.accessKey)
+	mac.Write([]byte(attr + "\x00" + v))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// logAccess records a request of the given kind; a no-op with the access
+// log turned off. Failures are logged and don't affect the ballot.
+func (a *App) logAccess(ctx context.Context, r *http.Request, kind string) {
+	if a.accessKey == nil {
+		return
+	}
+	ip := clientIP(r)
+	network := clientNetwork(ip)
+	_, err := a.db.Exec(ctx, `
+		INSERT INTO access_logs (kind, ip_hash, net_hash, ua_hash) VALUES ($1, $2, $3, $4)`,
+		kind, a.accessHash("ip", ip.String()), a.accessHash("net", network), a.accessHash("ua", r.UserAgent()))
+	if err != nil {
+		logHTTP.Errorf("error writing access log: %v", err)
+	}
+}
+
+// AccessAnomaly is one address (or network) with many ballots
+type AccessAnomaly struct {
+	Hash         string
+	Ballots      int
+	InvalidCodes int
+	Addresses    int // distinct IPs, networks only
+	UserAgents   int
+	First        time.Time
+	Last         time.Time
+}
+
+type AccessData struct {
+	Enabled      bool
+	Min          int
+	Retention    int // days; 0 keeps the log
+	Logged       int
+	Addresses    int
+	ByIP         []AccessAnomaly
+	ByNetwork    []AccessAnomaly
+	InvalidCodes []AccessAnomaly
+}
+
+// accessAnomalies groups the access log by column, keeping groups with at
+// least min rows of the kinds counted
+func (a *App) accessAnomalies(ctx context.Context, column string, min int, kinds ...string) ([]AccessAnomaly, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT `+column+`,
+			COUNT(*) FILTER (WHERE kind IN ('vote', 'proxy')),
+			COUNT(*) FILTER (WHERE kind = 'invalid_code'),
+			COUNT(DISTINCT ip_hash), COUNT(DISTINCT ua_hash), MIN(at), MAX(at)
+		FROM access_logs
+		GROUP BY 1
+		HAVING COUNT(*) FILTER (WHERE kind = ANY($2)) >= $1
+		ORDER BY COUNT(*) FILTER (WHERE kind = ANY($2)) DESC, 1
+		LIMIT 50`, min, kinds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []AccessAnomaly
+	for rows.Next() {
+		var an AccessAnomaly
+		if err := rows.Scan(&an.Hash, &an.Ballots, &an.InvalidCodes, &an.Addresses, &an.UserAgents, &an.First, &an.Last); err != nil {
+			return nil, err
+		}
+		an.Hash = an.Hash[:12]
+		list = append(list, an)
+	}
+	return list, rows.Err()
+}
+
+// adminAccessHandler: GET /admin/access reports addresses and networks with
+// many ballots or invalid codes, ?min=<n> at a time. Superadmin only.
+func (a *App) adminAccessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data := AccessData{Enabled: a.accessKey != nil, Min: defaultAnomalyMin}
+	if n, err := strconv.Atoi(r.URL.Query().Get("min")); err == nil && n > 0 {
+		data.Min = n
+	}
+	if period, ok := a.retention[ClassAccessLog]; ok {
+		data.Retention = int(period / (24 * time.Hour))
+	}
+
+	err := a.db.QueryRow(ctx, `
+		SELECT COUNT(*) FILTER (WHERE kind IN ('vote', 'proxy')), COUNT(DISTINCT ip_hash)
+		FROM access_logs`).Scan(&data.Logged, &data.Addresses)
+	if err == nil {
+		data.ByIP, err = a.accessAnomalies(ctx, "ip_hash", data.Min, AccessVote, AccessProxy)
+	}
+	if err == nil {
+		data.ByNetwork, err = a.accessAnomalies(ctx, "net_hash", data.Min, AccessVote, AccessProxy)
+	}
+	if err == nil {
+		data.InvalidCodes, err = a.accessAnomalies(ctx, "ip_hash", data.Min, AccessInvalidCode)
+	}
+	if err != nil {
+		logHTTP.Errorf("error getting access log: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "access.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+// commonPasswords are tried first by anyone guessing; lowercase
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "12345678": true, "123456789": true,
+	"1234567890": true, "qwertyuiop": true, "qwerty123": true, "admin123": true, "admin1234": true,
+	"11111111": true, "00000000": true, "iloveyou": true, "bismillah": true, "rahasia123": true,
+	"indonesia": true, "pemilihan": true, "sayangku": true, "superadmin": true, "passw0rd": true,
+}
+
+// validEmail reports whether s is a bare email address
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+// checkPasswordPolicy is the rule for every password an admin sets: long
+// enough, not a common password, not made of a few repeated characters and
+// not containing the username (or the name part of an email username). The
+// error is shown to the admin as-is.
+func checkPasswordPolicy(password, username string) error {
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Errorf("password minimal %d karakter", minPasswordLength)
+	}
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return fmt.Errorf("password terlalu umum")
+	}
+	distinct := map[rune]bool{}
+	for _, c := range lower {
+		distinct[c] = true
+	}
+	if len(distinct) < 4 {
+		return fmt.Errorf("password harus berisi sedikitnya 4 karakter berbeda")
+	}
+	name := strings.ToLower(username)
+	if i := strings.IndexByte(name, '@'); i > 0 {
+		name = name[:i]
+	}
+	if len(name) >= 3 && strings.Contains(lower, name) {
+		return fmt.Errorf("password tidak boleh berisi username")
+	}
+	return nil
+}
+
+// AccountRow is an admin account as listed on the accounts page
+type AccountRow struct {
+	ID        int
+	Username  string
+	Email     string
+	Role      Role
+	Disabled  bool
+	CreatedAt string
+}
+
+type AccountsData struct {
+	Current  *Account
+	Accounts []AccountRow
+	Invites  []InviteRow
+	Roles    []Role
+	Mail     bool // invites are mailed
+	Message  string
+	Error    string
+}
+
+func (a *App) listAccounts(ctx context.Context) ([]AccountRow, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, username, COALESCE(email, ''), role, disabled, to_char(created_at, 'YYYY-MM-DD HH24:MI')
+		FROM admin_accounts
+		ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []AccountRow
+	for rows.Next() {
+		var acc AccountRow
+		if err := rows.Scan(&acc.ID, &acc.Username, &acc.Email, &acc.Role, &acc.Disabled, &acc.CreatedAt); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, acc)
+	}
+	return accounts, rows.Err()
+}
+
+// adminAccountsHandler lists admin accounts and pending invites and handles
+// create / invite / role change / enable-disable / password reset.
+// Superadmin only.
+func (a *App) adminAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := AccountsData{Current: accountFrom(ctx), Roles: roles}
+	if m, err := a.orgMailer(ctx); err == nil && m != nil {
+		data.Mail = true
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var msg string
+		var err error
+		switch r.FormValue("action") {
+		case "invite", "revoke-invite":
+			// audited with the invite's own detail
+			msg, err = a.applyInviteAction(ctx, r)
+		default:
+			if msg, err = a.applyAccountAction(ctx, r); err == nil {
+				a.audit(ctx, actorName(r), "account."+r.FormValue("action"), r.FormValue("id"),
+					map[string]string{"username": r.FormValue("username"), "role": r.FormValue("role")})
+			}
+		}
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Message = msg
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	accounts, err := a.listAccounts(ctx)
+	if err != nil {
+		logDB.Errorf("error getting accounts: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Accounts = accounts
+	if data.Invites, err = a.listInvites(ctx); err != nil {
+		logDB.Errorf("error getting invites: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "accounts.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// applyAccountAction performs the form action; the returned error message is
+// shown to the admin as-is.
+func (a *App) applyAccountAction(ctx context.Context, r *http.Request) (string, error) {
+	action := r.FormValue("action")
+	username := strings.TrimSpace(r.FormValue("username"))
+	role := Role(r.FormValue("role"))
+	password := r.FormValue("password")
+
+	switch action {
+	case "create":
+		if username == "" {
+			return "", fmt.Errorf("username diperlukan")
+		}
+		if !validRole(role) {
+			return "", fmt.Errorf("role tidak valid")
+		}
+		email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+		if email != "" && !validEmail(email) {
+			return "", fmt.Errorf("alamat email tidak valid")
+		}
+		if err := checkPasswordPolicy(password, username); err != nil {
+			return "", err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		tag, err := a.db.Exec(ctx, `
+			INSERT INTO admin_accounts (username, password_hash, role, email)
+			VALUES ($1, $2, $3, NULLIF($4, ''))
+			ON CONFLICT (org_id, username) DO NOTHING`, username, string(hash), role, email)
+		if err != nil {
+			logDB.Errorf("error creating account: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		if tag.RowsAffected() == 0 {
+			return "", fmt.Errorf("username %s sudah ada", username)
+		}
+		return fmt.Sprintf("Akun %s dibuat", username), nil
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return "", fmt.Errorf("akun tidak valid")
+	}
+	if cur := accountFrom(ctx); cur != nil && cur.ID == id {
+		return "", fmt.Errorf("tidak dapat mengubah akun sendiri")
+	}
+
+	var query string
+	var args []interface{}
+	switch action {
+	case "role":
+		if !validRole(role) {
+			return "", fmt.Errorf("role tidak valid")
+		}
+		query, args = `UPDATE admin_accounts SET role = $2 WHERE id = $1`, []interface{}{id, role}
+	case "disable":
+		query, args = `UPDATE admin_accounts SET disabled = TRUE WHERE id = $1`, []interface{}{id}
+	case "enable":
+		query, args = `UPDATE admin_accounts SET disabled = FALSE WHERE id = $1`, []interface{}{id}
+	case "password":
+		var current string
+		if err := a.db.QueryRow(ctx, `SELECT username FROM admin_accounts WHERE id = $1`, id).Scan(&current); err != nil {
+			return "", fmt.Errorf("akun tidak ditemukan")
+		}
+		if err := checkPasswordPolicy(password, current); err != nil {
+			return "", err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		if err := a.setPassword(ctx, id, current, string(hash)); err != nil {
+			logDB.Errorf("error updating account: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		return "Password diganti; sesi akun ini diakhiri", nil
+	case "email":
+		email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+		if email != "" && !validEmail(email) {
+			return "", fmt.Errorf("alamat email tidak valid")
+		}
+		query, args = `UPDATE admin_accounts SET email = NULLIF($2, '') WHERE id = $1`, []interface{}{id, email}
+	default:
+		return "", fmt.Errorf("aksi tidak dikenal")
+	}
+
+	tag, err := a.db.Exec(ctx, query, args...)
+	if err != nil {
+		logDB.Errorf("error updating account: %v", err)
+		return "", fmt.Errorf("database error")
+	}
+	if tag.RowsAffected() == 0 {
+		return "", fmt.Errorf("akun tidak ditemukan")
+	}
+	return "Akun diperbarui", nil
+}
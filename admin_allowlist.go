@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The admin area can be limited to known networks, e.g. the office and the
+// VPN. ADMIN_ALLOW_IPS lists addresses or CIDR ranges fixed at deployment;
+// a superadmin adds more at /admin/allowlist (admin_allowlist). With either
+// list non-empty every /admin path, the login page included, answers 403 to
+// a client address (clientIP) outside both. The table is read into memory at
+// start and every allowlistRefresh after, like the branding.
+
+const allowlistRefresh = time.Minute
+
+// allowlist holds the networks allowed into the admin area
+type allowlist struct {
+	env []*net.IPNet // ADMIN_ALLOW_IPS
+
+	mu sync.RWMutex
+	db []*net.IPNet // admin_allowlist
+}
+
+// allows reports whether ip may open admin pages; with no networks listed
+// every address may
+func (l *allowlist) allows(ip net.IP) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return networksAllow(ip, l.env, l.db)
+}
+
+// networksAllow reports whether ip is in one of the lists, or the lists are
+// all empty
+func networksAllow(ip net.IP, lists ...[]*net.IPNet) bool {
+	empty := true
+	for _, list := range lists {
+		for _, n := range list {
+			empty = false
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return empty
+}
+
+// parseNetwork reads an address or a CIDR range; an address is a range of
+// one
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", s)
+	}
+	return n, nil
+}
+
+// loadAdminAllowlist reads ADMIN_ALLOW_IPS, comma separated
+func loadAdminAllowlist() (*allowlist, error) {
+	l := &allowlist{}
+	for _, s := range strings.Split(os.Getenv("ADMIN_ALLOW_IPS"), ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, fmt.Errorf("ADMIN_ALLOW_IPS: %v", err)
+		}
+		l.env = append(l.env, n)
+	}
+	return l, nil
+}
+
+// AllowlistEntry is a network added by a superadmin
+type AllowlistEntry struct {
+	ID        int
+	Network   string
+	Note      string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+func listAllowlist(ctx context.Context, q queryer) ([]AllowlistEntry, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, network::text, note, created_by, created_at
+		FROM admin_allowlist
+		ORDER BY network`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AllowlistEntry
+	for rows.Next() {
+		var e AllowlistEntry
+		if err := rows.Scan(&e.ID, &e.Network, &e.Note, &e.CreatedBy, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// loadAllowlist reads admin_allowlist into memory
+func (a *App) loadAllowlist(ctx context.Context) error {
+	entries, err := listAllowlist(ctx, a.db)
+	if err != nil {
+		return err
+	}
+	networks, err := entryNetworks(entries)
+	if err != nil {
+		return err
+	}
+	a.allowlist.mu.Lock()
+	a.allowlist.db = networks
+	a.allowlist.mu.Unlock()
+	return nil
+}
+
+func entryNetworks(entries []AllowlistEntry) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		n, err := parseNetwork(e.Network)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// isAdminPath reports whether p is in the admin area
+func isAdminPath(p string) bool {
+	return p == "/admin" || strings.HasPrefix(p, "/admin/")
+}
+
+// withAdminAllowlist turns away admin requests from outside the allowlist
+func (a *App) withAdminAllowlist(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminPath(r.URL.Path) {
+			if ip := clientIP(r); !a.allowlist.allows(ip) {
+				logHTTP.Warnf("admin request refused from %s %s", ip, r.URL.Path)
+				a.writeError(w, r, http.StatusForbidden, "Halaman admin hanya dapat dibuka dari jaringan yang diizinkan.")
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// AllowlistData is the data of allowlist.html
+type AllowlistData struct {
+	Env      []string
+	Entries  []AllowlistEntry
+	ClientIP string
+	Message  string
+	Error    string
+}
+
+// adminAllowlistHandler lists the allowed networks and adds or removes those
+// of the table. Superadmin only.
+func (a *App) adminAllowlistHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data AllowlistData
+	if ip := clientIP(r); ip != nil {
+		data.ClientIP = ip.String()
+	}
+	for _, n := range a.allowlist.env {
+		data.Env = append(data.Env, n.String())
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		msg, err := a.applyAllowlistAction(ctx, r)
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+		if err := a.loadAllowlist(ctx); err != nil {
+			logDB.Errorf("error loading admin allowlist: %v", err)
+		}
+		data.Message = msg
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries, err := listAllowlist(ctx, a.db)
+	if err != nil {
+		logDB.Errorf("error getting admin allowlist: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Entries = entries
+
+	if err := a.tmpl.ExecuteTemplate(w, "allowlist.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// applyAllowlistAction adds or removes a network and records it in the audit
+// log; the returned error message is shown to the admin as-is. A change that
+// would shut out the admin making it is refused.
+func (a *App) applyAllowlistAction(ctx context.Context, r *http.Request) (string, error) {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		logDB.Errorf("error updating admin allowlist: %v", err)
+		return "", fmt.Errorf("database error")
+	}
+	defer tx.Rollback(ctx)
+
+	var msg, action string
+	var detail map[string]string
+	switch r.FormValue("action") {
+	case "add":
+		n, err := parseNetwork(r.FormValue("network"))
+		if err != nil {
+			return "", fmt.Errorf("alamat atau jaringan tidak valid (contoh: 203.0.113.7 atau 10.8.0.0/16)")
+		}
+		if ones, bits := n.Mask.Size(); ones < bits/4 {
+			return "", fmt.Errorf("jaringan %s terlalu luas", n)
+		}
+		note := strings.TrimSpace(r.FormValue("note"))
+		if len(note) > 200 {
+			note = note[:200]
+		}
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO admin_allowlist (network, note, created_by) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id, network) DO NOTHING`, n.String(), note, actorName(r))
+		if err != nil {
+			logDB.Errorf("error adding to admin allowlist: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		if tag.RowsAffected() == 0 {
+			return "", fmt.Errorf("%s sudah ada di daftar", n)
+		}
+		msg, action, detail = fmt.Sprintf("%s ditambahkan", n), "allowlist.add", map[string]string{"network": n.String(), "note": note}
+	case "delete":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return "", fmt.Errorf("entri tidak valid")
+		}
+		var network string
+		err = tx.QueryRow(ctx, `DELETE FROM admin_allowlist WHERE id = $1 RETURNING network::text`, id).Scan(&network)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", fmt.Errorf("entri tidak ditemukan")
+		}
+		if err != nil {
+			logDB.Errorf("error deleting from admin allowlist: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		msg, action, detail = fmt.Sprintf("%s dihapus", network), "allowlist.delete", map[string]string{"network": network}
+	default:
+		return "", fmt.Errorf("aksi tidak dikenal")
+	}
+
+	entries, err := listAllowlist(ctx, tx)
+	if err != nil {
+		logDB.Errorf("error getting admin allowlist: %v", err)
+		return "", fmt.Errorf("database error")
+	}
+	networks, err := entryNetworks(entries)
+	if err != nil {
+		logDB.Errorf("error getting admin allowlist: %v", err)
+		return "", fmt.Errorf("database error")
+	}
+	if ip := clientIP(r); !networksAllow(ip, a.allowlist.env, networks) {
+		return "", fmt.Errorf("perubahan ini akan menutup akses alamat Anda sendiri (%s); tambahkan jaringan Anda terlebih dahulu", ip)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logDB.Errorf("error updating admin allowlist: %v", err)
+		return "", fmt.Errorf("database error")
+	}
+	a.audit(ctx, actorName(r), action, "", detail)
+	return msg, nil
+}
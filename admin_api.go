@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// AdminStats holds the counters shown at the top of the admin dashboard.
+type AdminStats struct {
+	TotalVoters      int `json:"total_voters"`
+	VotedCount       int `json:"voted_count"`
+	NotVotedCount    int `json:"not_voted_count"`
+	SetujuCount      int `json:"setuju_count"`
+	TidakSetujuCount int `json:"tidak_setuju_count"`
+	KosongCount      int `json:"kosong_count"` // blank
+	RusakCount       int `json:"rusak_count"`  // spoiled submissions
+}
+
+// adminStats computes the dashboard counters: turnout from the roll, the
+// online split per choice from the referendum tally. Served from the
+// results cache, see results_cache.go.
+func (a *App) adminStats(ctx context.Context) (AdminStats, error) {
+	r, err := a.cachedResults(ctx)
+	if err != nil {
+		return AdminStats{}, err
+	}
+	return r.Stats, nil
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logHTTP.Errorf("error encoding json: %v", err)
+	}
+}
+
+// adminStatsHandler serves the dashboard counters as JSON so the admin page
+// can poll them without reloading the full voter list.
+func (a *App) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := a.adminStats(r.Context())
+	if err != nil {
+		logTally.Errorf("error getting voting stats: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Card layout on A4 portrait, in millimetres: 2 columns x 4 rows
+const (
+	cardCols    = 2
+	cardRows    = 4
+	cardMargin  = 10.0
+	cardWidth   = (210.0 - 2*cardMargin) / cardCols
+	cardHeight  = (297.0 - 2*cardMargin) / cardRows
+	cardPadding = 5.0
+	cardQRSize  = 32.0
+)
+
+// baseURL returns the public address voters should open, within the
+// election's path. PUBLIC_URL wins; otherwise it is derived from the request
+// (honouring the nginx proxy headers).
+func (a *App) baseURL(r *http.Request) string {
+	base := a.electionOf(r).Base
+	if a.publicURL != "" {
+		return strings.TrimSuffix(a.publicURL, "/") + base
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + base
+}
+
+// mailBaseURL is the address of links sent by email, within the election's
+// path, from PUBLIC_URL only: a link derived from the request would let
+// anyone with a forged Host header have a genuine mail point at their server.
+// Empty without PUBLIC_URL.
+func (a *App) mailBaseURL(r *http.Request) string {
+	if a.publicURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(a.publicURL, "/") + a.electionOf(r).Base
+}
+
+// adminCardsHandler renders a print-ready PDF with one cut-out card per
+// voter (name, code, QR link and instructions) for the voters matching the
+// admin filter, e.g. only those who haven't voted yet.
+func (a *App) adminCardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := parseVoterFilter(r.URL.Query())
+	voters, err := a.listVoters(r.Context(), filter)
+	if err != nil {
+		logDB.Errorf("error getting voters: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if len(voters) == 0 {
+		http.Error(w, "tidak ada peserta untuk dicetak", http.StatusNotFound)
+		return
+	}
+
+	pdf, err := renderVoterCards(voters, a.baseURL(r))
+	if err != nil {
+		logHTTP.Errorf("error rendering cards: %v", err)
+		http.Error(w, "gagal membuat PDF", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("kartu-suara-%s.pdf", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(pdf)
+}
+
+// renderVoterCards lays the voters out as cards, eight per A4 page
+func renderVoterCards(voters []VoterInfo, base string) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(cardMargin, cardMargin, cardMargin)
+	pdf.SetAutoPageBreak(false, 0)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	perPage := cardCols * cardRows
+	for i, v := range voters {
+		if i%perPage == 0 {
+			pdf.AddPage()
+		}
+		slot := i % perPage
+		x := cardMargin + float64(slot%cardCols)*cardWidth
+		y := cardMargin + float64(slot/cardCols)*cardHeight
+
+		link := base + "/" + v.Code
+		png, err := qrcode.Encode(link, qrcode.Medium, 256)
+		if err != nil {
+			return nil, err
+		}
+		imgName := "qr-" + v.Code
+		pdf.RegisterImageOptionsReader(imgName, fpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+
+		// dashed cut line around the card
+		pdf.SetDrawColor(160, 160, 160)
+		pdf.SetDashPattern([]float64{1, 1}, 0)
+		pdf.Rect(x, y, cardWidth, cardHeight, "D")
+		pdf.SetDashPattern([]float64{}, 0)
+
+		textW := cardWidth - 3*cardPadding - cardQRSize
+		pdf.SetXY(x+cardPadding, y+cardPadding)
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.MultiCell(textW, 5, tr("Undangan Pemilihan Online"), "", "L", false)
+
+		pdf.SetX(x + cardPadding)
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(textW, 5, tr(v.Name), "", "L", false)
+		if v.Wilayah != "" {
+			pdf.SetX(x + cardPadding)
+			pdf.SetFont("Helvetica", "I", 9)
+			pdf.MultiCell(textW, 4.5, tr("Wilayah "+v.Wilayah), "", "L", false)
+		}
+
+		pdf.SetX(x + cardPadding)
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.CellFormat(textW, 6, "Kode unik:", "", 1, "L", false, 0, "")
+		pdf.SetX(x + cardPadding)
+		pdf.SetFont("Courier", "B", 16)
+		pdf.CellFormat(textW, 8, v.Code, "", 1, "L", false, 0, "")
+
+		pdf.ImageOptions(imgName, x+cardWidth-cardPadding-cardQRSize, y+cardPadding, cardQRSize, cardQRSize, false, fpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+
+		pdf.SetXY(x+cardPadding, y+cardPadding+cardQRSize+3)
+		pdf.SetFont("Helvetica", "", 8)
+		instructions := fmt.Sprintf("Pindai kode QR atau buka %s lalu masukkan kode unik di atas. "+
+			"Kode hanya dapat digunakan satu kali. Jangan berikan kode ini kepada orang lain.", base)
+		pdf.MultiCell(cardWidth-2*cardPadding, 3.8, tr(instructions), "", "L", false)
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
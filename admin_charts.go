@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ChartSeries is one named line/bar series in a chart
+type ChartSeries struct {
+	Name string `json:"name"`
+	Data []int  `json:"data"`
+}
+
+// ChartData is a ready-to-plot dataset: one label per x value and one or
+// more series of the same length.
+type ChartData struct {
+	Labels []string      `json:"labels"`
+	Series []ChartSeries `json:"series"`
+}
+
+// newChartData returns an empty dataset with the named series; slices are
+// non-nil so an empty chart encodes as [] rather than null
+func newChartData(series ...string) ChartData {
+	data := ChartData{Labels: []string{}}
+	for _, name := range series {
+		data.Series = append(data.Series, ChartSeries{Name: name, Data: []int{}})
+	}
+	return data
+}
+
+// choiceChart returns the distribution of online choices, plus those who
+// have not voted yet
+func (a *App) choiceChart(ctx context.Context) (ChartData, error) {
+	stats, err := a.adminStats(ctx)
+	if err != nil {
+		return ChartData{}, err
+	}
+	return ChartData{
+		Labels: []string{"Setuju", "Tidak Setuju", "Belum Memilih"},
+		Series: []ChartSeries{{
+			Name: "Peserta",
+			Data: []int{stats.SetujuCount, stats.TidakSetujuCount, stats.NotVotedCount},
+		}},
+	}, nil
+}
+
+// turnoutByGroupChart returns voted / not voted counts per wilayah
+func (a *App) turnoutByGroupChart(ctx context.Context) (ChartData, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT vm.wilayah,
+			COUNT(*) FILTER (WHERE v.used = true) AS voted,
+			COUNT(*) FILTER (WHERE v.used = false) AS not_voted
+		FROM voters v INNER JOIN vote_master vm ON v.phone = vm.phone
+		GROUP BY vm.wilayah
+		ORDER BY vm.wilayah`)
+	if err != nil {
+		return ChartData{}, err
+	}
+	defer rows.Close()
+
+	data := newChartData("Sudah Memilih", "Belum Memilih")
+	for rows.Next() {
+		var group string
+		var voted, notVoted int
+		if err := rows.Scan(&group, &voted, &notVoted); err != nil {
+			return ChartData{}, err
+		}
+		data.Labels = append(data.Labels, group)
+		data.Series[0].Data = append(data.Series[0].Data, voted)
+		data.Series[1].Data = append(data.Series[1].Data, notVoted)
+	}
+	return data, rows.Err()
+}
+
+// turnoutOverTimeChart buckets votes by hour (or day) in WIB, with a
+// running total alongside the per-bucket count
+func (a *App) turnoutOverTimeChart(ctx context.Context, bucket string) (ChartData, error) {
+	if bucket != "day" {
+		bucket = "hour"
+	}
+	labelFormat := "02/01 15:04"
+	if bucket == "day" {
+		labelFormat = "02/01/2006"
+	}
+
+	rows, err := a.db.Query(ctx, `
+		SELECT date_trunc($1, used_at AT TIME ZONE 'Asia/Jakarta') AS bucket, COUNT(*)
+		FROM voters
+		WHERE used = true AND used_at IS NOT NULL
+		GROUP BY bucket
+		ORDER BY bucket`, bucket)
+	if err != nil {
+		return ChartData{}, err
+	}
+	defer rows.Close()
+
+	data := newChartData("Suara", "Kumulatif")
+	total := 0
+	for rows.Next() {
+		var t time.Time
+		var n int
+		if err := rows.Scan(&t, &n); err != nil {
+			return ChartData{}, err
+		}
+		total += n
+		data.Labels = append(data.Labels, t.Format(labelFormat))
+		data.Series[0].Data = append(data.Series[0].Data, n)
+		data.Series[1].Data = append(data.Series[1].Data, total)
+	}
+	return data, rows.Err()
+}
+
+// adminChartHandler serves one of the chart datasets as JSON, or drawn with
+// a .svg suffix (chart_render.go); the chart is selected by the last path
+// segment, e.g. /admin/api/charts/choices.
+func (a *App) adminChartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	if name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/admin/api/charts/"), ".svg"); ok {
+		svg, err := a.adminChartSVG(ctx, name, r.URL.Query().Get("bucket"))
+		if err != nil {
+			logTally.Errorf("error getting chart data: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if svg == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeChartSVG(w, svg)
+		return
+	}
+
+	var data ChartData
+	var err error
+	switch r.URL.Path {
+	case "/admin/api/charts/choices":
+		data, err = a.choiceChart(ctx)
+	case "/admin/api/charts/turnout-by-group":
+		data, err = a.turnoutByGroupChart(ctx)
+	case "/admin/api/charts/turnout-over-time":
+		data, err = a.turnoutOverTimeChart(ctx, r.URL.Query().Get("bucket"))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logTally.Errorf("error getting chart data: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// csvSafe keeps a cell from being read as a formula by Excel or LibreOffice:
+// a value starting with = + - @, a tab or a carriage return, such as a name
+// "=HYPERLINK(...)", gets a leading apostrophe
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// csvSafeRow applies csvSafe to every cell of row
+func csvSafeRow(row []string) []string {
+	for i, s := range row {
+		row[i] = csvSafe(s)
+	}
+	return row
+}
+
+// csvPhone is csvSafe for a phone number: an E.164 number such as
+// +6281234567890 stays as it is, for re-import and messaging tools
+func csvPhone(s string) string {
+	if digits, ok := strings.CutPrefix(s, "+"); ok && len(digits) >= 8 && len(digits) <= 15 &&
+		strings.Trim(digits, "0123456789") == "" {
+		return s
+	}
+	return csvSafe(s)
+}
+
+// adminExportHandler streams the voter list as CSV using the same filter
+// parameters as the admin page, so what you see is what you export.
+func (a *App) adminExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := parseVoterFilter(r.URL.Query())
+	voters, err := a.listVoters(r.Context(), filter)
+	if err != nil {
+		logDB.Errorf("error getting voters: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("peserta-%s.csv", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// BOM so Excel opens the file as UTF-8
+	w.Write([]byte("\xEF\xBB\xBF"))
+
+	cw := csv.NewWriter(w)
+	header := []string{"No", "Kode", "Nama", "Wilayah", "No HP", "Status", "Waktu Memilih", "Pilihan"}
+	for _, f := range a.voterFields {
+		header = append(header, f.Label)
+	}
+	cw.Write(csvSafeRow(header))
+	for i, v := range voters {
+		status := "Belum Memilih"
+		if v.Used {
+			status = "Sudah Memilih"
+		}
+		// what was typed or imported is escaped, the rest the server wrote
+		cw.Write(append([]string{
+			fmt.Sprint(i + 1),
+			csvSafe(v.Code),
+			csvSafe(v.Name),
+			csvSafe(v.Wilayah),
+			csvPhone(v.Phone),
+			status,
+			v.UsedAt,
+			v.Choice,
+		}, csvSafeRow(v.Fields)...))
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		logHTTP.Errorf("error writing csv: %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A superadmin invites another admin of the organization by email. The
+// invite link carries the invite id and expiry signed with INVITE_KEY, so a
+// link can't be made up or moved to another invite, organization or role;
+// the invitee opens it, sets a password and gets an account named by their
+// email with the invited role. Inviting, revoking and accepting are recorded
+// in the audit log. With the organization's mail settings or SMTP_URL the
+// link is mailed, otherwise it is shown to the superadmin to pass on.
+
+// inviteTTL is how long an invite link can be used
+const inviteTTL = 7 * 24 * time.Hour
+
+// InviteRow is a pending invite as listed on the accounts page
+type InviteRow struct {
+	ID        int
+	Email     string
+	Role      Role
+	InvitedBy string
+	ExpiresAt string
+}
+
+// InvitePage is the data of invite.html
+type InvitePage struct {
+	Token   string
+	Email   string
+	Role    Role
+	Org     string
+	Error   string
+	Created bool
+}
+
+// loadInviteKey returns the key signing invite links; without INVITE_KEY
+// links only work until the server restarts
+func loadInviteKey() []byte {
+	if key := os.Getenv("INVITE_KEY"); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	log.Println("INVITE_KEY not set: invite links only work within this server run")
+	return key
+}
+
+// inviteSignature signs what an invite grants
+func (a *App) inviteSignature(id int, expires time.Time, email string, role Role) string {
+	mac := hmac.New(sha256.New, a.inviteKey)
+	fmt.Fprintf(mac, "invite|%s|%d|%d|%s|%s", a.org, id, expires.Unix(), email, role)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// inviteToken is the t parameter of an invite link: id.expiry.signature
+func (a *App) inviteToken(id int, expires time.Time, email string, role Role) string {
+	return fmt.Sprintf("%d.%d.%s", id, expires.Unix(), a.inviteSignature(id, expires, email, role))
+}
+
+var (
+	errInvalidInvite = errors.New("link undangan tidak valid atau sudah kedaluwarsa")
+	errInviteUsed    = errors.New("undangan ini sudah dipakai; silakan login")
+)
+
+// inviteLinkError reports whether err is about the link rather than the server
+func inviteLinkError(err error) bool {
+	return errors.Is(err, errInvalidInvite) || errors.Is(err, errInviteUsed)
+}
+
+// openInvite checks token against its invite, which must still be open. The
+// row is locked when q is a transaction.
+func (a *App) openInvite(ctx context.Context, q queryer, token string) (id int, email string, role Role, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, "", "", errInvalidInvite
+	}
+	if id, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, "", "", errInvalidInvite
+	}
+	var expires time.Time
+	var accepted, revoked bool
+	err = q.QueryRow(ctx, `
+		SELECT email, role, expires_at, accepted_at IS NOT NULL, revoked_at IS NOT NULL
+		FROM admin_invites WHERE id = $1
+		FOR UPDATE`, id).Scan(&email, &role, &expires, &accepted, &revoked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, "", "", errInvalidInvite
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+	if !hmac.Equal([]byte(parts[1]+"."+parts[2]), []byte(strconv.FormatInt(expires.Unix(), 10)+"."+a.inviteSignature(id, expires, email, role))) {
+		return 0, "", "", errInvalidInvite
+	}
+	if accepted {
+		return 0, "", "", errInviteUsed
+	}
+	if revoked || time.Now().After(expires) {
+		return 0, "", "", errInvalidInvite
+	}
+	return id, email, role, nil
+}
+
+func (a *App) listInvites(ctx context.Context) ([]InviteRow, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, email, role, invited_by, to_char(expires_at, 'YYYY-MM-DD HH24:MI')
+		FROM admin_invites
+		WHERE accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []InviteRow
+	for rows.Next() {
+		var inv InviteRow
+		if err := rows.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.ExpiresAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// applyInviteAction creates or revokes an invite from the accounts page and
+// records it in the audit log; the returned error message is shown to the
+// admin as-is.
+func (a *App) applyInviteAction(ctx context.Context, r *http.Request) (string, error) {
+	switch r.FormValue("action") {
+	case "invite":
+		addr, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("email")))
+		if err != nil {
+			return "", fmt.Errorf("alamat email tidak valid")
+		}
+		email := strings.ToLower(addr.Address)
+		role := Role(r.FormValue("role"))
+		if !validRole(role) {
+			return "", fmt.Errorf("role tidak valid")
+		}
+		var exists bool
+		if err := a.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM admin_accounts WHERE username = $1)`, email).Scan(&exists); err != nil {
+			logDB.Errorf("error checking account: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		if exists {
+			return "", fmt.Errorf("akun %s sudah ada", email)
+		}
+
+		// Without mail settings or over the day's quota the link is shown
+		// instead; otherwise the invite is mailed through the outbox, queued
+		// with the invite itself
+		m, err := a.orgMailer(ctx)
+		if err != nil {
+			logMailer.Errorf("error getting mailer: %v", err)
+		}
+		overQuota := false
+		if m != nil {
+			if err := a.checkMessageQuota(ctx); err != nil && !errors.Is(err, errMessageQuota) {
+				logMailer.Errorf("error checking message quota: %v", err)
+			} else if err != nil {
+				overQuota = true
+			}
+		}
+
+		tx, err := a.db.Begin(ctx)
+		if err != nil {
+			logDB.Errorf("error creating invite: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		defer tx.Rollback(ctx)
+		var id int
+		var expires time.Time
+		err = tx.QueryRow(ctx, `
+			INSERT INTO admin_invites (email, role, invited_by, expires_at)
+			VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second')
+			RETURNING id, expires_at`, email, role, actorName(r), int(inviteTTL/time.Second)).Scan(&id, &expires)
+		if err == nil {
+			err = auditIn(ctx, tx, actorName(r), "account.invite", strconv.Itoa(id),
+				map[string]string{"email": email, "role": string(role), "expires_at": expires.Format(time.RFC3339)})
+		}
+		// a mailed link is built from PUBLIC_URL only, never the Host a
+		// request claims; without it the link is only shown to this admin
+		base := a.mailBaseURL(r)
+		shown := base
+		if shown == "" {
+			shown = a.baseURL(r)
+		}
+		link := shown + "/invite?t=" + a.inviteToken(id, expires, email, role)
+		until := expires.In(a.voteEnd.Location()).Format("2006-01-02 15:04")
+		if err == nil && m != nil && !overQuota && base != "" {
+			err = enqueueMessage(ctx, tx, outboxMessage{
+				Channel:   ChannelEmail,
+				Recipient: email,
+				Subject:   "Undangan admin pemilihan",
+				Body: fmt.Sprintf("%s mengundang Anda menjadi %s di %s.\n\nBuka link berikut untuk membuat password "+
+					"(berlaku sampai %s):\n%s\n\nAbaikan email ini bila Anda tidak merasa diundang.\n",
+					actorName(r), role, base, until, link),
+				Source: "account.invite",
+			})
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			logDB.Errorf("error creating invite: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+
+		switch {
+		case m == nil:
+			return fmt.Sprintf("Undangan untuk %s dibuat. Kirimkan link ini kepadanya (berlaku sampai %s): %s",
+				email, until, link), nil
+		case overQuota:
+			return "", fmt.Errorf("undangan dibuat tetapi kuota email hari ini (%d) sudah habis; kirimkan link ini secara manual: %s",
+				a.quotas.MessagesPerDay, link)
+		case base == "":
+			return "", fmt.Errorf("undangan dibuat tetapi tidak dikirim karena PUBLIC_URL belum diatur; kirimkan link ini secara manual: %s",
+				link)
+		}
+		return fmt.Sprintf("Undangan untuk %s masuk antrean kirim; statusnya terlihat di halaman Email", email), nil
+
+	case "revoke-invite":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return "", fmt.Errorf("undangan tidak valid")
+		}
+		var email string
+		err = a.db.QueryRow(ctx, `
+			UPDATE admin_invites SET revoked_at = NOW()
+			WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+			RETURNING email`, id).Scan(&email)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", fmt.Errorf("undangan tidak ditemukan")
+		}
+		if err != nil {
+			logDB.Errorf("error revoking invite: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		a.audit(ctx, actorName(r), "account.invite_revoke", strconv.Itoa(id), map[string]string{"email": email})
+		return fmt.Sprintf("Undangan untuk %s dibatalkan", email), nil
+	}
+	return "", fmt.Errorf("aksi tidak dikenal")
+}
+
+// inviteHandler: GET /invite?t= shows the invite, POST sets the password and
+// creates the account. No login: the signed link is the credential.
+func (a *App) inviteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := InvitePage{Token: r.FormValue("t"), Org: a.org}
+
+	switch r.Method {
+	case http.MethodGet:
+		_, email, role, err := a.openInvite(ctx, a.db, data.Token)
+		if inviteLinkError(err) {
+			a.writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			logDB.Errorf("error getting invite: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		data.Email, data.Role = email, role
+	case http.MethodPost:
+		email, role, err := a.acceptInvite(ctx, data.Token, r.FormValue("password"), r.FormValue("password2"))
+		switch {
+		case inviteLinkError(err):
+			a.writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		case err != nil && email == "":
+			logDB.Errorf("error accepting invite: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		case err != nil:
+			data.Error = err.Error()
+		default:
+			data.Created = true
+		}
+		data.Email, data.Role = email, role
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := a.tmpl.ExecuteTemplate(w, "invite.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// acceptInvite creates the invited account; email is empty when the invite
+// couldn't be read
+func (a *App) acceptInvite(ctx context.Context, token, password, confirm string) (string, Role, error) {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	id, email, role, err := a.openInvite(ctx, tx, token)
+	if err != nil {
+		return "", "", err
+	}
+	if err := checkPasswordPolicy(password, email); err != nil {
+		return email, role, err
+	}
+	if password != confirm {
+		return email, role, fmt.Errorf("konfirmasi password tidak sama")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return email, role, err
+	}
+	var accountID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO admin_accounts (username, password_hash, role, email)
+		VALUES ($1, $2, $3, $1)
+		ON CONFLICT (org_id, username) DO NOTHING
+		RETURNING id`, email, string(hash), role).Scan(&accountID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return email, role, fmt.Errorf("akun %s sudah ada", email)
+	}
+	if err != nil {
+		logDB.Errorf("error creating invited account: %v", err)
+		return email, role, fmt.Errorf("database error")
+	}
+	if _, err := tx.Exec(ctx, `UPDATE admin_invites SET accepted_at = NOW(), account_id = $2 WHERE id = $1`, id, accountID); err != nil {
+		logDB.Errorf("error accepting invite: %v", err)
+		return email, role, fmt.Errorf("database error")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		logDB.Errorf("error accepting invite: %v", err)
+		return email, role, fmt.Errorf("database error")
+	}
+	a.audit(ctx, email, "account.invite_accept", strconv.Itoa(accountID),
+		map[string]string{"invite": strconv.Itoa(id), "username": email, "role": string(role)})
+	return email, role, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The admin page lists the whole roll, so at 100k voters every round trip
+// and every full scan shows. The counters come from the results cache in a
+// single aggregate (see loadLiveResults); the rest of the page, i.e. the
+// voter list, the group dropdown, the roll commitment and the tally
+// snapshot, is read in one batch. Large rolls are listed a page at a time,
+// see VoterPage.
+
+// adminPage is what the admin page reads besides the cached results
+type adminPage struct {
+	Voters   []VoterInfo
+	Groups   []string
+	Roll     *RollCommitment
+	Snapshot *TallySnapshot
+}
+
+// loadAdminPage sends the queries of the admin page in one round trip. A
+// paged list is limited to the page, and page.Total set.
+func (a *App) loadAdminPage(ctx context.Context, f VoterFilter, page *VoterPage) (*adminPage, error) {
+	inSQL := page.Paged() && a.pagesInSQL(f)
+	b := &pgx.Batch{}
+	sql, args := a.votersQuery(f)
+	if inSQL {
+		sql += fmt.Sprintf(" LIMIT %d OFFSET %d", page.Size, page.Offset())
+		countSQL, countArgs := a.votersCountQuery(f)
+		b.Queue(countSQL, countArgs...)
+	}
+	b.Queue(sql, args...)
+	b.Queue(groupsQuery)
+	b.Queue(rollCommitmentQuery, a.voteStart)
+	b.Queue(tallySnapshotQuery, a.voteEnd)
+
+	br := a.db.SendBatch(ctx, b)
+	defer br.Close()
+
+	p := &adminPage{}
+	if inSQL {
+		if err := br.QueryRow().Scan(&page.Total); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := br.Query()
+	if err == nil {
+		p.Voters, err = a.scanVoters(rows, f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if page.Paged() && !inSQL {
+		// filtered here after decrypting: keep just the page
+		page.Total = len(p.Voters)
+		p.Voters = p.Voters[min(page.Offset(), len(p.Voters)):min(page.Offset()+page.Size, len(p.Voters))]
+	}
+	if rows, err = br.Query(); err == nil {
+		p.Groups, err = scanGroups(rows)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Roll, err = scanRollCommitment(br.QueryRow()); err != nil {
+		return nil, err
+	}
+	if p.Snapshot, err = scanTallySnapshot(br.QueryRow()); err != nil {
+		return nil, err
+	}
+	return p, br.Close()
+}
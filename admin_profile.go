@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// SessionRow is an open admin session as listed on the profile page
+type SessionRow struct {
+	ID         int
+	Method     string // password, oidc or saml
+	IP         string
+	UserAgent  string
+	CreatedAt  string
+	LastSeenAt string
+	ExpiresAt  string
+	Current    bool // the session of this browser
+}
+
+type ProfileData struct {
+	Account  *Account
+	Home     string // the page of the account's role
+	Sessions []SessionRow
+	Devices  []DeviceRow // remembered browsers
+	Logins   []LoginRow  // latest sign-in attempts
+	Message  string
+	Error    string
+}
+
+// listSessions returns the open sessions of username, latest used first
+func (a *App) listSessions(ctx context.Context, username string, current int) ([]SessionRow, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, method, ip, user_agent, to_char(created_at, 'YYYY-MM-DD HH24:MI'),
+			to_char(last_seen_at, 'YYYY-MM-DD HH24:MI'), to_char(expires_at, 'YYYY-MM-DD HH24:MI')
+		FROM admin_sessions
+		WHERE username = $1 AND revoked_at IS NULL AND expires_at > NOW()
+			AND last_seen_at > NOW() - make_interval(secs => $2)
+		ORDER BY last_seen_at DESC`, username, a.sessions.idle.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []SessionRow
+	for rows.Next() {
+		var s SessionRow
+		if err := rows.Scan(&s.ID, &s.Method, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		s.Current = s.ID == current
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// adminProfileHandler: /admin/profile shows the signed-in admin's open
+// sessions and remembered browsers, and on POST revokes a session
+// (action=revoke), forgets a browser (action=forget) or does both for all
+// of them (action=logout-all). Every role.
+func (a *App) adminProfileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	acc := accountFrom(ctx)
+	data := ProfileData{Account: acc, Home: "/admin"}
+	switch acc.Role {
+	case RoleOperator:
+		data.Home = "/count"
+	case RoleObserver:
+		data.Home = "/observer"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "revoke":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			var found int
+			err := a.db.QueryRow(ctx, `
+				UPDATE admin_sessions SET revoked_at = NOW()
+				WHERE id = $1 AND username = $2 AND revoked_at IS NULL
+				RETURNING id`, id, acc.Username).Scan(&found)
+			if errors.Is(err, pgx.ErrNoRows) {
+				data.Error = "Sesi tidak ditemukan"
+				break
+			}
+			if err != nil {
+				logDB.Errorf("error revoking session: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			a.audit(ctx, acc.Username, "account.session_revoke", acc.Username, map[string]int{"session": id})
+			if id == acc.Session {
+				a.setCookie(w, r, adminSessionCookie, "", -1, http.SameSiteLaxMode)
+				a.electionRedirect(w, r, "/admin/login", http.StatusSeeOther)
+				return
+			}
+			data.Message = "Sesi diakhiri"
+		case "forget":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			tag, err := a.db.Exec(ctx, `
+				UPDATE admin_remember_tokens t SET revoked_at = NOW()
+				FROM admin_accounts acc
+				WHERE t.id = $1 AND acc.id = t.account_id AND acc.username = $2 AND t.revoked_at IS NULL`, id, acc.Username)
+			if err != nil {
+				logDB.Errorf("error revoking remember token: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			if tag.RowsAffected() == 0 {
+				data.Error = "Perangkat tidak ditemukan"
+				break
+			}
+			a.audit(ctx, acc.Username, "account.remember_revoke", acc.Username, map[string]int{"device": id})
+			data.Message = "Perangkat dilupakan"
+		case "logout-all":
+			n, err := a.endSessions(ctx, acc.Username, 0)
+			if err != nil {
+				logDB.Errorf("error revoking sessions: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			devices, err := a.forgetDevices(ctx, acc.Username)
+			if err != nil {
+				logDB.Errorf("error revoking remember tokens: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			a.audit(ctx, acc.Username, "account.logout_all", acc.Username, map[string]int64{"sessions": n, "devices": devices})
+			a.setCookie(w, r, adminRememberCookie, "", -1, http.SameSiteLaxMode)
+			if acc.Session != 0 {
+				a.setCookie(w, r, adminSessionCookie, "", -1, http.SameSiteLaxMode)
+				a.electionRedirect(w, r, "/admin/login", http.StatusSeeOther)
+				return
+			}
+			data.Message = fmt.Sprintf("%d sesi diakhiri", n)
+		default:
+			data.Error = "aksi tidak dikenal"
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions, err := a.listSessions(ctx, acc.Username, acc.Session)
+	if err != nil {
+		logDB.Errorf("error getting sessions: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Sessions = sessions
+	if data.Devices, err = a.listDevices(ctx, acc.Username); err != nil {
+		logDB.Errorf("error getting remembered devices: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if data.Logins, err = a.listLogins(ctx, acc.Username, false, 20); err != nil {
+		logDB.Errorf("error getting logins: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "profile.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
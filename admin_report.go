@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// Report layout on A4 portrait, in millimetres
+const (
+	reportMargin = 15.0
+	reportWidth  = 210.0 - 2*reportMargin
+)
+
+// adminReportHandler renders the results report as a PDF: the counts per
+// channel, the turnout and the dashboard charts, as of now
+func (a *App) adminReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pdf, err := a.renderReport(r.Context(), time.Now())
+	if err != nil {
+		logTally.Errorf("error rendering report: %v", err)
+		http.Error(w, "gagal membuat PDF", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("laporan-hasil-%s.pdf", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(pdf)
+}
+
+// renderReport lays the report out as of now
+func (a *App) renderReport(ctx context.Context, now time.Time) ([]byte, error) {
+	results, err := a.cachedResults(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byGroup, err := a.turnoutByGroupChart(ctx)
+	if err != nil {
+		return nil, err
+	}
+	overTime, err := a.turnoutOverTimeChart(ctx, "hour")
+	if err != nil {
+		return nil, err
+	}
+	c := splitChannels(results)
+	loc := a.voteEnd.Location()
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(reportMargin, reportMargin, reportMargin)
+	pdf.SetAutoPageBreak(false, reportMargin)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(reportWidth, 9, tr("Laporan Hasil Pemilihan"), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(reportWidth, 5, tr(fmt.Sprintf("Organisasi: %s", a.org)), "", 1, "L", false, 0, "")
+	pdf.CellFormat(reportWidth, 5, tr(fmt.Sprintf("Pemungutan suara: %s sampai %s",
+		a.voteStart.In(loc).Format("02/01/2006 15:04"), a.voteEnd.In(loc).Format("02/01/2006 15:04"))), "", 1, "L", false, 0, "")
+	status := "hasil sementara, pemungutan suara belum ditutup"
+	if now.After(a.voteEnd) {
+		status = "pemungutan suara sudah ditutup"
+	}
+	pdf.CellFormat(reportWidth, 5, tr(fmt.Sprintf("Dicetak: %s (%s)", now.In(loc).Format("02/01/2006 15:04"), status)), "", 1, "L", false, 0, "")
+	if results.Sealed > 0 {
+		pdf.SetTextColor(192, 57, 43)
+		pdf.CellFormat(reportWidth, 5, tr(fmt.Sprintf("%d surat suara online masih tersegel dan belum ikut dihitung", results.Sealed)), "", 1, "L", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	}
+	pdf.Ln(4)
+
+	// counts per channel
+	colW := []float64{50, 32, 32, 32, 34}
+	header := []string{"", "Suara", "Setuju", "Tidak Setuju", "Tidak Sah"}
+	rows := [][]int{
+		{c.Voted, c.Online.Setuju, c.Online.TidakSetuju, 0},
+		{c.Offline, c.Paper.Setuju, c.Paper.TidakSetuju, c.Paper.TidakSah},
+		{c.Voted + c.Offline, c.Online.Setuju + c.Paper.Setuju, c.Online.TidakSetuju + c.Paper.TidakSetuju, c.Paper.TidakSah},
+	}
+	names := []string{"Online", "Di tempat", "Total"}
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.SetFillColor(242, 242, 242)
+	for i, h := range header {
+		pdf.CellFormat(colW[i], 7, tr(h), "1", 0, "C", true, 0, "")
+	}
+	pdf.Ln(-1)
+	for i, row := range rows {
+		style := ""
+		if i == len(rows)-1 {
+			style = "B"
+		}
+		pdf.SetFont("Helvetica", style, 10)
+		pdf.CellFormat(colW[0], 7, tr(names[i]), "1", 0, "L", false, 0, "")
+		for j, v := range row {
+			pdf.CellFormat(colW[j+1], 7, strconv.Itoa(v), "1", 0, "R", false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+	pdf.Ln(2)
+	pdf.SetFont("Helvetica", "", 10)
+	turnout := fmt.Sprintf("Partisipasi online: %d dari %d peserta", c.Voted, results.Stats.TotalVoters)
+	if results.Stats.TotalVoters > 0 {
+		turnout += fmt.Sprintf(" (%.1f%%)", float64(c.Voted)*100/float64(results.Stats.TotalVoters))
+	}
+	pdf.CellFormat(reportWidth, 5, tr(turnout), "", 1, "L", false, 0, "")
+	y := pdf.GetY() + 6
+
+	charts := []struct {
+		title     string
+		data      ChartData
+		firstOnly bool
+	}{
+		{"Sebaran Pilihan", publicChoiceChart(results), false},
+		{"Partisipasi", publicTurnoutChart(results), false},
+		{"Partisipasi per Wilayah", byGroup, false},
+		{"Suara per Jam", overTime, true},
+	}
+	_, pageH := pdf.GetPageSize()
+	for _, ch := range charts {
+		bars := chartBars(ch.data, ch.firstOnly)
+		// keep a chart on one page where it fits
+		if need := 12 + 6*float64(len(bars)); y+need > pageH-reportMargin && need < pageH-2*reportMargin {
+			pdf.AddPage()
+			y = reportMargin
+		}
+		y = drawChartPDF(pdf, tr, reportMargin, y, reportWidth, ch.title, bars)
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
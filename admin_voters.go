@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+
+	"pemilihan.gkjp.id/eligibility"
+)
+
+// VoterFilter narrows and orders the admin voter list. It is parsed from the
+// query string so the current view can be bookmarked or shared.
+type VoterFilter struct {
+	Status string // "", "voted", "not_voted"
+	Choice string // "", "setuju", "tidak_setuju", "kosong"
+	Group  string // wilayah, "" for all
+	Search string // matches name, code or phone
+	Sort   string // key of voterSortColumns
+	Desc   bool
+
+	// attribute -> value (?field.<name>=), matched exactly but for case
+	Fields map[string]string
+
+	// with encrypted voter data SQL can only match the code or the exact
+	// phone; see listVoters
+	pii *piiKeyring
+}
+
+// voterSortColumns whitelists the sortable columns; the map value is spliced
+// into ORDER BY so it must never come from user input directly.
+var voterSortColumns = map[string]string{
+	"name":    "vm.name",
+	"used_at": "v.used_at",
+	"group":   "vm.wilayah",
+	"choice":  "v.vote_choice",
+}
+
+// parseVoterFilter reads the filter from URL query parameters, dropping
+// values that aren't recognised.
+func parseVoterFilter(q url.Values) VoterFilter {
+	f := VoterFilter{
+		Status: q.Get("status"),
+		Choice: q.Get("choice"),
+		Group:  strings.TrimSpace(q.Get("group")),
+		Search: strings.TrimSpace(q.Get("q")),
+		Sort:   q.Get("sort"),
+		Desc:   q.Get("order") == "desc",
+	}
+	if f.Status != "voted" && f.Status != "not_voted" {
+		f.Status = ""
+	}
+	if f.Choice != "setuju" && f.Choice != "tidak_setuju" && f.Choice != "kosong" {
+		f.Choice = ""
+	}
+	if _, ok := voterSortColumns[f.Sort]; !ok {
+		f.Sort = ""
+	}
+	for k, v := range q {
+		key, ok := strings.CutPrefix(k, fieldParamPrefix)
+		value := strings.TrimSpace(v[0])
+		if !ok || value == "" || !eligibility.ValidName(key) {
+			continue
+		}
+		if f.Fields == nil {
+			f.Fields = map[string]string{}
+		}
+		f.Fields[strings.ToLower(key)] = value
+	}
+	return f
+}
+
+// Query encodes the filter back into query parameters (without the leading "?")
+func (f VoterFilter) Query() string {
+	return f.values().Encode()
+}
+
+func (f VoterFilter) values() url.Values {
+	q := url.Values{}
+	if f.Status != "" {
+		q.Set("status", f.Status)
+	}
+	if f.Choice != "" {
+		q.Set("choice", f.Choice)
+	}
+	if f.Group != "" {
+		q.Set("group", f.Group)
+	}
+	if f.Search != "" {
+		q.Set("q", f.Search)
+	}
+	for k, v := range f.Fields {
+		q.Set(fieldParamPrefix+k, v)
+	}
+	if f.Sort != "" {
+		q.Set("sort", f.Sort)
+	}
+	if f.Desc {
+		q.Set("order", "desc")
+	}
+	return q
+}
+
+// URL returns path with the filter appended as its query string, so links
+// to other admin views (e.g. the export) keep the current selection.
+func (f VoterFilter) URL(path string) string {
+	if q := f.Query(); q != "" {
+		return path + "?" + q
+	}
+	return path
+}
+
+// pageURL links to page n of the admin voter list under the filter
+func (f VoterFilter) pageURL(n, size int) string {
+	q := f.values()
+	if n > 1 {
+		q.Set("page", strconv.Itoa(n))
+	}
+	if size != defaultVoterPageSize {
+		q.Set("per", strconv.Itoa(size))
+	}
+	return "/admin?" + q.Encode()
+}
+
+// Rolls larger than ADMIN_PAGINATE_ABOVE voters are listed one page at a
+// time on the admin page: only the page is read from the database and sent
+// to the browser, which otherwise receives the whole roll and pages it in
+// JavaScript. The exports still cover every matching voter.
+
+const (
+	defaultPaginateAbove = 5000
+	defaultVoterPageSize = 50
+)
+
+// voterPageSizes are the page sizes offered
+var voterPageSizes = []int{10, 25, 50, 100}
+
+// VoterPage is the page of the voter list shown; Size 0 lists every voter
+type VoterPage struct {
+	Number int // from 1
+	Size   int
+	Total  int // voters matching the filter
+}
+
+// parseVoterPage reads ?page= and ?per= (one of voterPageSizes)
+func parseVoterPage(q url.Values) VoterPage {
+	p := VoterPage{Number: 1, Size: defaultVoterPageSize}
+	if n, err := strconv.Atoi(q.Get("page")); err == nil && n > 1 {
+		p.Number = n
+	}
+	if n, err := strconv.Atoi(q.Get("per")); err == nil && slices.Contains(voterPageSizes, n) {
+		p.Size = n
+	}
+	return p
+}
+
+func (p VoterPage) Paged() bool {
+	return p.Size > 0
+}
+
+// Offset is the number of matching voters before the page
+func (p VoterPage) Offset() int {
+	if p.Size == 0 {
+		return 0
+	}
+	return (p.Number - 1) * p.Size
+}
+
+// Row numbers the i-th (from 0) voter of the page across the whole list
+func (p VoterPage) Row(i int) int {
+	return p.Offset() + i + 1
+}
+
+func (p VoterPage) Pages() int {
+	if p.Size == 0 || p.Total == 0 {
+		return 1
+	}
+	return (p.Total + p.Size - 1) / p.Size
+}
+
+// Last numbers the last voter of the page
+func (p VoterPage) Last() int {
+	return min(p.Offset()+p.Size, p.Total)
+}
+
+// Nearby lists the page numbers linked around the current page
+func (p VoterPage) Nearby() []int {
+	var pages []int
+	for n := max(1, p.Number-3); n <= min(p.Pages(), p.Number+3); n++ {
+		pages = append(pages, n)
+	}
+	return pages
+}
+
+// where builds the WHERE clause and its positional arguments
+func (f VoterFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	switch f.Status {
+	case "voted":
+		conds = append(conds, "v.used = TRUE")
+	case "not_voted":
+		conds = append(conds, "v.used = FALSE")
+	}
+	if f.Choice != "" {
+		conds = append(conds, "v.vote_choice = "+arg(f.Choice))
+	}
+	if f.Group != "" {
+		conds = append(conds, "vm.wilayah = "+arg(f.Group))
+	}
+	for _, k := range slices.Sorted(maps.Keys(f.Fields)) {
+		conds = append(conds, fmt.Sprintf("lower(vm.attributes->>%s) = lower(%s)", arg(k), arg(f.Fields[k])))
+	}
+	if f.Search != "" && f.pii.Enabled() {
+		conds = append(conds, fmt.Sprintf("(v.code ILIKE %s OR v.phone = %s)", arg("%"+f.Search+"%"), arg(f.pii.sealPhone(f.Search))))
+	} else if f.Search != "" {
+		p := arg("%" + f.Search + "%")
+		conds = append(conds, fmt.Sprintf("(vm.name ILIKE %s OR v.code ILIKE %s OR v.phone ILIKE %s)", p, p, p))
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// orderBy builds the ORDER BY clause; the default keeps the original
+// "most recent votes first, then roll order" listing.
+func (f VoterFilter) orderBy() string {
+	col, ok := voterSortColumns[f.Sort]
+	if !ok {
+		return "ORDER BY v.used_at NULLS LAST, v.id"
+	}
+	dir := "ASC"
+	if f.Desc {
+		dir = "DESC"
+	}
+	return fmt.Sprintf("ORDER BY %s %s NULLS LAST, v.id", col, dir)
+}
+
+// listVoters returns the voters matching the filter, filtered and sorted in
+// SQL. Encrypted names and phones can't be searched or sorted there, so then
+// the search and the name sort run here after decrypting.
+func (a *App) listVoters(ctx context.Context, f VoterFilter) ([]VoterInfo, error) {
+	sql, args := a.votersQuery(f)
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return a.scanVoters(rows, f)
+}
+
+// votersQuery is the query behind listVoters
+func (a *App) votersQuery(f VoterFilter) (string, []interface{}) {
+	if a.pii.Enabled() {
+		f.Search = ""
+	}
+	where, args := f.where()
+	return `
+		SELECT v.code, vm.name, v.used, COALESCE(v.used_at::text, '') AS used_at_text, COALESCE(v.vote_choice::text, '') AS vote_choice_text, vm.wilayah, v.phone,
+			vm.attributes
+		FROM voters v INNER JOIN vote_master vm ON v.phone = vm.phone
+		` + where + `
+		` + f.orderBy(), args
+}
+
+// votersCountQuery counts the rows of votersQuery
+func (a *App) votersCountQuery(f VoterFilter) (string, []interface{}) {
+	if a.pii.Enabled() {
+		f.Search = ""
+	}
+	where, args := f.where()
+	return `SELECT COUNT(*) FROM voters v INNER JOIN vote_master vm ON v.phone = vm.phone ` + where, args
+}
+
+// pagesInSQL reports whether SQL alone filters and orders the list under f,
+// so a page can be read with LIMIT/OFFSET. With encrypted voter data the
+// search and the name sort need every row decrypted first.
+func (a *App) pagesInSQL(f VoterFilter) bool {
+	return !a.pii.Enabled() || (f.Search == "" && f.Sort != "name")
+}
+
+// scanVoters reads the rows of votersQuery, closing them
+func (a *App) scanVoters(rows pgx.Rows, f VoterFilter) ([]VoterInfo, error) {
+	defer rows.Close()
+	search := ""
+	if a.pii.Enabled() {
+		search = strings.ToLower(f.Search)
+	}
+
+	var voters []VoterInfo
+	for rows.Next() {
+		var v VoterInfo
+		var attrs map[string]string
+		if err := rows.Scan(&v.Code, &v.Name, &v.Used, &v.UsedAt, &v.Choice, &v.Wilayah, &v.Phone, &attrs); err != nil {
+			return nil, err
+		}
+		attrs, err := a.pii.openAttributes(attrs)
+		if err != nil {
+			return nil, err
+		}
+		v.Fields = fieldValues(a.voterFields, attrs)
+		if err := a.pii.openAll(&v.Name, &v.Phone); err != nil {
+			return nil, err
+		}
+		if search != "" && !strings.Contains(strings.ToLower(v.Name), search) &&
+			!strings.Contains(strings.ToLower(v.Code), search) && !strings.Contains(v.Phone, search) {
+			continue
+		}
+		voters = append(voters, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if a.pii.Enabled() && f.Sort == "name" {
+		sort.SliceStable(voters, func(i, j int) bool {
+			if f.Desc {
+				return voters[i].Name > voters[j].Name
+			}
+			return voters[i].Name < voters[j].Name
+		})
+	}
+	return voters, nil
+}
+
+// listGroups returns the distinct wilayah values for the filter dropdown
+func (a *App) listGroups(ctx context.Context) ([]string, error) {
+	rows, err := a.db.Query(ctx, groupsQuery)
+	if err != nil {
+		return nil, err
+	}
+	return scanGroups(rows)
+}
+
+const groupsQuery = `SELECT DISTINCT wilayah FROM vote_master WHERE wilayah <> '' ORDER BY wilayah`
+
+// scanGroups reads the rows of groupsQuery, closing them
+func scanGroups(rows pgx.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var groups []string
+	for rows.Next() {
+		var g string
+		if err := rows.Scan(&g); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
@@ -0,0 +1,991 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+
+	"pemilihan.gkjp.id/tally"
+)
+
+// The /api/v1 JSON API is for integrations such as the membership system.
+// It is separate from the HTML handlers: it authenticates with a bearer
+// API key instead of basic auth (see apikeys.go), always answers in JSON,
+// and never exposes individual vote choices.
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// APIVoter is a roll entry as exposed by the API
+type APIVoter struct {
+	Code       string            `json:"code"`
+	Name       string            `json:"name"`
+	Phone      string            `json:"phone"`
+	Group      string            `json:"group"`
+	Shares     int               `json:"shares"`
+	Attributes map[string]string `json:"attributes"`
+	Voted      bool              `json:"voted"`
+	VotedAt    *time.Time        `json:"voted_at"`
+}
+
+// APIVoterList is one page of voters
+type APIVoterList struct {
+	Voters     []APIVoter `json:"voters"`
+	Total      int        `json:"total"`
+	Limit      int        `json:"limit"`
+	Offset     int        `json:"offset"`
+	NextCursor string     `json:"next_cursor,omitempty"` // absent on the last page
+}
+
+// APIVoterInput is the body of POST /api/v1/voters
+type APIVoterInput struct {
+	Code   string `json:"code"` // optional, generated when empty
+	Name   string `json:"name"`
+	Phone  string `json:"phone"`
+	Group  string `json:"group"`
+	Shares *int   `json:"shares,omitempty"` // voting shares, default 1
+
+	// membership status, join date, ...; read by ELIGIBILITY_RULE. Merged
+	// into the stored ones, an empty value removing one.
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// set for a walk-in registered while voting is open, see late.go
+	late *lateApproval
+}
+
+// APIElection is the current election or an archived one
+type APIElection struct {
+	ID          *int      `json:"id"` // nil for the current, not yet archived election
+	Name        string    `json:"name,omitempty"`
+	VoteStart   time.Time `json:"vote_start"`
+	VoteEnd     time.Time `json:"vote_end"`
+	Status      string    `json:"status"` // upcoming / open / closed / archived
+	TotalVoters int       `json:"total_voters"`
+	VotedCount  int       `json:"voted_count"`
+}
+
+// APIElectionList is the current election followed by the archived ones
+type APIElectionList struct {
+	Elections []APIElection `json:"elections"`
+}
+
+// APIElectionDetail adds the archived results and turnout
+type APIElectionDetail struct {
+	APIElection
+	Results []APIResult       `json:"results"`
+	Turnout []APIGroupTurnout `json:"turnout"`
+}
+
+type APIResult struct {
+	Channel string `json:"channel"`
+	Choice  string `json:"choice"`
+	Count   int    `json:"count"`
+}
+
+type APIGroupTurnout struct {
+	Group    string `json:"group"`
+	Voted    int    `json:"voted"`
+	NotVoted int    `json:"not_voted"`
+}
+
+// APIResults is the tally of the current election. Choice counts are
+// withheld until voting has closed.
+type APIResults struct {
+	Closed      bool               `json:"closed"`
+	Method      string             `json:"method"` // referendum / stv / schulze / borda
+	TotalVoters int                `json:"total_voters"`
+	VotedCount  int                `json:"voted_count"`
+	Results     []APIResult        `json:"results,omitempty"`
+	Borda       []tally.BordaScore `json:"borda,omitempty"` // point totals, borda only
+	Questions   []APIQuestion      `json:"questions,omitempty"`
+	Snapshot    *TallySnapshot     `json:"snapshot,omitempty"`
+}
+
+// APIQuestion is the result of one question and whether it stands under the
+// question's own quorum and threshold. Percentages are 0-100.
+type APIQuestion struct {
+	Question       string  `json:"question"`
+	Outcome        string  `json:"outcome"`
+	Quorum         float64 `json:"quorum,omitempty"`
+	Turnout        float64 `json:"turnout"` // of those entitled to answer
+	QuorumMet      bool    `json:"quorum_met"`
+	ShareQuorum    float64 `json:"share_quorum,omitempty"`
+	ShareTurnout   float64 `json:"share_turnout"` // shares present, of the entitled shares
+	ShareQuorumMet bool    `json:"share_quorum_met"`
+	Threshold      float64 `json:"threshold,omitempty"`
+	Winner         string  `json:"winner,omitempty"`
+	WinnerShare    float64 `json:"winner_share"` // of the valid answers
+	ThresholdMet   bool    `json:"threshold_met"`
+	Valid          bool    `json:"valid"`
+}
+
+// APIAuditPage is a page of audit events, newest first
+type APIAuditPage struct {
+	Events     []AuditEvent `json:"events"`
+	NextCursor string       `json:"next_cursor,omitempty"` // absent on the last page
+}
+
+// APIBallot is an anonymous ballot of an archived election
+type APIBallot struct {
+	ID      int64  `json:"id"`
+	Channel string `json:"channel"`
+	Choice  string `json:"choice"`
+}
+
+// APIBallotPage is a page of ballots in (shuffled) storage order
+type APIBallotPage struct {
+	Ballots    []APIBallot `json:"ballots"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// apiErrorBody is ErrorBody plus the error field of the first API version,
+// kept for existing clients
+type apiErrorBody struct {
+	ErrorBody
+	Error string `json:"error"` // same as message
+}
+
+// apiError writes a JSON error response
+func apiError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	writeJSON(w, status, apiErrorBody{
+		ErrorBody: ErrorBody{Code: errorCode(status), Message: msg, RequestID: requestIDFrom(r.Context())},
+		Error:     msg,
+	})
+}
+
+// apiHandler routes /api/v1/... and checks the scope each resource needs
+func (a *App) apiHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/")
+	resource, id, _ := strings.Cut(path, "/")
+
+	switch {
+	case resource == "voters":
+		if !requireScope(w, r, ScopeManageVoters) {
+			return
+		}
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			a.apiListVoters(w, r)
+		case id == "" && r.Method == http.MethodPost:
+			a.apiCreateVoter(w, r)
+		case id != "" && r.Method == http.MethodGet:
+			a.apiGetVoter(w, r, id)
+		case id != "" && r.Method == http.MethodDelete:
+			a.apiDeleteVoter(w, r, id)
+		default:
+			apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case resource == "elections" && strings.HasSuffix(id, "/voters"):
+		if !requireScope(w, r, ScopeManageVoters) {
+			return
+		}
+		if r.Method != http.MethodPut {
+			apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		a.apiBulkVoters(w, r, strings.TrimSuffix(id, "/voters"))
+	case path == "results" || path == "turnout":
+		// display screens poll these with read-live keys
+		if !requireScope(w, r, ScopeReadResults, ScopeReadLive) {
+			return
+		}
+		switch {
+		case r.Method != http.MethodGet:
+			apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		case path == "results":
+			a.apiResults(w, r)
+		default:
+			a.apiTurnout(w, r)
+		}
+	case resource == "elections":
+		if !requireScope(w, r, ScopeReadResults) {
+			return
+		}
+		switch {
+		case r.Method != http.MethodGet:
+			apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		case id == "":
+			a.apiListElections(w, r)
+		case strings.HasSuffix(id, "/ballots"):
+			a.apiListBallots(w, r, strings.TrimSuffix(id, "/ballots"))
+		default:
+			a.apiGetElection(w, r, id)
+		}
+	case path == "audit":
+		if !requireScope(w, r, ScopeReadAudit) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		a.apiAudit(w, r)
+	case resource == "webhooks":
+		if !requireScope(w, r, ScopeManageWebhooks) {
+			return
+		}
+		a.apiWebhooks(w, r, id)
+	case path == "usage":
+		if !requireScope(w, r, ScopeReadUsage) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		a.apiUsage(w, r)
+	default:
+		apiError(w, r, http.StatusNotFound, "not found")
+	}
+}
+
+// pageParams reads limit/offset, clamping limit to apiMaxLimit
+func pageParams(r *http.Request) (limit, offset int) {
+	limit, offset = apiDefaultLimit, 0
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > apiMaxLimit {
+		limit = apiMaxLimit
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && n > 0 {
+		offset = n
+	}
+	return limit, offset
+}
+
+const apiVoterColumns = `v.code, COALESCE(vm.name, v.name), v.phone, COALESCE(vm.wilayah, ''), v.shares,
+	COALESCE(vm.attributes, '{}'), v.used, v.used_at`
+
+func scanAPIVoter(row pgx.Row) (APIVoter, error) {
+	var v APIVoter
+	err := row.Scan(&v.Code, &v.Name, &v.Phone, &v.Group, &v.Shares, &v.Attributes, &v.Voted, &v.VotedAt)
+	return v, err
+}
+
+// apiListVoters: GET /api/v1/voters?status=&group=&q=&sort=&order=&limit=&cursor=
+// (or &offset=); next_cursor continues after the last voter of the page
+func (a *App) apiListVoters(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	f := parseVoterFilter(r.URL.Query())
+	f.pii = a.pii
+	// choices are never filterable or sortable through the API
+	f.Choice = ""
+	if f.Sort == "choice" {
+		f.Sort = ""
+	}
+	if f.Sort == "name" && a.pii.Enabled() {
+		apiError(w, r, http.StatusBadRequest, "voter names are encrypted and can't be sorted on")
+		return
+	}
+	limit, offset := pageParams(r)
+	var after *voterCursor
+	var c voterCursor
+	ok, err := decodeCursor(r, &c)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if ok {
+		if c.Sort != f.Sort || c.Desc != f.Desc {
+			apiError(w, r, http.StatusBadRequest, "cursor was made for a different sort order")
+			return
+		}
+		after, offset = &c, 0
+	}
+	where, args := f.where()
+
+	list := APIVoterList{Voters: []APIVoter{}, Limit: limit, Offset: offset}
+	err = a.db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM voters v INNER JOIN vote_master vm ON v.phone = vm.phone `+where, args...).Scan(&list.Total)
+	if err != nil {
+		logDB.Errorf("error counting voters: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	voters, next, err := a.pageVoters(ctx, f, limit, offset, after)
+	if err != nil {
+		logDB.Errorf("error getting voters: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	list.Voters = voters
+	if next != nil {
+		list.NextCursor = encodeCursor(next)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// pageVoters returns one page of the filtered roll, starting after the
+// cursor when one is given, and the cursor of the next page (nil on the
+// last page)
+func (a *App) pageVoters(ctx context.Context, f VoterFilter, limit, offset int, after *voterCursor) ([]APIVoter, *voterCursor, error) {
+	f.pii = a.pii
+	where, args := f.where()
+	if after != nil {
+		cond, cargs := after.after(f, len(args))
+		if where == "" {
+			where = "WHERE " + cond
+		} else {
+			where += " AND " + cond
+		}
+		args = append(args, cargs...)
+	}
+	col, _ := f.sortColumn()
+	// one extra row tells whether there is a next page
+	args = append(args, limit+1, offset)
+	rows, err := a.db.Query(ctx, fmt.Sprintf(`
+		SELECT %s, v.id, (%s)::text
+		FROM voters v INNER JOIN vote_master vm ON v.phone = vm.phone
+		%s
+		%s
+		LIMIT $%d OFFSET $%d`, apiVoterColumns, col, where, f.orderBy(), len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	voters := []APIVoter{}
+	var last voterCursor
+	more := false
+	for rows.Next() {
+		if len(voters) == limit {
+			more = true
+			break
+		}
+		var v APIVoter
+		last = voterCursor{Sort: f.Sort, Desc: f.Desc}
+		if err := rows.Scan(&v.Code, &v.Name, &v.Phone, &v.Group, &v.Shares, &v.Attributes, &v.Voted, &v.VotedAt, &last.ID, &last.Value); err != nil {
+			return nil, nil, err
+		}
+		if err := a.pii.openAll(&v.Name, &v.Phone); err != nil {
+			return nil, nil, err
+		}
+		if v.Attributes, err = a.pii.openAttributes(v.Attributes); err != nil {
+			return nil, nil, err
+		}
+		voters = append(voters, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if !more {
+		return voters, nil, nil
+	}
+	return voters, &last, nil
+}
+
+func (a *App) loadAPIVoter(ctx context.Context, code string) (APIVoter, error) {
+	v, err := scanAPIVoter(a.db.QueryRow(ctx, `
+		SELECT `+apiVoterColumns+`
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE v.code = $1`, code))
+	if err != nil {
+		return v, err
+	}
+	if err := a.pii.openAll(&v.Name, &v.Phone); err != nil {
+		return v, err
+	}
+	v.Attributes, err = a.pii.openAttributes(v.Attributes)
+	return v, err
+}
+
+// apiGetVoter: GET /api/v1/voters/{code}
+func (a *App) apiGetVoter(w http.ResponseWriter, r *http.Request, code string) {
+	v, err := a.loadAPIVoter(r.Context(), code)
+	if errors.Is(err, pgx.ErrNoRows) {
+		apiError(w, r, http.StatusNotFound, "voter not found")
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error getting voter: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// newVoterCode returns a random voting code
+func newVoterCode() (string, error) {
+	b := make([]byte, 5)
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = codeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// isUniqueViolation reports a unique constraint error from Postgres
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// apiCreateVoter: POST /api/v1/voters adds a member to the roll
+func (a *App) apiCreateVoter(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var raw json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&raw); err != nil {
+		apiError(w, r, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	var in APIVoterInput
+	if err := json.Unmarshal(raw, &in); err != nil {
+		apiError(w, r, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if err := a.mapFieldKeys(raw, &in); err != nil {
+		apiError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	in.Code = strings.TrimSpace(in.Code)
+	in.Name = strings.TrimSpace(in.Name)
+	in.Phone = strings.TrimSpace(in.Phone)
+	in.Group = strings.TrimSpace(in.Group)
+	if in.Name == "" || in.Phone == "" {
+		apiError(w, r, http.StatusUnprocessableEntity, "name and phone are required")
+		return
+	}
+	if in.Shares != nil && *in.Shares < 0 {
+		apiError(w, r, http.StatusUnprocessableEntity, "shares can't be negative")
+		return
+	}
+	attrs, err := normalizeAttributes(in.Attributes)
+	if err != nil {
+		apiError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	in.Attributes = attrs
+
+	code, err := a.createVoter(ctx, in)
+	if errors.Is(err, errVoterExists) || errors.Is(err, errCodeTaken) {
+		apiError(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, errIneligible) {
+		apiError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if errors.Is(err, errVoterQuota) {
+		apiError(w, r, http.StatusTooManyRequests, fmt.Sprintf("%v: the organization may have %d voters", err, a.quotas.Voters))
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error creating voter: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	a.audit(ctx, actorName(r), "voter.create", code, nil)
+	v, err := a.loadAPIVoter(ctx, code)
+	if err != nil {
+		logDB.Errorf("error getting voter: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/voters/"+code)
+	writeJSON(w, http.StatusCreated, v)
+}
+
+var (
+	errVoterExists = errors.New("phone already on the roll")
+	errCodeTaken   = errors.New("code already in use")
+)
+
+// createVoter adds in to the roll and returns its code. A generated code may
+// collide, so it is retried a few times before giving up.
+func (a *App) createVoter(ctx context.Context, in APIVoterInput) (string, error) {
+	for attempt := 0; ; attempt++ {
+		code := in.Code
+		if code == "" {
+			var err error
+			if code, err = newVoterCode(); err != nil {
+				return "", err
+			}
+		}
+		err := a.insertVoter(ctx, code, in)
+		if err == nil || !isUniqueViolation(err) {
+			return code, err
+		}
+		if in.Code != "" || attempt >= 5 {
+			return "", errCodeTaken
+		}
+	}
+}
+
+// insertVoter adds the member record (if new) and the roll entry
+func (a *App) insertVoter(ctx context.Context, code string, in APIVoterInput) error {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := a.checkVoterQuota(ctx, tx); err != nil {
+		return err
+	}
+
+	name, phone := a.pii.seal(in.Name), a.pii.sealPhone(in.Phone)
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM vote_master WHERE phone = $1)`, phone).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec(ctx, `INSERT INTO vote_master (name, wilayah, phone, attributes) VALUES ($1, $2, $3, $4)`,
+			name, in.Group, phone, attributesJSON(a.pii.sealAttributes(mergeAttributes(nil, in.Attributes))))
+		if err != nil {
+			return err
+		}
+	} else if in.Attributes != nil {
+		var stored map[string]string
+		if err := tx.QueryRow(ctx, `SELECT attributes FROM vote_master WHERE phone = $1 FOR UPDATE`, phone).Scan(&stored); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `UPDATE vote_master SET attributes = $2 WHERE phone = $1`, phone,
+			attributesJSON(a.pii.sealAttributes(mergeAttributes(stored, in.Attributes))))
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM voters WHERE phone = $1)`, phone).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return errVoterExists
+	}
+	if err := a.checkEligible(ctx, tx, phone); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO voters (code, name, phone, shares) VALUES ($1, $2, $3, COALESCE($4, 1))`,
+		code, name, phone, in.Shares)
+	if err != nil {
+		return err
+	}
+	if l := in.late; l != nil {
+		_, err = tx.Exec(ctx, `
+			UPDATE voters SET registered_late_at = NOW(), late_approved_by = $2, late_registered_by = $3, late_note = $4
+			WHERE code = $1`, code, l.approvedBy, l.registeredBy, l.note)
+		if err != nil {
+			return err
+		}
+	}
+	if err := meter(ctx, tx, usageVotersImported, 1); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// apiDeleteVoter: DELETE /api/v1/voters/{code} removes a voter who hasn't voted
+func (a *App) apiDeleteVoter(w http.ResponseWriter, r *http.Request, code string) {
+	ctx := r.Context()
+	var used bool
+	err := a.db.QueryRow(ctx, `SELECT used FROM voters WHERE code = $1`, code).Scan(&used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		apiError(w, r, http.StatusNotFound, "voter not found")
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error getting voter: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	if used {
+		apiError(w, r, http.StatusConflict, "voter has already voted")
+		return
+	}
+	if _, err := a.db.Exec(ctx, `DELETE FROM voters WHERE code = $1 AND used = FALSE`, code); err != nil {
+		logDB.Errorf("error deleting voter: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	a.codeChanged(ctx, code)
+	a.audit(ctx, actorName(r), "voter.delete", code, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// currentElection describes the election configured by VOTE_START/VOTE_END
+func (a *App) currentElection(ctx context.Context) (APIElection, error) {
+	e := APIElection{VoteStart: a.voteStart, VoteEnd: a.voteEnd}
+	now := time.Now()
+	switch {
+	case now.Before(a.voteStart):
+		e.Status = "upcoming"
+	case now.After(a.voteEnd):
+		e.Status = "closed"
+	default:
+		e.Status = "open"
+	}
+	stats, err := a.adminStats(ctx)
+	e.TotalVoters, e.VotedCount = stats.TotalVoters, stats.VotedCount
+	return e, err
+}
+
+func archivedToAPI(ae ArchivedElection) APIElection {
+	id := ae.ID
+	return APIElection{
+		ID:          &id,
+		Name:        ae.Name,
+		VoteStart:   ae.VoteStart,
+		VoteEnd:     ae.VoteEnd,
+		Status:      "archived",
+		TotalVoters: ae.TotalVoters,
+		VotedCount:  ae.VotedCount,
+	}
+}
+
+// apiListElections: GET /api/v1/elections lists the current election first,
+// then the archived ones, newest first
+func (a *App) apiListElections(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	current, err := a.currentElection(ctx)
+	if err != nil {
+		logTally.Errorf("error getting voting stats: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	archived, err := a.listArchivedElections(ctx)
+	if err != nil {
+		logDB.Errorf("error getting archived elections: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	list := APIElectionList{Elections: []APIElection{current}}
+	for _, ae := range archived {
+		list.Elections = append(list.Elections, archivedToAPI(ae))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// archivedElectionDetail loads a sealed election with its results and turnout
+func (a *App) archivedElectionDetail(ctx context.Context, id int) (APIElectionDetail, error) {
+	var data ArchiveData
+	if err := a.loadArchivedElection(ctx, id, &data); err != nil {
+		return APIElectionDetail{}, err
+	}
+	detail := APIElectionDetail{
+		APIElection: archivedToAPI(*data.Election),
+		Results:     []APIResult{},
+		Turnout:     []APIGroupTurnout{},
+	}
+	for _, res := range data.Results {
+		detail.Results = append(detail.Results, APIResult{Channel: res.Channel, Choice: res.Choice, Count: res.Count})
+	}
+	for _, t := range data.Turnout {
+		detail.Turnout = append(detail.Turnout, APIGroupTurnout{Group: t.Wilayah, Voted: t.Voted, NotVoted: t.NotVoted})
+	}
+	return detail, nil
+}
+
+// apiGetElection: GET /api/v1/elections/{id} returns an archived election
+func (a *App) apiGetElection(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		apiError(w, r, http.StatusNotFound, "election not found")
+		return
+	}
+	detail, err := a.archivedElectionDetail(r.Context(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		apiError(w, r, http.StatusNotFound, "election not found")
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error getting archived election: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// apiListBallots: GET /api/v1/elections/{id}/ballots?limit=&cursor= pages
+// through the sealed ballots of an archived election. Ballots were shuffled
+// when archived, so their order says nothing about when they were cast;
+// cast times are left out for the same reason.
+func (a *App) apiListBallots(w http.ResponseWriter, r *http.Request, idStr string) {
+	ctx := r.Context()
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		apiError(w, r, http.StatusNotFound, "election not found")
+		return
+	}
+	limit, _ := pageParams(r)
+	var c idCursor
+	if _, err := decodeCursor(r, &c); err != nil {
+		apiError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var sealed bool
+	err = a.db.QueryRow(ctx, `SELECT sealed FROM elections WHERE id = $1`, id).Scan(&sealed)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !sealed) {
+		apiError(w, r, http.StatusNotFound, "election not found")
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error getting election: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	rows, err := a.db.Query(ctx, `
+		SELECT id, channel, choice FROM archived_ballots
+		WHERE election_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`, id, c.ID, limit+1)
+	if err != nil {
+		logTally.Errorf("error getting ballots: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+	page := APIBallotPage{Ballots: []APIBallot{}}
+	for rows.Next() {
+		if len(page.Ballots) == limit {
+			page.NextCursor = encodeCursor(idCursor{ID: page.Ballots[limit-1].ID})
+			break
+		}
+		var b APIBallot
+		if err := rows.Scan(&b.ID, &b.Channel, &b.Choice); err != nil {
+			logTally.Errorf("error scanning ballot: %v", err)
+			apiError(w, r, http.StatusInternalServerError, "database error")
+			return
+		}
+		page.Ballots = append(page.Ballots, b)
+	}
+	if err := rows.Err(); err != nil {
+		logTally.Errorf("error getting ballots: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// liveResults counts the current election's ballots per channel and choice,
+// from the tally kept by triggers (see loadLiveResults)
+func (a *App) liveResults(ctx context.Context) ([]APIResult, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT channel, choice, SUM(ballots)::bigint FROM tally_counts
+		WHERE channel <> 'roll'
+		GROUP BY channel, choice
+		HAVING SUM(ballots) <> 0
+		ORDER BY 1 DESC, 2`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []APIResult{}
+	for rows.Next() {
+		var res APIResult
+		if err := rows.Scan(&res.Channel, &res.Choice, &res.Count); err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// liveGroupTurnout is the current turnout per wilayah
+func (a *App) liveGroupTurnout(ctx context.Context) ([]APIGroupTurnout, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT vm.wilayah, COUNT(*) FILTER (WHERE v.used = true), COUNT(*) FILTER (WHERE v.used = false)
+		FROM voters v INNER JOIN vote_master vm ON v.phone = vm.phone
+		GROUP BY vm.wilayah
+		ORDER BY vm.wilayah`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	turnout := []APIGroupTurnout{}
+	for rows.Next() {
+		var t APIGroupTurnout
+		if err := rows.Scan(&t.Group, &t.Voted, &t.NotVoted); err != nil {
+			return nil, err
+		}
+		turnout = append(turnout, t)
+	}
+	return turnout, rows.Err()
+}
+
+// apiResults: GET /api/v1/results returns the current tally; choice counts
+// and the close-time snapshot only once voting has closed
+func (a *App) apiResults(w http.ResponseWriter, r *http.Request) {
+	_, version, err := a.resultsVersion(r.Context())
+	if err != nil {
+		logTally.Errorf("error getting results: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	w.Header().Set("Cache-Control", apiResultsCacheControl)
+	w.Header().Add("Vary", "Authorization")
+	if notModified(w, r, version, "api") {
+		return
+	}
+	res, err := a.sharedResults(r.Context())
+	if err != nil {
+		logTally.Errorf("error getting results: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// APITurnout is the live turnout of the current election. Percentages are
+// 0-100.
+type APITurnout struct {
+	Open        bool              `json:"open"`
+	Closed      bool              `json:"closed"`
+	TotalVoters int               `json:"total_voters"`
+	VotedCount  int               `json:"voted_count"`
+	Turnout     float64           `json:"turnout"`
+	Groups      []APIGroupTurnout `json:"groups"`
+}
+
+// apiTurnout: GET /api/v1/turnout returns who has voted so far, in total and
+// per wilayah, with the validators of /api/v1/results
+func (a *App) apiTurnout(w http.ResponseWriter, r *http.Request) {
+	live, version, err := a.resultsVersion(r.Context())
+	if err != nil {
+		logTally.Errorf("error getting turnout: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	w.Header().Set("Cache-Control", apiResultsCacheControl)
+	w.Header().Add("Vary", "Authorization")
+	if notModified(w, r, version, "turnout") {
+		return
+	}
+	now := time.Now()
+	t := APITurnout{
+		Open:        !now.Before(a.voteStart) && !now.After(a.voteEnd),
+		Closed:      now.After(a.voteEnd),
+		TotalVoters: live.Stats.TotalVoters,
+		VotedCount:  live.Stats.VotedCount,
+	}
+	if t.TotalVoters > 0 {
+		t.Turnout = float64(t.VotedCount) * 100 / float64(t.TotalVoters)
+	}
+	if t.Groups, err = a.liveGroupTurnout(r.Context()); err != nil {
+		logTally.Errorf("error getting turnout: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// currentResults builds the /api/v1/results document
+func (a *App) currentResults(ctx context.Context, closed bool) (APIResults, error) {
+	stats, err := a.adminStats(ctx)
+	if err != nil {
+		return APIResults{}, fmt.Errorf("voting stats: %w", err)
+	}
+	res := APIResults{
+		Closed:      closed,
+		Method:      a.ballot.Method,
+		TotalVoters: stats.TotalVoters,
+		VotedCount:  stats.VotedCount,
+	}
+	if !closed {
+		return res, nil
+	}
+	if res.Results, err = a.liveResults(ctx); err != nil {
+		return res, err
+	}
+	if res.Snapshot, err = a.loadTallySnapshot(ctx); err != nil {
+		return res, fmt.Errorf("tally snapshot: %w", err)
+	}
+	questions, err := a.questionResults(ctx, a.db)
+	if err != nil {
+		return res, fmt.Errorf("counting ballots: %w", err)
+	}
+	for _, q := range questions {
+		v := q.Validity
+		res.Questions = append(res.Questions, APIQuestion{
+			Question:       q.Question,
+			Outcome:        q.Outcome,
+			Quorum:         v.Quorum,
+			Turnout:        v.TurnoutPct(),
+			QuorumMet:      v.QuorumMet(),
+			ShareQuorum:    v.ShareQuorum,
+			ShareTurnout:   v.SharePct(),
+			ShareQuorumMet: v.ShareQuorumMet(),
+			Threshold:      v.Threshold,
+			Winner:         v.Winner,
+			WinnerShare:    v.WinnerPct(),
+			ThresholdMet:   v.ThresholdMet(),
+			Valid:          v.Stands(),
+		})
+	}
+	if a.ballot.Method == MethodBorda {
+		count, err := a.countBallots(ctx, a.db)
+		if err != nil {
+			return res, fmt.Errorf("counting ballots: %w", err)
+		}
+		res.Borda = count.(*tally.BordaResult).Ranking()
+	}
+	return res, nil
+}
+
+// apiAudit: GET /api/v1/audit?limit=&before= pages through the audit ledger,
+// newest first; pass the smallest id seen as before= for the next page
+func (a *App) apiAudit(w http.ResponseWriter, r *http.Request) {
+	limit, _ := pageParams(r)
+	before, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	if err != nil || before <= 0 {
+		before = 1<<63 - 1
+	}
+	var c idCursor
+	ok, err := decodeCursor(r, &c)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if ok {
+		before = c.ID
+	}
+
+	rows, err := a.db.Query(r.Context(), `
+		SELECT id, at, actor, action, subject, COALESCE(detail, 'null'::jsonb)
+		FROM audit_events
+		WHERE id < $1
+		ORDER BY id DESC
+		LIMIT $2`, before, limit+1)
+	if err != nil {
+		logDB.Errorf("error getting audit events: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+	page := APIAuditPage{Events: []AuditEvent{}}
+	for rows.Next() {
+		if len(page.Events) == limit {
+			page.NextCursor = encodeCursor(idCursor{ID: page.Events[limit-1].ID})
+			break
+		}
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.Subject, &e.Detail); err != nil {
+			logDB.Errorf("error scanning audit event: %v", err)
+			apiError(w, r, http.StatusInternalServerError, "database error")
+			return
+		}
+		page.Events = append(page.Events, e)
+	}
+	if err := rows.Err(); err != nil {
+		logDB.Errorf("error getting audit events: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
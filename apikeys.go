@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Scope limits what an API key may do
+type Scope string
+
+const (
+	ScopeReadResults       Scope = "read-results"       // elections and results
+	ScopeManageVoters      Scope = "manage-voters"      // list, add and remove voters
+	ScopeReadAudit         Scope = "read-audit"         // the audit ledger
+	ScopeSendNotifications Scope = "send-notifications" // notification endpoints
+	ScopeManageWebhooks    Scope = "manage-webhooks"    // webhook subscriptions
+	ScopeReadUsage         Scope = "read-usage"         // usage per month, for billing
+	ScopeReadLive          Scope = "read-live"          // live turnout and results only, for display screens
+)
+
+var scopes = []Scope{ScopeReadResults, ScopeManageVoters, ScopeReadAudit, ScopeSendNotifications, ScopeManageWebhooks, ScopeReadUsage, ScopeReadLive}
+
+func validScope(s Scope) bool {
+	for _, scope := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyPrefix starts every issued key so leaked keys are easy to grep for
+const apiKeyPrefix = "gkjp_"
+
+// APIClient is the caller authenticated by requireAPIClient
+type APIClient struct {
+	KeyID             int // 0 for the API_TOKEN built-in, which has every scope
+	Name              string
+	Scopes            []Scope
+	RequestsPerMinute int // 0 leaves only the organization's quota
+}
+
+// Has reports whether the client was granted scope
+func (c *APIClient) Has(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+const apiClientKey ctxKey = accountKey + 1
+
+// apiClientFrom returns the client put on the context by requireAPIClient
+func apiClientFrom(ctx context.Context) *APIClient {
+	c, _ := ctx.Value(apiClientKey).(*APIClient)
+	return c
+}
+
+// APIKeyRow is an API key as listed in the admin panel; the secret itself
+// is only shown once, right after issuing
+type APIKeyRow struct {
+	ID                int
+	Name              string
+	Lookup            string
+	Scopes            []string
+	RequestsPerMinute int
+	CreatedAt         time.Time
+	CreatedBy         string
+	LastUsedAt        *time.Time
+	RevokedAt         *time.Time
+}
+
+type APIKeysData struct {
+	Keys    []APIKeyRow
+	Scopes  []Scope
+	NewKey  string // plaintext of the key just issued
+	Message string
+	Error   string
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a key of the form gkjp_<lookup>_<secret>. The lookup
+// part is stored in clear to find the row; only a hash of the whole key is
+// kept.
+func newAPIKey() (key, lookup string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	lookup = hex.EncodeToString(b[:4])
+	return apiKeyPrefix + lookup + "_" + hex.EncodeToString(b[4:]), lookup, nil
+}
+
+// authenticateAPIKey resolves a bearer token to a client. The API_TOKEN env
+// value keeps working as a key with every scope.
+func (a *App) authenticateAPIKey(ctx context.Context, token string) (*APIClient, error) {
+	if a.apiToken != "" && constantTimeEqual(token, a.apiToken) {
+		return &APIClient{Name: "api-token", Scopes: scopes}, nil
+	}
+	rest, ok := strings.CutPrefix(token, apiKeyPrefix)
+	if !ok {
+		return nil, nil
+	}
+	lookup, _, _ := strings.Cut(rest, "_")
+
+	var c APIClient
+	var hash string
+	var scopeNames []string
+	err := a.db.QueryRow(ctx, `
+		SELECT id, name, key_hash, scopes, requests_per_minute FROM api_keys
+		WHERE lookup = $1 AND revoked_at IS NULL`, lookup).Scan(&c.KeyID, &c.Name, &hash, &scopeNames, &c.RequestsPerMinute)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !constantTimeEqual(hashAPIKey(token), hash) {
+		return nil, nil
+	}
+	for _, s := range scopeNames {
+		c.Scopes = append(c.Scopes, Scope(s))
+	}
+	if _, err := a.db.Exec(ctx, `UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`, c.KeyID); err != nil {
+		logDB.Errorf("error updating api key: %v", err)
+	}
+	return &c, nil
+}
+
+// requireAPIClient authenticates the bearer token (an issued API key or
+// API_TOKEN) and puts the client on the request context
+func (a *App) requireAPIClient(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var client *APIClient
+		if ok && token != "" {
+			var err error
+			if client, err = a.authenticateAPIKey(r.Context(), token); err != nil {
+				logDB.Errorf("error authenticating api key: %v", err)
+				apiError(w, r, http.StatusInternalServerError, "database error")
+				return
+			}
+		}
+		if client == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			apiError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if !a.allowAPIRequest(w, r, client) {
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), apiClientKey, client)))
+	}
+}
+
+// requireScope answers 403 unless the API client holds scope
+func requireScope(w http.ResponseWriter, r *http.Request, any ...Scope) bool {
+	if c := apiClientFrom(r.Context()); c != nil {
+		for _, scope := range any {
+			if c.Has(scope) {
+				return true
+			}
+		}
+	}
+	apiError(w, r, http.StatusForbidden, fmt.Sprintf("missing scope %s", scopeList(any)))
+	return false
+}
+
+// scopeList names scopes as "a or b"
+func scopeList(scopes []Scope) string {
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = string(s)
+	}
+	return strings.Join(names, " or ")
+}
+
+func (a *App) listAPIKeys(ctx context.Context) ([]APIKeyRow, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, name, lookup, scopes, requests_per_minute, created_at, created_by, last_used_at, revoked_at
+		FROM api_keys
+		ORDER BY revoked_at IS NOT NULL, created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKeyRow
+	for rows.Next() {
+		var k APIKeyRow
+		if err := rows.Scan(&k.ID, &k.Name, &k.Lookup, &k.Scopes, &k.RequestsPerMinute, &k.CreatedAt, &k.CreatedBy, &k.LastUsedAt, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// adminAPIKeysHandler issues and revokes API keys. Superadmin only.
+func (a *App) adminAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := APIKeysData{Scopes: scopes}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			var granted []string
+			for _, s := range r.Form["scope"] {
+				if validScope(Scope(s)) {
+					granted = append(granted, s)
+				}
+			}
+			if name == "" {
+				data.Error = "nama diperlukan"
+				break
+			}
+			if len(granted) == 0 {
+				data.Error = "pilih minimal satu scope"
+				break
+			}
+			rpm := 0
+			if v := strings.TrimSpace(r.FormValue("requests_per_minute")); v != "" {
+				var err error
+				if rpm, err = strconv.Atoi(v); err != nil || rpm < 0 {
+					data.Error = "batas request per menit harus berupa angka"
+					break
+				}
+			}
+			key, lookup, err := newAPIKey()
+			if err != nil {
+				logDB.Errorf("error generating api key: %v", err)
+				data.Error = "gagal membuat key"
+				break
+			}
+			var id int
+			err = a.db.QueryRow(ctx, `
+				INSERT INTO api_keys (name, lookup, key_hash, scopes, requests_per_minute, created_by)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id`, name, lookup, hashAPIKey(key), granted, rpm, actorName(r)).Scan(&id)
+			if err != nil {
+				logDB.Errorf("error creating api key: %v", err)
+				data.Error = "database error"
+				break
+			}
+			a.audit(ctx, actorName(r), "apikey.create", strconv.Itoa(id), map[string]interface{}{"name": name, "scopes": granted, "requests_per_minute": rpm})
+			data.NewKey = key
+			data.Message = fmt.Sprintf("API key %s dibuat. Simpan key ini sekarang; key tidak akan ditampilkan lagi.", name)
+		case "revoke":
+			id, err := strconv.Atoi(r.FormValue("id"))
+			if err != nil {
+				data.Error = "key tidak valid"
+				break
+			}
+			tag, err := a.db.Exec(ctx, `UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
+			if err != nil {
+				logDB.Errorf("error revoking api key: %v", err)
+				data.Error = "database error"
+				break
+			}
+			if tag.RowsAffected() == 0 {
+				data.Error = "key tidak ditemukan atau sudah dicabut"
+				break
+			}
+			a.audit(ctx, actorName(r), "apikey.revoke", strconv.Itoa(id), nil)
+			data.Message = "API key dicabut"
+		default:
+			data.Error = "aksi tidak dikenal"
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys, err := a.listAPIKeys(ctx)
+	if err != nil {
+		logDB.Errorf("error getting api keys: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Keys = keys
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := a.tmpl.ExecuteTemplate(w, "apikeys.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ArchivedElection is a finished, sealed election
+type ArchivedElection struct {
+	ID          int
+	Name        string
+	VoteStart   time.Time
+	VoteEnd     time.Time
+	TotalVoters int
+	VotedCount  int
+	ArchivedAt  time.Time
+	ArchivedBy  string
+}
+
+// Turnout is the voted share in percent
+func (e ArchivedElection) Turnout() float64 {
+	if e.TotalVoters == 0 {
+		return 0
+	}
+	return float64(e.VotedCount) * 100 / float64(e.TotalVoters)
+}
+
+// ArchivedResult is one choice count of an archived election
+type ArchivedResult struct {
+	Channel string
+	Choice  string
+	Count   int
+}
+
+// ArchivedTurnout is the turnout of one wilayah in an archived election
+type ArchivedTurnout struct {
+	Wilayah  string
+	Voted    int
+	NotVoted int
+}
+
+type ArchiveData struct {
+	Elections []ArchivedElection
+	Election  *ArchivedElection
+	Results   []ArchivedResult
+	Turnout   []ArchivedTurnout
+	CanClose  bool // current election has ended and may be archived
+	CanManage bool
+	Message   string
+	Error     string
+}
+
+var errElectionStillOpen = errors.New("pemilihan belum ditutup")
+
+// archiveElection copies the finished election into the archive tables,
+// seals it, and clears the live roll and offline tally, all in one
+// transaction. Once sealed, the database triggers reject any further writes.
+func (a *App) archiveElection(ctx context.Context, name, by string) (int, error) {
+	if !time.Now().After(a.voteEnd) {
+		return 0, errElectionStillOpen
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var id int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO elections (name, vote_start, vote_end, total_voters, voted_count, archived_by)
+		SELECT $1, $2, $3, COUNT(*), COUNT(*) FILTER (WHERE used = true), $4
+		FROM voters
+		RETURNING id`, name, a.voteStart, a.voteEnd, by).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	steps := []string{
+		`INSERT INTO archived_results (election_id, channel, choice, count)
+			SELECT $1, 'online', vote_choice, COUNT(*) FROM voters
+			WHERE used = true AND vote_choice IS NOT NULL GROUP BY vote_choice`,
+		`INSERT INTO archived_results (election_id, channel, choice, count)
+			SELECT $1, 'offline', vote_choice, COUNT(*) FROM offline_voters
+			GROUP BY vote_choice`,
+		`INSERT INTO archived_results (election_id, channel, choice, count)
+			SELECT $1, channel, 'rusak', COUNT(*) FROM spoiled_ballots GROUP BY channel`,
+		`INSERT INTO archived_turnout (election_id, wilayah, voted, not_voted)
+			SELECT $1, vm.wilayah,
+				COUNT(*) FILTER (WHERE v.used = true),
+				COUNT(*) FILTER (WHERE v.used = false)
+			FROM voters v INNER JOIN vote_master vm ON v.phone = vm.phone
+			GROUP BY vm.wilayah`,
+		// ballots are stored shuffled and without any voter reference
+		`INSERT INTO archived_ballots (election_id, channel, choice, cast_at)
+			SELECT $1, channel, choice, cast_at FROM (
+				SELECT 'online' AS channel, vote_choice AS choice, used_at AS cast_at FROM voters
+				WHERE used = true AND vote_choice IS NOT NULL
+				UNION ALL
+				SELECT 'offline', vote_choice, used_at FROM offline_voters
+			) b ORDER BY random()`,
+		`UPDATE elections SET sealed = TRUE WHERE id = $1`,
+	}
+	for _, q := range steps {
+		if _, err := tx.Exec(ctx, q, id); err != nil {
+			return 0, err
+		}
+	}
+
+	// move the election out of the active views
+	if _, err := tx.Exec(ctx, `DELETE FROM offline_voters`); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM spoiled_ballots`); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM voters`); err != nil {
+		return 0, err
+	}
+	if err := meter(ctx, tx, usageElectionsRun, 1); err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit(ctx)
+}
+
+func (a *App) listArchivedElections(ctx context.Context) ([]ArchivedElection, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, name, vote_start, vote_end, total_voters, voted_count, archived_at, archived_by
+		FROM elections
+		WHERE sealed
+		ORDER BY vote_end DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var elections []ArchivedElection
+	for rows.Next() {
+		var e ArchivedElection
+		if err := rows.Scan(&e.ID, &e.Name, &e.VoteStart, &e.VoteEnd, &e.TotalVoters, &e.VotedCount, &e.ArchivedAt, &e.ArchivedBy); err != nil {
+			return nil, err
+		}
+		elections = append(elections, e)
+	}
+	return elections, rows.Err()
+}
+
+// loadArchivedElection fills in the detail view for one sealed election
+func (a *App) loadArchivedElection(ctx context.Context, id int, data *ArchiveData) error {
+	var e ArchivedElection
+	err := a.db.QueryRow(ctx, `
+		SELECT id, name, vote_start, vote_end, total_voters, voted_count, archived_at, archived_by
+		FROM elections
+		WHERE id = $1 AND sealed`, id).
+		Scan(&e.ID, &e.Name, &e.VoteStart, &e.VoteEnd, &e.TotalVoters, &e.VotedCount, &e.ArchivedAt, &e.ArchivedBy)
+	if err != nil {
+		return err
+	}
+	data.Election = &e
+
+	rows, err := a.db.Query(ctx, `
+		SELECT channel, choice, count FROM archived_results
+		WHERE election_id = $1
+		ORDER BY channel DESC, choice`, id)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r ArchivedResult
+		if err := rows.Scan(&r.Channel, &r.Choice, &r.Count); err != nil {
+			rows.Close()
+			return err
+		}
+		data.Results = append(data.Results, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = a.db.Query(ctx, `
+		SELECT wilayah, voted, not_voted FROM archived_turnout
+		WHERE election_id = $1
+		ORDER BY wilayah`, id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t ArchivedTurnout
+		if err := rows.Scan(&t.Wilayah, &t.Voted, &t.NotVoted); err != nil {
+			return err
+		}
+		data.Turnout = append(data.Turnout, t)
+	}
+	return rows.Err()
+}
+
+// adminArchiveHandler lists archived elections (/admin/archive), shows one
+// of them read-only (/admin/archive/{id}) and, for superadmins, archives the
+// current election on POST.
+func (a *App) adminArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	acc := accountFrom(ctx)
+	data := ArchiveData{
+		CanClose:  time.Now().After(a.voteEnd),
+		CanManage: acc != nil && acc.Role == RoleSuperadmin,
+	}
+
+	if r.Method == http.MethodPost {
+		if !data.CanManage {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			data.Error = "nama pemilihan diperlukan"
+		} else if r.FormValue("confirm") != "ARSIPKAN" {
+			data.Error = "ketik ARSIPKAN untuk konfirmasi"
+		} else if id, err := a.archiveElection(ctx, name, acc.Username); err != nil {
+			if errors.Is(err, errElectionStillOpen) {
+				data.Error = err.Error()
+			} else {
+				logDB.Errorf("error archiving election: %v", err)
+				data.Error = "gagal mengarsipkan pemilihan"
+			}
+		} else {
+			a.audit(ctx, acc.Username, "election.archive", strconv.Itoa(id), map[string]string{"name": name})
+			a.electionRedirect(w, r, fmt.Sprintf("/admin/archive/%d", id), http.StatusSeeOther)
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if idStr := strings.TrimPrefix(r.URL.Path, "/admin/archive/"); idStr != r.URL.Path && idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := a.loadArchivedElection(ctx, id, &data); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				http.NotFound(w, r)
+				return
+			}
+			logDB.Errorf("error getting archived election: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		elections, err := a.listArchivedElections(ctx)
+		if err != nil {
+			logDB.Errorf("error getting archived elections: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		data.Elections = elections
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "archive.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
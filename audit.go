@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// audit appends an entry to the audit ledger. The ledger is append-only; only
+// the AUDIT_RETENTION_DAYS policy ever trims it. Failures are logged rather
+// than returned so a broken ledger never blocks the action being recorded.
+func (a *App) audit(ctx context.Context, actor, action, subject string, detail interface{}) {
+	tx, err := a.db.Begin(ctx)
+	if err == nil {
+		defer tx.Rollback(ctx)
+		if err = auditIn(ctx, tx, actor, action, subject, detail); err == nil {
+			err = tx.Commit(ctx)
+		}
+	}
+	if err != nil {
+		logDB.Errorf("error writing audit event: %v", err)
+	}
+}
+
+// auditIn appends an entry to the audit ledger through db and queues the
+// webhooks of its action, so within a transaction the entry, its webhooks
+// and whatever else the transaction writes are kept or lost together
+func auditIn(ctx context.Context, db execer, actor, action, subject string, detail interface{}) error {
+	payload, err := json.Marshal(detail)
+	if err != nil {
+		logDB.Errorf("error encoding audit detail: %v", err)
+		payload = []byte("null")
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO audit_events (actor, action, subject, detail)
+		VALUES ($1, $2, $3, $4)`, actor, action, subject, payload)
+	if err != nil {
+		return err
+	}
+	return enqueueWebhooks(ctx, db, action, subject, detail)
+}
+
+// actorName names the account or API client behind the request for the
+// audit ledger
+func actorName(r *http.Request) string {
+	if acc := accountFrom(r.Context()); acc != nil {
+		return acc.Username
+	}
+	if c := apiClientFrom(r.Context()); c != nil {
+		return "api:" + c.Name
+	}
+	return "anonymous"
+}
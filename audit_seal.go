@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"pemilihan.gkjp.id/verify"
+)
+
+// The audit ledger is sealed periodically into a hash chain: each seal
+// covers the events since the previous one, in id order, and its hash is
+//
+//	h = prev; for each event: h = SHA256(h || SHA256(canonical event))
+//
+// starting from the previous seal's hash (zeros for the first seal). With
+// AUDIT_SIGNING_KEY set every seal is signed, and seal hashes go out as
+// audit.seal webhooks so they can be anchored outside this server. Rewriting
+// or deleting a sealed event then breaks the chain, which verify-audit (and
+// cmd/pemilihan-verify) checks on an export without database access.
+
+const auditExportFormat = verify.AuditFormat
+
+// auditSettle keeps the newest events out of a seal: an event whose id was
+// taken before the seal may commit after it, and would then sit inside a
+// sealed range without being part of the hash
+const auditSettle = time.Minute
+
+var auditGenesis = verify.AuditGenesis
+
+// The export format and the chain are defined in package verify
+type (
+	AuditSeal        = verify.AuditSeal
+	AuditExportEvent = verify.AuditEvent
+	AuditExport      = verify.AuditExport
+)
+
+const auditEventColumns = `id, at, actor, action, subject, COALESCE(detail, 'null'::jsonb)::text`
+
+func scanAuditEvents(rows pgx.Rows) ([]AuditExportEvent, error) {
+	defer rows.Close()
+	events := []AuditExportEvent{}
+	for rows.Next() {
+		var e AuditExportEvent
+		var at time.Time
+		if err := rows.Scan(&e.ID, &at, &e.Actor, &e.Action, &e.Subject, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.At = at.UTC().Format(time.RFC3339Nano)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// sealAudit seals the settled events since the last seal, returning nil
+// when there was nothing to seal
+func (a *App) sealAudit(ctx context.Context) (*AuditSeal, error) {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// one sealer at a time, or two seals would share a predecessor
+	if _, err := tx.Exec(ctx, `LOCK TABLE audit_seals IN EXCLUSIVE MODE`); err != nil {
+		return nil, err
+	}
+	s := AuditSeal{PrevHash: auditGenesis}
+	var after int64
+	err = tx.QueryRow(ctx, `SELECT last_event_id, hash FROM audit_seals ORDER BY id DESC LIMIT 1`).Scan(&after, &s.PrevHash)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT `+auditEventColumns+`
+		FROM audit_events
+		WHERE id > $1 AND at < $2
+		ORDER BY id`, after, time.Now().Add(-auditSettle))
+	if err != nil {
+		return nil, err
+	}
+	events, err := scanAuditEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	s.FirstID, s.LastID, s.Events = events[0].ID, events[len(events)-1].ID, len(events)
+	if s.Hash, err = verify.AuditChain(s.PrevHash, events); err != nil {
+		return nil, err
+	}
+	// stored with microsecond precision; sign what will be read back
+	s.SealedAt = time.Now().UTC().Truncate(time.Microsecond)
+	if a.auditKey != nil {
+		s.PublicKey = base64.StdEncoding.EncodeToString(a.auditKey.Public().(ed25519.PublicKey))
+		s.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(a.auditKey, s.Message()))
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO audit_seals (first_event_id, last_event_id, events, prev_hash, hash, sealed_at, public_key, signature)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`, s.FirstID, s.LastID, s.Events, s.PrevHash, s.Hash, s.SealedAt, s.PublicKey, s.Signature).Scan(&s.ID)
+	if err != nil {
+		return nil, err
+	}
+	// not an audit event itself: that would leave a new event after every seal
+	if err := enqueueWebhooks(ctx, tx, "audit.seal", "", s); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// buildAuditExport reads the ledger and its seals in one consistent view
+func (a *App) buildAuditExport(ctx context.Context) (*AuditExport, error) {
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	return auditExportOf(ctx, tx)
+}
+
+// auditExportOf reads the ledger and its seals within tx
+func auditExportOf(ctx context.Context, tx pgx.Tx) (*AuditExport, error) {
+	exp := &AuditExport{Format: auditExportFormat, ExportedAt: time.Now(), Seals: []AuditSeal{}}
+	rows, err := tx.Query(ctx, `SELECT `+auditEventColumns+` FROM audit_events ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	if exp.Events, err = scanAuditEvents(rows); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(ctx, `
+		SELECT id, first_event_id, last_event_id, events, prev_hash, hash, sealed_at, public_key, signature
+		FROM audit_seals ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s AuditSeal
+		if err := rows.Scan(&s.ID, &s.FirstID, &s.LastID, &s.Events, &s.PrevHash, &s.Hash, &s.SealedAt,
+			&s.PublicKey, &s.Signature); err != nil {
+			return nil, err
+		}
+		exp.Seals = append(exp.Seals, s)
+	}
+	return exp, rows.Err()
+}
+
+// adminAuditExportHandler: GET /admin/audit.json seals what has settled and
+// downloads the audit ledger with every seal
+func (a *App) adminAuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := a.sealAudit(ctx); err != nil {
+		logDB.Errorf("error sealing audit log: %v", err)
+	}
+	exp, err := a.buildAuditExport(ctx)
+	if err != nil {
+		logDB.Errorf("error exporting audit log: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	a.audit(ctx, actorName(r), "audit.export", "", map[string]int{"events": len(exp.Events), "seals": len(exp.Seals)})
+
+	filename := fmt.Sprintf("audit-%s.json", exp.ExportedAt.Format("20060102-150405"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	writeJSON(w, http.StatusOK, exp)
+}
+
+// runVerifyAudit checks an audit export offline: seal signatures, the links
+// between seals and the hash of every sealed range.
+// Usage: pemilihan verify-audit [-pubkey <base64>] audit.json
+func runVerifyAudit(args []string) {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	pubkey := fs.String("pubkey", "", "announced Ed25519 public key (base64); without it unsigned seals are accepted")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: verify-audit [-pubkey <base64>] audit.json")
+	}
+	raw, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("verify-audit: %v", err)
+	}
+	ok, err := verify.CheckAudit(os.Stdout, raw, *pubkey)
+	if err != nil {
+		log.Fatalf("verify-audit: %v", err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
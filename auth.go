@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role controls which admin routes an account may use
+type Role string
+
+const (
+	// RoleSuperadmin can do everything, including managing accounts
+	RoleSuperadmin Role = "superadmin"
+	// RoleOperator runs the helpdesk and offline count, but can't edit the roll
+	RoleOperator Role = "operator"
+	// RoleObserver only sees turnout and, after close, results
+	RoleObserver Role = "observer"
+)
+
+var roles = []Role{RoleSuperadmin, RoleOperator, RoleObserver}
+
+func validRole(r Role) bool {
+	for _, role := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// roleMapEntry is one group=role pair of a role map; the group may itself
+// contain = and , (an LDAP DN), so pairs end at a role name
+var roleMapEntry = regexp.MustCompile(`^\s*(.+?)\s*=\s*(superadmin|operator|observer)\s*(?:,|$)`)
+
+// parseRoleMap reads a map of an identity provider's groups to roles,
+// written group=role,group=role (OIDC_ROLES, SAML_ROLES)
+func parseRoleMap(s string) (map[string]Role, error) {
+	m := map[string]Role{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		match := roleMapEntry.FindStringSubmatch(s)
+		if match == nil {
+			return nil, fmt.Errorf("%q: use group=superadmin|operator|observer", s)
+		}
+		m[match[1]] = Role(match[2])
+		s = s[len(match[0]):]
+	}
+	return m, nil
+}
+
+// highestRole returns the highest role any of groups maps to in m
+func highestRole(groups []string, m map[string]Role) (Role, bool) {
+	best := len(roles)
+	for _, g := range groups {
+		role, ok := m[g]
+		if !ok {
+			continue
+		}
+		for i, r := range roles {
+			if r == role && i < best {
+				best = i
+			}
+		}
+	}
+	if best == len(roles) {
+		return "", false
+	}
+	return roles[best], true
+}
+
+// Account is an authenticated admin user
+type Account struct {
+	ID       int // 0 for accounts configured through env vars, OIDC, SAML or LDAP
+	Username string
+	Role     Role
+	Session  int // admin_sessions id when signed in through /admin/login, 0 with basic auth
+}
+
+type ctxKey int
+
+const accountKey ctxKey = iota
+
+// accountFrom returns the account put on the context by requireRole
+func accountFrom(ctx context.Context) *Account {
+	acc, _ := ctx.Value(accountKey).(*Account)
+	return acc
+}
+
+// authenticate resolves the basic auth credentials, or else the session of
+// a sign-in through /admin/login, to an account
+func (a *App) authenticate(r *http.Request) (*Account, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user == "" || pass == "" {
+		return a.sessionAccount(r)
+	}
+	return a.checkPassword(r.Context(), user, pass)
+}
+
+// checkPassword resolves a username and password to an account. The env
+// credentials (ADMIN_*, COUNT_*, OBSERVER_*) act as built-in accounts so a
+// fresh deployment works before any rows exist in admin_accounts; usernames
+// in neither are checked against the directory when LDAP is on.
+func (a *App) checkPassword(ctx context.Context, user, pass string) (*Account, bool) {
+	if user == "" || pass == "" {
+		return nil, false
+	}
+	builtin := []struct {
+		user, pass string
+		role       Role
+	}{
+		{a.adminUser, a.adminPass, RoleSuperadmin},
+		{a.countUser, a.countPass, RoleOperator},
+		{a.observerUser, a.observerPass, RoleObserver},
+	}
+	for _, b := range builtin {
+		if b.user != "" && b.pass != "" && constantTimeEqual(user, b.user) && constantTimeEqual(pass, b.pass) {
+			return &Account{Username: user, Role: b.role}, true
+		}
+	}
+
+	var acc Account
+	var hash string
+	err := a.db.QueryRow(ctx, `
+		SELECT id, username, password_hash, role
+		FROM admin_accounts
+		WHERE username = $1 AND disabled = FALSE`, user).
+		Scan(&acc.ID, &acc.Username, &hash, &acc.Role)
+	if errors.Is(err, pgx.ErrNoRows) && a.ldap != nil {
+		return a.ldap.authenticate(ctx, user, pass)
+	}
+	if err != nil {
+		// run a comparison anyway so unknown users take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return nil, false
+	}
+	return &acc, true
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+// requireRole wraps h so it only runs for accounts holding one of the given
+// roles. Superadmins are always allowed. Unauthenticated requests get a 401
+// challenge (browsers the login page), authenticated ones
+// without the role a 403.
+func (a *App) requireRole(h http.HandlerFunc, allowed ...Role) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		acc, ok := a.authenticate(r)
+		if user, pass, basic := r.BasicAuth(); !ok && basic && user != "" && pass != "" {
+			a.recordLogin(r, user, LoginBasic, false, "password")
+		}
+		if !ok {
+			acc, ok = a.rememberedAccount(w, r)
+		}
+		if !ok && a.wantsLoginPage(r) {
+			a.electionRedirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Admin Area", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		permitted := acc.Role == RoleSuperadmin
+		for _, role := range allowed {
+			if acc.Role == role {
+				permitted = true
+			}
+		}
+		if !permitted {
+			logHTTP.Warnf("forbidden: %s (%s) %s %s", acc.Username, acc.Role, r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), accountKey, acc)))
+	}
+}
+
+// constantTimeEqual compares two secrets without leaking their length
+// difference through timing
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
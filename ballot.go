@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+
+	"pemilihan.gkjp.id/eligibility"
+	"pemilihan.gkjp.id/tally"
+)
+
+// Election methods, set with ELECTION_METHOD
+const (
+	MethodReferendum = "referendum" // one question, setuju / tidak setuju (default)
+	MethodSTV        = "stv"        // ranked ballots, SEATS winners by single transferable vote
+	MethodSchulze    = "schulze"    // ranked ballots, one winner by Condorcet / Schulze
+	MethodBorda      = "borda"      // ranked ballots, one winner by Borda points
+)
+
+// invalidChoice marks a spoilt paper ballot entered at the count
+const invalidChoice = tally.InvalidChoice
+
+// Errors of a ballot that doesn't follow the question flow
+var (
+	errBadChoice         = errors.New("invalid choice")
+	errFollowUpMissing   = errors.New("follow-up question not answered")
+	errFollowUpNotAsked  = errors.New("follow-up question does not apply to this choice")
+	errBadFollowUpAnswer = errors.New("invalid follow-up answer")
+)
+
+// FollowUp is a question shown only to voters who gave a certain answer
+// to the main question, e.g. "if you approve the merger, choose the
+// implementation date"
+type FollowUp struct {
+	When     string     // FOLLOW_UP_WHEN: the main answer that opens it
+	Question string     // FOLLOW_UP_QUESTION
+	Options  []string   // FOLLOW_UP_OPTIONS, separated by "|"
+	Rule     tally.Rule // FOLLOW_UP_QUORUM, FOLLOW_UP_SHARE_QUORUM, FOLLOW_UP_THRESHOLD
+}
+
+// BallotConfig describes what voters choose between. Ranked ballots are
+// stored in vote_choice as 1-based candidate numbers in order of
+// preference, e.g. "3>1>4".
+type BallotConfig struct {
+	Method     string
+	Candidates []string // CANDIDATES, separated by "|", in order of nomination
+	Seats      int
+	TieBreak   tally.TieBreak
+	FollowUp   *FollowUp  // referendum only
+	Rule       tally.Rule // QUORUM, SHARE_QUORUM, THRESHOLD (referendum only)
+
+	Eligibility *eligibility.Rule // ELIGIBILITY_RULE; nil lets everyone on the roll vote
+	TotalShares int               // TOTAL_SHARES; 0 leaves the sum of the voter weights unchecked
+}
+
+// loadBallotConfig reads ELECTION_METHOD, CANDIDATES, SEATS, TIE_BREAK,
+// ELIGIBILITY_RULE and TOTAL_SHARES
+func loadBallotConfig() (BallotConfig, error) {
+	b := BallotConfig{Method: strings.ToLower(strings.TrimSpace(os.Getenv("ELECTION_METHOD"))), Seats: 1}
+	if b.Method == "" {
+		b.Method = MethodReferendum
+	}
+	var err error
+	if b.Rule, err = loadRule("QUORUM", "SHARE_QUORUM", "THRESHOLD"); err != nil {
+		return b, err
+	}
+	if s := strings.TrimSpace(os.Getenv("ELIGIBILITY_RULE")); s != "" {
+		if b.Eligibility, err = eligibility.Parse(s); err != nil {
+			return b, fmt.Errorf("invalid ELIGIBILITY_RULE: %w", err)
+		}
+	}
+	if s := strings.TrimSpace(os.Getenv("TOTAL_SHARES")); s != "" {
+		if b.TotalShares, err = strconv.Atoi(s); err != nil || b.TotalShares <= 0 || b.TotalShares > maxShares {
+			return b, fmt.Errorf("invalid TOTAL_SHARES %q: want a whole number from 1 to %d", s, maxShares)
+		}
+	}
+	switch b.Method {
+	case MethodReferendum:
+		b.FollowUp, err = loadFollowUp()
+		return b, err
+	case MethodSTV, MethodSchulze, MethodBorda:
+	default:
+		return b, fmt.Errorf("invalid ELECTION_METHOD %q", b.Method)
+	}
+	if os.Getenv("FOLLOW_UP_QUESTION") != "" {
+		return b, errors.New("FOLLOW_UP_QUESTION needs ELECTION_METHOD=referendum")
+	}
+	if b.Rule.Threshold > 0 {
+		return b, errors.New("THRESHOLD needs ELECTION_METHOD=referendum; ranked methods only take a QUORUM")
+	}
+
+	for _, name := range strings.Split(os.Getenv("CANDIDATES"), "|") {
+		if name = strings.TrimSpace(name); name != "" {
+			b.Candidates = append(b.Candidates, name)
+		}
+	}
+	if len(b.Candidates) < 2 {
+		return b, errors.New("CANDIDATES needs at least two names separated by |")
+	}
+	if s := os.Getenv("SEATS"); s != "" && b.Method == MethodSTV {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n >= len(b.Candidates) {
+			return b, fmt.Errorf("invalid SEATS %q: must be between 1 and the number of candidates - 1", s)
+		}
+		b.Seats = n
+	}
+	b.TieBreak, err = tally.ParseTieBreak(os.Getenv("TIE_BREAK"))
+	if err != nil {
+		return b, fmt.Errorf("TIE_BREAK: %w", err)
+	}
+	return b, nil
+}
+
+// loadFollowUp reads FOLLOW_UP_QUESTION, FOLLOW_UP_WHEN and
+// FOLLOW_UP_OPTIONS; there is no follow-up without a question
+func loadFollowUp() (*FollowUp, error) {
+	f := &FollowUp{
+		Question: strings.TrimSpace(os.Getenv("FOLLOW_UP_QUESTION")),
+		When:     strings.TrimSpace(os.Getenv("FOLLOW_UP_WHEN")),
+	}
+	if f.Question == "" {
+		return nil, nil
+	}
+	if f.When != tally.ChoiceSetuju && f.When != tally.ChoiceTidakSetuju {
+		return nil, fmt.Errorf("invalid FOLLOW_UP_WHEN %q: must be setuju or tidak_setuju", f.When)
+	}
+	for _, o := range strings.Split(os.Getenv("FOLLOW_UP_OPTIONS"), "|") {
+		if o = strings.TrimSpace(o); o != "" {
+			f.Options = append(f.Options, o)
+		}
+	}
+	if len(f.Options) < 2 {
+		return nil, errors.New("FOLLOW_UP_OPTIONS needs at least two options separated by |")
+	}
+	var err error
+	f.Rule, err = loadRule("FOLLOW_UP_QUORUM", "FOLLOW_UP_SHARE_QUORUM", "FOLLOW_UP_THRESHOLD")
+	return f, err
+}
+
+// loadRule reads a question's quorums and threshold, all in percent
+func loadRule(quorumVar, shareQuorumVar, thresholdVar string) (tally.Rule, error) {
+	var rule tally.Rule
+	for _, p := range []struct {
+		name string
+		dst  *float64
+	}{{quorumVar, &rule.Quorum}, {shareQuorumVar, &rule.ShareQuorum}, {thresholdVar, &rule.Threshold}} {
+		s := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(os.Getenv(p.name)), "%"))
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 || v > 100 {
+			return rule, fmt.Errorf("invalid %s %q: must be a percentage between 0 and 100", p.name, os.Getenv(p.name))
+		}
+		*p.dst = v
+	}
+	return rule, nil
+}
+
+// Ranked reports whether voters rank candidates instead of answering the
+// referendum question
+func (b BallotConfig) Ranked() bool {
+	return b.Method != MethodReferendum
+}
+
+// normalizeChoice checks a ballot entered at the count; ranked elections
+// take a ranking such as "2 > 1 > 3" or tidak_sah
+func (b BallotConfig) normalizeChoice(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !b.Ranked() || s == invalidChoice || s == tally.BlankChoice {
+		return s, nil
+	}
+	ranking, err := tally.ParseRanking(s, len(b.Candidates))
+	if err != nil {
+		return "", err
+	}
+	return tally.FormatRanking(ranking), nil
+}
+
+// checkReferendum validates a referendum ballot against the question flow:
+// the follow-up answer is required when the main answer opens the
+// follow-up and must be left out otherwise. Blank ballots and spoilt paper
+// ballots carry no follow-up answer.
+func (b BallotConfig) checkReferendum(choice, followUp string, offline bool) error {
+	switch {
+	case choice == tally.ChoiceSetuju, choice == tally.ChoiceTidakSetuju, choice == tally.BlankChoice:
+	case choice == invalidChoice && offline:
+	default:
+		return errBadChoice
+	}
+	asked := b.FollowUp != nil && choice == b.FollowUp.When
+	if !asked {
+		if followUp != "" {
+			return errFollowUpNotAsked
+		}
+		return nil
+	}
+	if followUp == "" {
+		// a paper ballot can leave it blank; it is counted as unanswered
+		if offline {
+			return nil
+		}
+		return errFollowUpMissing
+	}
+	for _, o := range b.FollowUp.Options {
+		if followUp == o {
+			return nil
+		}
+	}
+	return errBadFollowUpAnswer
+}
+
+// recordSpoiled logs a malformed online submission as spoiled. Only
+// submissions with a code that may still vote count, so stray requests
+// don't inflate the tally; the code isn't stored.
+func (a *App) recordSpoiled(ctx context.Context, code, reason string) {
+	_, err := a.db.Exec(ctx, `
+		INSERT INTO spoiled_ballots (channel, reason)
+		SELECT 'online', $2 WHERE EXISTS (SELECT 1 FROM voters WHERE code = $1 AND used = false)`, code, reason)
+	if err != nil {
+		logTally.Errorf("error recording spoiled ballot: %v", err)
+	}
+}
+
+// followUpMessage is the voter-facing text of a question flow error
+func followUpMessage(err error) string {
+	switch {
+	case errors.Is(err, errFollowUpMissing):
+		return "pertanyaan lanjutan wajib dijawab"
+	case errors.Is(err, errFollowUpNotAsked):
+		return "pertanyaan lanjutan tidak berlaku untuk pilihan ini"
+	case errors.Is(err, errBadFollowUpAnswer):
+		return "jawaban pertanyaan lanjutan tidak valid"
+	}
+	return "pilihan tidak valid"
+}
+
+// ballotError is a submission the server can't accept: Reason goes to the
+// spoiled ballot log, Message to the voter
+type ballotError struct {
+	Reason  string
+	Message string
+}
+
+// ballotFromForm reads and checks the selection of a voting form. Blank
+// ballots are sent as choice=kosong.
+func (b BallotConfig) ballotFromForm(r *http.Request) (choice, followUp string, berr *ballotError) {
+	choice = strings.TrimSpace(r.FormValue("choice"))
+	followUp = strings.TrimSpace(r.FormValue("follow_up"))
+	if b.Ranked() && choice != tally.BlankChoice {
+		var err error
+		if choice, err = b.rankingFromForm(r); err != nil {
+			return "", "", &ballotError{err.Error(), "urutan pilihan harus 1, 2, 3, ... tanpa nomor ganda"}
+		}
+	}
+	if choice == "" {
+		return "", "", &ballotError{"no choice", "pilihan diperlukan"}
+	}
+	if !b.Ranked() {
+		if err := b.checkReferendum(choice, followUp, false); err != nil {
+			return "", "", &ballotError{err.Error(), followUpMessage(err)}
+		}
+	}
+	return choice, followUp, nil
+}
+
+// rankingFromForm builds a ballot from the rank_<i> fields of the voting
+// form. Voters rank as many candidates as they like; the ranks given must
+// run 1, 2, 3, ... without gaps or repeats.
+func (b BallotConfig) rankingFromForm(r *http.Request) (string, error) {
+	type ranked struct{ rank, candidate int }
+	var ranks []ranked
+	for i := range b.Candidates {
+		v := strings.TrimSpace(r.FormValue(fmt.Sprintf("rank_%d", i)))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return "", tally.ErrBadRanking
+		}
+		ranks = append(ranks, ranked{n, i})
+	}
+	if len(ranks) == 0 {
+		return "", tally.ErrBadRanking
+	}
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i].rank < ranks[j].rank })
+	ranking := make([]int, len(ranks))
+	for i, rc := range ranks {
+		if rc.rank != i+1 {
+			return "", tally.ErrBadRanking
+		}
+		ranking[i] = rc.candidate
+	}
+	return tally.FormatRanking(ranking), nil
+}
+
+// Tally is the configured counting method
+func (b BallotConfig) Tally() tally.Tally {
+	return tally.ForMethod(b.Method, b.Candidates, b.Seats, b.TieBreak)
+}
+
+// queryer is what the counts need of a pool or transaction
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// loadBallots reads every online and offline ballot of the current
+// election, grouped by choice and follow-up answer, plus the spoiled
+// submissions as choice "rusak". Paper ballots aren't linked to a voter, so
+// each carries one share.
+func loadBallots(ctx context.Context, q queryer) ([]tally.Ballot, error) {
+	rows, err := q.Query(ctx, `
+		SELECT 'online', vote_choice, COALESCE(follow_up, ''), COUNT(*), SUM(shares) FROM voters
+		WHERE used = true AND vote_choice IS NOT NULL GROUP BY vote_choice, follow_up
+		UNION ALL
+		SELECT 'offline', vote_choice, COALESCE(follow_up, ''), COUNT(*), COUNT(*) FROM offline_voters
+		GROUP BY vote_choice, follow_up
+		UNION ALL
+		SELECT channel, 'rusak', '', COUNT(*), 0 FROM spoiled_ballots GROUP BY channel`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ballots []tally.Ballot
+	for rows.Next() {
+		var b tally.Ballot
+		if err := rows.Scan(&b.Channel, &b.Choice, &b.FollowUp, &b.Count, &b.Shares); err != nil {
+			return nil, err
+		}
+		ballots = append(ballots, b)
+	}
+	return ballots, rows.Err()
+}
+
+// countBallots counts the ballots of the current election with the
+// configured method
+func (a *App) countBallots(ctx context.Context, q queryer) (tally.Result, error) {
+	ballots, err := loadBallots(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return a.ballot.Tally().Tally(ballots), nil
+}
+
+// countFollowUp counts the follow-up answers; nil without a follow-up
+func (a *App) countFollowUp(ctx context.Context, q queryer) (*tally.FollowUpResult, error) {
+	f := a.ballot.FollowUp
+	if f == nil {
+		return nil, nil
+	}
+	ballots, err := loadBallots(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return tally.FollowUp{When: f.When, Options: f.Options}.Tally(ballots).(*tally.FollowUpResult), nil
+}
+
+// countReferendum counts the setuju / tidak setuju ballots per channel
+func countReferendum(ctx context.Context, q queryer) (*tally.ReferendumResult, error) {
+	ballots, err := loadBallots(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return tally.Referendum{}.Tally(ballots).(*tally.ReferendumResult), nil
+}
+
+// QuestionResult is one question of the ballot and whether its result
+// stands under the question's own quorum and threshold
+type QuestionResult struct {
+	Question string
+	Outcome  string
+	Validity tally.Validity
+}
+
+// questionLabel names the main question in results
+func (b BallotConfig) questionLabel() string {
+	if b.Ranked() {
+		return "Pemilihan (" + b.Method + ")"
+	}
+	return "Pertanyaan utama (setuju / tidak setuju)"
+}
+
+// questionResults counts every question of the current election, the main
+// question first and then the follow-up. Everyone on the roll, with their
+// shares, is entitled to answer the main question.
+func (a *App) questionResults(ctx context.Context, q queryer) ([]QuestionResult, error) {
+	var e tally.Electorate
+	err := q.QueryRow(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(shares), 0),
+			COUNT(*) FILTER (WHERE checked_in_at IS NOT NULL), COALESCE(SUM(shares) FILTER (WHERE checked_in_at IS NOT NULL), 0)
+		FROM voters`).Scan(&e.Voters, &e.Shares, &e.Present, &e.PresentShares)
+	if err != nil {
+		return nil, err
+	}
+	ballots, err := loadBallots(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return a.ballot.questions(ballots, e), nil
+}
+
+// questions counts every question of the ballot out of ballots
+func (b BallotConfig) questions(ballots []tally.Ballot, e tally.Electorate) []QuestionResult {
+	main := b.Tally().Tally(ballots).(tally.Measurable)
+	results := []QuestionResult{{
+		Question: b.questionLabel(),
+		Outcome:  main.Outcome(),
+		Validity: main.Validity(b.Rule, e).WithPresent(e, ballots),
+	}}
+	if f := b.FollowUp; f != nil {
+		res := tally.FollowUp{When: f.When, Options: f.Options}.Tally(ballots).(*tally.FollowUpResult)
+		results = append(results, QuestionResult{
+			Question: f.Question,
+			Outcome:  res.Outcome(),
+			Validity: res.Validity(f.Rule, e),
+		})
+	}
+	return results
+}
+
+// certifiedOutcome is the outcome frozen in the tally snapshot, one line per
+// question: ranked elections certify the winners and the tie-break rule
+// applied, follow-ups their answers, and every question with a quorum or
+// threshold whether its result stands
+func (b BallotConfig) certifiedOutcome(questions []QuestionResult) string {
+	var lines []string
+	for i, q := range questions {
+		line := q.Outcome
+		if i > 0 {
+			line = q.Question + ": " + line
+		} else if !b.Ranked() && q.Validity.IsZero() {
+			continue // the referendum counts are in the snapshot already
+		}
+		if !q.Validity.IsZero() {
+			line += ". " + q.Validity.String()
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Each organization sets its own logo (an upload or a URL), colors and the
+// sender name of its mail in org_branding, so members of one organization
+// never see another's logo on the ballot, the results page or in an invite.
+// The branding is read into memory at start and every brandingRefresh after
+// (other instances of the organization pick up a change within that time);
+// templates take it through the brand and logo functions.
+
+const (
+	brandingRefresh = time.Minute
+	maxLogoSize     = 512 << 10
+)
+
+// logoTypes are the uploads accepted as a logo; no SVG, which could carry
+// script served from this origin
+var logoTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+
+var brandColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Branding is how the organization's pages and mail look; empty fields keep
+// the defaults
+type Branding struct {
+	LogoURL      string // external logo, used when nothing was uploaded
+	PrimaryColor string // headings, e.g. #dd3333
+	AccentColor  string // buttons
+	SenderName   string // display name of mail from SMTP_FROM
+	UpdatedAt    time.Time
+	UpdatedBy    string
+
+	logo     []byte
+	logoType string
+}
+
+// HasLogo reports whether a logo was uploaded
+func (b Branding) HasLogo() bool {
+	return len(b.logo) > 0
+}
+
+// brandingCache holds the organization's branding; the zero value is the
+// default look
+type brandingCache struct {
+	mu       sync.RWMutex
+	branding Branding
+}
+
+func (c *brandingCache) current() Branding {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.branding
+}
+
+func (a *App) loadBranding(ctx context.Context) error {
+	var b Branding
+	var logoURL, primary, accent, sender, logoType *string
+	err := a.db.QueryRow(ctx, `
+		SELECT logo, logo_type, logo_url, primary_color, accent_color, sender_name, updated_at, updated_by
+		FROM org_branding`).Scan(&b.logo, &logoType, &logoURL, &primary, &accent, &sender, &b.UpdatedAt, &b.UpdatedBy)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	for _, f := range []struct {
+		dst *string
+		src *string
+	}{{&b.LogoURL, logoURL}, {&b.PrimaryColor, primary}, {&b.AccentColor, accent}, {&b.SenderName, sender}, {&b.logoType, logoType}} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	a.branding.mu.Lock()
+	a.branding.branding = b
+	a.branding.mu.Unlock()
+	return nil
+}
+
+// logoURL is the address of the logo on the pages: the upload, the external
+// URL, or the bundled logo
+func (a *App) logoURL() string {
+	b := a.branding.current()
+	switch {
+	case b.HasLogo():
+		return a.election.Path("/branding/logo?v=" + strconv.FormatInt(b.UpdatedAt.Unix(), 10))
+	case b.LogoURL != "":
+		return b.LogoURL
+	}
+	return a.election.Path("/static/logo.png")
+}
+
+// brandingLogoHandler: GET /branding/logo serves the uploaded logo from
+// memory; the address carries the version, so it can be kept long
+func (a *App) brandingLogoHandler(w http.ResponseWriter, r *http.Request) {
+	b := a.branding.current()
+	if !b.HasLogo() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", b.logoType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", b.UpdatedAt, bytes.NewReader(b.logo))
+}
+
+// BrandingData is the data of branding.html
+type BrandingData struct {
+	Branding Branding
+	Logo     string
+	Message  string
+	Error    string
+}
+
+// adminBrandingHandler shows and updates the organization's branding.
+// Superadmin only.
+func (a *App) adminBrandingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data BrandingData
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxLogoSize+64<<10)
+		changed, err := a.saveBranding(ctx, r)
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+		if err := a.loadBranding(ctx); err != nil {
+			logDB.Errorf("error loading branding: %v", err)
+		}
+		a.audit(ctx, actorName(r), "branding.update", "", changed)
+		data.Message = "Tampilan disimpan"
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data.Branding, data.Logo = a.branding.current(), a.logoURL()
+	if err := a.tmpl.ExecuteTemplate(w, "branding.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// saveBranding stores the form; the returned error message is shown to the
+// admin as-is, and changed lists what was set for the audit log
+func (a *App) saveBranding(ctx context.Context, r *http.Request) (changed map[string]string, err error) {
+	if err := r.ParseMultipartForm(maxLogoSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return nil, fmt.Errorf("logo maksimal %d KB", maxLogoSize>>10)
+	}
+	primary := strings.TrimSpace(r.FormValue("primary_color"))
+	accent := strings.TrimSpace(r.FormValue("accent_color"))
+	for _, c := range []string{primary, accent} {
+		if c != "" && !brandColorPattern.MatchString(c) {
+			return nil, fmt.Errorf("warna harus berbentuk #rrggbb")
+		}
+	}
+	logoURL := strings.TrimSpace(r.FormValue("logo_url"))
+	if logoURL != "" {
+		u, err := url.Parse(logoURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("URL logo harus berupa alamat https://")
+		}
+	}
+	sender := strings.TrimSpace(r.FormValue("sender_name"))
+	if strings.ContainsAny(sender, "\r\n<>\"") {
+		return nil, fmt.Errorf("nama pengirim tidak valid")
+	}
+	changed = map[string]string{"logo_url": logoURL, "primary_color": primary, "accent_color": accent, "sender_name": sender}
+
+	// the uploaded logo stays unless a new one comes or it is removed
+	logoSQL := `org_branding.logo`
+	typeSQL := `org_branding.logo_type`
+	var logo []byte
+	var logoType string
+	if file, _, err := r.FormFile("logo"); err == nil {
+		defer file.Close()
+		if logo, err = io.ReadAll(io.LimitReader(file, maxLogoSize+1)); err != nil {
+			return nil, fmt.Errorf("gagal membaca file")
+		}
+		if len(logo) > maxLogoSize {
+			return nil, fmt.Errorf("logo maksimal %d KB", maxLogoSize>>10)
+		}
+		logoType = http.DetectContentType(logo)
+		if !logoTypes[logoType] {
+			return nil, fmt.Errorf("logo harus berupa PNG, JPEG, GIF atau WebP")
+		}
+		logoSQL, typeSQL = `EXCLUDED.logo`, `EXCLUDED.logo_type`
+		changed["logo"] = fmt.Sprintf("%s, %d bytes", logoType, len(logo))
+	} else if r.FormValue("remove_logo") != "" {
+		logoSQL, typeSQL = `NULL`, `NULL`
+		changed["logo"] = "removed"
+	}
+
+	_, err = a.db.Exec(ctx, `
+		INSERT INTO org_branding (logo, logo_type, logo_url, primary_color, accent_color, sender_name, updated_by)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), $7)
+		ON CONFLICT (org_id) DO UPDATE SET
+			logo = `+logoSQL+`, logo_type = `+typeSQL+`, logo_url = EXCLUDED.logo_url,
+			primary_color = EXCLUDED.primary_color, accent_color = EXCLUDED.accent_color,
+			sender_name = EXCLUDED.sender_name, updated_at = NOW(), updated_by = EXCLUDED.updated_by`,
+		logo, logoType, logoURL, primary, accent, sender, actorName(r))
+	if err != nil {
+		logDB.Errorf("error saving branding: %v", err)
+		return nil, fmt.Errorf("database error")
+	}
+	return changed, nil
+}
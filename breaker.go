@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// A circuit breaker sits in front of the database dial. After
+// breakerThreshold failed dials in a row it opens: new connections fail at
+// once with errDatabaseUnavailable, and withBreaker answers requests with the
+// error page (503) instead of letting them queue behind connect timeouts.
+// Once breakerCooldown has passed, one dial goes through as a trial; success
+// closes the breaker, failure keeps it open for another cooldown. The public
+// results page keeps showing the last results read, marked with their time.
+
+const (
+	breakerThreshold = 3
+	breakerCooldown  = 10 * time.Second
+)
+
+var errDatabaseUnavailable = errors.New("database unavailable (circuit breaker open)")
+
+type dbBreaker struct {
+	mu        sync.Mutex
+	failures  int       // failed dials in a row
+	openUntil time.Time // zero while closed
+	probing   bool      // the trial dial is running
+}
+
+// allow reports whether a dial may go ahead, taking the trial when the
+// cooldown is over
+func (b *dbBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *dbBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		if !b.openUntil.IsZero() {
+			logDB.Warnf("database reachable again: circuit breaker closed")
+		}
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures < breakerThreshold && b.openUntil.IsZero() {
+		return
+	}
+	if b.openUntil.IsZero() {
+		logDB.Errorf("database unreachable after %d attempts, failing fast: %v", b.failures, err)
+	}
+	b.openUntil = time.Now().Add(breakerCooldown)
+}
+
+// Open reports whether database work fails fast right now
+func (b *dbBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero() && (b.probing || time.Now().Before(b.openUntil))
+}
+
+// dialFunc wraps the pool's dial with the breaker
+func (b *dbBreaker) dialFunc(dial pgconn.DialFunc) pgconn.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !b.allow() {
+			return nil, errDatabaseUnavailable
+		}
+		conn, err := dial(ctx, network, addr)
+		if ctx.Err() == nil {
+			// a caller giving up says nothing about the database
+			b.record(err)
+		}
+		return conn, err
+	}
+}
+
+// degradedRoute reports whether r is served while the breaker is open: the
+// voting page without a code, the logo and the system status need no
+// database, and the results page falls back to the last results read
+func degradedRoute(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/static/"), r.URL.Path == "/status", r.URL.Path == "/status/health",
+		r.URL.Path == "/branding/logo":
+		return true
+	case r.URL.Path == "/":
+		return r.URL.Query().Get("code") == ""
+	}
+	return false
+}
+
+// withBreaker fails requests fast while the database is unreachable
+func (a *App) withBreaker(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.breaker.Open() && !degradedRoute(r) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(breakerCooldown/time.Second)))
+			a.writeError(w, r, http.StatusServiceUnavailable,
+				"Database sedang tidak dapat dihubungi. Silakan coba lagi beberapa saat lagi; pilihan yang belum terkirim belum tercatat.")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
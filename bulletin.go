@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/jackc/pgx/v4"
+
+	"pemilihan.gkjp.id/verify"
+)
+
+const bulletinFormat = verify.BulletinFormat
+
+// The bulletin board format is defined in package verify, which checks it
+// offline
+type (
+	Bulletin         = verify.Bulletin
+	BulletinElection = verify.BulletinElection
+	BulletinFollowUp = verify.BulletinFollowUp
+	BulletinBallot   = verify.BulletinBallot
+	SignedBulletin   = verify.SignedBulletin
+)
+
+var errNoSnapshot = errors.New("no tally snapshot yet")
+var errBallotsChanged = errors.New("ballot set changed since close")
+
+// loadSigningKey reads the base64 32-byte Ed25519 seed in the env variable
+// name, e.g. BULLETIN_SIGNING_KEY; what it signs stays unsigned without it
+func loadSigningKey(name string) (ed25519.PrivateKey, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s must be a base64 %d-byte Ed25519 seed", name, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// buildBulletin reads the snapshot and the ballots in one consistent view and
+// checks the ballots still hash to the root frozen at close
+func (a *App) buildBulletin(ctx context.Context) (*Bulletin, error) {
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	snap, err := a.loadTallySnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if snap == nil || snap.MerkleRoot == "" {
+		return nil, errNoSnapshot
+	}
+	leaves, err := merkleLeaves(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if merkleRoot(merkleLevels(leaves)) != snap.MerkleRoot {
+		return nil, errBallotsChanged
+	}
+
+	b := &Bulletin{
+		Format: bulletinFormat,
+		Election: BulletinElection{
+			VoteStart: a.voteStart,
+			VoteEnd:   a.voteEnd,
+			Method:    a.ballot.Method,
+		},
+		Snapshot: *snap,
+		Ballots:  make([]BulletinBallot, len(leaves)),
+	}
+	if a.ballot.Ranked() {
+		b.Election.Candidates = a.ballot.Candidates
+		b.Election.TieBreak = a.ballot.TieBreak.Rule
+		if a.ballot.TieBreak.Seed != "" {
+			b.Election.TieBreak += ":" + a.ballot.TieBreak.Seed
+		}
+		if a.ballot.Method == MethodSTV {
+			b.Election.Seats = a.ballot.Seats
+		}
+	}
+	if f := a.ballot.FollowUp; f != nil {
+		b.Election.FollowUp = &BulletinFollowUp{When: f.When, Question: f.Question, Options: f.Options}
+	}
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM spoiled_ballots`).Scan(&b.Spoiled); err != nil {
+		return nil, err
+	}
+	for i, l := range leaves {
+		b.Ballots[i] = BulletinBallot{
+			Leaf: hex.EncodeToString(l.Hash), Tag: hex.EncodeToString(l.Tag),
+			Channel: l.Channel, Choice: l.Choice, FollowUp: l.FollowUp,
+		}
+	}
+	return b, nil
+}
+
+// signBulletin encodes b and signs the encoding with key, if any
+func signBulletin(b *Bulletin, key ed25519.PrivateKey) (*SignedBulletin, error) {
+	body, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	s := &SignedBulletin{Bulletin: body, SHA256: hex.EncodeToString(sum[:])}
+	if key != nil {
+		s.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+		s.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, body))
+	}
+	return s, nil
+}
+
+// adminBulletinHandler: GET /admin/bulletin.json downloads the bulletin
+// board export once voting has closed
+func (a *App) adminBulletinHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := a.buildBulletin(ctx)
+	if errors.Is(err, errNoSnapshot) {
+		http.Error(w, "bulletin tersedia setelah pemilihan ditutup", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errBallotsChanged) {
+		http.Error(w, "data surat suara berubah sejak penutupan", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logTally.Errorf("error building bulletin: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	signed, err := signBulletin(b, a.bulletinKey)
+	if err != nil {
+		logTally.Errorf("error signing bulletin: %v", err)
+		http.Error(w, "bulletin error", http.StatusInternalServerError)
+		return
+	}
+	a.audit(ctx, actorName(r), "bulletin.export", "", map[string]interface{}{
+		"sha256": signed.SHA256, "ballots": len(b.Ballots), "signed": signed.Signature != "",
+	})
+
+	filename := fmt.Sprintf("bulletin-%s.json", a.voteEnd.Format("20060102"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	writeJSON(w, http.StatusOK, signed)
+}
+
+// runVerifyBulletin checks a bulletin board export offline: digest,
+// signature, Merkle root and a recount against the announced totals.
+// Usage: pemilihan verify-bulletin [-pubkey <base64>] bulletin.json
+func runVerifyBulletin(args []string) {
+	fs := flag.NewFlagSet("verify-bulletin", flag.ExitOnError)
+	pubkey := fs.String("pubkey", "", "announced Ed25519 public key (base64); without it the embedded key is only checked for consistency")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: verify-bulletin [-pubkey <base64>] bulletin.json")
+	}
+	raw, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("verify-bulletin: %v", err)
+	}
+	ok, err := verify.CheckBulletin(os.Stdout, raw, *pubkey)
+	if err != nil {
+		log.Fatalf("verify-bulletin: %v", err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
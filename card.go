@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // decodes uploaded logos
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+
+	"pemilihan.gkjp.id/tally"
+)
+
+// The results card is the official graphic of the result for social media:
+// a 1200x630 PNG (the size link previews use) with the organization's logo
+// and color, the name of the election, the outcome of the main question and
+// the turnout. It is drawn from the live count like /admin/report.pdf and
+// says so until voting closes. The logo is the upload or the bundled logo;
+// an external LOGO URL is never fetched by the server.
+
+// Card layout, in pixels
+const (
+	cardImgWidth  = 1200
+	cardImgHeight = 630
+	cardImgMargin = 60
+	cardBandH     = 150
+	cardLogoSize  = 110
+)
+
+var (
+	cardInk    = color.RGBA{0x2c, 0x3e, 0x50, 0xff}
+	cardMuted  = color.RGBA{0x7f, 0x8c, 0x8d, 0xff}
+	cardTrack  = color.RGBA{0xec, 0xf0, 0xf1, 0xff}
+	cardGreen  = color.RGBA{0x27, 0xae, 0x60, 0xff}
+	cardRed    = color.RGBA{0xc0, 0x39, 0x2b, 0xff}
+	cardOrange = color.RGBA{0xe6, 0x7e, 0x22, 0xff}
+)
+
+// cardFonts are the Go fonts, parsed once
+var cardFonts struct {
+	once          sync.Once
+	regular, bold *opentype.Font
+	err           error
+}
+
+// cardFace is the regular or bold Go font at size pixels
+func cardFace(bold bool, size float64) (font.Face, error) {
+	cardFonts.once.Do(func() {
+		if cardFonts.regular, cardFonts.err = opentype.Parse(goregular.TTF); cardFonts.err != nil {
+			return
+		}
+		cardFonts.bold, cardFonts.err = opentype.Parse(gobold.TTF)
+	})
+	if cardFonts.err != nil {
+		return nil, cardFonts.err
+	}
+	f := cardFonts.regular
+	if bold {
+		f = cardFonts.bold
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// resultCard is what the card says
+type resultCard struct {
+	Title    string
+	Headline string // the outcome, e.g. DISETUJUI
+	Color    color.RGBA
+	Detail   string // the counts behind it
+	Validity string // the quorum and threshold checks; empty without a rule
+	Turnout  string
+	Share    float64 // turnout, 0 to 1
+	Footer   string
+}
+
+// buildResultCard words the card out of the results as of now
+func (a *App) buildResultCard(ctx context.Context, results *LiveResults, now time.Time) resultCard {
+	card := resultCard{Title: "Hasil Pemilihan", Color: cardInk}
+	if s, err := a.loadPortalSettings(ctx); err != nil {
+		logTally.Errorf("error getting portal settings for card: %v", err)
+	} else if t := strings.TrimSpace(s.Title); t != "" {
+		card.Title = t
+	}
+
+	q := a.ballot.questions(results.Ballots, results.Electorate)[0]
+	res := a.ballot.Tally().Tally(results.Ballots)
+	winners := res.Winners()
+	switch {
+	case len(results.Ballots) == 0:
+		card.Headline, card.Color = "Belum ada suara", cardMuted
+	case a.ballot.Ranked():
+		card.Detail = q.Outcome
+		if len(winners) == 0 {
+			card.Headline, card.Color = "Belum ada pemenang", cardOrange
+		} else {
+			card.Headline, card.Color = "Terpilih: "+strings.Join(winners, ", "), cardGreen
+		}
+	default:
+		t := res.(*tally.ReferendumResult).Total()
+		valid := t.Setuju + t.TidakSetuju
+		card.Detail = fmt.Sprintf("Setuju %d (%.1f%%)  ·  Tidak setuju %d (%.1f%%)",
+			t.Setuju, pct(t.Setuju, valid), t.TidakSetuju, pct(t.TidakSetuju, valid))
+		if blank := t.TidakSah + t.Kosong + t.Rusak; blank > 0 {
+			card.Detail += fmt.Sprintf("  ·  Tidak sah/kosong %d", blank)
+		}
+		switch {
+		case len(winners) == 0:
+			card.Headline, card.Color = "SERI", cardOrange
+		case winners[0] == tally.ChoiceSetuju:
+			card.Headline, card.Color = "DISETUJUI", cardGreen
+		default:
+			card.Headline, card.Color = "DITOLAK", cardRed
+		}
+	}
+	if v := q.Validity; !v.IsZero() && len(results.Ballots) > 0 {
+		card.Validity = "Hasil " + v.String()
+		if !v.Stands() {
+			card.Headline, card.Color = "TIDAK SAH: "+card.Headline, cardRed
+		}
+	}
+
+	if v := q.Validity; v.Entitled > 0 {
+		card.Turnout = fmt.Sprintf("Partisipasi: %d dari %d pemilih (%.1f%%)", v.Turnout, v.Entitled, v.TurnoutPct())
+		card.Share = v.TurnoutPct() / 100
+	} else {
+		card.Turnout = "Partisipasi: belum ada pemilih terdaftar"
+	}
+
+	loc := a.voteEnd.Location()
+	if now.After(a.voteEnd) {
+		card.Footer = "Hasil akhir · pemungutan suara ditutup " + a.voteEnd.In(loc).Format("02/01/2006 15:04")
+	} else {
+		card.Footer = "Hasil sementara per " + now.In(loc).Format("02/01/2006 15:04")
+	}
+	if results.Sealed > 0 {
+		card.Footer += fmt.Sprintf(" · %d suara online masih tersegel", results.Sealed)
+	}
+	return card
+}
+
+// pct is n of total in percent
+func pct(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// cardLogo is the organization's logo as an image: the upload, else the
+// bundled logo
+func (a *App) cardLogo() image.Image {
+	if b := a.branding.current(); b.HasLogo() {
+		if img, _, err := image.Decode(bytes.NewReader(b.logo)); err == nil {
+			return img
+		}
+	}
+	f, err := staticFS.Open("static/logo.png")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+// brandColor parses a #rrggbb branding color, or returns def
+func brandColor(s string, def color.RGBA) color.RGBA {
+	if !brandColorPattern.MatchString(s) {
+		return def
+	}
+	v, _ := strconv.ParseUint(s[1:], 16, 32)
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
+
+// cardText draws s with face at x, baseline y
+func cardText(dst draw.Image, face font.Face, c color.Color, x, y int, s string) {
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(c), Face: face, Dot: fixed.P(x, y)}
+	d.DrawString(s)
+}
+
+// cardWrap breaks s into lines no wider than width, ending the last of
+// maxLines with an ellipsis when s doesn't fit
+func cardWrap(face font.Face, s string, width, maxLines int) []string {
+	fits := func(s string) bool { return font.MeasureString(face, s).Ceil() <= width }
+	var lines []string
+	line := ""
+	for _, w := range strings.Fields(s) {
+		next := w
+		if line != "" {
+			next = line + " " + w
+		}
+		if fits(next) || line == "" {
+			line = next
+			continue
+		}
+		lines = append(lines, line)
+		line = w
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+		lines[maxLines-1] += "…"
+	}
+	for i, l := range lines {
+		for !fits(l) && len([]rune(l)) > 1 {
+			r := []rune(strings.TrimSuffix(l, "…"))
+			l = string(r[:len(r)-1]) + "…"
+		}
+		lines[i] = l
+	}
+	return lines
+}
+
+// renderResultCard draws card as a PNG in the organization's branding
+func (a *App) renderResultCard(card resultCard) ([]byte, error) {
+	faces := map[string]struct {
+		bold bool
+		size float64
+	}{
+		"org": {false, 26}, "title": {true, 44}, "headline": {true, 64},
+		"text": {false, 28}, "small": {false, 22},
+	}
+	face := make(map[string]font.Face, len(faces))
+	for name, f := range faces {
+		ff, err := cardFace(f.bold, f.size)
+		if err != nil {
+			return nil, err
+		}
+		defer ff.Close()
+		face[name] = ff
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, cardImgWidth, cardImgHeight))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	b := a.branding.current()
+	primary := brandColor(b.PrimaryColor, cardInk)
+	draw.Draw(img, image.Rect(0, 0, cardImgWidth, cardBandH), image.NewUniform(primary), image.Point{}, draw.Src)
+
+	// logo on a white tile in the band, keeping its aspect ratio
+	textX := cardImgMargin
+	if logo := a.cardLogo(); logo != nil {
+		tile := image.Rect(cardImgMargin, (cardBandH-cardLogoSize)/2, cardImgMargin+cardLogoSize, (cardBandH+cardLogoSize)/2)
+		draw.Draw(img, tile, image.White, image.Point{}, draw.Src)
+		lb := logo.Bounds()
+		inner := cardLogoSize - 12
+		w, h := inner, inner
+		if lb.Dx() > lb.Dy() {
+			h = inner * lb.Dy() / lb.Dx()
+		} else {
+			w = inner * lb.Dx() / lb.Dy()
+		}
+		x0, y0 := tile.Min.X+(cardLogoSize-w)/2, tile.Min.Y+(cardLogoSize-h)/2
+		draw.CatmullRom.Scale(img, image.Rect(x0, y0, x0+w, y0+h), logo, lb, draw.Over, nil)
+		textX = tile.Max.X + 30
+	}
+	bandWidth := cardImgWidth - textX - cardImgMargin
+	titleLines := cardWrap(face["title"], card.Title, bandWidth, 2)
+	y := cardBandH/2 + 15
+	if len(titleLines) > 1 {
+		y = cardBandH/2 - 8
+	}
+	for _, l := range titleLines {
+		cardText(img, face["title"], color.White, textX, y, l)
+		y += 48
+	}
+	if org := a.org; org != "" && len(titleLines) == 1 {
+		cardText(img, face["org"], color.NRGBA{0xff, 0xff, 0xff, 0xcc}, textX, cardBandH/2+52, org)
+	}
+
+	width := cardImgWidth - 2*cardImgMargin
+	y = cardBandH + 90
+	for _, l := range cardWrap(face["headline"], card.Headline, width, 1) {
+		cardText(img, face["headline"], card.Color, cardImgMargin, y, l)
+	}
+	y += 52
+	for _, l := range cardWrap(face["text"], card.Detail, width, 2) {
+		cardText(img, face["text"], cardInk, cardImgMargin, y, l)
+		y += 36
+	}
+	if card.Validity != "" {
+		for _, l := range cardWrap(face["small"], card.Validity, width, 2) {
+			cardText(img, face["small"], cardMuted, cardImgMargin, y, l)
+			y += 30
+		}
+	}
+
+	// turnout with a bar, above the footer
+	y = cardImgHeight - 140
+	cardText(img, face["text"], cardInk, cardImgMargin, y, card.Turnout)
+	bar := image.Rect(cardImgMargin, y+18, cardImgWidth-cardImgMargin, y+40)
+	draw.Draw(img, bar, image.NewUniform(cardTrack), image.Point{}, draw.Src)
+	if share := min(max(card.Share, 0), 1); share > 0 {
+		fill := bar
+		fill.Max.X = bar.Min.X + int(share*float64(bar.Dx()))
+		draw.Draw(img, fill, image.NewUniform(brandColor(b.AccentColor, primary)), image.Point{}, draw.Src)
+	}
+	cardText(img, face["small"], cardMuted, cardImgMargin, cardImgHeight-40, card.Footer)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// adminCardHandler: GET /admin/card.png draws the results card as of now.
+// Superadmin only.
+func (a *App) adminCardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	results, err := a.cachedResults(ctx)
+	if err != nil {
+		logTally.Errorf("error getting results for card: %v", err)
+		http.Error(w, "database error", http.StatusServiceUnavailable)
+		return
+	}
+	now := time.Now()
+	img, err := a.renderResultCard(a.buildResultCard(ctx, results, now))
+	if err != nil {
+		logTally.Errorf("error rendering results card: %v", err)
+		http.Error(w, "gagal membuat gambar", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "image/png")
+	h.Set("Content-Length", strconv.Itoa(len(img)))
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if r.URL.Query().Get("download") != "" {
+		h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "hasil-"+now.Format("20060102-150405")+".png"))
+	}
+	w.Write(img)
+}
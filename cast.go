@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Casting a ballot is the one write every voter makes, mostly in the first
+// minutes after voting opens. It is a single statement: the conditional
+// UPDATE, dropping the voter's open prepared ballot (see challenge.go), and
+// telling an unknown code from a used one, all in one round trip. The
+// statement is prepared on each new pool connection (warmStatements) rather
+// than on the first vote it serves.
+//
+// The closing SELECT sees the table as it was before the UPDATE, so a code
+// that exists is found whether or not this statement used it. Of two
+// concurrent casts of one code the second waits on the row lock, finds
+// used = TRUE and casts nothing. Codes are unique per organization; the
+// statement names it, as bench-vote runs it without row-level security.
+const castVoteSQL = `
+	WITH cast_ballot AS (
+		UPDATE voters
+		SET used = TRUE, used_at = NOW(), vote_choice = NULLIF($1, ''), follow_up = NULLIF($3, ''), receipt = $4,
+			sealed_choice = $5
+		WHERE org_id = current_org() AND code = $2 AND used = FALSE AND checked_in_at IS NULL
+		RETURNING id
+	), dropped AS (
+		DELETE FROM ballot_challenges c USING cast_ballot b
+		WHERE c.voter_id = b.id AND c.challenged_at IS NULL
+	)
+	SELECT EXISTS (SELECT 1 FROM cast_ballot), EXISTS (SELECT 1 FROM voters WHERE org_id = current_org() AND code = $2)`
+
+// onlineVoteEvent is the data of every vote.cast webhook of an online
+// ballot; shared, and only ever read
+var onlineVoteEvent = map[string]string{"channel": "online"}
+
+// castOutcome is what castVote did with a code
+type castOutcome int
+
+const (
+	castAccepted castOutcome = iota
+	castUnknownCode
+	castAlreadyUsed
+)
+
+func (o castOutcome) String() string {
+	return [...]string{castAccepted: "accepted", castUnknownCode: "unknown code", castAlreadyUsed: "already used"}[o]
+}
+
+// castVote records the ballot of code if it hasn't voted yet
+func castVote(ctx context.Context, q queryer, code, choice, followUp, receipt string, sealed []byte) (castOutcome, error) {
+	var cast, exists bool
+	if err := q.QueryRow(ctx, castVoteSQL, choice, code, followUp, receipt, sealed).Scan(&cast, &exists); err != nil {
+		return 0, err
+	}
+	switch {
+	case cast:
+		return castAccepted, nil
+	case !exists:
+		return castUnknownCode, nil
+	}
+	return castAlreadyUsed, nil
+}
+
+// warmStatements prepares the vote path on a new connection, so the rush
+// at opening doesn't pay a parse per fresh connection. Connections without
+// a statement cache (statement_cache_mode=describe, capacity 0) skip it.
+func warmStatements(ctx context.Context, conn *pgx.Conn) error {
+	cache := conn.StatementCache()
+	if cache == nil {
+		return nil
+	}
+	_, err := cache.Get(ctx, castVoteSQL)
+	return err
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"pemilihan.gkjp.id/tally"
+)
+
+// Benaloh challenge: instead of casting straight away a voter may first
+// prepare their ballot. The server records the ballot and shows a commitment
+// to it, SHA-256 of "<nonce>|<choice>|<follow up>", before it knows what the
+// voter will do next. The voter then either casts that prepared ballot as is
+// or challenges it: the server reveals the nonce and what it recorded, the
+// voter checks both against the commitment and their intent, and the
+// challenged ballot is spoiled. Since the server can't tell which ballots
+// will be challenged, one that records selections wrongly gets caught.
+
+// PreparedBallot is a ballot recorded ahead of the voter's decision to cast
+// or challenge it
+type PreparedBallot struct {
+	ID           int        `json:"id"`
+	Commitment   string     `json:"commitment"`
+	Nonce        string     `json:"nonce"`
+	Choice       string     `json:"choice"`
+	FollowUp     string     `json:"follow_up,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ChallengedAt *time.Time `json:"challenged_at,omitempty"`
+}
+
+var errNoPrepared = errors.New("prepared ballot not found")
+
+func challengeCommitment(nonce, choice, followUp string) string {
+	sum := sha256.Sum256([]byte(nonce + "|" + choice + "|" + followUp))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadPrepared returns the ballot id prepared by code, either still open to
+// be cast or already challenged, or errNoPrepared
+func (a *App) loadPrepared(ctx context.Context, code, id string, challenged bool) (*PreparedBallot, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, errNoPrepared
+	}
+	var p PreparedBallot
+	err = a.db.QueryRow(ctx, `
+		SELECT c.id, c.commitment, c.nonce, c.vote_choice, COALESCE(c.follow_up, ''), c.created_at, c.challenged_at
+		FROM ballot_challenges c JOIN voters v ON v.id = c.voter_id
+		WHERE c.id = $1 AND v.code = $2 AND (c.challenged_at IS NOT NULL) = $3`, n, code, challenged).Scan(
+		&p.ID, &p.Commitment, &p.Nonce, &p.Choice, &p.FollowUp, &p.CreatedAt, &p.ChallengedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errNoPrepared
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// readableChoice spells out a recorded choice for the voter: candidate names
+// in order for a ranking
+func (b BallotConfig) readableChoice(choice string) string {
+	if !b.Ranked() || choice == tally.BlankChoice {
+		return strings.ToUpper(strings.ReplaceAll(choice, "_", " "))
+	}
+	ranking, err := tally.ParseRanking(choice, len(b.Candidates))
+	if err != nil {
+		return choice
+	}
+	names := make([]string, len(ranking))
+	for i, c := range ranking {
+		names[i] = fmt.Sprintf("%d. %s", i+1, b.Candidates[c])
+	}
+	return strings.Join(names, ", ")
+}
+
+// loadChallengeView fills the ballot page for ?prepared=<id> or
+// ?challenged=<id>; an id that isn't the voter's is ignored
+func (a *App) loadChallengeView(ctx context.Context, r *http.Request, code string, data *ViewData) error {
+	var err error
+	if id := r.URL.Query().Get("prepared"); id != "" {
+		data.Prepared, err = a.loadPrepared(ctx, code, id, false)
+	} else if id := r.URL.Query().Get("challenged"); id != "" {
+		data.Challenged, err = a.loadPrepared(ctx, code, id, true)
+		if data.Challenged != nil {
+			data.ChallengedText = a.ballot.readableChoice(data.Challenged.Choice)
+		}
+	}
+	if errors.Is(err, errNoPrepared) {
+		return nil
+	}
+	return err
+}
+
+// prepareHandler: POST /prepare records the ballot of the voting form without
+// casting it and shows its commitment. A voter keeps one prepared ballot; a
+// new one replaces it.
+func (a *App) prepareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if election := a.electionOf(r); time.Now().Before(election.VoteStart) || time.Now().After(election.VoteEnd) {
+		http.Error(w, "pemilihan tidak sedang berlangsung", http.StatusForbidden)
+		return
+	}
+	code := strings.TrimSpace(r.FormValue("code"))
+	if code == "" {
+		http.Error(w, "kode diperlukan", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("for") != "" {
+		http.Error(w, "uji surat suara tidak tersedia untuk surat suara kuasa", http.StatusBadRequest)
+		return
+	}
+	// nothing is cast yet, so a bad selection isn't logged as spoiled
+	choice, followUp, berr := a.ballot.ballotFromForm(r)
+	if berr != nil {
+		http.Error(w, berr.Message, http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "nonce error", http.StatusInternalServerError)
+		logHTTP.Errorf("nonce error: %v", err)
+		return
+	}
+	nonce := hex.EncodeToString(b)
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		logDB.Errorf("db begin error: %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var voterID int
+	err = tx.QueryRow(ctx, `SELECT id FROM voters WHERE code = $1 AND used = FALSE FOR UPDATE`, code).Scan(&voterID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "kode tidak ditemukan atau sudah digunakan", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `DELETE FROM ballot_challenges WHERE voter_id = $1 AND challenged_at IS NULL`, voterID)
+	}
+	var id int
+	if err == nil {
+		err = tx.QueryRow(ctx, `
+			INSERT INTO ballot_challenges (voter_id, commitment, nonce, vote_choice, follow_up)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+			RETURNING id`, voterID, challengeCommitment(nonce, choice, followUp), nonce, choice, followUp).Scan(&id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		logDB.Errorf("db exec error: %v", err)
+		return
+	}
+	a.electionRedirect(w, r, fmt.Sprintf("/?code=%s&prepared=%d", url.QueryEscape(code), id), http.StatusSeeOther)
+}
+
+// challengeHandler: POST /challenge spoils the prepared ballot and reveals
+// what the server recorded. The voter can then prepare or cast a new one.
+func (a *App) challengeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code := strings.TrimSpace(r.FormValue("code"))
+	id, err := strconv.Atoi(r.FormValue("prepared"))
+	if code == "" || err != nil {
+		http.Error(w, "surat suara yang disiapkan tidak ditemukan", http.StatusBadRequest)
+		return
+	}
+	var commitment string
+	err = a.db.QueryRow(ctx, `
+		UPDATE ballot_challenges c SET challenged_at = NOW()
+		FROM voters v
+		WHERE c.id = $1 AND v.id = c.voter_id AND v.code = $2 AND c.challenged_at IS NULL
+		RETURNING c.commitment`, id, code).Scan(&commitment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "surat suara yang disiapkan tidak ditemukan", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		logDB.Errorf("db exec error: %v", err)
+		return
+	}
+	a.audit(ctx, code, "ballot.challenge", code, map[string]string{"commitment": commitment})
+	a.electionRedirect(w, r, fmt.Sprintf("/?code=%s&challenged=%d", url.QueryEscape(code), id), http.StatusSeeOther)
+}
+
+// challengesHandler: GET /challenges lists every challenged ballot with its
+// opening, without any voter reference, so auditors can check that each
+// commitment matches what was revealed. Public.
+func (a *App) challengesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	rows, err := a.db.Query(ctx, `
+		SELECT id, commitment, nonce, vote_choice, COALESCE(follow_up, ''), created_at, challenged_at
+		FROM ballot_challenges WHERE challenged_at IS NOT NULL
+		ORDER BY challenged_at, id`)
+	if err != nil {
+		logTally.Errorf("error getting challenges: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	challenges := []PreparedBallot{}
+	for rows.Next() {
+		var p PreparedBallot
+		if err := rows.Scan(&p.ID, &p.Commitment, &p.Nonce, &p.Choice, &p.FollowUp, &p.CreatedAt, &p.ChallengedAt); err != nil {
+			logTally.Errorf("error getting challenges: %v", err)
+			apiError(w, r, http.StatusInternalServerError, "database error")
+			return
+		}
+		challenges = append(challenges, p)
+	}
+	if err := rows.Err(); err != nil {
+		logTally.Errorf("error getting challenges: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, challenges)
+}
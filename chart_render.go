@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// Charts are drawn on the server, so they need no script: as SVG for the
+// admin dashboard (/admin/api/charts/<name>.svg) and the public results page
+// (/status/charts/<name>.svg), and straight into the PDF report. All of them
+// lay a dataset out the same way, one horizontal bar per label and series
+// scaled to the largest value, so the dashboard, the page and the paper
+// agree.
+
+// chartColors are the bar colors: per series, or per label with one series
+var chartColors = [][3]int{{0x27, 0xae, 0x60}, {0xc0, 0x39, 0x2b}, {0x95, 0xa5, 0xa6}}
+
+// chartBar is one bar of a laid out chart
+type chartBar struct {
+	Label string // empty on the later series of a label
+	Title string // label and series
+	Value int
+	Share float64 // of the largest value, 0 to 1
+	Color [3]int
+}
+
+// chartBars lays data out; with firstOnly only the first series is drawn,
+// e.g. when a running total would dwarf the per-hour bars
+func chartBars(data ChartData, firstOnly bool) []chartBar {
+	series := data.Series
+	if firstOnly && len(series) > 1 {
+		series = series[:1]
+	}
+	max := 1
+	for _, s := range series {
+		for _, v := range s.Data {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	var bars []chartBar
+	for i, label := range data.Labels {
+		for si, s := range series {
+			if i >= len(s.Data) {
+				continue
+			}
+			b := chartBar{Title: label + " - " + s.Name, Value: s.Data[i], Share: float64(s.Data[i]) / float64(max)}
+			if si == 0 {
+				b.Label = label
+			}
+			if len(series) > 1 {
+				b.Color = chartColors[si%len(chartColors)]
+			} else {
+				b.Color = chartColors[i%len(chartColors)]
+			}
+			bars = append(bars, b)
+		}
+	}
+	return bars
+}
+
+// SVG layout, in pixels
+const (
+	svgChartWidth = 480
+	svgLabelWidth = 130
+	svgValueWidth = 60
+	svgRowHeight  = 22
+	svgBarHeight  = 14
+	svgTitleSpace = 26
+)
+
+// svgEscape escapes s for SVG text and attributes
+func svgEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// renderChartSVG draws bars under title as a standalone SVG image
+func renderChartSVG(title string, bars []chartBar) []byte {
+	rows := len(bars)
+	if rows == 0 {
+		rows = 1
+	}
+	height := svgTitleSpace + rows*svgRowHeight + 6
+	barSpace := float64(svgChartWidth - svgLabelWidth - svgValueWidth)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="%s" font-family="sans-serif" font-size="12">`,
+		svgChartWidth, height, svgChartWidth, height, svgEscape(title))
+	fmt.Fprintf(&b, `<title>%s</title>`, svgEscape(title))
+	fmt.Fprintf(&b, `<text x="0" y="16" font-size="14" font-weight="bold" fill="#2c3e50">%s</text>`, svgEscape(title))
+	if len(bars) == 0 {
+		fmt.Fprintf(&b, `<text x="0" y="%d" fill="#7f8c8d">Belum ada data</text>`, svgTitleSpace+15)
+	}
+	for i, bar := range bars {
+		y := svgTitleSpace + i*svgRowHeight
+		if bar.Label != "" {
+			label := bar.Label
+			if r := []rune(label); len(r) > 18 {
+				label = string(r[:17]) + "…"
+			}
+			fmt.Fprintf(&b, `<text x="0" y="%d" fill="#2c3e50"><title>%s</title>%s</text>`, y+12, svgEscape(bar.Title), svgEscape(label))
+		}
+		width := bar.Share * barSpace
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%d" rx="2" fill="#%02x%02x%02x"><title>%s: %d</title></rect>`,
+			svgLabelWidth, y+(svgRowHeight-svgBarHeight)/2-2, width, svgBarHeight, bar.Color[0], bar.Color[1], bar.Color[2],
+			svgEscape(bar.Title), bar.Value)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" fill="#2c3e50">%d</text>`, float64(svgLabelWidth)+width+6, y+12, bar.Value)
+	}
+	b.WriteString(`</svg>`)
+	return b.Bytes()
+}
+
+// writeChartSVG serves an SVG chart; it carries user data (wilayah names),
+// so it may not run or load anything even when opened on its own
+func writeChartSVG(w http.ResponseWriter, svg []byte) {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(svg)))
+	w.Write(svg)
+}
+
+// drawChartPDF draws bars under title at y across width millimetres from x,
+// going on to the next page at the bottom margin, and returns the y below
+// the chart
+func drawChartPDF(pdf *fpdf.Fpdf, tr func(string) string, x, y, width float64, title string, bars []chartBar) float64 {
+	const (
+		labelW = 40.0
+		valueW = 16.0
+		rowH   = 6.0
+		barH   = 4.0
+	)
+	pdf.SetXY(x, y)
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.CellFormat(width, 7, tr(title), "", 1, "L", false, 0, "")
+	y += 8
+	pdf.SetFont("Helvetica", "", 9)
+	if len(bars) == 0 {
+		pdf.SetXY(x, y)
+		pdf.CellFormat(width, rowH, "Belum ada data", "", 1, "L", false, 0, "")
+		return y + rowH + 4
+	}
+	barSpace := width - labelW - valueW
+	_, pageH := pdf.GetPageSize()
+	_, top, _, bottom := pdf.GetMargins()
+	for _, bar := range bars {
+		if y+rowH > pageH-bottom {
+			pdf.AddPage()
+			y = top
+		}
+		if bar.Label != "" {
+			pdf.SetXY(x, y)
+			pdf.CellFormat(labelW-2, rowH, tr(bar.Label), "", 0, "L", false, 0, "")
+		}
+		pdf.SetFillColor(bar.Color[0], bar.Color[1], bar.Color[2])
+		bw := bar.Share * barSpace
+		if bw > 0 {
+			pdf.Rect(x+labelW, y+(rowH-barH)/2, bw, barH, "F")
+		}
+		pdf.SetXY(x+labelW+bw+1.5, y)
+		pdf.CellFormat(valueW, rowH, strconv.Itoa(bar.Value), "", 0, "L", false, 0, "")
+		y += rowH
+	}
+	return y + 4
+}
+
+// publicChoiceChart is the choice distribution of /status: online and paper
+// ballots together
+func publicChoiceChart(results *LiveResults) ChartData {
+	c := splitChannels(results)
+	return ChartData{
+		Labels: []string{"Setuju", "Tidak Setuju", "Tidak Sah"},
+		Series: []ChartSeries{{
+			Name: "Suara",
+			Data: []int{c.Online.Setuju + c.Paper.Setuju, c.Online.TidakSetuju + c.Paper.TidakSetuju, c.Paper.TidakSah},
+		}},
+	}
+}
+
+// publicTurnoutChart is the turnout of /status: the roll that voted online,
+// the ballots entered on paper, and the roll that hasn't voted
+func publicTurnoutChart(results *LiveResults) ChartData {
+	c := splitChannels(results)
+	return ChartData{
+		Labels: []string{"Memilih Online", "Suara di Tempat", "Belum Memilih"},
+		Series: []ChartSeries{{
+			Name: "Peserta",
+			Data: []int{c.Voted, c.Offline, results.Stats.NotVotedCount},
+		}},
+	}
+}
+
+// statusChartHandler: GET /status/charts/choices.svg and
+// /status/charts/turnout.svg draw the public results. They are cached like
+// /status.
+func (a *App) statusChartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/status/charts/"), ".svg")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var chart func(*LiveResults) ChartData
+	var title string
+	switch name {
+	case "choices":
+		chart, title = publicChoiceChart, "Sebaran Pilihan"
+	case "turnout":
+		chart, title = publicTurnoutChart, "Partisipasi"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	results, version, err := a.resultsVersion(r.Context())
+	if err != nil {
+		logTally.Errorf("error getting results for chart: %v", err)
+		http.Error(w, "database error", http.StatusServiceUnavailable)
+		return
+	}
+	if time.Now().After(a.voteEnd) {
+		w.Header().Set("Cache-Control", statusClosedCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", statusCacheControl)
+	}
+	if notModified(w, r, version, "chart-"+name) {
+		return
+	}
+	writeChartSVG(w, renderChartSVG(title, chartBars(chart(results), false)))
+}
+
+// adminChartSVG draws the dashboard chart name, as adminChartHandler serves
+// it in JSON
+func (a *App) adminChartSVG(ctx context.Context, name, bucket string) ([]byte, error) {
+	var data ChartData
+	var err error
+	var title string
+	firstOnly := false
+	switch name {
+	case "choices":
+		title = "Sebaran Pilihan"
+		data, err = a.choiceChart(ctx)
+	case "turnout-by-group":
+		title = "Partisipasi per Wilayah"
+		data, err = a.turnoutByGroupChart(ctx)
+	case "turnout-over-time":
+		title, firstOnly = "Suara per Jam", true
+		if bucket == "day" {
+			title = "Suara per Hari"
+		}
+		data, err = a.turnoutOverTimeChart(ctx, bucket)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return renderChartSVG(title, chartBars(data, firstOnly)), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// schemaProbes are columns the server can't run without, the oldest next to
+// the newest migrate.sql adds: missing ones mean migrate.sql wasn't run, or
+// not since the last upgrade. Add the newest here with each migration the
+// server depends on.
+var schemaProbes = []struct{ table, column string }{
+	{"vote_master", "phone"},
+	{"voters", "code"},
+	{"admin_accounts", "role"},
+	{"audit_events", "action"},
+	{"tally_snapshots", "ballot_hash"},
+	{"revoked_codes", "code"},
+	{"kiosk_terminals", "token_hash"},
+	{"voters", "checked_in_at"},
+	{"voters", "code_sent_at"},
+	{"voters", "registered_late_at"},
+	{"tally_snapshots", "late_registered"},
+	{"admin_notifications", "superadmin_only"},
+	{"scheduled_jobs", "locked_until"},
+	{"outbox_messages", "next_attempt_at"},
+}
+
+// checkResult is one line of the readiness report
+type checkResult struct {
+	name   string
+	detail string
+	failed bool
+	skip   bool
+}
+
+// runCheck implements the `check` subcommand:
+//
+//	pemilihan-pendeta check [-timeout 10s]
+//
+// It checks the configuration of this process the way the server would read
+// it before an election: DATABASE_URL connects, migrate.sql has been run and
+// keeps the organizations apart, VOTE_START comes before VOTE_END, a
+// superadmin can sign in, the SMTP server of SMTP_URL takes a login and the
+// templates parse. It prints a line per check and exits 1 if one failed,
+// changing nothing.
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "how long connecting to the database may take")
+	fs.Parse(args)
+
+	var results []checkResult
+	report := func(name string, err error, detail string) {
+		if err != nil {
+			results = append(results, checkResult{name: name, detail: err.Error(), failed: true})
+			return
+		}
+		results = append(results, checkResult{name: name, detail: detail})
+	}
+	skip := func(name, why string) {
+		results = append(results, checkResult{name: name, detail: why, skip: true})
+	}
+
+	// voting window
+	voteStart, voteEnd, err := checkVoteWindow()
+	report("voting window", err, fmt.Sprintf("%s to %s", voteStart.Format(time.RFC3339), voteEnd.Format(time.RFC3339)))
+
+	// database and schema
+	ctx := context.Background()
+	var db *pgxpool.Pool
+	if databaseURL := os.Getenv("DATABASE_URL"); databaseURL == "" {
+		report("database", errors.New("DATABASE_URL is not set"), "")
+	} else {
+		cctx, cancel := context.WithTimeout(ctx, *timeout)
+		db, err = connectOrg(cctx, databaseURL, true)
+		if err == nil {
+			err = db.Ping(cctx)
+		}
+		cancel()
+		if err != nil {
+			report("database", err, "")
+			if db != nil {
+				db.Close()
+				db = nil
+			}
+		} else {
+			defer db.Close()
+			report("database", nil, "connected as organization "+orgFromEnv())
+		}
+	}
+	if db == nil {
+		skip("schema", "no database")
+	} else {
+		report("schema", checkSchema(ctx, db), fmt.Sprintf("%d tables and columns present, tenant isolation on", len(schemaProbes)))
+	}
+
+	// admin credentials
+	detail, err := checkAdminCredentials(ctx, db)
+	report("admin credentials", err, detail)
+
+	// SMTP
+	if v := os.Getenv("SMTP_URL"); v == "" {
+		skip("smtp", "SMTP_URL is not set; no mail is sent unless an organization sets its own")
+	} else {
+		m, err := newMailer(v, os.Getenv("SMTP_FROM"))
+		if err == nil {
+			err = m.check()
+		}
+		if err != nil {
+			report("smtp", err, "")
+		} else {
+			report("smtp", nil, "signed in to "+m.addr)
+		}
+	}
+
+	// templates
+	election, err := loadElection(voteStart, voteEnd)
+	if err != nil {
+		election = &Election{}
+	}
+	tmpl, err := parseTemplates(false, &App{election: election})
+	detail = ""
+	if err == nil {
+		detail = fmt.Sprintf("%d templates parsed", len(tmpl.Templates()))
+	}
+	report("templates", err, detail)
+
+	if failed := printReport(results); failed > 0 {
+		fmt.Printf("\n%d of %d checks failed\n", failed, len(results))
+		os.Exit(1)
+	}
+	fmt.Println("\nready")
+}
+
+// printReport prints a line per result and returns how many failed
+func printReport(results []checkResult) int {
+	failed := 0
+	for _, r := range results {
+		status := "ok"
+		switch {
+		case r.failed:
+			status = "FAIL"
+			failed++
+		case r.skip:
+			status = "skip"
+		}
+		fmt.Printf("%-4s  %-17s  %s\n", status, r.name, r.detail)
+	}
+	return failed
+}
+
+// checkVoteWindow reads VOTE_START and VOTE_END as the server does
+func checkVoteWindow() (time.Time, time.Time, error) {
+	startStr, endStr := os.Getenv("VOTE_START"), os.Getenv("VOTE_END")
+	if startStr == "" || endStr == "" {
+		return time.Time{}, time.Time{}, errors.New("VOTE_START and VOTE_END are required (RFC3339)")
+	}
+	start, err := time.Parse(time.RFC3339, startStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid VOTE_START: %v", err)
+	}
+	end, err := time.Parse(time.RFC3339, endStr)
+	if err != nil {
+		return start, time.Time{}, fmt.Errorf("invalid VOTE_END: %v", err)
+	}
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("VOTE_START %s is not before VOTE_END %s", startStr, endStr)
+	}
+	return start, end, nil
+}
+
+// checkSchema looks for the schemaProbes and for broken tenant isolation
+func checkSchema(ctx context.Context, db *pgxpool.Pool) error {
+	var missing []string
+	for _, p := range schemaProbes {
+		var ok bool
+		err := db.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+			)`, p.table, p.column).Scan(&ok)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			missing = append(missing, p.table+"."+p.column)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s (run migrate.sql)", strings.Join(missing, ", "))
+	}
+	problems, err := checkTenantIsolation(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("tenant isolation is broken (run migrate.sql): %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkAdminCredentials finds a way for a superadmin to sign in: ADMIN_USER
+// and ADMIN_PASS, an account in admin_accounts, or the identity provider
+func checkAdminCredentials(ctx context.Context, db *pgxpool.Pool) (string, error) {
+	user, pass := os.Getenv("ADMIN_USER"), os.Getenv("ADMIN_PASS")
+	switch {
+	case user != "" && pass != "":
+		return "ADMIN_USER " + user, nil
+	case user != "" || pass != "":
+		return "", errors.New("set both ADMIN_USER and ADMIN_PASS, or neither")
+	}
+	if db != nil {
+		var n int
+		err := db.QueryRow(ctx, `
+			SELECT COUNT(*) FROM admin_accounts WHERE role = $1 AND disabled = FALSE`, RoleSuperadmin).Scan(&n)
+		if err != nil {
+			return "", err
+		}
+		if n > 0 {
+			return fmt.Sprintf("%d superadmin accounts", n), nil
+		}
+	}
+	if os.Getenv("OIDC_ISSUER") != "" || os.Getenv("SAML_IDP_METADATA") != "" {
+		return "sign-in through the identity provider", nil
+	}
+	return "", errors.New("no superadmin: set ADMIN_USER and ADMIN_PASS")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// At a meeting that votes both online and in the room, the desk checks in
+// the members who came to vote on paper at /checkin: the operator enters the
+// code of the member's letter and the number of the paper ballot handed to
+// them. A checked-in code casts nothing online (castVoteSQL refuses it), and
+// the voters checked in count toward the quorums with their shares, paper
+// ballots entered or not (tally.Validity.WithPresent). The ballot reference
+// ties the member to the numbered ballot for reconciliation after the count;
+// the paper ballot itself stays anonymous. Check-ins close with voting.
+
+const (
+	// maxBallotRef caps the length of a paper ballot reference
+	maxBallotRef = 50
+	// checkInListLimit caps the recent check-ins listed
+	checkInListLimit = 100
+)
+
+// CheckIn is a voter checked in at the room
+type CheckIn struct {
+	Code        string
+	Name        string
+	BallotRef   string
+	Shares      int
+	CheckedInBy string
+	CheckedInAt time.Time
+}
+
+// CheckInData is the data of checkin.html
+type CheckInData struct {
+	Recent  []CheckIn // latest first
+	Count   int       // voters checked in
+	Shares  int       // their shares together
+	Closed  bool      // voting has closed
+	Message string
+	Error   string
+}
+
+// checkedIn returns the paper ballot reference of code, empty unless its
+// voter checked in at the room
+func (a *App) checkedIn(ctx context.Context, code string) (string, error) {
+	var ref string
+	err := a.db.QueryRow(ctx, `
+		SELECT COALESCE(ballot_ref, '') FROM voters WHERE code = $1 AND checked_in_at IS NOT NULL`, code).Scan(&ref)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return ref, err
+}
+
+// checkinHandler: GET /checkin shows the check-ins; POST checks a voter in
+// (action=checkin) or takes back a check-in made in error (action=undo).
+// Operators and the superadmin.
+func (a *App) checkinHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := CheckInData{Closed: time.Now().After(a.voteEnd)}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if data.Closed {
+			data.Error = "check-in ditutup karena pemilihan sudah selesai"
+			break
+		}
+		var err error
+		switch r.FormValue("action") {
+		case "checkin":
+			data.Message, err = a.checkIn(ctx, strings.TrimSpace(r.FormValue("code")), strings.TrimSpace(r.FormValue("ballot_ref")), actorName(r))
+		case "undo":
+			data.Message, err = a.undoCheckIn(ctx, strings.TrimSpace(r.FormValue("code")), actorName(r))
+		default:
+			err = errors.New("aksi tidak dikenal")
+		}
+		if err != nil {
+			data.Error = err.Error()
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := a.loadCheckIns(ctx, &data); err != nil {
+		logDB.Errorf("error getting check-ins: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err := a.tmpl.ExecuteTemplate(w, "checkin.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// checkIn marks the voter of code as voting in the room on the paper ballot
+// ref. A voter who voted online, is checked in already or fails the
+// eligibility rule is refused; the error is shown to the operator as-is.
+func (a *App) checkIn(ctx context.Context, code, ref, actor string) (string, error) {
+	if code == "" {
+		return "", errors.New("kode pemilih diperlukan")
+	}
+	if ref == "" {
+		return "", errors.New("nomor surat suara diperlukan")
+	}
+	if len(ref) > maxBallotRef {
+		return "", fmt.Errorf("nomor surat suara paling panjang %d karakter", maxBallotRef)
+	}
+	if ok, err := a.eligible(ctx, code); err != nil {
+		logDB.Errorf("error checking eligibility: %v", err)
+		return "", errors.New("database error")
+	} else if !ok {
+		return "", fmt.Errorf("kode %s tidak memenuhi syarat untuk memilih di pemilihan ini", code)
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		logDB.Errorf("error checking in: %v", err)
+		return "", errors.New("database error")
+	}
+	defer tx.Rollback(ctx)
+
+	var name, held string
+	var used, checked bool
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(vm.name, v.name, ''), v.used, v.checked_in_at IS NOT NULL, COALESCE(v.ballot_ref, '')
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE v.code = $1
+		FOR UPDATE OF v`, code).Scan(&name, &used, &checked, &held)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("kode %s tidak ada di daftar pemilih", code)
+	}
+	if err != nil {
+		logDB.Errorf("error checking in: %v", err)
+		return "", errors.New("database error")
+	}
+	if err := a.pii.openAll(&name); err != nil {
+		logDB.Errorf("error checking in: %v", err)
+		return "", errors.New("database error")
+	}
+	switch {
+	case used:
+		return "", fmt.Errorf("%s (%s) sudah memilih online dan tidak boleh menerima surat suara kertas", name, code)
+	case checked:
+		return "", fmt.Errorf("%s (%s) sudah check-in dengan surat suara nomor %s", name, code, held)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE voters SET checked_in_at = NOW(), checked_in_by = $2, ballot_ref = $3 WHERE code = $1`,
+		code, actor, ref)
+	if isUniqueViolation(err) {
+		return "", fmt.Errorf("surat suara nomor %s sudah dipakai pemilih lain", ref)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		logDB.Errorf("error checking in: %v", err)
+		return "", errors.New("database error")
+	}
+
+	a.results.invalidate()
+	a.audit(ctx, actor, "voter.checkin", code, map[string]string{"ballot_ref": ref})
+	return fmt.Sprintf("%s (%s) check-in dengan surat suara nomor %s", name, code, ref), nil
+}
+
+// undoCheckIn takes back the check-in of code, which can then vote online
+// again
+func (a *App) undoCheckIn(ctx context.Context, code, actor string) (string, error) {
+	var ref string
+	err := a.db.QueryRow(ctx, `
+		WITH old AS (
+			SELECT id, ballot_ref FROM voters WHERE code = $1 AND checked_in_at IS NOT NULL FOR UPDATE
+		)
+		UPDATE voters v SET checked_in_at = NULL, checked_in_by = NULL, ballot_ref = NULL
+		FROM old WHERE v.id = old.id
+		RETURNING COALESCE(old.ballot_ref, '')`, code).Scan(&ref)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("kode %s belum check-in", code)
+	}
+	if err != nil {
+		logDB.Errorf("error undoing check-in: %v", err)
+		return "", errors.New("database error")
+	}
+	a.results.invalidate()
+	a.audit(ctx, actor, "voter.checkin_undo", code, map[string]string{"ballot_ref": ref})
+	return fmt.Sprintf("Check-in %s dibatalkan; surat suara nomor %s tidak berlaku", code, ref), nil
+}
+
+// loadCheckIns fills the totals and the latest check-ins
+func (a *App) loadCheckIns(ctx context.Context, data *CheckInData) error {
+	err := a.db.QueryRow(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(shares), 0) FROM voters WHERE checked_in_at IS NOT NULL`).Scan(&data.Count, &data.Shares)
+	if err != nil {
+		return err
+	}
+	rows, err := a.db.Query(ctx, `
+		SELECT v.code, COALESCE(vm.name, v.name, ''), COALESCE(v.ballot_ref, ''), v.shares,
+			COALESCE(v.checked_in_by, ''), v.checked_in_at
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE v.checked_in_at IS NOT NULL
+		ORDER BY v.checked_in_at DESC, v.code
+		LIMIT $1`, checkInListLimit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c CheckIn
+		if err := rows.Scan(&c.Code, &c.Name, &c.BallotRef, &c.Shares, &c.CheckedInBy, &c.CheckedInAt); err != nil {
+			return err
+		}
+		if err := a.pii.openAll(&c.Name); err != nil {
+			return err
+		}
+		data.Recent = append(data.Recent, c)
+	}
+	return rows.Err()
+}
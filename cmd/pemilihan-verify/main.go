@@ -0,0 +1,76 @@
+// Command pemilihan-verify checks the published records of an election
+// without the server or its database: bulletin board exports (ballots and
+// announced totals) and audit log exports (the signed hash chain). It only
+// needs the files and the announced public keys, so observers can build it
+// on their own machine:
+//
+//	go build ./cmd/pemilihan-verify
+//	pemilihan-verify -pubkey <bulletin key> -audit-pubkey <audit key> bulletin.json audit.json
+//
+// It exits with status 1 when any check fails.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"pemilihan.gkjp.id/verify"
+)
+
+func main() {
+	log.SetFlags(0)
+	pubkey := flag.String("pubkey", "", "announced bulletin signing key (base64 Ed25519); without it the embedded key is only checked for consistency")
+	auditPubkey := flag.String("audit-pubkey", "", "announced audit seal key (base64 Ed25519); without it unsigned seals are accepted")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: pemilihan-verify [-pubkey <base64>] [-audit-pubkey <base64>] file.json ...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for i, name := range flag.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// a bulletin wraps its body in "bulletin"; an audit export names
+		// its format at the top
+		var probe struct {
+			Bulletin json.RawMessage `json:"bulletin"`
+			Format   string          `json:"format"`
+		}
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		var ok bool
+		switch {
+		case probe.Bulletin != nil:
+			fmt.Printf("%s: bulletin board\n", name)
+			ok, err = verify.CheckBulletin(os.Stdout, raw, *pubkey)
+		case probe.Format == verify.AuditFormat:
+			fmt.Printf("%s: audit log\n", name)
+			ok, err = verify.CheckAudit(os.Stdout, raw, *auditPubkey)
+		default:
+			log.Fatalf("%s: neither a bulletin board nor an audit log export", name)
+		}
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		if !ok {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Invitation letters often go out weeks before voting opens, and a letter
+// lost on the way is a ballot anyone can cast. With CODE_EXPIRES_AFTER
+// (e.g. 336h) a code must be activated within that long of being issued:
+// its holder enters it, and the ballot page mails a confirmation link to the
+// member's email on record (the "email" member attribute). The link points at
+// PUBLIC_URL, never at the Host of the request asking for it, and opening it
+// shows a button that activates the code, so a mail scanner following the
+// link activates nothing. A code left unactivated past its deadline expires and
+// can neither be activated nor vote, so a letter found late is worthless and
+// one found early still needs the member's mailbox. The superadmin can
+// activate a code at the desk for a member without email, after checking
+// who they are.
+
+const (
+	// activationLinkTTL caps how long an activation link can be used
+	activationLinkTTL = 24 * time.Hour
+
+	// activationResend is how long a code waits before another link is mailed
+	activationResend = 10 * time.Minute
+)
+
+// CodeActivation is where a code stands when it needs activating
+type CodeActivation struct {
+	Activated bool
+	Deadline  time.Time // activate by then, or the code expires
+	Email     string    // the member's, where the link goes; may be empty
+	Mailable  bool      // a link can be mailed: there is an email and PUBLIC_URL
+	Sent      bool      // a link was just asked for
+}
+
+// Expired reports whether the code ran out unactivated
+func (c *CodeActivation) Expired() bool {
+	return !c.Activated && time.Now().After(c.Deadline)
+}
+
+// MaskedEmail is Email with most of the local part hidden, to show whose
+// mailbox the link went to without giving it away
+func (c *CodeActivation) MaskedEmail() string {
+	return maskEmail(c.Email)
+}
+
+// maskEmail hides most of the local part of email
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return ""
+	}
+	return local[:1] + strings.Repeat("*", min(len(local)-1, 6)) + "@" + domain
+}
+
+var errInvalidActivation = errors.New("link aktivasi tidak valid atau sudah kedaluwarsa")
+
+// codeActivation returns where code stands, or nil when codes need no
+// activation or code is unknown
+func (a *App) codeActivation(ctx context.Context, code string) (*CodeActivation, error) {
+	if a.codeTTL == 0 {
+		return nil, nil
+	}
+	var c CodeActivation
+	var issued time.Time
+	err := a.db.QueryRow(ctx, `
+		SELECT v.issued_at, v.activated_at IS NOT NULL, COALESCE(vm.attributes->>'email', '')
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE v.code = $1`, code).Scan(&issued, &c.Activated, &c.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := a.pii.openAll(&c.Email); err != nil {
+		return nil, err
+	}
+	c.Deadline = issued.Add(a.codeTTL)
+	c.Mailable = c.Email != "" && a.publicURL != ""
+	return &c, nil
+}
+
+// activationSignature signs which code a link activates until when
+func (a *App) activationSignature(code string, expires time.Time) string {
+	mac := hmac.New(sha256.New, a.inviteKey)
+	fmt.Fprintf(mac, "activate|%s|%s|%d", a.org, code, expires.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// activationToken is the t parameter of an activation link:
+// code.expiry.signature
+func (a *App) activationToken(code string, expires time.Time) string {
+	return fmt.Sprintf("%s.%d.%s", code, expires.Unix(), a.activationSignature(code, expires))
+}
+
+// openActivation returns the code an activation link activates, or
+// errInvalidActivation
+func (a *App) openActivation(token string) (string, error) {
+	rest, sig, ok := cutLast(token, ".")
+	if !ok {
+		return "", errInvalidActivation
+	}
+	code, exp, ok := cutLast(rest, ".")
+	if !ok {
+		return "", errInvalidActivation
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", errInvalidActivation
+	}
+	expires := time.Unix(unix, 0)
+	if !hmac.Equal([]byte(sig), []byte(a.activationSignature(code, expires))) || time.Now().After(expires) {
+		return "", errInvalidActivation
+	}
+	return code, nil
+}
+
+// cutLast slices s around the last sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// ActivateData is the data of activate.html
+type ActivateData struct {
+	Token string
+	Org   string
+}
+
+// activateHandler: POST /activate mails the activation link of code= to the
+// member, or activates the code of the link with t=; GET /activate?t= asks
+// to confirm the activation. The link is the credential, so no session is
+// needed.
+func (a *App) activateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodPost:
+		if t := r.FormValue("t"); t != "" {
+			code, err := a.openActivation(t)
+			if err == nil {
+				err = a.activateCode(ctx, code, "")
+			}
+			if errors.Is(err, errInvalidActivation) {
+				a.writeError(w, r, http.StatusNotFound, err.Error())
+				return
+			}
+			if err != nil {
+				logDB.Errorf("error activating code: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			a.electionRedirect(w, r, "/?activation=done&code="+url.QueryEscape(code), http.StatusSeeOther)
+			return
+		}
+		code := strings.TrimSpace(r.FormValue("code"))
+		if err := a.sendActivation(ctx, a.mailBaseURL(r), code); err != nil {
+			logMailer.Errorf("error sending activation: %v", err)
+		}
+		a.electionRedirect(w, r, "/?activation=sent&code="+url.QueryEscape(code), http.StatusSeeOther)
+	case http.MethodGet:
+		t := r.FormValue("t")
+		if _, err := a.openActivation(t); err != nil {
+			a.writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		if err := a.tmpl.ExecuteTemplate(w, "activate.html", ActivateData{Token: t, Org: a.org}); err != nil {
+			logHTTP.Errorf("error executing template: %v", err)
+			http.Error(w, "template error", http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sendActivation queues the activation link of code to the member's email
+// when the code still needs activating and no link went out in the last
+// activationResend. baseURL is PUBLIC_URL; without it nothing is sent.
+func (a *App) sendActivation(ctx context.Context, baseURL, code string) error {
+	if baseURL == "" {
+		return nil
+	}
+	c, err := a.codeActivation(ctx, code)
+	if err != nil || c == nil || c.Activated || c.Expired() || c.Email == "" {
+		return err
+	}
+	m, err := a.orgMailer(ctx)
+	if err != nil || m == nil {
+		return err
+	}
+	if err := a.checkMessageQuota(ctx); err != nil {
+		return err
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, `
+		UPDATE voters SET activation_mailed_at = NOW()
+		WHERE code = $1 AND activated_at IS NULL
+			AND (activation_mailed_at IS NULL OR activation_mailed_at < NOW() - $2 * INTERVAL '1 second')`,
+		code, int(activationResend/time.Second))
+	if err != nil || tag.RowsAffected() == 0 {
+		return err
+	}
+
+	expires := time.Now().Add(activationLinkTTL)
+	if c.Deadline.Before(expires) {
+		expires = c.Deadline
+	}
+	link := baseURL + "/activate?t=" + url.QueryEscape(a.activationToken(code, expires))
+	body := fmt.Sprintf("Kode pemilihan Anda di %s perlu diaktifkan sebelum dapat dipakai memilih.\n\nBuka link berikut "+
+		"untuk mengaktifkannya (berlaku sampai %s):\n%s\n\nAbaikan email ini bila Anda tidak memintanya, dan hubungi "+
+		"panitia bila surat undangan Anda hilang.\n",
+		baseURL, expires.In(a.voteEnd.Location()).Format("2006-01-02 15:04"), link)
+	err = enqueueMessage(ctx, tx, outboxMessage{
+		Channel:   ChannelEmail,
+		Recipient: c.Email,
+		Subject:   "Aktivasi kode pemilihan",
+		Body:      body,
+		Source:    "voter.activation",
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// activateCode activates code unless it expired first, which is
+// errInvalidActivation; activating it again does nothing. actor is the admin
+// activating it at the desk, empty for the member's own link.
+func (a *App) activateCode(ctx context.Context, code, actor string) error {
+	tag, err := a.db.Exec(ctx, `
+		UPDATE voters SET activated_at = NOW()
+		WHERE code = $1 AND activated_at IS NULL AND issued_at + $2 * INTERVAL '1 second' > NOW()`,
+		code, int(a.codeTTL/time.Second))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		c, err := a.codeActivation(ctx, code)
+		if err != nil {
+			return err
+		}
+		if c == nil || !c.Activated {
+			return errInvalidActivation
+		}
+		return nil
+	}
+	a.codeChanged(ctx, code)
+	if actor == "" {
+		a.audit(ctx, "system", "voter.activate", code, map[string]string{"via": "email"})
+	} else {
+		a.audit(ctx, actor, "voter.activate", code, map[string]string{"via": "desk"})
+	}
+	return nil
+}
+
+// adminActivateHandler: POST /admin/activate activates a code at the desk,
+// for a member who can't get the email. Superadmin only.
+func (a *App) adminActivateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code := strings.TrimSpace(r.FormValue("code"))
+	err := a.activateCode(r.Context(), code, actorName(r))
+	if errors.Is(err, errInvalidActivation) {
+		http.Error(w, "kode tidak ditemukan atau sudah kedaluwarsa", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error activating code: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	a.electionRedirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every page view of a voter link looks up its code. Voter rows only change
+// when the code votes (apart from roll edits by admins), so lookups are kept
+// in memory in front of Redis and the database, for codeCacheTTL like the
+// shared entries. A vote through this server drops its code right away. A
+// roll edit anywhere (a name changed, a voter erased or removed, a ballot
+// reset) NOTIFYs codes_changed with "<org>:<voter id>", or "<org>:*" for a
+// large batch, and every instance drops those voters (over the results
+// LISTEN connection, see results_cache.go). Votes don't notify: the server
+// casting one drops the code itself and a used code stays used. Nothing is
+// kept while that connection is down. With REDIS_URL set only codes that
+// already voted are kept in memory; the rest are shared through Redis, which
+// every instance updates when a code changes. Revoked codes are checked
+// before the lookup, see revoked.go.
+
+const (
+	codesChannel = "codes_changed"
+
+	// codeCacheMax bounds the entries kept; past it expired ones are swept,
+	// and everything is dropped if that isn't enough
+	codeCacheMax = 200000
+)
+
+type codeCache struct {
+	mu        sync.Mutex
+	listening bool
+	gen       uint64 // bumped on every drop, see set
+	entries   map[string]cachedCode
+	codes     map[int]string // code of each cached voter id
+}
+
+type cachedCode struct {
+	entry   codeEntry
+	expires time.Time
+}
+
+// get returns the entry of code, if any, and the generation to set a
+// freshly loaded one under
+func (c *codeCache) get(code string) (codeEntry, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[code]
+	if !ok || time.Now().After(e.expires) {
+		return codeEntry{}, c.gen, false
+	}
+	return e.entry, c.gen, true
+}
+
+// set keeps e unless something was dropped since gen, when e may already be
+// stale, or nobody listens for codes_changed
+func (c *codeCache) set(code string, e codeEntry, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.listening || gen != c.gen {
+		return
+	}
+	now := time.Now()
+	if len(c.entries) >= codeCacheMax {
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+				delete(c.codes, v.entry.ID)
+			}
+		}
+		if len(c.entries) >= codeCacheMax {
+			c.entries, c.codes = nil, nil
+		}
+	}
+	if c.entries == nil {
+		c.entries, c.codes = map[string]cachedCode{}, map[int]string{}
+	}
+	c.entries[code] = cachedCode{entry: e, expires: now.Add(codeCacheTTL)}
+	c.codes[e.ID] = code
+}
+
+func (c *codeCache) drop(code string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if e, ok := c.entries[code]; ok {
+		delete(c.codes, e.entry.ID)
+		delete(c.entries, code)
+	}
+}
+
+// changed drops what a codes_changed payload names, if it is of org
+func (c *codeCache) changed(org, payload string) {
+	of, voter, ok := strings.Cut(payload, ":")
+	if !ok || of != org {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if voter == "*" {
+		c.entries, c.codes = nil, nil
+		return
+	}
+	id, err := strconv.Atoi(voter)
+	if err != nil {
+		return
+	}
+	if code, ok := c.codes[id]; ok {
+		delete(c.entries, code)
+		delete(c.codes, id)
+	}
+}
+
+// setListening drops everything: what changed while nobody listened is
+// unknown
+func (c *codeCache) setListening(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listening = on
+	c.gen++
+	c.entries, c.codes = nil, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// API list endpoints page with opaque cursors: each page carries a
+// next_cursor naming its last row, and the next request continues after
+// that row (keyset pagination) instead of scanning past an OFFSET. Rows
+// added or removed meanwhile don't shift the pages.
+
+var errBadCursor = errors.New("invalid cursor")
+
+// encodeCursor turns a page position into an opaque token
+func encodeCursor(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reads the ?cursor= of r into v; it reports false when there
+// is none
+func decodeCursor(r *http.Request, v interface{}) (bool, error) {
+	s := r.URL.Query().Get("cursor")
+	if s == "" {
+		return false, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return false, errBadCursor
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, errBadCursor
+	}
+	return true, nil
+}
+
+// idCursor is the position in a list ordered by id
+type idCursor struct {
+	ID int64 `json:"id"`
+}
+
+// voterCursor is the position in the roll: the sort value and id of the
+// last voter of a page. Sort and direction are included so a cursor isn't
+// used with a different ordering.
+type voterCursor struct {
+	Sort  string  `json:"s,omitempty"`
+	Desc  bool    `json:"d,omitempty"`
+	Value *string `json:"v"` // sort column as text; nil for NULL
+	ID    int     `json:"id"`
+}
+
+// sortColumn is the column orderBy sorts on and its direction
+func (f VoterFilter) sortColumn() (col string, desc bool) {
+	if col, ok := voterSortColumns[f.Sort]; ok {
+		return col, f.Desc
+	}
+	return "v.used_at", false
+}
+
+// after builds the keyset condition for the rows following c in the order
+// of f.orderBy (sort column NULLS LAST, then v.id), numbering its
+// parameters after the n already in use
+func (c voterCursor) after(f VoterFilter, n int) (string, []interface{}) {
+	col, desc := f.sortColumn()
+	if c.Value == nil {
+		return fmt.Sprintf("(%s IS NULL AND v.id > $%d)", col, n+1), []interface{}{c.ID}
+	}
+	cast := "text"
+	if col == "v.used_at" {
+		cast = "timestamptz"
+	}
+	op := ">"
+	if desc {
+		op = "<"
+	}
+	cond := fmt.Sprintf("(%[1]s %[2]s $%[3]d::%[4]s OR (%[1]s = $%[3]d::%[4]s AND v.id > $%[5]d) OR %[1]s IS NULL)",
+		col, op, n+1, cast, n+2)
+	return cond, []interface{}{*c.Value, c.ID}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// With DEV=1 the templates and static files are served from the working
+// tree instead of the binary: runDevReload polls templates/ and static/,
+// parses the templates again when a file changes and tells the browsers on
+// /dev/reload (server-sent events), which the pages listen to through the
+// devReload script in brand-style, so they refresh themselves. A template
+// that doesn't parse keeps the last good set and logs the error. None of it
+// exists outside dev mode: the endpoint isn't routed and the script renders
+// empty.
+
+const (
+	// devPollInterval is how often the dev watcher looks for changes
+	devPollInterval = 500 * time.Millisecond
+
+	// devKeepAlive is how often an idle reload stream gets a comment, so
+	// proxies and browsers keep it open
+	devKeepAlive = 30 * time.Second
+)
+
+// devWatchDirs are the directories the dev watcher polls
+var devWatchDirs = []string{"templates", "static"}
+
+// templateSet is the parsed templates, swapped whole when dev mode reparses
+// them
+type templateSet struct {
+	mu   sync.RWMutex
+	tmpl *template.Template
+}
+
+// ExecuteTemplate executes the template name of the current set
+func (s *templateSet) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	s.mu.RLock()
+	t := s.tmpl
+	s.mu.RUnlock()
+	return t.ExecuteTemplate(w, name, data)
+}
+
+func (s *templateSet) set(t *template.Template) {
+	s.mu.Lock()
+	s.tmpl = t
+	s.mu.Unlock()
+}
+
+// devReloader fans a change out to the browsers on /dev/reload
+type devReloader struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+func (d *devReloader) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	d.mu.Lock()
+	if d.clients == nil {
+		d.clients = map[chan struct{}]bool{}
+	}
+	d.clients[ch] = true
+	d.mu.Unlock()
+	return ch
+}
+
+func (d *devReloader) unsubscribe(ch chan struct{}) {
+	d.mu.Lock()
+	delete(d.clients, ch)
+	d.mu.Unlock()
+}
+
+// notify tells every browser to reload; one already told isn't told twice
+func (d *devReloader) notify() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch := range d.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// devReloadScript is the template func that puts the reload listener on
+// every page in dev mode, and nothing otherwise
+func (a *App) devReloadScript() template.HTML {
+	if a.reload == nil {
+		return ""
+	}
+	return template.HTML(fmt.Sprintf(`<script>
+(function () {
+  var es = new EventSource(%q);
+  es.addEventListener("reload", function () { location.reload(); });
+})();
+</script>`, a.election.Path("/dev/reload")))
+}
+
+// devStamp sums up the files under dirs: a change to any of them, a new one
+// or a removed one changes it
+func devStamp(dirs []string) (string, error) {
+	var n int
+	var latest time.Time
+	var size int64
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			n++
+			size += info.Size()
+			if info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d/%d/%d", n, size, latest.UnixNano()), nil
+}
+
+// runDevReload polls the working tree until ctx ends, reparsing the
+// templates and reloading the browsers on every change
+func (a *App) runDevReload(ctx context.Context) {
+	last, err := devStamp(devWatchDirs)
+	if err != nil {
+		logHTTP.Errorf("error watching templates: %v", err)
+	}
+	ticker := time.NewTicker(devPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stamp, err := devStamp(devWatchDirs)
+		if err != nil {
+			logHTTP.Errorf("error watching templates: %v", err)
+			continue
+		}
+		if stamp == last {
+			continue
+		}
+		last = stamp
+		t, err := parseTemplates(true, a)
+		if err != nil {
+			// keep the last good set; the next save tries again
+			logHTTP.Errorf("error reloading templates: %v", err)
+			continue
+		}
+		a.tmpl.set(t)
+		logHTTP.Debugf("templates reloaded")
+		a.reload.notify()
+	}
+}
+
+// devReloadHandler: GET /dev/reload streams a reload event whenever the
+// templates or static files change. Dev mode only.
+func (a *App) devReloadHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := a.reload.subscribe()
+	defer a.reload.unsubscribe(ch)
+	keepAlive := time.NewTicker(devKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// devStaticHandler serves static/ from the working tree, uncached, so an
+// edited stylesheet shows on the next reload
+func devStaticHandler() http.Handler {
+	files := http.FileServer(http.Dir("."))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// checkDevTree fails unless the working directory has what dev mode serves
+func checkDevTree() error {
+	for _, dir := range devWatchDirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("DEV=1 serves %s/ from the working directory, which has none: run from the repository root", dir)
+		}
+	}
+	return nil
+}
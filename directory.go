@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With DIRECTORY_SOURCE set, the roll follows a group in the organization's
+// directory: Google Workspace (Admin SDK, through a service account with
+// domain-wide delegation), Microsoft Entra ID / Azure AD (Microsoft Graph,
+// client credentials) or any SCIM 2.0 server. Every DIRECTORY_SYNC_INTERVAL
+// the members of DIRECTORY_GROUP (nested groups included) are upserted by
+// phone like rows of PUT /api/v1/elections/current/voters, so new members
+// get a code, and the synced voters who left the group lose theirs, unless
+// they already voted. Voters added by hand stay untouched until a member with
+// their phone shows up, from then on the directory owns them.
+//
+// Members without a name or a phone are skipped. A run that can't read the
+// whole group changes nothing, and neither does a group that comes back
+// empty. Syncing stops once the roll is committed (roll.go): after that the
+// roll must not change.
+
+const (
+	directoryDefaultInterval = time.Hour
+	directoryMinInterval     = 5 * time.Minute
+
+	// directoryMaxMembers bounds what a run reads, against a source that keeps
+	// paging
+	directoryMaxMembers = 200000
+)
+
+// directoryMember is a member of the group, as the roll needs it
+type directoryMember struct {
+	ID    string
+	Name  string
+	Phone string
+	Group string // wilayah: org unit or department
+}
+
+// directorySource lists the members of the configured group
+type directorySource interface {
+	name() string
+	members(ctx context.Context) ([]directoryMember, error)
+}
+
+// directorySync is the sync configured through DIRECTORY_*
+type directorySync struct {
+	source   directorySource
+	interval time.Duration
+}
+
+// DirectorySyncReport is the outcome of one run, audited as voter.sync
+type DirectorySyncReport struct {
+	Source    string `json:"source"`
+	Members   int    `json:"members"`
+	Created   int    `json:"created"`
+	Updated   int    `json:"updated"`
+	Unchanged int    `json:"unchanged"`
+	Removed   int    `json:"removed"`
+	Skipped   int    `json:"skipped"` // no name or phone, or a phone seen before
+	Failed    int    `json:"failed"`
+}
+
+var errRollFrozen = errors.New("the roll is committed, directory sync stopped")
+
+// loadDirectorySync reads the sync from the env; nil without DIRECTORY_SOURCE
+func loadDirectorySync() (*directorySync, error) {
+	kind := os.Getenv("DIRECTORY_SOURCE")
+	if kind == "" {
+		return nil, nil
+	}
+	d := &directorySync{interval: directoryDefaultInterval}
+	if v := os.Getenv("DIRECTORY_SYNC_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval < directoryMinInterval {
+			return nil, fmt.Errorf("invalid DIRECTORY_SYNC_INTERVAL %q: a duration of at least %s", v, directoryMinInterval)
+		}
+		d.interval = interval
+	}
+	group := os.Getenv("DIRECTORY_GROUP")
+	client := &http.Client{Timeout: 30 * time.Second}
+	var err error
+	switch kind {
+	case "google":
+		d.source, err = loadGoogleDirectory(group, client)
+	case "azure":
+		d.source, err = loadAzureDirectory(group, client)
+	case "scim":
+		d.source, err = loadSCIMDirectory(group, client)
+	default:
+		err = fmt.Errorf("invalid DIRECTORY_SOURCE %q: google, azure or scim", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// syncDirectory brings the roll in line with the directory group. It returns
+// a nil report when another instance is syncing.
+func (a *App) syncDirectory(ctx context.Context) (*DirectorySyncReport, error) {
+	frozen, err := a.rollFrozen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if frozen {
+		return nil, errRollFrozen
+	}
+
+	// one run per organization at a time, whatever the number of instances
+	conn, err := a.db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtext('directory_sync'), current_org())`).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, nil
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock(hashtext('directory_sync'), current_org())`)
+
+	source := a.directory.source
+	members, err := source.members(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s directory: %w", source.name(), err)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("%s directory group has no members, roll left as is", source.name())
+	}
+
+	report := &DirectorySyncReport{Source: source.name(), Members: len(members)}
+	phones := make(map[string]bool, len(members))
+	for _, m := range members {
+		in := APIVoterInput{
+			Name:  strings.TrimSpace(m.Name),
+			Phone: localPhone(m.Phone),
+			Group: strings.TrimSpace(m.Group),
+		}
+		if in.Name == "" || in.Phone == "" || phones[in.Phone] {
+			report.Skipped++
+			continue
+		}
+		phones[in.Phone] = true
+		code, status, err := a.upsertVoter(ctx, in)
+		if errors.Is(err, errVoterExists) || errors.Is(err, errCodeTaken) || errors.Is(err, errPhoneAfterVote) || errors.Is(err, errVoterQuota) ||
+			errors.Is(err, errIneligible) {
+			logJobs.Errorf("error syncing directory member %s: %v", m.ID, err)
+			report.Failed++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := a.db.Exec(ctx, `UPDATE voters SET synced_from = $2 WHERE code = $1 AND synced_from IS DISTINCT FROM $2`, code, source.name()); err != nil {
+			return nil, err
+		}
+		switch status {
+		case bulkCreated:
+			report.Created++
+		case bulkUpdated:
+			report.Updated++
+		default:
+			report.Unchanged++
+		}
+	}
+
+	// synced voters who left the group and haven't voted lose their code
+	departed, err := a.departedVoters(ctx, phones)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range departed {
+		tag, err := a.db.Exec(ctx, `DELETE FROM voters WHERE code = $1 AND used = FALSE AND synced_from IS NOT NULL`, code)
+		if err != nil {
+			return nil, err
+		}
+		if tag.RowsAffected() > 0 {
+			a.codeChanged(ctx, code)
+			report.Removed++
+		}
+	}
+	return report, nil
+}
+
+// rollFrozen reports whether the roll of the current election can no longer
+// change: voting opened or the roll was committed early
+func (a *App) rollFrozen(ctx context.Context) (bool, error) {
+	if !time.Now().Before(a.voteStart) {
+		return true, nil
+	}
+	c, err := loadRollCommitment(ctx, a.db, a.voteStart)
+	return c != nil, err
+}
+
+// departedVoters returns the codes of synced voters who haven't voted and
+// whose phone isn't among phones
+func (a *App) departedVoters(ctx context.Context, phones map[string]bool) ([]string, error) {
+	rows, err := a.db.Query(ctx, `SELECT code, phone FROM voters WHERE synced_from IS NOT NULL AND used = FALSE`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var codes []string
+	for rows.Next() {
+		var code, phone string
+		if err := rows.Scan(&code, &phone); err != nil {
+			return nil, err
+		}
+		// compared in the clear: phones sealed under an older PII key differ
+		if err := a.pii.openAll(&phone); err != nil {
+			return nil, err
+		}
+		if !phones[phone] {
+			codes = append(codes, code)
+		}
+	}
+	return codes, rows.Err()
+}
+
+// localPhone writes a directory phone number the way the roll does: digits
+// only, Indonesian numbers starting with 0 instead of +62
+func localPhone(s string) string {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(s) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		}
+	}
+	p := b.String()
+	switch {
+	case strings.HasPrefix(p, "+62"):
+		p = "0" + p[3:]
+	case strings.HasPrefix(p, "62") && len(p) >= 10:
+		p = "0" + p[2:]
+	}
+	if len(strings.TrimPrefix(p, "+")) < 6 {
+		return ""
+	}
+	return p
+}
+
+// directoryPhone is a phone number of a Google Workspace or SCIM user
+type directoryPhone struct {
+	Value   string `json:"value"`
+	Type    string `json:"type"`
+	Primary bool   `json:"primary"`
+}
+
+// pickPhone prefers the mobile number, then the primary one, then the first
+func pickPhone(phones []directoryPhone) string {
+	for _, p := range phones {
+		if p.Type == "mobile" {
+			return p.Value
+		}
+	}
+	for _, p := range phones {
+		if p.Primary {
+			return p.Value
+		}
+	}
+	if len(phones) > 0 {
+		return phones[0].Value
+	}
+	return ""
+}
+
+// directoryGet decodes the JSON document at u, fetched with the bearer token
+func directoryGet(ctx context.Context, client *http.Client, u, token string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("GET %s: %s %s", u, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(v)
+}
+
+// directoryToken posts an OAuth 2.0 token request and returns the access token
+func directoryToken(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tok.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s %s", resp.Status, tok.Error, tok.ErrorDescription)
+	}
+	return tok.AccessToken, nil
+}
+
+// Google Workspace: the group's members come from the Admin SDK, which only
+// gives their ids, so the domain's users are listed and matched to them
+
+const (
+	googleDirectoryAPI = "https://admin.googleapis.com/admin/directory/v1"
+	googleScopes       = "https://www.googleapis.com/auth/admin.directory.group.member.readonly https://www.googleapis.com/auth/admin.directory.user.readonly"
+)
+
+type googleDirectory struct {
+	group    string // group email or id
+	subject  string // the admin the service account acts as
+	email    string // the service account
+	key      *rsa.PrivateKey
+	tokenURI string
+	api      string
+	client   *http.Client
+}
+
+func loadGoogleDirectory(group string, client *http.Client) (*googleDirectory, error) {
+	file, subject := os.Getenv("GOOGLE_SERVICE_ACCOUNT_FILE"), os.Getenv("GOOGLE_ADMIN_EMAIL")
+	if group == "" || file == "" || subject == "" {
+		return nil, errors.New("DIRECTORY_SOURCE=google needs DIRECTORY_GROUP, GOOGLE_SERVICE_ACCOUNT_FILE and GOOGLE_ADMIN_EMAIL")
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading GOOGLE_SERVICE_ACCOUNT_FILE: %w", err)
+	}
+	var sa struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(raw, &sa); err != nil {
+		return nil, fmt.Errorf("invalid GOOGLE_SERVICE_ACCOUNT_FILE: %w", err)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil || sa.ClientEmail == "" {
+		return nil, errors.New("invalid GOOGLE_SERVICE_ACCOUNT_FILE: not a service account key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GOOGLE_SERVICE_ACCOUNT_FILE: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid GOOGLE_SERVICE_ACCOUNT_FILE: not an RSA key")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &googleDirectory{
+		group:    group,
+		subject:  subject,
+		email:    sa.ClientEmail,
+		key:      key,
+		tokenURI: sa.TokenURI,
+		api:      googleDirectoryAPI,
+		client:   client,
+	}, nil
+}
+
+func (g *googleDirectory) name() string { return "google" }
+
+// token signs the service account's assertion for the admin and trades it
+// for an access token
+func (g *googleDirectory) token(ctx context.Context) (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   g.email,
+		"sub":   g.subject,
+		"scope": googleScopes,
+		"aud":   g.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, g.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return directoryToken(ctx, g.client, g.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	})
+}
+
+func (g *googleDirectory) members(ctx context.Context) ([]directoryMember, error) {
+	token, err := g.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[string]bool{}
+	for page := ""; ; {
+		var res struct {
+			Members []struct {
+				ID     string `json:"id"`
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"members"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		q := url.Values{"includeDerivedMembership": {"true"}, "maxResults": {"200"}, "pageToken": {page}}
+		if err := directoryGet(ctx, g.client, g.api+"/groups/"+url.PathEscape(g.group)+"/members?"+q.Encode(), token, &res); err != nil {
+			return nil, err
+		}
+		for _, m := range res.Members {
+			if m.Type == "USER" && m.Status != "SUSPENDED" {
+				ids[m.ID] = true
+			}
+		}
+		if page = res.NextPageToken; page == "" {
+			break
+		}
+		if len(ids) > directoryMaxMembers {
+			return nil, fmt.Errorf("more than %d members", directoryMaxMembers)
+		}
+	}
+
+	var members []directoryMember
+	for page, seen := "", 0; len(ids) > 0; {
+		var res struct {
+			Users []struct {
+				ID   string `json:"id"`
+				Name struct {
+					FullName string `json:"fullName"`
+				} `json:"name"`
+				Phones      []directoryPhone `json:"phones"`
+				Suspended   bool             `json:"suspended"`
+				OrgUnitPath string           `json:"orgUnitPath"`
+			} `json:"users"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		q := url.Values{"customer": {"my_customer"}, "maxResults": {"500"}, "projection": {"basic"}, "pageToken": {page}}
+		if err := directoryGet(ctx, g.client, g.api+"/users?"+q.Encode(), token, &res); err != nil {
+			return nil, err
+		}
+		for _, u := range res.Users {
+			if !ids[u.ID] || u.Suspended {
+				continue
+			}
+			members = append(members, directoryMember{
+				ID:    u.ID,
+				Name:  u.Name.FullName,
+				Phone: pickPhone(u.Phones),
+				Group: strings.TrimPrefix(u.OrgUnitPath, "/"),
+			})
+		}
+		if seen += len(res.Users); seen > directoryMaxMembers*5 {
+			return nil, fmt.Errorf("more than %d users", directoryMaxMembers*5)
+		}
+		if page = res.NextPageToken; page == "" {
+			break
+		}
+	}
+	return members, nil
+}
+
+// Microsoft Entra ID / Azure AD: the group's transitive members through
+// Microsoft Graph, with an app registration holding GroupMember.Read.All and
+// User.Read.All application permissions
+
+const (
+	azureLogin = "https://login.microsoftonline.com"
+	azureGraph = "https://graph.microsoft.com/v1.0"
+)
+
+type azureDirectory struct {
+	group        string // group object id
+	tenant       string
+	clientID     string
+	clientSecret string
+	login        string
+	graph        string
+	client       *http.Client
+}
+
+func loadAzureDirectory(group string, client *http.Client) (*azureDirectory, error) {
+	d := &azureDirectory{
+		group:        group,
+		tenant:       os.Getenv("AZURE_TENANT_ID"),
+		clientID:     os.Getenv("AZURE_CLIENT_ID"),
+		clientSecret: os.Getenv("AZURE_CLIENT_SECRET"),
+		login:        azureLogin,
+		graph:        azureGraph,
+		client:       client,
+	}
+	if d.group == "" || d.tenant == "" || d.clientID == "" || d.clientSecret == "" {
+		return nil, errors.New("DIRECTORY_SOURCE=azure needs DIRECTORY_GROUP, AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET")
+	}
+	return d, nil
+}
+
+func (d *azureDirectory) name() string { return "azure" }
+
+func (d *azureDirectory) members(ctx context.Context) ([]directoryMember, error) {
+	token, err := directoryToken(ctx, d.client, d.login+"/"+url.PathEscape(d.tenant)+"/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {d.clientID},
+		"client_secret": {d.clientSecret},
+		"scope":         {"https://graph.microsoft.com/.default"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var members []directoryMember
+	next := d.graph + "/groups/" + url.PathEscape(d.group) + "/transitiveMembers?" + url.Values{
+		"$select": {"id,displayName,mobilePhone,businessPhones,department,accountEnabled"},
+		"$top":    {"999"},
+	}.Encode()
+	for next != "" {
+		var res struct {
+			Value []struct {
+				Type           string   `json:"@odata.type"`
+				ID             string   `json:"id"`
+				DisplayName    string   `json:"displayName"`
+				MobilePhone    string   `json:"mobilePhone"`
+				BusinessPhones []string `json:"businessPhones"`
+				Department     string   `json:"department"`
+				AccountEnabled *bool    `json:"accountEnabled"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := directoryGet(ctx, d.client, next, token, &res); err != nil {
+			return nil, err
+		}
+		for _, u := range res.Value {
+			if u.Type != "#microsoft.graph.user" || (u.AccountEnabled != nil && !*u.AccountEnabled) {
+				continue
+			}
+			m := directoryMember{ID: u.ID, Name: u.DisplayName, Phone: u.MobilePhone, Group: u.Department}
+			if m.Phone == "" && len(u.BusinessPhones) > 0 {
+				m.Phone = u.BusinessPhones[0]
+			}
+			members = append(members, m)
+		}
+		if len(members) > directoryMaxMembers {
+			return nil, fmt.Errorf("more than %d members", directoryMaxMembers)
+		}
+		// only follow links back to Graph, the token goes with them
+		if next = res.NextLink; next != "" && !strings.HasPrefix(next, d.graph+"/") {
+			return nil, fmt.Errorf("unexpected next page %s", next)
+		}
+	}
+	return members, nil
+}
+
+// SCIM 2.0 (RFC 7644): the active users of the server, or only the members
+// of DIRECTORY_GROUP when set, nested groups included
+
+type scimDirectory struct {
+	base   string
+	token  string
+	group  string // group id, optional
+	client *http.Client
+}
+
+func loadSCIMDirectory(group string, client *http.Client) (*scimDirectory, error) {
+	base := strings.TrimSuffix(os.Getenv("SCIM_URL"), "/")
+	token := os.Getenv("SCIM_TOKEN")
+	if base == "" || token == "" {
+		return nil, errors.New("DIRECTORY_SOURCE=scim needs SCIM_URL and SCIM_TOKEN")
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid SCIM_URL %q: an https URL", base)
+	}
+	return &scimDirectory{base: base, token: token, group: group, client: client}, nil
+}
+
+func (s *scimDirectory) name() string { return "scim" }
+
+// groupUsers returns the ids of the users in the group and its subgroups
+func (s *scimDirectory) groupUsers(ctx context.Context) (map[string]bool, error) {
+	users := map[string]bool{}
+	seen := map[string]bool{s.group: true}
+	queue := []string{s.group}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		var g struct {
+			Members []struct {
+				Value string `json:"value"`
+				Type  string `json:"type"`
+				Ref   string `json:"$ref"`
+			} `json:"members"`
+		}
+		if err := directoryGet(ctx, s.client, s.base+"/Groups/"+url.PathEscape(id)+"?attributes=members", s.token, &g); err != nil {
+			return nil, err
+		}
+		for _, m := range g.Members {
+			isGroup := m.Type == "Group" || strings.Contains(m.Ref, "/Groups/")
+			switch {
+			case isGroup && !seen[m.Value]:
+				seen[m.Value] = true
+				queue = append(queue, m.Value)
+			case !isGroup:
+				users[m.Value] = true
+			}
+		}
+		if len(users) > directoryMaxMembers {
+			return nil, fmt.Errorf("more than %d members", directoryMaxMembers)
+		}
+	}
+	return users, nil
+}
+
+func (s *scimDirectory) members(ctx context.Context) ([]directoryMember, error) {
+	var in map[string]bool
+	if s.group != "" {
+		var err error
+		if in, err = s.groupUsers(ctx); err != nil {
+			return nil, err
+		}
+		if len(in) == 0 {
+			return nil, nil
+		}
+	}
+
+	var members []directoryMember
+	const count = 100
+	for start := 1; ; start += count {
+		var res struct {
+			TotalResults int `json:"totalResults"`
+			Resources    []struct {
+				ID          string `json:"id"`
+				DisplayName string `json:"displayName"`
+				Name        struct {
+					Formatted  string `json:"formatted"`
+					GivenName  string `json:"givenName"`
+					FamilyName string `json:"familyName"`
+				} `json:"name"`
+				PhoneNumbers []directoryPhone `json:"phoneNumbers"`
+				Active       *bool            `json:"active"`
+				Enterprise   struct {
+					Department string `json:"department"`
+				} `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"`
+			} `json:"Resources"`
+		}
+		u := s.base + "/Users?startIndex=" + strconv.Itoa(start) + "&count=" + strconv.Itoa(count)
+		if err := directoryGet(ctx, s.client, u, s.token, &res); err != nil {
+			return nil, err
+		}
+		for _, r := range res.Resources {
+			if (in != nil && !in[r.ID]) || (r.Active != nil && !*r.Active) {
+				continue
+			}
+			m := directoryMember{ID: r.ID, Name: r.DisplayName, Phone: pickPhone(r.PhoneNumbers), Group: r.Enterprise.Department}
+			if m.Name == "" {
+				m.Name = r.Name.Formatted
+			}
+			if m.Name == "" {
+				m.Name = strings.TrimSpace(r.Name.GivenName + " " + r.Name.FamilyName)
+			}
+			members = append(members, m)
+		}
+		if len(res.Resources) == 0 || start+len(res.Resources) > res.TotalResults {
+			break
+		}
+		if start > directoryMaxMembers*5 {
+			return nil, fmt.Errorf("more than %d users", directoryMaxMembers*5)
+		}
+	}
+	return members, nil
+}
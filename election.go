@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Several elections (one per organization, see org.go) can share a domain:
+// the proxy in front sends /e/<slug>/... or <slug>.<ELECTION_DOMAIN> to the
+// process serving that election. ELECTION_SLUG names this process's
+// election. withElection resolves the slug of every request, strips the
+// path prefix so the routes stay as they are, and puts the Election on the
+// request context. Requests without a slug (old links, printed cards, the
+// bare domain) belong to this election too; the slug of another election is
+// a 404. Without ELECTION_SLUG nothing changes.
+
+const electionKey ctxKey = accountKey + 3
+
+// electionPathPrefix starts the path of every page of an election reached
+// by path
+const electionPathPrefix = "/e/"
+
+var electionSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Election is the election a request is for
+type Election struct {
+	Slug      string // empty without ELECTION_SLUG
+	Domain    string // ELECTION_DOMAIN; subdomain routing when set
+	Base      string // path prefix of this election's links, e.g. /e/rapat-anggota-2025
+	VoteStart time.Time
+	VoteEnd   time.Time
+}
+
+// loadElection reads the routing of the election served from the env
+func loadElection(voteStart, voteEnd time.Time) (*Election, error) {
+	e := &Election{
+		Slug:      os.Getenv("ELECTION_SLUG"),
+		Domain:    strings.ToLower(strings.Trim(os.Getenv("ELECTION_DOMAIN"), ".")),
+		VoteStart: voteStart,
+		VoteEnd:   voteEnd,
+	}
+	if e.Slug == "" {
+		if e.Domain != "" {
+			return nil, fmt.Errorf("ELECTION_DOMAIN needs ELECTION_SLUG")
+		}
+		return e, nil
+	}
+	if !electionSlugPattern.MatchString(e.Slug) {
+		return nil, fmt.Errorf("invalid ELECTION_SLUG %q: use lowercase letters, digits and dashes", e.Slug)
+	}
+	if e.Domain == "" {
+		// the subdomain keeps the paths; otherwise links carry the prefix
+		e.Base = electionPathPrefix + e.Slug
+	}
+	return e, nil
+}
+
+// Path returns the address of p (an absolute path) within the election
+func (e *Election) Path(p string) string {
+	return e.Base + p
+}
+
+// electionFrom returns the election withElection resolved
+func electionFrom(ctx context.Context) (*Election, bool) {
+	e, ok := ctx.Value(electionKey).(*Election)
+	return e, ok
+}
+
+// electionOf returns the election of r, this process's when r didn't pass
+// withElection
+func (a *App) electionOf(r *http.Request) *Election {
+	if e, ok := electionFrom(r.Context()); ok {
+		return e
+	}
+	return a.election
+}
+
+// requestSlug returns the election slug r names, if any, and r's path
+// without the slug's prefix
+func (e *Election) requestSlug(r *http.Request) (slug, path string) {
+	path = r.URL.Path
+	if rest, ok := strings.CutPrefix(path, electionPathPrefix); ok {
+		slug, path, _ = strings.Cut(rest, "/")
+		return slug, "/" + path
+	}
+	if e.Domain != "" {
+		host := strings.ToLower(r.Host)
+		if h, _, ok := strings.Cut(host, ":"); ok {
+			host = h
+		}
+		if label, ok := strings.CutSuffix(host, "."+e.Domain); ok && !strings.Contains(label, ".") {
+			return label, path
+		}
+	}
+	return "", path
+}
+
+// withElection resolves the election of each request
+func (a *App) withElection(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slug, path := a.election.requestSlug(r)
+		if slug != "" && slug != a.election.Slug {
+			a.writeError(w, r, http.StatusNotFound, "Pemilihan tidak ditemukan.")
+			return
+		}
+		if path != r.URL.Path {
+			u := *r.URL
+			u.Path, u.RawPath = path, ""
+			r2 := r.Clone(r.Context())
+			r2.URL = &u
+			r = r2
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), electionKey, a.election)))
+	})
+}
+
+// electionRedirect redirects to p within the election of r
+func (a *App) electionRedirect(w http.ResponseWriter, r *http.Request, p string, code int) {
+	http.Redirect(w, r, a.electionOf(r).Path(p), code)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+
+	"pemilihan.gkjp.id/eligibility"
+)
+
+// Members can carry attributes besides name and group: membership status,
+// dues paid, join date, whatever the organization keeps. They are imported
+// through the voter API (APIVoterInput.Attributes) into
+// vote_master.attributes. ELIGIBILITY_RULE (see package eligibility) decides
+// from them who of the roll may vote in this election: a code isn't issued
+// to a member who fails it, and a ballot isn't accepted from one, so a
+// member whose status changes after the import is still stopped at the
+// ballot box.
+
+const (
+	maxAttributes      = 50
+	maxAttributeLength = 200
+)
+
+var errIneligible = errors.New("member doesn't meet the election's eligibility rule")
+
+// normalizeAttributes lowercases and trims the attribute names of in, which
+// the rule matches on, and checks their number and size. Nil stays nil.
+func normalizeAttributes(in map[string]string) (map[string]string, error) {
+	if in == nil {
+		return nil, nil
+	}
+	if len(in) > maxAttributes {
+		return nil, fmt.Errorf("at most %d attributes", maxAttributes)
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if !eligibility.ValidName(k) {
+			return nil, fmt.Errorf("invalid attribute name %q: use letters, digits and _", k)
+		}
+		v = strings.TrimSpace(v)
+		if len(k) > maxAttributeLength || len(v) > maxAttributeLength {
+			return nil, fmt.Errorf("attribute %q is longer than %d characters", k, maxAttributeLength)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// mergeAttributes applies the imported attributes in to the stored ones: a
+// value sets the attribute, an empty value removes it, and attributes not
+// named are kept
+func mergeAttributes(stored, in map[string]string) map[string]string {
+	merged := maps.Clone(stored)
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	for k, v := range in {
+		if v == "" {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// attributesJSON is attrs as a jsonb query parameter
+func attributesJSON(attrs map[string]string) string {
+	b, _ := json.Marshal(attrs)
+	return string(b)
+}
+
+// checkEligible returns errIneligible if the member record of the sealed
+// phone fails the eligibility rule
+func (a *App) checkEligible(ctx context.Context, q queryer, phone string) error {
+	if a.ballot.Eligibility == nil {
+		return nil
+	}
+	var attrs map[string]string
+	err := q.QueryRow(ctx, `SELECT attributes FROM vote_master WHERE phone = $1`, phone).Scan(&attrs)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if attrs, err = a.pii.openAttributes(attrs); err != nil {
+		return err
+	}
+	if !a.ballot.Eligibility.Eval(attrs) {
+		return errIneligible
+	}
+	return nil
+}
+
+// eligible reports whether the voter with code meets the eligibility rule.
+// An unknown code is left to the caller.
+func (a *App) eligible(ctx context.Context, code string) (bool, error) {
+	if a.ballot.Eligibility == nil {
+		return true, nil
+	}
+	var attrs map[string]string
+	err := a.db.QueryRow(ctx, `
+		SELECT COALESCE(vm.attributes, '{}')
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE v.code = $1`, code).Scan(&attrs)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if attrs, err = a.pii.openAttributes(attrs); err != nil {
+		return false, err
+	}
+	return a.ballot.Eligibility.Eval(attrs), nil
+}
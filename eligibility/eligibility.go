@@ -0,0 +1,421 @@
+// Package eligibility decides from a member's attributes whether they may
+// vote. A Rule is parsed from text such as
+//
+//	member_status = active AND dues_paid = yes AND joined before 2024-01-01
+//
+// and evaluated against the attributes imported with the member, so a rule
+// can be written and tested without a database or HTTP handler.
+//
+// A condition names an attribute, an operator and a value: = != < <= > >=,
+// before and after (dates, 2006-01-02), or in (a, b, c). "joined_before
+// 2024-01-01" is read as "joined before 2024-01-01". Conditions combine with
+// AND, OR, NOT and parentheses; AND binds tighter than OR. Names and
+// keywords are case-insensitive, and so are = != and in. Values with spaces
+// or operator characters are quoted with "". Two dates or two numbers
+// compare as such, anything else as text.
+//
+// A member without the attribute, or with a value that isn't a date where a
+// date is needed, fails the condition.
+package eligibility
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DateLayout is how dates are written in rules and attributes
+const DateLayout = "2006-01-02"
+
+// Rule is a parsed eligibility rule
+type Rule struct {
+	src  string
+	root node
+}
+
+// String is the rule as it was written
+func (r *Rule) String() string {
+	return r.src
+}
+
+// Eval reports whether a member with attrs meets the rule. Attribute names
+// must be lowercase.
+func (r *Rule) Eval(attrs map[string]string) bool {
+	return r.root.eval(attrs)
+}
+
+type node interface {
+	eval(attrs map[string]string) bool
+}
+
+type and []node
+
+func (n and) eval(attrs map[string]string) bool {
+	for _, c := range n {
+		if !c.eval(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+type or []node
+
+func (n or) eval(attrs map[string]string) bool {
+	for _, c := range n {
+		if c.eval(attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+type not struct{ node }
+
+func (n not) eval(attrs map[string]string) bool {
+	return !n.node.eval(attrs)
+}
+
+// cond is one comparison of an attribute
+type cond struct {
+	attr   string
+	op     string // = != < <= > >= before after in
+	values []string
+}
+
+func (c *cond) eval(attrs map[string]string) bool {
+	v, ok := attrs[c.attr]
+	if !ok {
+		return false
+	}
+	v = strings.TrimSpace(v)
+	switch c.op {
+	case "=":
+		return strings.EqualFold(v, c.values[0])
+	case "!=":
+		return !strings.EqualFold(v, c.values[0])
+	case "in":
+		for _, want := range c.values {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+		return false
+	case "before", "after":
+		d, err := time.Parse(DateLayout, v)
+		if err != nil {
+			return false
+		}
+		want, _ := time.Parse(DateLayout, c.values[0])
+		if c.op == "before" {
+			return d.Before(want)
+		}
+		return d.After(want)
+	}
+	cmp := compare(v, c.values[0])
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// compare orders a and b as dates, numbers or text, in that order of
+// preference
+func compare(a, b string) int {
+	if da, err := time.Parse(DateLayout, a); err == nil {
+		if db, err := time.Parse(DateLayout, b); err == nil {
+			return da.Compare(db)
+		}
+	}
+	if na, err := strconv.ParseFloat(a, 64); err == nil {
+		if nb, err := strconv.ParseFloat(b, 64); err == nil {
+			switch {
+			case na < nb:
+				return -1
+			case na > nb:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// Parse reads a rule. An empty rule is an error; no rule at all is a nil
+// *Rule, which the caller checks.
+func Parse(src string) (*Rule, error) {
+	src = strings.TrimSpace(src)
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	p := &parser{toks: toks}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %s", p.toks[p.pos])
+	}
+	return &Rule{src: src, root: root}, nil
+}
+
+// token is a word, a quoted value or one of ( ) , and the operators
+type token struct {
+	text   string
+	quoted bool
+}
+
+func (t token) String() string {
+	return strconv.Quote(t.text)
+}
+
+// is reports whether t is the unquoted keyword or symbol s
+func (t token) is(s string) bool {
+	return !t.quoted && strings.EqualFold(t.text, s)
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',' || r == '=':
+			toks = append(toks, token{text: string(r)})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			if i+1 < len(rs) && rs[i+1] == '=' {
+				toks = append(toks, token{text: string(rs[i : i+2])})
+				i += 2
+			} else if r == '!' {
+				return nil, fmt.Errorf("unexpected ! (use != or NOT)")
+			} else {
+				toks = append(toks, token{text: string(r)})
+				i++
+			}
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				j++
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			toks = append(toks, token{text: string(rs[i+1 : j]), quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune(`()!=<>,"`, rs[j]) {
+				j++
+			}
+			toks = append(toks, token{text: string(rs[i:j])})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos == len(p.toks) {
+		return token{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *parser) next() (token, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("rule ends too early")
+	}
+	p.pos++
+	return t, nil
+}
+
+// accept consumes the keyword or symbol s if it is next
+func (p *parser) accept(s string) bool {
+	if t, ok := p.peek(); ok && t.is(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (node, error) {
+	n, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	nodes := or{n}
+	for p.accept("or") {
+		if n, err = p.and(); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *parser) and() (node, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	nodes := and{n}
+	for p.accept("and") {
+		if n, err = p.unary(); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept("not") {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{n}, nil
+	}
+	if p.accept("(") {
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return n, nil
+	}
+	return p.cond()
+}
+
+var operators = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "before": true, "after": true, "in": true}
+
+// reserved can't name an attribute
+var reserved = map[string]bool{"and": true, "or": true, "not": true, "before": true, "after": true, "in": true}
+
+func (p *parser) cond() (node, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	attr := strings.ToLower(t.text)
+	if t.quoted || !validName(attr) {
+		return nil, fmt.Errorf("expected an attribute name, got %s", t)
+	}
+
+	c := &cond{attr: attr}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !op.quoted && operators[strings.ToLower(op.text)]:
+		c.op = strings.ToLower(op.text)
+	case strings.HasSuffix(attr, "_before") || strings.HasSuffix(attr, "_after"):
+		// joined_before 2024-01-01
+		i := strings.LastIndexByte(attr, '_')
+		c.attr, c.op = attr[:i], attr[i+1:]
+		p.pos--
+	default:
+		return nil, fmt.Errorf("expected an operator after %s, got %s", attr, op)
+	}
+
+	if c.op == "in" {
+		if c.values, err = p.list(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if c.op == "before" || c.op == "after" {
+		if _, err := time.Parse(DateLayout, v); err != nil {
+			return nil, fmt.Errorf("%s %s needs a date like 2024-01-01, got %q", c.attr, c.op, v)
+		}
+	}
+	c.values = []string{v}
+	return c, nil
+}
+
+// list reads (a, b, c)
+func (p *parser) list() ([]string, error) {
+	if !p.accept("(") {
+		return nil, fmt.Errorf("in needs a list like (a, b)")
+	}
+	var values []string
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if p.accept(")") {
+			return values, nil
+		}
+		if !p.accept(",") {
+			return nil, fmt.Errorf("expected , or ) in list")
+		}
+	}
+}
+
+func (p *parser) value() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if !t.quoted && (strings.ContainsAny(t.text, "(),=<>!") || t.is("and") || t.is("or")) {
+		return "", fmt.Errorf("expected a value, got %s", t)
+	}
+	return strings.TrimSpace(t.text), nil
+}
+
+// validName reports whether s can name an attribute: letters, digits, _ and
+// - and . not leading
+func validName(s string) bool {
+	if s == "" || reserved[s] {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidName reports whether s can name an attribute in a rule
+func ValidName(s string) bool {
+	return validName(strings.ToLower(s))
+}
@@ -0,0 +1,128 @@
+package eligibility
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, src := range []string{
+		"member_status = active",
+		"member_status = active AND dues_paid = yes AND joined before 2024-01-01",
+		"joined_before 2024-01-01",
+		"NOT (region in (utara, \"jakarta barat\") OR age < 17)",
+		"age >= 17 and age <= 70 or role != guest",
+		"since after 2020-12-31",
+		"note = \"a = b\"",
+	} {
+		r, err := Parse(src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", src, err)
+			continue
+		}
+		if r.String() != src {
+			t.Errorf("Parse(%q).String() = %q", src, r.String())
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"   ",
+		"member_status",
+		"member_status =",
+		"member_status active",
+		"= active",
+		"\"status\" = active",
+		"and = x",
+		"member_status = active AND",
+		"member_status = active OR OR age > 1",
+		"(member_status = active",
+		"member_status = active)",
+		"region in utara",
+		"region in (utara",
+		"region in (utara barat)",
+		"joined before 2024-13-01",
+		"joined before yesterday",
+		"age ! 17",
+		"note = \"open",
+		"age = (17)",
+		"1st = x",
+	} {
+		if r, err := Parse(src); err == nil {
+			t.Errorf("Parse(%q) = %q, want an error", src, r.String())
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	member := map[string]string{
+		"member_status": "Active",
+		"dues_paid":     "yes",
+		"joined":        "2019-05-01",
+		"age":           "9",
+		"region":        "Jakarta Barat",
+		"score":         "10",
+	}
+	for _, c := range []struct {
+		rule string
+		want bool
+	}{
+		{"member_status = active", true},
+		{"MEMBER_STATUS = ACTIVE", true},
+		{"member_status != active", false},
+		{"member_status = active AND dues_paid = yes AND joined before 2024-01-01", true},
+		{"joined_before 2019-05-01", false},
+		{"joined after 2019-04-30", true},
+		// numbers compare as numbers, not text
+		{"age < 17", true},
+		{"score > 9", true},
+		{"score >= 10 AND score <= 10", true},
+		// dates compare as dates
+		{"joined < 2020-01-01", true},
+		{"region in (utara, \"jakarta barat\")", true},
+		{"region in (utara, selatan)", false},
+		{"NOT region = utara", true},
+		{"member_status = lapsed OR dues_paid = yes", true},
+		// AND binds tighter than OR
+		{"member_status = lapsed AND dues_paid = no OR age < 17", true},
+		{"member_status = lapsed AND (dues_paid = no OR age < 17)", false},
+		// a member without the attribute fails the condition, either way
+		{"baptized = yes", false},
+		{"baptized != yes", false},
+		{"baptized before 2020-01-01", false},
+		{"NOT baptized = yes", true},
+		// a value that isn't a date fails a date condition
+		{"region before 2020-01-01", false},
+	} {
+		r, err := Parse(c.rule)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", c.rule, err)
+			continue
+		}
+		if got := r.Eval(member); got != c.want {
+			t.Errorf("%q = %v, want %v", c.rule, got, c.want)
+		}
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want bool
+	}{
+		{"member_status", true},
+		{"Member_Status", true},
+		{"seat-class", true},
+		{"v1.2", true},
+		{"_x", true},
+		{"", false},
+		{"AND", false},
+		{"in", false},
+		{"1st", false},
+		{"-x", false},
+		{"a b", false},
+	} {
+		if got := ValidName(c.name); got != c.want {
+			t.Errorf("ValidName(%q) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
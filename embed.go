@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The organization's website can show the tally in an iframe of
+// /embed/results: the totals of /status on a small page without script,
+// forms or cookies that reloads itself while voting runs. Its
+// Content-Security-Policy lets only EMBED_ORIGINS frame it (any site when
+// unset) and load nothing but its logo. With EMBED_KEY the page needs a link
+// signed for the organization until an expiry, made by a superadmin at
+// /admin/embed, so a link copied off the website stops working after it.
+
+const (
+	embedRefresh     = 15 // seconds between reloads while voting runs
+	embedDefaultDays = 30
+	embedMaxDays     = 365
+)
+
+// embedConfig is where the results may be embedded
+type embedConfig struct {
+	key     []byte   // EMBED_KEY: signs embed links; nil leaves the page open
+	origins []string // EMBED_ORIGINS: sites allowed to frame the page; any when empty
+}
+
+// loadEmbedConfig reads EMBED_KEY and EMBED_ORIGINS, a comma separated list
+// of origins such as https://gkjp.id
+func loadEmbedConfig() (embedConfig, error) {
+	var c embedConfig
+	if key := os.Getenv("EMBED_KEY"); key != "" {
+		c.key = []byte(key)
+	}
+	for _, o := range strings.Split(os.Getenv("EMBED_ORIGINS"), ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" ||
+			strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+			return embedConfig{}, fmt.Errorf("invalid EMBED_ORIGINS entry %q: want an origin like https://example.org", o)
+		}
+		c.origins = append(c.origins, u.Scheme+"://"+u.Host)
+	}
+	return c, nil
+}
+
+// frameAncestors is the frame-ancestors source list of the page
+func (c embedConfig) frameAncestors() string {
+	if len(c.origins) == 0 {
+		return "*"
+	}
+	return strings.Join(c.origins, " ")
+}
+
+// embedSignature signs an embed link of the organization until expires
+func (a *App) embedSignature(expires int64) string {
+	mac := hmac.New(sha256.New, a.embed.key)
+	fmt.Fprintf(mac, "embed|%s|%d", a.org, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// embedToken is the t parameter of an embed link: expiry.signature
+func (a *App) embedToken(expires time.Time) string {
+	return fmt.Sprintf("%d.%s", expires.Unix(), a.embedSignature(expires.Unix()))
+}
+
+// validEmbedToken reports whether t is an unexpired link of the organization
+func (a *App) validEmbedToken(t string, now time.Time) bool {
+	exp, sig, ok := strings.Cut(t, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(a.embedSignature(expires)))
+}
+
+// EmbedData is the data of embed.html
+type EmbedData struct {
+	Counts      ChannelCounts
+	Total       int // ballots, online and paper
+	Setuju      int
+	TidakSetuju int
+	TidakSah    int
+	Sealed      int    // online ballots still sealed
+	Phase       string // before, open or closed
+	Refresh     int    // seconds; 0 once closed
+	AsOf        string // the database is unreachable: results as of this time
+	Unavailable bool
+}
+
+// embedResultsHandler: GET /embed/results is the tally for an iframe on the
+// organization's website; ?t= carries the signed link with EMBED_KEY
+func (a *App) embedResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' https: data:; "+
+		"base-uri 'none'; form-action 'none'; frame-ancestors "+a.embed.frameAncestors())
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if a.embed.key != nil && !a.validEmbedToken(r.URL.Query().Get("t"), time.Now()) {
+		h.Set("Cache-Control", "no-store")
+		a.writeError(w, r, http.StatusForbidden, "link hasil tidak valid atau sudah kedaluwarsa")
+		return
+	}
+
+	ctx := r.Context()
+	now := time.Now()
+	data := EmbedData{Phase: "open", Refresh: embedRefresh}
+	switch {
+	case now.Before(a.voteStart):
+		data.Phase = "before"
+	case now.After(a.voteEnd):
+		data.Phase, data.Refresh = "closed", 0
+	}
+	results, version, err := a.resultsVersion(ctx)
+	if err != nil {
+		last, at := a.results.lastKnown()
+		if last == nil {
+			logTally.Errorf("error getting results for embed: %v", err)
+			data.Unavailable = true
+		} else {
+			data.Counts, data.Sealed = splitChannels(last), last.Sealed
+			data.AsOf = at.In(a.voteEnd.Location()).Format("15:04:05")
+		}
+		// keep trying while the database is down, even after close
+		data.Refresh = embedRefresh
+		h.Set("Cache-Control", "no-store")
+	} else {
+		if data.Phase == "closed" {
+			h.Set("Cache-Control", statusClosedCacheControl)
+		} else {
+			h.Set("Cache-Control", statusCacheControl)
+		}
+		if notModified(w, r, version, "embed") {
+			return
+		}
+		data.Counts, data.Sealed = splitChannels(results), results.Sealed
+	}
+	c := data.Counts
+	data.Total = c.Voted + c.Offline
+	data.Setuju = c.Online.Setuju + c.Paper.Setuju
+	data.TidakSetuju = c.Online.TidakSetuju + c.Paper.TidakSetuju
+	data.TidakSah = c.Paper.TidakSah
+
+	if data.Unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := a.tmpl.ExecuteTemplate(w, "embed.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+	}
+}
+
+// EmbedAdminData is the data of embed_admin.html
+type EmbedAdminData struct {
+	URL     string // the page to frame, signed with EMBED_KEY
+	Expires string // of URL; empty without EMBED_KEY
+	Signed  bool   // EMBED_KEY is set
+	Days    int
+	Origins []string
+	Error   string
+}
+
+// adminEmbedHandler: GET /admin/embed shows the iframe code of the results;
+// with EMBED_KEY, POST signs a link for ?days=. Superadmin only.
+func (a *App) adminEmbedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := EmbedAdminData{Signed: a.embed.key != nil, Days: embedDefaultDays, Origins: a.embed.origins}
+	base := a.baseURL(r) + "/embed/results"
+
+	switch r.Method {
+	case http.MethodGet:
+		if !data.Signed {
+			data.URL = base
+		}
+	case http.MethodPost:
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 1 || days > embedMaxDays {
+			data.Error = fmt.Sprintf("masa berlaku 1 sampai %d hari", embedMaxDays)
+			break
+		}
+		if !data.Signed {
+			data.URL = base
+			break
+		}
+		data.Days = days
+		expires := time.Now().Add(time.Duration(days) * 24 * time.Hour).Truncate(time.Second)
+		data.URL = base + "?t=" + a.embedToken(expires)
+		data.Expires = expires.In(a.voteEnd.Location()).Format("2006-01-02 15:04")
+		a.audit(ctx, actorName(r), "embed.link", "", map[string]string{"expires_at": expires.Format(time.RFC3339)})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := a.tmpl.ExecuteTemplate(w, "embed_admin.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type ErasureData struct {
+	Code     string
+	Name     string
+	Wilayah  string
+	Used     bool
+	Erased   bool
+	Found    bool
+	AfterEnd bool
+	Message  string
+	Error    string
+}
+
+var errAlreadyErased = errors.New("data peserta sudah dihapus")
+
+// eraseVoter irreversibly removes a voter's personal data while keeping the
+// roll row (used flag and choice) so the ballot stays counted. The member
+// record is deleted and the roll's name/phone are overwritten; the new phone
+// is random so nothing can be joined back to the person.
+func (a *App) eraseVoter(ctx context.Context, code string) error {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var phone string
+	var erasedAt *time.Time
+	err = tx.QueryRow(ctx, `SELECT phone, erased_at FROM voters WHERE code = $1 FOR UPDATE`, code).Scan(&phone, &erasedAt)
+	if err != nil {
+		return err
+	}
+	if erasedAt != nil {
+		return errAlreadyErased
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM vote_master WHERE phone = $1`, phone); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE roll_version_entries SET entry = (entry || '{"name": "[dihapus]", "phone": ""}') - 'attributes'
+		WHERE code = $1 AND entry IS NOT NULL`, code)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE voters
+		SET name = '[dihapus]',
+			phone = 'erased-' || md5(random()::text || clock_timestamp()::text),
+			erased_at = NOW(),
+			pseudonymized_at = COALESCE(pseudonymized_at, NOW())
+		WHERE code = $1`, code)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	a.codeChanged(ctx, code)
+	return nil
+}
+
+// adminErasureHandler handles right-to-erasure requests: GET looks the voter
+// up, POST erases after the admin retypes the code. Only allowed once
+// voting has closed, so an erased voter can't be left unable to vote.
+func (a *App) adminErasureHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := ErasureData{
+		Code:     strings.TrimSpace(r.FormValue("code")),
+		AfterEnd: time.Now().After(a.voteEnd),
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !data.AfterEnd {
+			data.Error = "penghapusan hanya dapat dilakukan setelah pemilihan ditutup"
+			break
+		}
+		if r.FormValue("confirm") != data.Code {
+			data.Error = "kode konfirmasi tidak sama"
+			break
+		}
+		err := a.eraseVoter(ctx, data.Code)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			data.Error = "kode tidak ditemukan"
+		case errors.Is(err, errAlreadyErased):
+			data.Error = err.Error()
+		case err != nil:
+			logDB.Errorf("error erasing voter: %v", err)
+			data.Error = "gagal menghapus data"
+		default:
+			// the ledger keeps only the code, never the erased name or phone
+			a.audit(ctx, actorName(r), "voter.erase", data.Code, nil)
+			data.Message = "Data pribadi peserta telah dihapus. Suaranya tetap dihitung."
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if data.Code != "" {
+		var erasedAt *time.Time
+		err := a.db.QueryRow(ctx, `
+			SELECT v.name, COALESCE(vm.wilayah, ''), v.used, v.erased_at
+			FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+			WHERE v.code = $1`, data.Code).
+			Scan(&data.Name, &data.Wilayah, &data.Used, &erasedAt)
+		if err == nil {
+			err = a.pii.openAll(&data.Name)
+		}
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			logDB.Errorf("error getting voter: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		data.Found = err == nil
+		data.Erased = erasedAt != nil
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "erasure.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
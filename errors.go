@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const requestIDKey ctxKey = accountKey + 2
+
+// requestIDFrom returns the ID given to the request by withErrors
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// ErrorBody is the JSON form of an error response
+type ErrorBody struct {
+	Code      string `json:"code"` // e.g. not_found, derived from the status
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// ErrorPage is the data of error.html
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+}
+
+// errorCode turns a status into a stable snake_case code, e.g. 404 ->
+// not_found
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return fmt.Sprintf("status_%d", status)
+	}
+	return strings.ReplaceAll(strings.ToLower(strings.ReplaceAll(text, "-", " ")), " ", "_")
+}
+
+// preferredType returns which of the offered media types the Accept header
+// ranks highest, or "" when it accepts neither explicitly. Wildcards don't
+// count, so a bare */* keeps the plain text response.
+func preferredType(r *http.Request, offers ...string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if _, err := fmt.Sscanf(v, "%g", &q); err != nil {
+				continue
+			}
+		}
+		for _, offer := range offers {
+			if mediaType == offer && q > bestQ {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	return best
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// errorWriter holds back plain text error responses (as written by
+// http.Error) so they can be rendered in the format the client asked for
+type errorWriter struct {
+	http.ResponseWriter
+	status int
+	held   bool
+	body   bytes.Buffer
+}
+
+func (ew *errorWriter) WriteHeader(status int) {
+	if ew.status != 0 {
+		return
+	}
+	ew.status = status
+	if status >= 400 && strings.HasPrefix(ew.Header().Get("Content-Type"), "text/plain") {
+		ew.held = true
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorWriter) Write(b []byte) (int, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.held {
+		return ew.body.Write(b)
+	}
+	return ew.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers (e.g. the CSV exports) keep flushing
+func (ew *errorWriter) Flush() {
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok && !ew.held {
+		f.Flush()
+	}
+}
+
+// withErrors gives every request an ID (echoed in X-Request-ID) and turns
+// the plain text errors of the handlers into JSON for clients that send
+// Accept: application/json, or into the error page for browsers. Other
+// clients keep the plain text.
+func (a *App) withErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 || strings.ContainsAny(id, " \t\r\n") {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		ew := &errorWriter{ResponseWriter: w}
+		h.ServeHTTP(ew, r)
+		if !ew.held {
+			return
+		}
+
+		msg := strings.TrimSpace(ew.body.String())
+		if ew.status >= 500 {
+			logHTTP.Errorf("request %s: %s %s: %d %s", id, r.Method, r.URL.Path, ew.status, msg)
+		}
+		a.writeError(w, r, ew.status, msg)
+	})
+}
+
+// writeError renders an error as JSON, HTML or plain text depending on the
+// Accept header
+func (a *App) writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	w.Header().Del("X-Content-Type-Options")
+	switch preferredType(r, "application/json", "text/html") {
+	case "application/json":
+		writeJSON(w, status, ErrorBody{Code: errorCode(status), Message: msg, RequestID: requestIDFrom(r.Context())})
+		return
+	case "text/html":
+		var buf bytes.Buffer
+		err := a.tmpl.ExecuteTemplate(&buf, "error.html", ErrorPage{
+			Status:     status,
+			StatusText: http.StatusText(status),
+			Message:    msg,
+			RequestID:  requestIDFrom(r.Context()),
+		})
+		if err != nil {
+			logHTTP.Errorf("error executing template: %v", err)
+			break
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(buf.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, msg)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// The GraphQL endpoint lets the reporting team combine elections, voters and
+// turnout in one query (e.g. turnout by group by hour) instead of us adding a
+// REST endpoint per question. It is read-only and, like the admin page, only
+// available to superadmins.
+
+// TurnoutRow is one bucket of the turnout query; Group and Hour are only set
+// when grouping by them
+type TurnoutRow struct {
+	Group    *string
+	Hour     *time.Time
+	Voted    int
+	Eligible *int // not meaningful per hour, so nil when grouping by hour
+}
+
+var (
+	gqlResultType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Result",
+		Fields: graphql.Fields{
+			"channel": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"choice":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"count":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	gqlGroupTurnoutType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "GroupTurnout",
+		Fields: graphql.Fields{
+			"group":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"voted":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"notVoted": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	gqlVoterType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Voter",
+		Fields: graphql.Fields{
+			"code":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"phone":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"group":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"voted":   &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"votedAt": &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+	gqlStatsType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stats",
+		Fields: graphql.Fields{
+			"totalVoters":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"votedCount":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"notVotedCount":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"setujuCount":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"tidakSetujuCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	gqlTurnoutRowType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "TurnoutRow",
+		Fields: graphql.Fields{
+			"group":    &graphql.Field{Type: graphql.String},
+			"hour":     &graphql.Field{Type: graphql.DateTime},
+			"voted":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"eligible": &graphql.Field{Type: graphql.Int},
+		},
+	})
+)
+
+// newGraphQLSchema builds the schema; resolvers reuse the admin queries
+func (a *App) newGraphQLSchema() (graphql.Schema, error) {
+	// fields resolve against the Go structs by (case-insensitive) field name
+	electionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Election",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.Int, Description: "null for the current election"},
+			"name":        &graphql.Field{Type: graphql.String},
+			"voteStart":   &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"voteEnd":     &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"status":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"totalVoters": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"votedCount":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"results": &graphql.Field{
+				Type: graphql.NewList(gqlResultType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					e := p.Source.(APIElection)
+					if e.ID == nil {
+						return a.liveResults(p.Context)
+					}
+					detail, err := a.archivedElectionDetail(p.Context, *e.ID)
+					return detail.Results, err
+				},
+			},
+			"turnout": &graphql.Field{
+				Type: graphql.NewList(gqlGroupTurnoutType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					e := p.Source.(APIElection)
+					if e.ID == nil {
+						return a.liveGroupTurnout(p.Context)
+					}
+					detail, err := a.archivedElectionDetail(p.Context, *e.ID)
+					return detail.Turnout, err
+				},
+			},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"election": &graphql.Field{
+				Type:        electionType,
+				Description: "The current election",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return a.currentElection(p.Context)
+				},
+			},
+			"elections": &graphql.Field{
+				Type:        graphql.NewList(electionType),
+				Description: "Archived elections, newest first",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					archived, err := a.listArchivedElections(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					out := []APIElection{}
+					for _, ae := range archived {
+						out = append(out, archivedToAPI(ae))
+					}
+					return out, nil
+				},
+			},
+			"stats": &graphql.Field{
+				Type: gqlStatsType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return a.adminStats(p.Context)
+				},
+			},
+			"voters": &graphql.Field{
+				Type:        graphql.NewList(gqlVoterType),
+				Description: "The roll of the current election",
+				Args: graphql.FieldConfigArgument{
+					"status": &graphql.ArgumentConfig{Type: graphql.String, Description: "voted / not_voted"},
+					"group":  &graphql.ArgumentConfig{Type: graphql.String},
+					"search": &graphql.ArgumentConfig{Type: graphql.String},
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: apiDefaultLimit},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: a.resolveVoters,
+			},
+			"turnout": &graphql.Field{
+				Type:        graphql.NewList(gqlTurnoutRowType),
+				Description: "Turnout of the current election, optionally by group and/or hour",
+				Args: graphql.FieldConfigArgument{
+					"byGroup": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+					"byHour":  &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+				},
+				Resolve: a.resolveTurnout,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+func (a *App) resolveVoters(p graphql.ResolveParams) (interface{}, error) {
+	f := VoterFilter{}
+	f.Status, _ = p.Args["status"].(string)
+	f.Group, _ = p.Args["group"].(string)
+	f.Search, _ = p.Args["search"].(string)
+	if f.Status != "voted" && f.Status != "not_voted" {
+		f.Status = ""
+	}
+	limit, _ := p.Args["limit"].(int)
+	offset, _ := p.Args["offset"].(int)
+	if limit <= 0 || limit > apiMaxLimit {
+		limit = apiMaxLimit
+	}
+	voters, _, err := a.pageVoters(p.Context, f, limit, offset, nil)
+	return voters, err
+}
+
+func (a *App) resolveTurnout(p graphql.ResolveParams) (interface{}, error) {
+	byGroup, _ := p.Args["byGroup"].(bool)
+	byHour, _ := p.Args["byHour"].(bool)
+
+	rows, err := a.db.Query(p.Context, `
+		SELECT
+			CASE WHEN $1 THEN vm.wilayah END,
+			CASE WHEN $2 THEN date_trunc('hour', v.used_at) END,
+			COUNT(*) FILTER (WHERE v.used = true),
+			COUNT(*)
+		FROM voters v INNER JOIN vote_master vm ON v.phone = vm.phone
+		WHERE NOT $2 OR v.used = true
+		GROUP BY 1, 2
+		ORDER BY 1, 2`, byGroup, byHour)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []TurnoutRow
+	for rows.Next() {
+		var t TurnoutRow
+		var eligible int
+		if err := rows.Scan(&t.Group, &t.Hour, &t.Voted, &eligible); err != nil {
+			return nil, err
+		}
+		if !byHour {
+			t.Eligible = &eligible
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// adminGraphQLHandler executes a GraphQL query sent as a JSON POST body or
+// as ?query= on GET
+func (a *App) adminGraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				apiError(w, r, http.StatusBadRequest, "invalid variables")
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			apiError(w, r, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	default:
+		apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if req.Query == "" {
+		apiError(w, r, http.StatusBadRequest, "query is required")
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         a.graphqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        r.Context(),
+	})
+	for _, e := range result.Errors {
+		logHTTP.Warnf("graphql error: %s", e.Message)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,199 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative adminpb/admin.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"pemilihan.gkjp.id/adminpb"
+)
+
+// The gRPC admin service lets back-office batch jobs import voters, read the
+// counters and export results without scraping the HTML pages. It listens on
+// its own port and only accepts clients with a certificate signed by
+// GRPC_CLIENT_CA (mutual TLS).
+
+// grpcMaxImport caps the voters in one ImportVoters call
+const grpcMaxImport = 10000
+
+// grpcTLSConfig builds the mutual TLS config from the GRPC_TLS_CERT,
+// GRPC_TLS_KEY and GRPC_CLIENT_CA files
+func grpcTLSConfig() (*tls.Config, error) {
+	certFile, keyFile, caFile := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY"), os.Getenv("GRPC_CLIENT_CA")
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("GRPC_TLS_CERT, GRPC_TLS_KEY and GRPC_CLIENT_CA are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// newGRPCServer returns the admin gRPC server secured with mutual TLS
+func (a *App) newGRPCServer() (*grpc.Server, error) {
+	cfg, err := grpcTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(cfg)))
+	adminpb.RegisterAdminServiceServer(srv, &adminService{app: a})
+	return srv, nil
+}
+
+// grpcActor names the calling client by its certificate's common name for
+// the audit log
+func grpcActor(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+			return "grpc:" + info.State.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	return "grpc"
+}
+
+type adminService struct {
+	adminpb.UnimplementedAdminServiceServer
+	app *App
+}
+
+func (s *adminService) ImportVoters(ctx context.Context, req *adminpb.ImportVotersRequest) (*adminpb.ImportVotersResponse, error) {
+	if len(req.Voters) > grpcMaxImport {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d voters per call", grpcMaxImport)
+	}
+	resp := &adminpb.ImportVotersResponse{}
+	for i, v := range req.Voters {
+		in := APIVoterInput{
+			Code:  strings.TrimSpace(v.Code),
+			Name:  strings.TrimSpace(v.Name),
+			Phone: strings.TrimSpace(v.Phone),
+			Group: strings.TrimSpace(v.Group),
+		}
+		if in.Name == "" || in.Phone == "" {
+			resp.Rejected = append(resp.Rejected, &adminpb.RejectedVoter{Index: int32(i), Reason: "name and phone are required"})
+			continue
+		}
+		code, err := s.app.createVoter(ctx, in)
+		if errors.Is(err, errVoterExists) || errors.Is(err, errCodeTaken) || errors.Is(err, errVoterQuota) || errors.Is(err, errIneligible) {
+			resp.Rejected = append(resp.Rejected, &adminpb.RejectedVoter{Index: int32(i), Reason: err.Error()})
+			continue
+		}
+		if err != nil {
+			logDB.Errorf("error importing voter: %v", err)
+			return nil, status.Error(codes.Internal, "database error")
+		}
+		resp.Imported = append(resp.Imported, &adminpb.ImportedVoter{Index: int32(i), Code: code})
+	}
+	s.app.audit(ctx, grpcActor(ctx), "voter.import", "", map[string]int{
+		"imported": len(resp.Imported),
+		"rejected": len(resp.Rejected),
+	})
+	return resp, nil
+}
+
+func (s *adminService) GetStats(ctx context.Context, _ *adminpb.GetStatsRequest) (*adminpb.Stats, error) {
+	stats, err := s.app.adminStats(ctx)
+	if err != nil {
+		logTally.Errorf("error getting voting stats: %v", err)
+		return nil, status.Error(codes.Internal, "database error")
+	}
+	return &adminpb.Stats{
+		VoteStart:        timestamppb.New(s.app.voteStart),
+		VoteEnd:          timestamppb.New(s.app.voteEnd),
+		Closed:           time.Now().After(s.app.voteEnd),
+		TotalVoters:      int32(stats.TotalVoters),
+		VotedCount:       int32(stats.VotedCount),
+		NotVotedCount:    int32(stats.NotVotedCount),
+		SetujuCount:      int32(stats.SetujuCount),
+		TidakSetujuCount: int32(stats.TidakSetujuCount),
+	}, nil
+}
+
+// ExportResults returns the results of an archived election, or of the
+// current one once voting has closed
+func (s *adminService) ExportResults(ctx context.Context, req *adminpb.ExportResultsRequest) (*adminpb.ExportResultsResponse, error) {
+	var detail APIElectionDetail
+	var ballotHash string
+	if req.ElectionId == 0 {
+		if !time.Now().After(s.app.voteEnd) {
+			return nil, status.Error(codes.FailedPrecondition, "voting has not closed yet")
+		}
+		var err error
+		if detail.APIElection, err = s.app.currentElection(ctx); err != nil {
+			logDB.Errorf("error getting election: %v", err)
+			return nil, status.Error(codes.Internal, "database error")
+		}
+		if detail.Results, err = s.app.liveResults(ctx); err != nil {
+			logTally.Errorf("error getting results: %v", err)
+			return nil, status.Error(codes.Internal, "database error")
+		}
+		if detail.Turnout, err = s.app.liveGroupTurnout(ctx); err != nil {
+			logTally.Errorf("error getting turnout: %v", err)
+			return nil, status.Error(codes.Internal, "database error")
+		}
+		snap, err := s.app.loadTallySnapshot(ctx)
+		if err != nil {
+			logTally.Errorf("error loading tally snapshot: %v", err)
+			return nil, status.Error(codes.Internal, "database error")
+		}
+		if snap != nil {
+			ballotHash = snap.BallotHash
+		}
+	} else {
+		var err error
+		detail, err = s.app.archivedElectionDetail(ctx, int(req.ElectionId))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "election not found")
+		}
+		if err != nil {
+			logDB.Errorf("error getting archived election: %v", err)
+			return nil, status.Error(codes.Internal, "database error")
+		}
+	}
+
+	resp := &adminpb.ExportResultsResponse{
+		ElectionId:  req.ElectionId,
+		Name:        detail.Name,
+		VoteStart:   timestamppb.New(detail.VoteStart),
+		VoteEnd:     timestamppb.New(detail.VoteEnd),
+		Status:      detail.Status,
+		TotalVoters: int32(detail.TotalVoters),
+		VotedCount:  int32(detail.VotedCount),
+		BallotHash:  ballotHash,
+	}
+	for _, r := range detail.Results {
+		resp.Results = append(resp.Results, &adminpb.Result{Channel: r.Channel, Choice: r.Choice, Count: int32(r.Count)})
+	}
+	for _, t := range detail.Turnout {
+		resp.Turnout = append(resp.Turnout, &adminpb.GroupTurnout{Group: t.Group, Voted: int32(t.Voted), NotVoted: int32(t.NotVoted)})
+	}
+	return resp, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// During the rush a member who can't get through wants to know whether the
+// server is down or their connection is. The results page (/status) shows a
+// system status panel above the results, filled from /status/health: whether
+// voting is open, the server's time and whether the system is healthy. The
+// document is never cached and reads nothing from the database, so it still
+// answers while the database is unreachable, and it holds nothing a member
+// couldn't see on the pages already.
+
+// healthBusyShare is the share of MAX_IN_FLIGHT past which the server
+// reports itself busy, a little before it starts turning requests away
+const healthBusyShare = 0.8
+
+// SystemHealth is the /status/health document
+type SystemHealth struct {
+	Election   string    `json:"election"` // upcoming, open or closed
+	VoteStart  time.Time `json:"vote_start"`
+	VoteEnd    time.Time `json:"vote_end"`
+	ServerTime time.Time `json:"server_time"`
+	Status     string    `json:"status"`  // ok, busy or degraded
+	Message    string    `json:"message"` // for the members
+}
+
+// systemHealth describes the election and this instance as of now
+func (a *App) systemHealth() SystemHealth {
+	now := time.Now()
+	h := SystemHealth{
+		VoteStart:  a.voteStart,
+		VoteEnd:    a.voteEnd,
+		ServerTime: now.In(a.voteEnd.Location()),
+		Status:     "ok",
+		Message:    "Sistem berjalan normal. Jika halaman pemilihan tidak terbuka, periksa koneksi internet Anda.",
+	}
+	switch {
+	case now.Before(a.voteStart):
+		h.Election = "upcoming"
+	case now.After(a.voteEnd):
+		h.Election = "closed"
+	default:
+		h.Election = "open"
+	}
+	s := &a.shedder
+	switch {
+	case a.breaker.Open():
+		h.Status = "degraded"
+		h.Message = "Database sedang tidak dapat dihubungi, sehingga suara belum dapat dikirim. Silakan coba lagi beberapa menit lagi."
+	case s.max > 0 && float64(s.inFlight.Load()) >= healthBusyShare*float64(s.max):
+		h.Status = "busy"
+		h.Message = "Server sedang ramai. Halaman mungkin lambat atau meminta Anda mencoba lagi beberapa detik kemudian."
+	}
+	return h
+}
+
+// healthHandler: GET /status/health returns the SystemHealth, uncached
+func (a *App) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.systemHealth())
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Members who lost their letter call the helpdesk. At /helpdesk an operator
+// looks a member up by name or by a custom field such as the member ID
+// (VOTER_FIELDS), sees whether their code was mailed and whether it voted,
+// and mails the code again to the member's email on record. The page never
+// shows the code itself, a choice or a count: the operator helps the member
+// reach their own ballot, nothing more.
+
+const (
+	// helpdeskLimit caps the voters a lookup lists
+	helpdeskLimit = 20
+
+	// helpdeskMinQuery is the shortest name a lookup takes
+	helpdeskMinQuery = 3
+
+	// codeResendInterval is how long a code waits before it is mailed again
+	codeResendInterval = 10 * time.Minute
+)
+
+// HelpdeskVoter is a voter as the helpdesk sees them
+type HelpdeskVoter struct {
+	ID        int
+	Name      string
+	Group     string
+	Fields    []string // values of VOTER_FIELDS
+	Email     string   // masked
+	Used      bool
+	UsedAt    *time.Time
+	CheckedIn bool
+	Revoked   bool
+	SentAt    *time.Time // last mailed, nil if never
+	SentCount int
+}
+
+// HelpdeskData is the data of helpdesk.html
+type HelpdeskData struct {
+	Query     string
+	Fields    []VoterField
+	Voters    []HelpdeskVoter
+	Searched  bool
+	Truncated bool // more than helpdeskLimit matched
+	Message   string
+	Error     string
+}
+
+// helpdeskHandler: GET /helpdesk?q= looks voters up; POST action=resend
+// mails a voter's code again. Operators and the superadmin.
+func (a *App) helpdeskHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := HelpdeskData{Query: strings.TrimSpace(r.FormValue("q")), Fields: a.voterFields}
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if r.FormValue("action") != "resend" {
+			data.Error = "aksi tidak dikenal"
+			break
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		var err error
+		if data.Message, err = a.resendCode(ctx, a.mailBaseURL(r), id, actorName(r)); err != nil {
+			data.Error = err.Error()
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if data.Query != "" {
+		data.Searched = true
+		if len([]rune(data.Query)) < helpdeskMinQuery {
+			data.Error = fmt.Sprintf("isi paling sedikit %d huruf", helpdeskMinQuery)
+		} else {
+			voters, err := a.helpdeskLookup(ctx, data.Query)
+			if err != nil {
+				logDB.Errorf("error looking up voters: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			if len(voters) > helpdeskLimit {
+				voters, data.Truncated = voters[:helpdeskLimit], true
+			}
+			data.Voters = voters
+		}
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "helpdesk.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// helpdeskLookup returns up to helpdeskLimit+1 voters whose name contains q
+// or one of whose custom fields is q. Encrypted names can't be searched in
+// SQL, so then every voter is read and matched here.
+func (a *App) helpdeskLookup(ctx context.Context, q string) ([]HelpdeskVoter, error) {
+	where := ""
+	var args []interface{}
+	if !a.pii.Enabled() {
+		args = append(args, q, "%"+q+"%")
+		conds := []string{"COALESCE(vm.name, v.name) ILIKE $2"}
+		for _, f := range a.voterFields {
+			args = append(args, f.Key)
+			conds = append(conds, fmt.Sprintf("lower(vm.attributes->>$%d) = lower($1)", len(args)))
+		}
+		where = "WHERE " + strings.Join(conds, " OR ")
+	}
+	rows, err := a.db.Query(ctx, `
+		SELECT v.id, COALESCE(vm.name, v.name, ''), COALESCE(vm.wilayah, ''), COALESCE(vm.attributes, '{}'),
+			v.used, v.used_at, v.checked_in_at IS NOT NULL, EXISTS (SELECT 1 FROM revoked_codes rc WHERE rc.code = v.code),
+			v.code_sent_at, v.code_sent_count
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		`+where+`
+		ORDER BY COALESCE(vm.name, v.name), v.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	search := strings.ToLower(q)
+	var voters []HelpdeskVoter
+	for rows.Next() {
+		var v HelpdeskVoter
+		var attrs map[string]string
+		if err := rows.Scan(&v.ID, &v.Name, &v.Group, &attrs, &v.Used, &v.UsedAt, &v.CheckedIn, &v.Revoked,
+			&v.SentAt, &v.SentCount); err != nil {
+			return nil, err
+		}
+		if err := a.pii.openAll(&v.Name); err != nil {
+			return nil, err
+		}
+		if attrs, err = a.pii.openAttributes(attrs); err != nil {
+			return nil, err
+		}
+		v.Fields = fieldValues(a.voterFields, attrs)
+		if a.pii.Enabled() && !strings.Contains(strings.ToLower(v.Name), search) && !matchesField(v.Fields, q) {
+			continue
+		}
+		v.Email = maskEmail(attrs["email"])
+		voters = append(voters, v)
+		if len(voters) > helpdeskLimit {
+			break
+		}
+	}
+	return voters, rows.Err()
+}
+
+// matchesField reports whether one of values is q, ignoring case
+func matchesField(values []string, q string) bool {
+	for _, v := range values {
+		if v != "" && strings.EqualFold(v, q) {
+			return true
+		}
+	}
+	return false
+}
+
+// resendCode queues the code of voter id to the member's email on record,
+// together with its audit event; baseURL is mailBaseURL, and nothing is sent
+// without one. The error is shown to the operator as-is.
+func (a *App) resendCode(ctx context.Context, baseURL string, id int, actor string) (string, error) {
+	var code, name, email string
+	var used bool
+	var sentAt *time.Time
+	err := a.db.QueryRow(ctx, `
+		SELECT v.code, COALESCE(vm.name, v.name, ''), COALESCE(vm.attributes->>'email', ''), v.used, v.code_sent_at
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE v.id = $1`, id).Scan(&code, &name, &email, &used, &sentAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errors.New("pemilih tidak ditemukan")
+	}
+	if err != nil {
+		logMailer.Errorf("error resending code: %v", err)
+		return "", errors.New("database error")
+	}
+	if err := a.pii.openAll(&name, &email); err != nil {
+		logMailer.Errorf("error resending code: %v", err)
+		return "", errors.New("database error")
+	}
+	switch {
+	case used:
+		return "", fmt.Errorf("%s sudah memilih", name)
+	case a.revoked.has(code):
+		return "", fmt.Errorf("kode milik %s sudah dicabut panitia; kode baru diterbitkan panitia", name)
+	case email == "":
+		return "", fmt.Errorf("tidak ada email terdaftar untuk %s", name)
+	case sentAt != nil && time.Since(*sentAt) < codeResendInterval:
+		return "", fmt.Errorf("kode %s baru dikirim pukul %s; tunggu %d menit sebelum mengirim lagi",
+			name, sentAt.In(a.voteEnd.Location()).Format("15:04"), int(codeResendInterval/time.Minute))
+	}
+
+	m, err := a.orgMailer(ctx)
+	if err != nil {
+		logMailer.Errorf("error resending code: %v", err)
+		return "", errors.New("database error")
+	}
+	if m == nil {
+		return "", errNoMailer
+	}
+	if baseURL == "" {
+		return "", errors.New("PUBLIC_URL belum diatur, jadi link kode tidak dapat dikirim lewat email")
+	}
+	if err := a.checkMessageQuota(ctx); errors.Is(err, errMessageQuota) {
+		return "", errors.New("kuota email hari ini sudah habis")
+	} else if err != nil {
+		logMailer.Errorf("error resending code: %v", err)
+		return "", errors.New("database error")
+	}
+	link := baseURL + "/?code=" + url.QueryEscape(code)
+	body := fmt.Sprintf("Yth. %s,\n\nBerikut kode pemilihan Anda: %s\n\nBuka link berikut untuk memilih:\n%s\n\n"+
+		"Jangan berikan kode ini kepada siapa pun.\n", name, code, link)
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		logMailer.Errorf("error resending code: %v", err)
+		return "", errors.New("database error")
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `
+		UPDATE voters SET code_sent_at = NOW(), code_sent_count = code_sent_count + 1 WHERE id = $1`, id)
+	if err == nil {
+		err = auditIn(ctx, tx, actor, "voter.code_resend", code, map[string]string{"via": "email"})
+	}
+	if err == nil {
+		err = enqueueMessage(ctx, tx, outboxMessage{
+			Channel:   ChannelEmail,
+			Recipient: email,
+			Subject:   "Kode pemilihan Anda",
+			Body:      body,
+			Source:    "voter.code_resend",
+		})
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		logMailer.Errorf("error resending code: %v", err)
+		return "", errors.New("database error")
+	}
+	return fmt.Sprintf("Kode %s masuk antrean kirim ke %s", name, maskEmail(email)), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ElectionComparison is one archived election in the historical comparison
+type ElectionComparison struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	VoteEnd     time.Time `json:"vote_end"`
+	TotalVoters int       `json:"total_voters"`
+	VotedCount  int       `json:"voted_count"`
+	Turnout     float64   `json:"turnout"`        // online, in percent
+	TurnoutDiff *float64  `json:"turnout_change"` // percentage points vs the previous election
+	Ballots     int       `json:"ballots"`        // online + offline
+	Setuju      int       `json:"setuju"`
+	TidakSetuju int       `json:"tidak_setuju"`
+	TidakSah    int       `json:"tidak_sah"`
+	SetujuShare float64   `json:"setuju_share"` // of valid ballots, in percent
+}
+
+// Change formats the turnout change against the previous election
+func (c ElectionComparison) Change() string {
+	if c.TurnoutDiff == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f poin", *c.TurnoutDiff)
+}
+
+// GroupHistory is the turnout of one wilayah across the compared elections;
+// Turnout lines up with the election list and is nil where the wilayah
+// didn't take part
+type GroupHistory struct {
+	Wilayah string     `json:"wilayah"`
+	Turnout []*float64 `json:"turnout"`
+}
+
+// Cells formats the turnout row for the HTML table
+func (g GroupHistory) Cells() []string {
+	cells := make([]string, len(g.Turnout))
+	for i, t := range g.Turnout {
+		if t == nil {
+			cells[i] = "-"
+		} else {
+			cells[i] = fmt.Sprintf("%.1f%%", *t)
+		}
+	}
+	return cells
+}
+
+type HistoryData struct {
+	Elections []ElectionComparison `json:"elections"`
+	Groups    []GroupHistory       `json:"groups"`
+}
+
+// electionHistory compares all sealed elections, oldest first
+func (a *App) electionHistory(ctx context.Context) (HistoryData, error) {
+	data := HistoryData{Elections: []ElectionComparison{}, Groups: []GroupHistory{}}
+
+	rows, err := a.db.Query(ctx, `
+		SELECT e.id, e.name, e.vote_end, e.total_voters, e.voted_count,
+			COALESCE(SUM(r.count), 0),
+			COALESCE(SUM(r.count) FILTER (WHERE r.choice = 'setuju'), 0),
+			COALESCE(SUM(r.count) FILTER (WHERE r.choice = 'tidak_setuju'), 0),
+			COALESCE(SUM(r.count) FILTER (WHERE r.choice = 'tidak_sah'), 0)
+		FROM elections e
+		LEFT JOIN archived_results r ON r.election_id = e.id
+		WHERE e.sealed
+		GROUP BY e.id
+		ORDER BY e.vote_end`)
+	if err != nil {
+		return data, err
+	}
+	index := map[int]int{}
+	for rows.Next() {
+		var c ElectionComparison
+		if err := rows.Scan(&c.ID, &c.Name, &c.VoteEnd, &c.TotalVoters, &c.VotedCount,
+			&c.Ballots, &c.Setuju, &c.TidakSetuju, &c.TidakSah); err != nil {
+			rows.Close()
+			return data, err
+		}
+		c.Turnout = percent(c.VotedCount, c.TotalVoters)
+		c.SetujuShare = percent(c.Setuju, c.Setuju+c.TidakSetuju)
+		if n := len(data.Elections); n > 0 {
+			diff := c.Turnout - data.Elections[n-1].Turnout
+			c.TurnoutDiff = &diff
+		}
+		index[c.ID] = len(data.Elections)
+		data.Elections = append(data.Elections, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = a.db.Query(ctx, `
+		SELECT t.election_id, t.wilayah, t.voted, t.not_voted
+		FROM archived_turnout t
+		JOIN elections e ON e.id = t.election_id AND e.sealed
+		ORDER BY t.wilayah`)
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, voted, notVoted int
+		var wilayah string
+		if err := rows.Scan(&id, &wilayah, &voted, &notVoted); err != nil {
+			return data, err
+		}
+		if n := len(data.Groups); n == 0 || data.Groups[n-1].Wilayah != wilayah {
+			data.Groups = append(data.Groups, GroupHistory{Wilayah: wilayah, Turnout: make([]*float64, len(data.Elections))})
+		}
+		t := percent(voted, voted+notVoted)
+		data.Groups[len(data.Groups)-1].Turnout[index[id]] = &t
+	}
+	return data, rows.Err()
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// adminHistoryHandler shows turnout and outcomes across archived elections
+func (a *App) adminHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := a.electionHistory(r.Context())
+	if err != nil {
+		logTally.Errorf("error comparing elections: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err := a.tmpl.ExecuteTemplate(w, "history.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// adminHistoryAPIHandler returns the same comparison as JSON
+func (a *App) adminHistoryAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := a.electionHistory(r.Context())
+	if err != nil {
+		logTally.Errorf("error comparing elections: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With REDIS_URL set, the hottest reads are shared between server instances
+// through Redis: the code lookup behind every voter link, and the
+// /api/v1/results document that result pages and dashboards poll. Redis is
+// only a cache: when it is down every read falls back to the database.
+//
+// Keys are namespaced per election (by vote end). A code's entry is dropped
+// when that code votes, is activated or erased, and otherwise expires after
+// codeCacheTTL, which bounds how long other roll edits (import) take to show. Results follow
+// the rules of the in-process cache: written only while this instance
+// listens for results_changed, and dropped by every listener on each change.
+// Redis holds what the voters table holds, names encrypted under PII_KEY
+// included, so it needs the same protection as the database.
+
+const (
+	codeCacheTTL    = 30 * time.Second
+	resultsCacheTTL = time.Minute
+)
+
+// hotKey names a cache entry of the current election of this organization
+func (a *App) hotKey(parts ...string) string {
+	return "pemilihan:" + a.org + ":" + strconv.FormatInt(a.voteEnd.Unix(), 10) + ":" + strings.Join(parts, ":")
+}
+
+// hotGet decodes the entry under key into v and reports whether there was
+// one; Redis errors count as a miss
+func (a *App) hotGet(ctx context.Context, key string, v interface{}) bool {
+	if a.redis == nil {
+		return false
+	}
+	raw, err := a.redis.Get(ctx, key)
+	if err != nil {
+		logDB.Errorf("error reading cache: %v", err)
+		return false
+	}
+	return raw != nil && json.Unmarshal(raw, v) == nil
+}
+
+func (a *App) hotSet(ctx context.Context, key string, v interface{}, ttl time.Duration) {
+	if a.redis == nil {
+		return
+	}
+	raw, err := json.Marshal(v)
+	if err == nil {
+		err = a.redis.Set(ctx, key, raw, ttl)
+	}
+	if err != nil {
+		logDB.Errorf("error writing cache: %v", err)
+	}
+}
+
+func (a *App) hotDel(ctx context.Context, keys ...string) {
+	if a.redis == nil {
+		return
+	}
+	if err := a.redis.Del(ctx, keys...); err != nil {
+		logDB.Errorf("error dropping cache: %v", err)
+	}
+}
+
+// codeEntry is a cached code lookup; Name as stored, sealed under PII_KEY
+type codeEntry struct {
+	ID   int    `json:"id"` // voters.id, as codes_changed names it
+	Name string `json:"name"`
+	Used bool   `json:"used"`
+}
+
+// lookupCode returns the voter name and used flag behind a code, from
+// memory, Redis or the database in that order. The vote itself always checks
+// the database; this only serves the voting page.
+func (a *App) lookupCode(ctx context.Context, code string) (string, bool, error) {
+	e, gen, ok := a.codes.get(code)
+	if !ok {
+		key := a.hotKey("code", code)
+		if !a.hotGet(ctx, key, &e) {
+			if err := a.db.QueryRow(ctx, "SELECT id, name, used FROM voters WHERE code=$1", code).Scan(&e.ID, &e.Name, &e.Used); err != nil {
+				return "", false, err
+			}
+			a.hotSet(ctx, key, e, codeCacheTTL)
+		}
+		if a.redis == nil || e.Used {
+			a.codes.set(code, e, gen)
+		}
+	}
+	name := e.Name
+	if err := a.pii.openAll(&name); err != nil {
+		return "", false, err
+	}
+	return name, e.Used, nil
+}
+
+// codeChanged drops the cached lookup of a code that just voted, was
+// activated or went away
+func (a *App) codeChanged(ctx context.Context, code string) {
+	a.codes.drop(code)
+	a.hotDel(ctx, a.hotKey("code", code))
+}
+
+// resultsKey is the entry of /api/v1/results, which differs once closed
+func (a *App) resultsKey(closed bool) string {
+	if closed {
+		return a.hotKey("results", "closed")
+	}
+	return a.hotKey("results", "open")
+}
+
+// sharedResults is currentResults through Redis
+func (a *App) sharedResults(ctx context.Context) (APIResults, error) {
+	closed := time.Now().After(a.voteEnd)
+	var res APIResults
+	if a.hotGet(ctx, a.resultsKey(closed), &res) {
+		return res, nil
+	}
+	_, gen := a.results.lookup(a.voteEnd)
+	res, err := a.currentResults(ctx, closed)
+	if err != nil {
+		return res, err
+	}
+	if a.results.current(gen) {
+		a.hotSet(ctx, a.resultsKey(closed), res, resultsCacheTTL)
+	}
+	return res, nil
+}
+
+// resultsChanged drops the shared results after a results_changed
+// notification
+func (a *App) resultsChanged(ctx context.Context) {
+	a.hotDel(ctx, a.resultsKey(false), a.resultsKey(true))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// idempotencyTTL is how long a stored response is replayed for its key
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyWriteTimeout bounds releasing or storing a key once the
+	// handler ran, which goes on after the client went away
+	idempotencyWriteTimeout = 5 * time.Second
+)
+
+// responseRecorder keeps a copy of what the wrapped handler writes
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent makes POSTs carrying an Idempotency-Key header safe to retry:
+// the first request with a key runs the handler and stores its response, and
+// later requests with the same key and body get that response replayed
+// instead of running again. Keys are per caller and endpoint. Requests
+// without the header are passed through unchanged.
+func (a *App) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > 255 {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+		scope := actorName(r) + " " + r.URL.Path
+
+		ctx := r.Context()
+		_, err = a.db.Exec(ctx, `
+			DELETE FROM idempotency_keys
+			WHERE scope = $1 AND key = $2 AND created_at < $3`, scope, key, time.Now().Add(-idempotencyTTL))
+		if err != nil {
+			logDB.Errorf("error expiring idempotency key: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		// claim the key; a row that is already there belongs to an earlier attempt
+		tag, err := a.db.Exec(ctx, `
+			INSERT INTO idempotency_keys (scope, key, fingerprint)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (org_id, scope, key) DO NOTHING`, scope, key, fingerprint)
+		if err != nil {
+			logDB.Errorf("error claiming idempotency key: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			a.replayIdempotent(w, r, scope, key, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		h(rec, r)
+
+		// a key left claimed would answer every retry with 409 until it
+		// expires, so a client that disconnected doesn't cancel this
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyWriteTimeout)
+		defer cancel()
+		// server errors aren't kept, so the client can retry with the same key
+		if rec.status == 0 || rec.status >= 500 {
+			if _, err := a.db.Exec(ctx, `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2`, scope, key); err != nil {
+				logDB.Errorf("error releasing idempotency key: %v", err)
+			}
+			return
+		}
+		_, err = a.db.Exec(ctx, `
+			UPDATE idempotency_keys
+			SET status = $3, content_type = $4, body = $5, completed_at = NOW()
+			WHERE scope = $1 AND key = $2`, scope, key, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		if err != nil {
+			logDB.Errorf("error storing idempotent response: %v", err)
+		}
+	}
+}
+
+// replayIdempotent answers a repeated key with the stored response
+func (a *App) replayIdempotent(w http.ResponseWriter, r *http.Request, scope, key, fingerprint string) {
+	var stored string
+	var status *int
+	var contentType *string
+	var body []byte
+	err := a.db.QueryRow(r.Context(), `
+		SELECT fingerprint, status, content_type, body FROM idempotency_keys
+		WHERE scope = $1 AND key = $2`, scope, key).Scan(&stored, &status, &contentType, &body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// released by a failed attempt in the meantime
+		http.Error(w, "request with this Idempotency-Key failed, please retry", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error getting idempotency key: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if stored != fingerprint {
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if status == nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "request with this Idempotency-Key is still being processed", http.StatusConflict)
+		return
+	}
+	if contentType != nil && *contentType != "" {
+		w.Header().Set("Content-Type", *contentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(*status)
+	w.Write(body)
+}
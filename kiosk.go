@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Members without a phone vote on shared terminals at the venue. An operator
+// signs in on the terminal and unlocks it at /kiosk/unlock under a name
+// ("Meja 1"); that ends the operator's session on the terminal and gives it
+// a kiosk cookie instead (random token, kiosk_terminals keeps its SHA-256).
+// The unlocked terminal shows /kiosk, where a voter enters only their code
+// and gets the usual ballot page. After the confirmation, or when a voter
+// walks away mid-ballot, the page goes to /kiosk/reset, which clears
+// whatever the browser kept and starts over at /kiosk for the next voter.
+// Every ballot cast on a terminal is audited under its name. Terminals lock
+// after kioskUnlockTTL, or when an operator locks them.
+
+const (
+	kioskCookie = "kiosk_terminal"
+
+	// kioskUnlockTTL is how long an unlocked terminal stays unlocked
+	kioskUnlockTTL = 12 * time.Hour
+
+	// kioskResetAfter is how long the confirmation stays on screen
+	kioskResetAfter = 10 * time.Second
+
+	// kioskIdleAfter resets a ballot page left without input this long
+	kioskIdleAfter = 2 * time.Minute
+
+	// maxKioskName caps the length of a terminal's name
+	maxKioskName = 50
+)
+
+// KioskTerminal is a shared voting terminal an operator unlocked
+type KioskTerminal struct {
+	ID         int
+	Name       string
+	UnlockedBy string
+	UnlockedAt time.Time
+	ExpiresAt  time.Time
+	Ballots    int // cast on the terminal
+}
+
+// KioskView is what the ballot page needs to know on a terminal
+type KioskView struct {
+	Terminal   string
+	ResetAfter int // seconds the confirmation stays on screen
+	IdleAfter  int // seconds without input before the page resets
+}
+
+// KioskData is the data of kiosk.html
+type KioskData struct {
+	Terminal *KioskTerminal // nil on a locked terminal
+	Error    string
+}
+
+// KioskUnlockData is the data of kiosk_unlock.html
+type KioskUnlockData struct {
+	Terminals []KioskTerminal // unlocked ones, newest first
+	Current   *KioskTerminal  // this browser's, if unlocked
+	Message   string
+	Error     string
+}
+
+// kioskTerminal returns the terminal of the kiosk cookie, if it is still
+// unlocked
+func (a *App) kioskTerminal(r *http.Request) (*KioskTerminal, bool) {
+	c, err := r.Cookie(kioskCookie)
+	if err != nil || c.Value == "" {
+		return nil, false
+	}
+	var t KioskTerminal
+	err = a.db.QueryRow(r.Context(), `
+		SELECT id, name, unlocked_by, unlocked_at, expires_at, ballots FROM kiosk_terminals
+		WHERE token_hash = $1 AND locked_at IS NULL AND expires_at > NOW()`, sessionTokenHash(c.Value)).
+		Scan(&t.ID, &t.Name, &t.UnlockedBy, &t.UnlockedAt, &t.ExpiresAt, &t.Ballots)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			logDB.Errorf("error getting kiosk terminal: %v", err)
+		}
+		return nil, false
+	}
+	return &t, true
+}
+
+// kioskView returns the terminal view of r, nil off a terminal
+func (a *App) kioskView(r *http.Request) *KioskView {
+	t, ok := a.kioskTerminal(r)
+	if !ok {
+		return nil
+	}
+	return &KioskView{
+		Terminal:   t.Name,
+		ResetAfter: int(kioskResetAfter / time.Second),
+		IdleAfter:  int(kioskIdleAfter / time.Second),
+	}
+}
+
+// kioskVoted audits a ballot cast on a terminal, if r comes from one
+func (a *App) kioskVoted(ctx context.Context, r *http.Request, code string) {
+	t, ok := a.kioskTerminal(r)
+	if !ok {
+		return
+	}
+	if _, err := a.db.Exec(ctx, `UPDATE kiosk_terminals SET ballots = ballots + 1 WHERE id = $1`, t.ID); err != nil {
+		logTally.Errorf("error counting kiosk ballot: %v", err)
+	}
+	a.audit(ctx, "kiosk:"+t.Name, "kiosk.vote", code, map[string]interface{}{"terminal": t.ID})
+}
+
+// kioskHandler: GET /kiosk asks an unlocked terminal's voter for their code,
+// or says the terminal is locked; POST takes the code to the ballot page
+func (a *App) kioskHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	t, ok := a.kioskTerminal(r)
+	data := KioskData{Terminal: t}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !ok {
+			break
+		}
+		if code := strings.TrimSpace(r.FormValue("code")); code != "" {
+			a.electionRedirect(w, r, "/?code="+url.QueryEscape(code), http.StatusSeeOther)
+			return
+		}
+		data.Error = "Masukkan kode pada surat undangan Anda."
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.tmpl.ExecuteTemplate(w, "kiosk.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// kioskResetHandler: /kiosk/reset clears what the browser kept of the last
+// voter, every cookie but the terminal's included, and starts over at /kiosk
+func (a *App) kioskResetHandler(w http.ResponseWriter, r *http.Request) {
+	for _, c := range r.Cookies() {
+		if c.Name != kioskCookie {
+			a.setCookie(w, r, c.Name, "", -1, http.SameSiteLaxMode)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Clear-Site-Data", `"cache", "storage"`)
+	a.electionRedirect(w, r, "/kiosk", http.StatusSeeOther)
+}
+
+// kioskUnlockHandler: GET /kiosk/unlock lists the unlocked terminals; POST
+// unlocks this browser as a terminal (action=unlock) or locks one
+// (action=lock). Operators and the superadmin.
+func (a *App) kioskUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data KioskUnlockData
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "unlock":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" || len(name) > maxKioskName {
+				data.Error = fmt.Sprintf("isi nama terminal, paling panjang %d karakter", maxKioskName)
+				break
+			}
+			if err := a.unlockKiosk(w, r, name); err != nil {
+				logDB.Errorf("error unlocking kiosk: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			a.electionRedirect(w, r, "/kiosk", http.StatusSeeOther)
+			return
+		case "lock":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			var name string
+			err := a.db.QueryRow(ctx, `
+				UPDATE kiosk_terminals SET locked_at = NOW(), locked_by = $2
+				WHERE id = $1 AND locked_at IS NULL
+				RETURNING name`, id, actorName(r)).Scan(&name)
+			if errors.Is(err, pgx.ErrNoRows) {
+				data.Error = "terminal tidak ditemukan atau sudah terkunci"
+				break
+			}
+			if err != nil {
+				logDB.Errorf("error locking kiosk: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			a.audit(ctx, actorName(r), "kiosk.lock", name, map[string]int{"terminal": id})
+			data.Message = fmt.Sprintf("Terminal %s dikunci", name)
+		default:
+			data.Error = "aksi tidak dikenal"
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	terminals, err := a.listKiosks(ctx)
+	if err != nil {
+		logDB.Errorf("error getting kiosk terminals: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Terminals = terminals
+	data.Current, _ = a.kioskTerminal(r)
+	if err := a.tmpl.ExecuteTemplate(w, "kiosk_unlock.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// unlockKiosk makes this browser the terminal name: the terminal it was
+// before is locked, the operator's session on it ends and it gets the kiosk
+// cookie
+func (a *App) unlockKiosk(w http.ResponseWriter, r *http.Request, name string) error {
+	ctx := r.Context()
+	actor := actorName(r)
+	if old, ok := a.kioskTerminal(r); ok {
+		if _, err := a.db.Exec(ctx, `UPDATE kiosk_terminals SET locked_at = NOW(), locked_by = $2 WHERE id = $1`, old.ID, actor); err != nil {
+			return err
+		}
+		a.audit(ctx, actor, "kiosk.lock", old.Name, map[string]int{"terminal": old.ID})
+	}
+
+	token := randomToken(32)
+	expires := time.Now().Add(kioskUnlockTTL)
+	var id int
+	err := a.db.QueryRow(ctx, `
+		INSERT INTO kiosk_terminals (name, token_hash, unlocked_by, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`, name, sessionTokenHash(token), actor, expires).Scan(&id)
+	if err != nil {
+		return err
+	}
+	a.audit(ctx, actor, "kiosk.unlock", name, map[string]int{"terminal": id})
+
+	// voters must not find the operator signed in
+	a.endBrowserSession(w, r)
+	a.setCookie(w, r, kioskCookie, token, int(kioskUnlockTTL/time.Second), http.SameSiteLaxMode)
+	return nil
+}
+
+func (a *App) listKiosks(ctx context.Context) ([]KioskTerminal, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, name, unlocked_by, unlocked_at, expires_at, ballots FROM kiosk_terminals
+		WHERE locked_at IS NULL AND expires_at > NOW()
+		ORDER BY unlocked_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terminals []KioskTerminal
+	for rows.Next() {
+		var t KioskTerminal
+		if err := rows.Scan(&t.ID, &t.Name, &t.UnlockedBy, &t.UnlockedAt, &t.ExpiresAt, &t.Ballots); err != nil {
+			return nil, err
+		}
+		terminals = append(terminals, t)
+	}
+	return terminals, rows.Err()
+}
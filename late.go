@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Bylaws may let a member who walks in on the day register while voting is
+// open, up to some time before close. With LATE_REGISTRATION_CUTOFF (e.g. 1h)
+// the superadmin registers them at /admin/late until that long before vote
+// end: the voter is added to the roll with a fresh code, shown once to hand
+// over, along with the committee member who approved the registration. Late
+// voters are flagged on the roll, listed on that page and counted in the
+// closing snapshot; they also show as additions against the roll commitment.
+
+const (
+	// maxLateText caps the approver and the note of a late registration
+	maxLateText = 200
+)
+
+// lateApproval is who let a voter onto the roll while voting was open
+type lateApproval struct {
+	approvedBy   string // the committee member who approved it
+	registeredBy string // the admin who entered it
+	note         string
+}
+
+// LateVoter is a voter registered while voting was open
+type LateVoter struct {
+	Code         string
+	Name         string
+	Group        string
+	ApprovedBy   string
+	RegisteredBy string
+	Note         string
+	RegisteredAt time.Time
+	Used         bool
+}
+
+// IssuedCode is the code of a voter just registered, shown once
+type IssuedCode struct {
+	Code string
+	Name string
+	Link string
+}
+
+// LateData is the data of late.html
+type LateData struct {
+	Enabled bool      // LATE_REGISTRATION_CUTOFF is set
+	Open    bool      // registration is open now
+	Start   time.Time // voting opens
+	Cutoff  time.Time // registration closes
+	Fields  []VoterField
+	Groups  []string
+	Voters  []LateVoter // newest first
+	Issued  *IssuedCode
+	Message string
+	Error   string
+}
+
+// lateWindow returns when late registration closes and whether it is open
+// at now
+func (a *App) lateWindow(now time.Time) (time.Time, bool) {
+	cutoff := a.voteEnd.Add(-a.lateCutoff)
+	return cutoff, a.lateCutoff > 0 && !now.Before(a.voteStart) && now.Before(cutoff)
+}
+
+// adminLateHandler: GET /admin/late lists the late registrations; POST
+// registers a walk-in. Superadmin only.
+func (a *App) adminLateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := LateData{Enabled: a.lateCutoff > 0, Start: a.voteStart, Fields: a.voterFields}
+	data.Cutoff, data.Open = a.lateWindow(time.Now())
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		issued, err := a.registerLate(ctx, r)
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+		data.Issued = issued
+		data.Message = fmt.Sprintf("%s terdaftar dengan kode %s", issued.Name, issued.Code)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	voters, err := a.listLate(ctx)
+	if err != nil {
+		logDB.Errorf("error getting late registrations: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Voters = voters
+	if data.Groups, err = a.listGroups(ctx); err != nil {
+		logDB.Errorf("error getting groups: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err := a.tmpl.ExecuteTemplate(w, "late.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// registerLate adds the walk-in of the form to the roll and returns their
+// code; the error is shown to the admin as-is
+func (a *App) registerLate(ctx context.Context, r *http.Request) (*IssuedCode, error) {
+	if _, open := a.lateWindow(time.Now()); !open {
+		return nil, errors.New("pendaftaran susulan hanya dibuka selama pemilihan berlangsung, sampai batas LATE_REGISTRATION_CUTOFF")
+	}
+	in := APIVoterInput{
+		Name:  strings.TrimSpace(r.FormValue("name")),
+		Phone: strings.TrimSpace(r.FormValue("phone")),
+		Group: strings.TrimSpace(r.FormValue("group")),
+		late: &lateApproval{
+			approvedBy:   strings.TrimSpace(r.FormValue("approved_by")),
+			registeredBy: actorName(r),
+			note:         strings.TrimSpace(r.FormValue("note")),
+		},
+	}
+	switch {
+	case in.Name == "" || in.Phone == "":
+		return nil, errors.New("nama dan nomor HP diperlukan")
+	case in.late.approvedBy == "":
+		return nil, errors.New("isi nama panitia yang menyetujui pendaftaran")
+	case len(in.late.approvedBy) > maxLateText || len(in.late.note) > maxLateText:
+		return nil, fmt.Errorf("penyetuju dan catatan paling panjang %d karakter", maxLateText)
+	}
+	for _, f := range a.voterFields {
+		if v := strings.TrimSpace(r.FormValue(fieldParamPrefix + f.Key)); v != "" {
+			if in.Attributes == nil {
+				in.Attributes = map[string]string{}
+			}
+			in.Attributes[f.Key] = v
+		}
+	}
+	attrs, err := normalizeAttributes(in.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	in.Attributes = attrs
+
+	code, err := a.createVoter(ctx, in)
+	switch {
+	case errors.Is(err, errVoterExists):
+		return nil, errors.New("nomor HP ini sudah ada di daftar pemilih")
+	case errors.Is(err, errIneligible):
+		return nil, errors.New("anggota ini tidak memenuhi syarat untuk memilih di pemilihan ini")
+	case errors.Is(err, errVoterQuota):
+		return nil, fmt.Errorf("kuota pemilih organisasi (%d) sudah penuh", a.quotas.Voters)
+	case err != nil:
+		logDB.Errorf("error registering late voter: %v", err)
+		return nil, errors.New("database error")
+	}
+	a.audit(ctx, in.late.registeredBy, "voter.late_register", code, map[string]string{
+		"approved_by": in.late.approvedBy, "note": in.late.note,
+	})
+	return &IssuedCode{Code: code, Name: in.Name, Link: a.baseURL(r) + "/?code=" + url.QueryEscape(code)}, nil
+}
+
+func (a *App) listLate(ctx context.Context) ([]LateVoter, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT v.code, COALESCE(vm.name, v.name, ''), COALESCE(vm.wilayah, ''), COALESCE(v.late_approved_by, ''),
+			COALESCE(v.late_registered_by, ''), COALESCE(v.late_note, ''), v.registered_late_at, v.used
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE v.registered_late_at IS NOT NULL
+		ORDER BY v.registered_late_at DESC, v.code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var voters []LateVoter
+	for rows.Next() {
+		var v LateVoter
+		if err := rows.Scan(&v.Code, &v.Name, &v.Group, &v.ApprovedBy, &v.RegisteredBy, &v.Note, &v.RegisteredAt, &v.Used); err != nil {
+			return nil, err
+		}
+		if err := a.pii.openAll(&v.Name); err != nil {
+			return nil, err
+		}
+		voters = append(voters, v)
+	}
+	return voters, rows.Err()
+}
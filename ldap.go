@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With LDAP_URL set, admins whose accounts live in the organization's
+// directory (Active Directory, OpenLDAP) sign in with their directory
+// username and password through the usual basic auth. A username that is
+// neither an env credential nor in admin_accounts is looked up under
+// LDAP_BASE_DN with LDAP_USER_FILTER by the LDAP_BIND_DN service account;
+// the entry's role is the first of LDAP_SUPERADMIN_FILTER,
+// LDAP_OPERATOR_FILTER and LDAP_OBSERVER_FILTER it matches, and a user
+// matching none is refused before their password is tried. The password is
+// checked by binding as the entry. Basic auth sends the password with every
+// request, so a successful sign-in is remembered for ldapCacheTTL.
+//
+// The client below is a minimal LDAPv3 one: simple bind, search and
+// StartTLS, over ldaps:// or ldap:// upgraded with StartTLS; the password
+// never crosses the network in the clear.
+
+const (
+	ldapTimeout  = 10 * time.Second
+	ldapCacheTTL = 5 * time.Minute
+
+	ldapResultSuccess            = 0
+	ldapResultSizeLimitExceeded  = 4
+	ldapResultInvalidCredentials = 49
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+var errLDAPInvalidCredentials = errors.New("ldap: invalid credentials")
+
+// ldapError is an unsuccessful result from the server
+type ldapError struct {
+	code int
+	msg  string
+}
+
+func (e ldapError) Error() string { return fmt.Sprintf("ldap: result %d: %s", e.code, e.msg) }
+
+// ldapDirectory is the directory configured through LDAP_*
+type ldapDirectory struct {
+	addr       string
+	tls        *tls.Config
+	startTLS   bool // ldap://, upgraded before binding
+	bindDN     string
+	bindPass   string
+	baseDN     string
+	userFilter string
+	roles      []ldapRoleFilter // in the order of roles
+
+	mu       sync.Mutex
+	cacheKey []byte
+	cache    map[string]ldapCached
+}
+
+type ldapRoleFilter struct {
+	role   Role
+	filter string
+}
+
+type ldapCached struct {
+	role    Role
+	expires time.Time
+}
+
+// loadLDAP reads the directory from the env; nil without LDAP_URL
+func loadLDAP() (*ldapDirectory, error) {
+	rawURL := os.Getenv("LDAP_URL")
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid LDAP_URL %q", rawURL)
+	}
+	d := &ldapDirectory{
+		bindDN:     os.Getenv("LDAP_BIND_DN"),
+		bindPass:   os.Getenv("LDAP_BIND_PASSWORD"),
+		baseDN:     os.Getenv("LDAP_BASE_DN"),
+		userFilter: os.Getenv("LDAP_USER_FILTER"),
+		cacheKey:   make([]byte, 32),
+		cache:      map[string]ldapCached{},
+		tls:        &tls.Config{ServerName: u.Hostname()},
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+	case "ldap":
+		d.startTLS = true
+		if port == "" {
+			port = "389"
+		}
+	default:
+		return nil, fmt.Errorf("invalid LDAP_URL: unsupported scheme %q (use ldaps:// or ldap:// with StartTLS)", u.Scheme)
+	}
+	d.addr = net.JoinHostPort(u.Hostname(), port)
+	if caFile := os.Getenv("LDAP_CA_FILE"); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("LDAP_CA_FILE: %v", err)
+		}
+		d.tls.RootCAs = x509.NewCertPool()
+		if !d.tls.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("LDAP_CA_FILE: no certificates found")
+		}
+	}
+	if d.baseDN == "" {
+		return nil, fmt.Errorf("LDAP_URL needs LDAP_BASE_DN, e.g. DC=gkjp,DC=id")
+	}
+	if (d.bindDN == "") != (d.bindPass == "") {
+		return nil, fmt.Errorf("LDAP_BIND_DN and LDAP_BIND_PASSWORD go together")
+	}
+	if d.userFilter == "" {
+		d.userFilter = "(sAMAccountName=%s)"
+	}
+	if !strings.Contains(d.userFilter, "%s") {
+		return nil, fmt.Errorf("LDAP_USER_FILTER must contain %%s for the username")
+	}
+	if _, err := ldapFilter(strings.ReplaceAll(d.userFilter, "%s", "x")); err != nil {
+		return nil, fmt.Errorf("invalid LDAP_USER_FILTER: %v", err)
+	}
+	for _, role := range roles {
+		env := "LDAP_" + strings.ToUpper(string(role)) + "_FILTER"
+		filter := os.Getenv(env)
+		if filter == "" {
+			continue
+		}
+		if _, err := ldapFilter(filter); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", env, err)
+		}
+		d.roles = append(d.roles, ldapRoleFilter{role, filter})
+	}
+	if len(d.roles) == 0 {
+		return nil, fmt.Errorf("LDAP_URL needs at least one of LDAP_SUPERADMIN_FILTER, LDAP_OPERATOR_FILTER, LDAP_OBSERVER_FILTER")
+	}
+	if _, err := rand.Read(d.cacheKey); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// cacheEntry keys a username and password in the cache without keeping the
+// password
+func (d *ldapDirectory) cacheEntry(user, pass string) string {
+	mac := hmac.New(sha256.New, d.cacheKey)
+	fmt.Fprintf(mac, "%s\x00%s", user, pass)
+	return string(mac.Sum(nil))
+}
+
+// authenticate checks user and pass against the directory and returns the
+// account with its role
+func (d *ldapDirectory) authenticate(ctx context.Context, user, pass string) (*Account, bool) {
+	if user == "" || pass == "" {
+		// an empty password would be an unauthenticated bind, which succeeds
+		return nil, false
+	}
+	key := d.cacheEntry(user, pass)
+	d.mu.Lock()
+	cached, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return &Account{Username: user, Role: cached.role}, true
+	}
+
+	role, err := d.check(ctx, user, pass)
+	if err != nil {
+		if !errors.Is(err, errLDAPInvalidCredentials) {
+			logHTTP.Errorf("error checking ldap login: %v", err)
+		}
+		return nil, false
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	for k, c := range d.cache {
+		if now.After(c.expires) {
+			delete(d.cache, k)
+		}
+	}
+	d.cache[key] = ldapCached{role: role, expires: now.Add(ldapCacheTTL)}
+	d.mu.Unlock()
+	return &Account{Username: user, Role: role}, true
+}
+
+// check finds user's entry, its role and then binds as it with pass
+func (d *ldapDirectory) check(ctx context.Context, user, pass string) (Role, error) {
+	c, err := d.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer c.close()
+	if d.bindDN != "" {
+		if err := c.bind(d.bindDN, d.bindPass); err != nil {
+			return "", fmt.Errorf("service bind: %w", err)
+		}
+	}
+
+	filter, err := ldapFilter(strings.ReplaceAll(d.userFilter, "%s", ldapEscape(user)))
+	if err != nil {
+		return "", err
+	}
+	entries, err := c.search(d.baseDN, ldapScopeSubtree, filter, 2)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 {
+		// unknown or ambiguous usernames fail like a wrong password
+		return "", errLDAPInvalidCredentials
+	}
+	dn := entries[0]
+
+	var role Role
+	for _, rf := range d.roles {
+		filter, _ := ldapFilter(rf.filter)
+		matched, err := c.search(dn, ldapScopeBase, filter, 1)
+		if err != nil {
+			return "", err
+		}
+		if len(matched) > 0 {
+			role = rf.role
+			break
+		}
+	}
+	if role == "" {
+		logHTTP.Warnf("ldap: %s matches no role filter", user)
+		return "", errLDAPInvalidCredentials
+	}
+
+	if err := c.bind(dn, pass); err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// ldapEscape escapes a value for use in a search filter (RFC 4515)
+func ldapEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// BER encoding of the few LDAP messages we send
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+	return append(append([]byte{tag}, berLength(len(body))...), body...)
+}
+
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+	berSequence    = 0x30
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+
+	ldapScopeBase    = 0
+	ldapScopeSubtree = 2
+)
+
+// ldapFilter encodes a search filter in the string form of RFC 4515
+func ldapFilter(s string) ([]byte, error) {
+	f, rest, err := parseLDAPFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after filter", rest)
+	}
+	return f, nil
+}
+
+func parseLDAPFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("filter must start with (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", fmt.Errorf("unterminated filter")
+	}
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			f, rest, err := parseLDAPFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			parts, s = append(parts, f), rest
+		}
+		if !strings.HasPrefix(s, ")") || len(parts) == 0 {
+			return nil, "", fmt.Errorf("bad filter list")
+		}
+		return berTLV(tag, parts...), s[1:], nil
+	case '!':
+		f, rest, err := parseLDAPFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("bad ! filter")
+		}
+		return berTLV(0xa2, f), rest[1:], nil
+	}
+
+	end := strings.IndexAny(s, "()")
+	if end < 0 || s[end] != ')' {
+		return nil, "", fmt.Errorf("unterminated filter")
+	}
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", fmt.Errorf("bad filter item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	op := attr[len(attr)-1]
+	switch op {
+	case '~', '>', '<', ':':
+		attr = attr[:len(attr)-1]
+	default:
+		op = '='
+	}
+
+	if op == ':' {
+		f, err := ldapExtensibleMatch(attr, value)
+		return f, rest, err
+	}
+	if attr == "" {
+		return nil, "", fmt.Errorf("bad filter item %q", item)
+	}
+	if op == '=' && value == "*" {
+		return berString(0x87, attr), rest, nil
+	}
+	if op == '=' && strings.Contains(value, "*") {
+		pieces := strings.Split(value, "*")
+		var subs [][]byte
+		for i, p := range pieces {
+			if p == "" {
+				continue
+			}
+			v, err := ldapUnescape(p)
+			if err != nil {
+				return nil, "", err
+			}
+			tag := byte(0x81) // any
+			switch i {
+			case 0:
+				tag = 0x80 // initial
+			case len(pieces) - 1:
+				tag = 0x82 // final
+			}
+			subs = append(subs, berTLV(tag, v))
+		}
+		return berTLV(0xa4, berString(berOctetString, attr), berTLV(berSequence, subs...)), rest, nil
+	}
+	v, err := ldapUnescape(value)
+	if err != nil {
+		return nil, "", err
+	}
+	tag := map[byte]byte{'=': 0xa3, '>': 0xa5, '<': 0xa6, '~': 0xa8}[op]
+	return berTLV(tag, berString(berOctetString, attr), berTLV(berOctetString, v)), rest, nil
+}
+
+// ldapExtensibleMatch encodes attr[:dn][:rule]:=value, e.g. the
+// memberOf:1.2.840.113556.1.4.1941: match of nested AD groups
+func ldapExtensibleMatch(attr, value string) ([]byte, error) {
+	parts := strings.Split(attr, ":")
+	var rule, typ string
+	var dnAttrs bool
+	typ = parts[0]
+	for _, p := range parts[1:] {
+		switch {
+		case strings.EqualFold(p, "dn"):
+			dnAttrs = true
+		case p != "":
+			rule = p
+		}
+	}
+	if typ == "" && rule == "" {
+		return nil, fmt.Errorf("extensible match needs an attribute or a rule")
+	}
+	v, err := ldapUnescape(value)
+	if err != nil {
+		return nil, err
+	}
+	var fields [][]byte
+	if rule != "" {
+		fields = append(fields, berString(0x81, rule))
+	}
+	if typ != "" {
+		fields = append(fields, berString(0x82, typ))
+	}
+	fields = append(fields, berTLV(0x83, v))
+	if dnAttrs {
+		fields = append(fields, berTLV(0x84, []byte{0xff}))
+	}
+	return berTLV(0xa9, fields...), nil
+}
+
+// ldapUnescape decodes the \xx escapes of a filter value
+func ldapUnescape(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return nil, fmt.Errorf("bad escape in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("bad escape in %q", s)
+		}
+		b = append(b, c[0])
+		i += 2
+	}
+	return b, nil
+}
+
+// BER decoding of the replies
+
+type berElement struct {
+	tag  byte
+	data []byte
+}
+
+func readBER(r io.Reader) (berElement, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return berElement{}, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return berElement{}, fmt.Errorf("ldap: bad length")
+		}
+		lb := make([]byte, size)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return berElement{}, err
+		}
+		n = 0
+		for _, b := range lb {
+			n = n<<8 | int(b)
+		}
+		if n > 16<<20 {
+			return berElement{}, fmt.Errorf("ldap: message too large")
+		}
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return berElement{}, err
+	}
+	return berElement{hdr[0], data}, nil
+}
+
+// children splits a constructed element into its elements
+func (e berElement) children() ([]berElement, error) {
+	var out []berElement
+	r := strings.NewReader(string(e.data))
+	for r.Len() > 0 {
+		c, err := readBER(r)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: malformed reply")
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func (e berElement) int() int {
+	n := 0
+	for _, b := range e.data {
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+func (d *ldapDirectory) dial(ctx context.Context) (*ldapConn, error) {
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	var err error
+	if d.startTLS {
+		conn, err = dialer.DialContext(ctx, "tcp", d.addr)
+	} else {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: d.tls}).DialContext(ctx, "tcp", d.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if d.startTLS {
+		if err := c.extended(ldapStartTLSOID); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+		tlsConn := tls.Client(conn, d.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+		c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+	return c, nil
+}
+
+func (c *ldapConn) close() {
+	c.msgID++
+	c.conn.Write(berTLV(berSequence, berInt(berInteger, c.msgID), []byte{ldapUnbindRequest, 0}))
+	c.conn.Close()
+}
+
+// send writes a request and returns its message id
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.msgID++
+	_, err := c.conn.Write(berTLV(berSequence, berInt(berInteger, c.msgID), op))
+	return c.msgID, err
+}
+
+// receive reads the protocol op of the next reply to id
+func (c *ldapConn) receive(id int) (berElement, error) {
+	for {
+		msg, err := readBER(c.r)
+		if err != nil {
+			return berElement{}, err
+		}
+		parts, err := msg.children()
+		if err != nil || len(parts) < 2 {
+			return berElement{}, fmt.Errorf("ldap: malformed reply")
+		}
+		if parts[0].int() != id {
+			// e.g. a notice of disconnection (id 0)
+			if parts[0].int() == 0 {
+				return berElement{}, fmt.Errorf("ldap: server closed the connection")
+			}
+			continue
+		}
+		return parts[1], nil
+	}
+}
+
+// ldapResult reads the LDAPResult of a response op
+func ldapResult(op berElement) error {
+	fields, err := op.children()
+	if err != nil || len(fields) < 3 {
+		return fmt.Errorf("ldap: malformed result")
+	}
+	switch code := fields[0].int(); code {
+	case ldapResultSuccess:
+		return nil
+	case ldapResultInvalidCredentials:
+		return errLDAPInvalidCredentials
+	default:
+		return ldapError{code, string(fields[2].data)}
+	}
+}
+
+func (c *ldapConn) bind(dn, pass string) error {
+	id, err := c.send(berTLV(ldapBindRequest, berInt(berInteger, 3), berString(berOctetString, dn), berString(0x80, pass)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return fmt.Errorf("ldap: unexpected reply to bind")
+	}
+	return ldapResult(op)
+}
+
+func (c *ldapConn) extended(oid string) error {
+	id, err := c.send(berTLV(ldapExtendedRequest, berString(0x80, oid)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapExtendedResponse {
+		return fmt.Errorf("ldap: unexpected reply to extended request")
+	}
+	return ldapResult(op)
+}
+
+// search returns the DNs of the entries under base matching filter, asking
+// for no attributes
+func (c *ldapConn) search(base string, scope int, filter []byte, sizeLimit int) ([]string, error) {
+	id, err := c.send(berTLV(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, scope),
+		berInt(berEnumerated, 0), // never dereference aliases
+		berInt(berInteger, sizeLimit),
+		berInt(berInteger, int(ldapTimeout.Seconds())),
+		berTLV(berBoolean, []byte{0xff}), // types only
+		filter,
+		berTLV(berSequence, berString(berOctetString, "1.1")), // no attributes
+	))
+	if err != nil {
+		return nil, err
+	}
+	var dns []string
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			fields, err := op.children()
+			if err != nil || len(fields) == 0 {
+				return nil, fmt.Errorf("ldap: malformed entry")
+			}
+			dns = append(dns, string(fields[0].data))
+		case ldapSearchReference:
+			// referrals to other servers aren't followed
+		case ldapSearchDone:
+			if err := ldapResult(op); err != nil {
+				// more entries than sizeLimit: enough to tell
+				var le ldapError
+				if errors.As(err, &le) && le.code == ldapResultSizeLimitExceeded {
+					return dns, nil
+				}
+				return nil, err
+			}
+			return dns, nil
+		default:
+			return nil, fmt.Errorf("ldap: unexpected reply to search")
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// When everyone votes at 08:00 sharp the database, not Go, is the
+// bottleneck: requests queue for connections until they all time out. Past
+// MAX_IN_FLIGHT concurrent requests the server answers at once with a small
+// "busy, retry in a few seconds" response (503 with Retry-After) instead of
+// queueing. Ballots get a quarter of the limit on top, so page loads are
+// turned away before votes are, and static files are never shed.
+
+const (
+	defaultMaxInFlight = 200
+	shedRetryAfter     = 5 // seconds
+)
+
+type loadShedder struct {
+	max      int64 // 0 turns shedding off
+	inFlight atomic.Int64
+	shed     atomic.Int64 // requests turned away since the last log line
+	lastLog  atomic.Int64 // unix seconds
+}
+
+// limit is the in-flight count up to which r is served
+func (s *loadShedder) limit(r *http.Request) int64 {
+	if r.Method == http.MethodPost && r.URL.Path == "/vote" {
+		return s.max + s.max/4
+	}
+	return s.max
+}
+
+// shedLoad serves h while fewer than the limit of requests are in flight
+func (a *App) shedLoad(h http.Handler) http.Handler {
+	s := &a.shedder
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.max == 0 || strings.HasPrefix(r.URL.Path, "/static/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		n := s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		if n > s.limit(r) {
+			s.logShed(n)
+			writeBusy(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// logShed notes shedding at most every 10 seconds
+func (s *loadShedder) logShed(inFlight int64) {
+	shed := s.shed.Add(1)
+	now := time.Now().Unix()
+	last := s.lastLog.Load()
+	if now-last < 10 || !s.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+	s.shed.Add(-shed)
+	logHTTP.Warnf("overloaded: %d requests in flight, %d turned away since the last report", inFlight, shed)
+}
+
+const busyPage = `<!doctype html>
+<html lang="id">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width,initial-scale=1">
+%s<title>Server sibuk</title>
+<style>body{font-family:sans-serif;text-align:center;padding:48px 16px;color:#2c3e50}</style>
+</head>
+<body>
+<h1>Server sedang sibuk</h1>
+<p>%s</p>
+</body>
+</html>
+`
+
+// writeBusy answers without touching the database or the templates
+func writeBusy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(shedRetryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+	msg := fmt.Sprintf("Banyak pemilih sedang mengakses. Silakan coba lagi dalam %d detik.", shedRetryAfter)
+	if r.Method != http.MethodGet {
+		what := "permintaan Anda <strong>belum diproses</strong>"
+		if r.URL.Path == "/vote" {
+			what = "pilihan Anda <strong>belum tercatat</strong>"
+		}
+		msg = fmt.Sprintf("Banyak pemilih sedang mengakses dan %s. Kembali ke halaman sebelumnya dan kirim ulang dalam %d detik.",
+			what, shedRetryAfter)
+	}
+	switch preferredType(r, "application/json", "text/html") {
+	case "application/json":
+		writeJSON(w, http.StatusServiceUnavailable, ErrorBody{Code: errorCode(http.StatusServiceUnavailable), Message: "server busy, retry later"})
+	case "text/html":
+		refresh := ""
+		if r.Method == http.MethodGet {
+			refresh = fmt.Sprintf("<meta http-equiv=\"refresh\" content=\"%d\">\n", shedRetryAfter)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, busyPage, refresh, msg)
+	default:
+		http.Error(w, "server busy, retry later", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// On a host without a log shipper the server can keep its own log: with
+// LOG_FILE everything it prints, to stdout and stderr, also goes to that
+// file, lines from stdout stamped with the time like the log package does.
+// The file is rotated once it reaches LOG_FILE_MAX_MB (default 100) and,
+// with LOG_FILE_ROTATE (e.g. 24h), once it has been written that long; the
+// rotated files are renamed <LOG_FILE>.<time> and only the newest
+// LOG_FILE_KEEP (default 7) are kept.
+
+const (
+	defaultLogFileMaxMB = 100
+	defaultLogFileKeep  = 7
+
+	// logFileStamp names rotated files; it sorts by time
+	logFileStamp = "20060102-150405"
+)
+
+// rotatingFile is a log file that rotates itself by size and age
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	every    time.Duration // 0 rotates by size only
+	keep     int
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// openRotatingFile opens path for appending, creating it if needed
+func openRotatingFile(path string, maxSize int64, every time.Duration, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, every: every, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.openedAt = f, info.Size(), time.Now()
+	// a file kept from an earlier run is as old as its first write
+	if info.Size() > 0 && info.ModTime().Before(r.openedAt) {
+		r.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+// Write appends p, rotating first when p would take the file over its size
+// or the file is due
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	due := r.every > 0 && time.Since(r.openedAt) >= r.every
+	if r.size > 0 && (r.size+int64(len(p)) > r.maxSize || due) {
+		if err := r.rotate(); err != nil {
+			// keep writing to the file we have rather than lose the line
+			fmt.Fprintln(os.Stderr, "error rotating log file:", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file after the current time, starts a new one and
+// removes the rotated files past keep
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().Format(logFileStamp)
+	if err := os.Rename(r.path, rotated); err != nil {
+		// reopen the file so writes go on
+		if oerr := r.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// prune removes the oldest rotated files, keeping r.keep
+func (r *rotatingFile) prune() error {
+	old, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, name := range old {
+		suffix := name[len(r.path)+1:]
+		if _, err := time.Parse(logFileStamp, suffix); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	if len(rotated) <= r.keep {
+		return nil
+	}
+	slices.Sort(rotated)
+	for _, name := range rotated[:len(rotated)-r.keep] {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startLogFile tees stdout and stderr into LOG_FILE, if set
+func startLogFile() error {
+	path := os.Getenv("LOG_FILE")
+	if path == "" {
+		return nil
+	}
+	maxMB := defaultLogFileMaxMB
+	if v := os.Getenv("LOG_FILE_MAX_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid LOG_FILE_MAX_MB %q: use a size in megabytes", v)
+		}
+		maxMB = n
+	}
+	var every time.Duration
+	if v := os.Getenv("LOG_FILE_ROTATE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return fmt.Errorf("invalid LOG_FILE_ROTATE %q: use a duration such as 24h", v)
+		}
+		every = d
+	}
+	keep := defaultLogFileKeep
+	if v := os.Getenv("LOG_FILE_KEEP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid LOG_FILE_KEEP %q: use a number of rotated files", v)
+		}
+		keep = n
+	}
+
+	file, err := openRotatingFile(path, int64(maxMB)<<20, every, keep)
+	if err != nil {
+		return fmt.Errorf("unable to open LOG_FILE: %v", err)
+	}
+	stdout, err := teeLines(os.Stdout, file, true)
+	if err != nil {
+		return err
+	}
+	stderr, err := teeLines(os.Stderr, file, false)
+	if err != nil {
+		return err
+	}
+	os.Stdout, os.Stderr = stdout, stderr
+	log.SetOutput(stderr)
+	return nil
+}
+
+// teeLines returns a pipe whose lines are copied to out and to file, each
+// line whole; stamp puts the time before the file's copy of each line
+func teeLines(out *os.File, file io.Writer, stamp bool) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		lines := bufio.NewReader(pr)
+		for {
+			line, err := lines.ReadBytes('\n')
+			if len(line) > 0 {
+				out.Write(line)
+				if stamp {
+					line = append([]byte(time.Now().Format("2006/01/02 15:04:05 ")), line...)
+				}
+				file.Write(line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return pw, nil
+}
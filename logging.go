@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log lines of the http, db, mailer, tally and jobs (scheduler) subsystems go
+// through a level filter: LOG_LEVEL sets the level of all of them and, after a
+// comma, of single subsystems, e.g. `warn` for a quiet production run or
+// `warn,http=debug,db=debug` for the vote path in detail. During an incident
+// a superadmin turns levels up at /admin/logging for a while without a
+// restart; the change is NOTIFYed to every instance of the organization
+// (over the results LISTEN connection, see results_cache.go) and falls back
+// to LOG_LEVEL when it expires. Debug lines never hold a choice or a code.
+
+const (
+	logLevelsChannel = "log_levels"
+
+	// maxLogOverride caps how long levels set at /admin/logging last
+	maxLogOverride = 24 * time.Hour
+)
+
+// logLevel is how much a subsystem logs, debug being the most
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+	levelOff
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l logLevel) String() string { return logLevelNames[l] }
+
+func parseLogLevel(s string) (logLevel, error) {
+	if i := slices.Index(logLevelNames, strings.ToLower(strings.TrimSpace(s))); i >= 0 {
+		return logLevel(i), nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (use %s)", s, strings.Join(logLevelNames, ", "))
+}
+
+// logSubsystem names the part of the server a log line comes from
+type logSubsystem string
+
+const (
+	logHTTP   logSubsystem = "http"
+	logDB     logSubsystem = "db"
+	logMailer logSubsystem = "mailer"
+	logTally  logSubsystem = "tally"
+	logJobs   logSubsystem = "jobs"
+)
+
+var logSubsystems = []logSubsystem{logHTTP, logDB, logMailer, logTally, logJobs}
+
+// logConfig is a default level and the subsystems that differ from it
+type logConfig struct {
+	Default    logLevel
+	Subsystems map[logSubsystem]logLevel
+}
+
+// parseLogConfig reads the LOG_LEVEL syntax: an optional default level,
+// then subsystem=level pairs, separated by commas
+func parseLogConfig(spec string) (logConfig, error) {
+	c := logConfig{Default: levelInfo, Subsystems: map[logSubsystem]logLevel{}}
+	for i, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, pair := strings.Cut(part, "=")
+		if !pair {
+			if i > 0 {
+				return c, fmt.Errorf("the default level %q goes first", part)
+			}
+			l, err := parseLogLevel(part)
+			if err != nil {
+				return c, err
+			}
+			c.Default = l
+			continue
+		}
+		sub := logSubsystem(strings.ToLower(strings.TrimSpace(name)))
+		if !slices.Contains(logSubsystems, sub) {
+			return c, fmt.Errorf("unknown log subsystem %q (use http, db, mailer, tally, jobs)", name)
+		}
+		l, err := parseLogLevel(value)
+		if err != nil {
+			return c, err
+		}
+		c.Subsystems[sub] = l
+	}
+	return c, nil
+}
+
+// String writes c in the LOG_LEVEL syntax
+func (c logConfig) String() string {
+	parts := []string{c.Default.String()}
+	for _, sub := range logSubsystems {
+		if l, ok := c.Subsystems[sub]; ok && l != c.Default {
+			parts = append(parts, string(sub)+"="+l.String())
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c logConfig) level(sub logSubsystem) logLevel {
+	if l, ok := c.Subsystems[sub]; ok {
+		return l
+	}
+	return c.Default
+}
+
+// logFilter holds the levels in effect: LOG_LEVEL, or the override set at
+// /admin/logging until it expires
+type logFilter struct {
+	mu       sync.RWMutex
+	base     logConfig
+	override *logConfig
+	until    time.Time
+	setBy    string
+}
+
+// logs is the filter of this process
+var logs = &logFilter{base: logConfig{Default: levelInfo}}
+
+// loadLogLevels reads LOG_LEVEL
+func loadLogLevels() error {
+	c, err := parseLogConfig(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL: %v", err)
+	}
+	logs.mu.Lock()
+	logs.base = c
+	logs.mu.Unlock()
+	return nil
+}
+
+// current returns the levels in effect, and until when if overridden
+func (f *logFilter) current() (logConfig, *logOverride) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.override != nil && time.Now().Before(f.until) {
+		return *f.override, &logOverride{Spec: f.override.String(), Until: f.until, SetBy: f.setBy}
+	}
+	return f.base, nil
+}
+
+func (f *logFilter) enabled(sub logSubsystem, l logLevel) bool {
+	c, _ := f.current()
+	return l >= c.level(sub)
+}
+
+func (f *logFilter) setOverride(c *logConfig, until time.Time, by string) {
+	f.mu.Lock()
+	f.override, f.until, f.setBy = c, until, by
+	f.mu.Unlock()
+}
+
+func (s logSubsystem) logf(l logLevel, format string, args ...interface{}) {
+	if logs.enabled(s, l) {
+		log.Printf("%s [%s] %s", strings.ToUpper(l.String()), s, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s logSubsystem) Debugf(format string, args ...interface{}) { s.logf(levelDebug, format, args...) }
+func (s logSubsystem) Infof(format string, args ...interface{})  { s.logf(levelInfo, format, args...) }
+func (s logSubsystem) Warnf(format string, args ...interface{})  { s.logf(levelWarn, format, args...) }
+func (s logSubsystem) Errorf(format string, args ...interface{}) { s.logf(levelError, format, args...) }
+
+// logOverride is levels set at /admin/logging, as NOTIFYed to the instances
+type logOverride struct {
+	Org   string    `json:"org"`
+	Spec  string    `json:"spec"` // empty goes back to LOG_LEVEL
+	Until time.Time `json:"until"`
+	SetBy string    `json:"set_by"`
+}
+
+// applyLogOverride takes the levels of a notification meant for this
+// organization
+func (a *App) applyLogOverride(payload string) error {
+	var o logOverride
+	if err := json.Unmarshal([]byte(payload), &o); err != nil {
+		return err
+	}
+	if o.Org != a.org {
+		return nil
+	}
+	if o.Spec == "" {
+		logs.setOverride(nil, time.Time{}, "")
+		return nil
+	}
+	c, err := parseLogConfig(o.Spec)
+	if err != nil {
+		return err
+	}
+	logs.setOverride(&c, o.Until, o.SetBy)
+	return nil
+}
+
+// LoggingData is the data of logging.html
+type LoggingData struct {
+	Base       string       // LOG_LEVEL
+	Override   *logOverride // nil when LOG_LEVEL is in effect
+	Subsystems []logSubsystem
+	Levels     []string
+	Message    string
+	Error      string
+}
+
+// adminLoggingHandler: GET /admin/logging shows the levels in effect; POST
+// sets levels on every instance for a while (action=set) or goes back to
+// LOG_LEVEL (action=reset). Superadmin only.
+func (a *App) adminLoggingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := LoggingData{Subsystems: logSubsystems, Levels: logLevelNames}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var err error
+		switch r.FormValue("action") {
+		case "set":
+			data.Message, err = a.overrideLogLevels(ctx, r, actorName(r))
+		case "reset":
+			o := logOverride{Org: a.org, SetBy: actorName(r)}
+			if err = a.notifyLogLevels(ctx, o); err == nil {
+				a.audit(ctx, o.SetBy, "logging.reset", "", nil)
+				data.Message = "Level log kembali ke LOG_LEVEL"
+			}
+		default:
+			err = errors.New("aksi tidak dikenal")
+		}
+		if err != nil {
+			data.Error = err.Error()
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logs.mu.RLock()
+	data.Base = logs.base.String()
+	logs.mu.RUnlock()
+	_, data.Override = logs.current()
+	if err := a.tmpl.ExecuteTemplate(w, "logging.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// overrideLogLevels sets the levels of the form for the duration chosen;
+// the error is shown to the admin as-is
+func (a *App) overrideLogLevels(ctx context.Context, r *http.Request, actor string) (string, error) {
+	parts := []string{r.FormValue("default")}
+	for _, sub := range logSubsystems {
+		if v := r.FormValue("level." + string(sub)); v != "" {
+			parts = append(parts, string(sub)+"="+v)
+		}
+	}
+	c, err := parseLogConfig(strings.Join(parts, ","))
+	if err != nil {
+		return "", err
+	}
+	d, err := time.ParseDuration(r.FormValue("for"))
+	if err != nil || d <= 0 || d > maxLogOverride {
+		return "", fmt.Errorf("pilih lama berlaku, paling lama %v", maxLogOverride)
+	}
+	o := logOverride{Org: a.org, Spec: c.String(), Until: time.Now().Add(d), SetBy: actor}
+	if err := a.notifyLogLevels(ctx, o); err != nil {
+		return "", err
+	}
+	a.audit(ctx, actor, "logging.set", "", map[string]string{"levels": o.Spec, "until": o.Until.Format(time.RFC3339)})
+	return fmt.Sprintf("Level log %s berlaku sampai %s", o.Spec, o.Until.In(a.voteEnd.Location()).Format("15:04")), nil
+}
+
+// notifyLogLevels applies o here and tells the other instances
+func (a *App) notifyLogLevels(ctx context.Context, o logOverride) error {
+	payload, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	// this instance doesn't wait for the notification
+	if err := a.applyLogOverride(string(payload)); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(ctx, `SELECT pg_notify($1, $2)`, logLevelsChannel, string(payload)); err != nil {
+		logDB.Errorf("error notifying log levels: %v", err)
+		return errors.New("level log hanya berubah di server ini: database error")
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every admin sign-in attempt leaves a row in admin_logins: who, how, whether
+// it worked and why not, the client address, its network (/24, or /64 for
+// IPv6, as in the access log) and the user agent. Basic auth is checked on
+// every request, so only its failures are attempts. Two things raise an
+// alert, sent to ADMIN_ALERT_EMAIL and ADMIN_ALERT_SLACK_URL and recorded in
+// the audit log as account.login_alert:
+//
+//   - ADMIN_ALERT_FAILURES failed attempts (default 5) for one username or
+//     from one address within ADMIN_ALERT_WINDOW (default 15m), at any time
+//   - a successful sign-in from a network the account hasn't signed in from
+//     in loginHistory, while voting is open
+//
+// An alert isn't repeated for the same username or address within the
+// window.
+
+const (
+	defaultAlertFailures = 5
+	defaultAlertWindow   = 15 * time.Minute
+
+	// loginHistory is how long attempts are kept, and how far back a
+	// network counts as known
+	loginHistory = 90 * 24 * time.Hour
+)
+
+// Sign-in methods of admin_logins
+const (
+	LoginPassword = "password" // form at /admin/login, including LDAP
+	LoginBasic    = "basic"    // basic auth header
+	LoginRemember = "remember" // remembered browser
+	LoginOIDC     = "oidc"
+	LoginSAML     = "saml"
+)
+
+// loginAlerts is where alerts about admin sign-ins go
+type loginAlerts struct {
+	emails   []string
+	slackURL string
+	failures int
+	window   time.Duration
+
+	mu   sync.Mutex
+	sent map[string]time.Time // alert key -> last sent
+}
+
+// loadLoginAlerts reads ADMIN_ALERT_EMAIL (comma separated),
+// ADMIN_ALERT_SLACK_URL (an incoming webhook), ADMIN_ALERT_FAILURES and
+// ADMIN_ALERT_WINDOW. Attempts are recorded without either destination.
+func loadLoginAlerts() (*loginAlerts, error) {
+	l := &loginAlerts{failures: defaultAlertFailures, window: defaultAlertWindow, sent: map[string]time.Time{}}
+	for _, e := range strings.Split(os.Getenv("ADMIN_ALERT_EMAIL"), ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !validEmail(e) {
+			return nil, fmt.Errorf("invalid ADMIN_ALERT_EMAIL address %q", e)
+		}
+		l.emails = append(l.emails, e)
+	}
+	if v := os.Getenv("ADMIN_ALERT_SLACK_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid ADMIN_ALERT_SLACK_URL: an https:// webhook address")
+		}
+		l.slackURL = v
+	}
+	if v := os.Getenv("ADMIN_ALERT_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 {
+			return nil, fmt.Errorf("invalid ADMIN_ALERT_FAILURES %q: a number of at least 2", v)
+		}
+		l.failures = n
+	}
+	if v := os.Getenv("ADMIN_ALERT_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute || d > 24*time.Hour {
+			return nil, fmt.Errorf("invalid ADMIN_ALERT_WINDOW %q: a duration between 1m and 24h", v)
+		}
+		l.window = d
+	}
+	return l, nil
+}
+
+// due reports whether the alert under key may go out now, and if so marks
+// it sent
+func (l *loginAlerts) due(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, t := range l.sent {
+		if now.Sub(t) >= l.window {
+			delete(l.sent, k)
+		}
+	}
+	if _, ok := l.sent[key]; ok {
+		return false
+	}
+	l.sent[key] = now
+	return true
+}
+
+// clientNetwork is the /24 (or /64) of ip, the "location" of a sign-in
+func clientNetwork(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	mask := net.CIDRMask(64, 128)
+	if ip.To4() != nil {
+		mask = net.CIDRMask(24, 32)
+	}
+	return ip.Mask(mask).String()
+}
+
+// recordLogin stores a sign-in attempt and raises the alerts it calls for.
+// reason says why a failed attempt failed. Failures are logged and don't
+// affect the sign-in.
+func (a *App) recordLogin(r *http.Request, username, method string, success bool, reason string) {
+	ctx := r.Context()
+	var ip string
+	addr := clientIP(r)
+	if addr != nil {
+		ip = addr.String()
+	}
+	network := clientNetwork(addr)
+	userAgent := r.UserAgent()
+	if len(userAgent) > 300 {
+		userAgent = userAgent[:300]
+	}
+	if len(username) > 200 {
+		username = username[:200]
+	}
+
+	// whether the network is known has to be read before this attempt counts
+	newNetwork := false
+	if success && username != "" {
+		now := time.Now()
+		if !now.Before(a.voteStart) && now.Before(a.voteEnd) {
+			var known bool
+			err := a.db.QueryRow(ctx, `
+				SELECT EXISTS (SELECT 1 FROM admin_logins
+				WHERE username = $1 AND success AND network = $2 AND created_at > NOW() - make_interval(secs => $3))`,
+				username, network, loginHistory.Seconds()).Scan(&known)
+			if err != nil {
+				logDB.Errorf("error checking login history: %v", err)
+			}
+			newNetwork = err == nil && !known
+		}
+	}
+
+	_, err := a.db.Exec(ctx, `
+		INSERT INTO admin_logins (username, method, success, reason, ip, network, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, username, method, success, reason, ip, network, userAgent)
+	if err != nil {
+		logDB.Errorf("error recording login: %v", err)
+		return
+	}
+
+	alert := loginAlert{Username: username, Method: method, IP: ip, Network: network, UserAgent: userAgent}
+	switch {
+	case success && newNetwork:
+		alert.Kind = "new_network"
+		a.raiseLoginAlert(ctx, "network|"+username+"|"+network, alert)
+	case success:
+		if _, err := a.db.Exec(ctx, `DELETE FROM admin_logins WHERE created_at < NOW() - make_interval(secs => $1)`, loginHistory.Seconds()); err != nil {
+			logDB.Errorf("error pruning logins: %v", err)
+		}
+	default:
+		a.checkFailedLogins(ctx, alert)
+	}
+}
+
+// checkFailedLogins raises an alert when the username or the address of a
+// failed attempt reached the threshold within the window
+func (a *App) checkFailedLogins(ctx context.Context, alert loginAlert) {
+	var byUser, byIP int
+	err := a.db.QueryRow(ctx, `
+		SELECT COUNT(*) FILTER (WHERE $1 <> '' AND username = $1), COUNT(*) FILTER (WHERE $2 <> '' AND ip = $2)
+		FROM admin_logins
+		WHERE NOT success AND created_at > NOW() - make_interval(secs => $3)`,
+		alert.Username, alert.IP, a.loginAlerts.window.Seconds()).Scan(&byUser, &byIP)
+	if err != nil {
+		logDB.Errorf("error counting failed logins: %v", err)
+		return
+	}
+	alert.Kind, alert.Window = "failures", a.loginAlerts.window.String()
+	if byUser >= a.loginAlerts.failures {
+		alert.Failures = byUser
+		a.raiseLoginAlert(ctx, "user|"+alert.Username, alert)
+	}
+	if byIP >= a.loginAlerts.failures {
+		alert.Failures = byIP
+		a.raiseLoginAlert(ctx, "ip|"+alert.IP, alert)
+	}
+}
+
+// loginAlert is the detail of an account.login_alert audit event
+type loginAlert struct {
+	Kind      string `json:"kind"` // failures or new_network
+	Username  string `json:"username"`
+	Method    string `json:"method"`
+	IP        string `json:"ip"`
+	Network   string `json:"network"`
+	UserAgent string `json:"user_agent"`
+	Failures  int    `json:"failures,omitempty"`
+	Window    string `json:"window,omitempty"`
+}
+
+// text is the alert as mailed and posted
+func (l loginAlert) text(org string) string {
+	who := l.Username
+	if who == "" {
+		who = "(tanpa username)"
+	}
+	if l.Kind == "new_network" {
+		return fmt.Sprintf("[%s] Login admin %s (%s) dari jaringan baru %s (IP %s) selama pemilihan berlangsung.\nBrowser: %s",
+			org, who, l.Method, l.Network, l.IP, l.UserAgent)
+	}
+	return fmt.Sprintf("[%s] %d login admin gagal dalam %s; percobaan terakhir: akun %s (%s) dari IP %s.\nBrowser: %s",
+		org, l.Failures, l.Window, who, l.Method, l.IP, l.UserAgent)
+}
+
+// raiseLoginAlert records the alert and queues it for Slack and the alert
+// emails with its audit event, unless the same key was alerted within the
+// window
+func (a *App) raiseLoginAlert(ctx context.Context, key string, alert loginAlert) {
+	if !a.loginAlerts.due(key, time.Now()) {
+		return
+	}
+	text := alert.text(a.org)
+	a.notify(ctx, notification{Kind: NotifySuspicious, Message: text, Link: "/admin/logins", SuperadminOnly: true})
+
+	var messages []outboxMessage
+	if a.loginAlerts.slackURL != "" {
+		messages = append(messages, outboxMessage{Channel: ChannelSlack, Recipient: a.loginAlerts.slackURL, Body: text, Source: "account.login_alert"})
+	}
+	if len(a.loginAlerts.emails) > 0 {
+		m, err := a.orgMailer(ctx)
+		if err != nil {
+			logMailer.Errorf("error getting mailer: %v", err)
+		}
+		if m == nil {
+			logMailer.Warnf("login alert not mailed: no mail settings")
+		} else {
+			for _, to := range a.loginAlerts.emails {
+				messages = append(messages, outboxMessage{
+					Channel:   ChannelEmail,
+					Recipient: to,
+					Subject:   "Peringatan login admin pemilihan",
+					Body:      text + "\n",
+					Source:    "account.login_alert",
+				})
+			}
+		}
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err == nil {
+		defer tx.Rollback(ctx)
+		err = auditIn(ctx, tx, "system", "account.login_alert", alert.Username, alert)
+	}
+	for _, m := range messages {
+		if err == nil {
+			err = enqueueMessage(ctx, tx, m)
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		logDB.Errorf("error recording login alert: %v", err)
+	}
+}
+
+// postSlack posts text to a Slack incoming webhook
+func postSlack(ctx context.Context, hookURL, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("slack answered %s", resp.Status)
+	}
+	return nil
+}
+
+// LoginRow is an attempt as listed on the logins page and the profile
+type LoginRow struct {
+	Username  string
+	Method    string
+	Success   bool
+	Reason    string
+	IP        string
+	UserAgent string
+	CreatedAt time.Time
+}
+
+// listLogins returns the latest attempts, of username if not empty, only
+// the failed ones with failed
+func (a *App) listLogins(ctx context.Context, username string, failed bool, limit int) ([]LoginRow, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT username, method, success, reason, ip, user_agent, created_at
+		FROM admin_logins
+		WHERE ($1 = '' OR username = $1) AND (NOT $2 OR NOT success)
+		ORDER BY created_at DESC
+		LIMIT $3`, username, failed, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logins []LoginRow
+	for rows.Next() {
+		var l LoginRow
+		if err := rows.Scan(&l.Username, &l.Method, &l.Success, &l.Reason, &l.IP, &l.UserAgent, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		logins = append(logins, l)
+	}
+	return logins, rows.Err()
+}
+
+// LoginsData is the data of logins.html
+type LoginsData struct {
+	Logins   []LoginRow
+	Username string
+	Failed   bool
+	Alerts   bool // alerts have somewhere to go
+	Failures int
+	Window   time.Duration
+}
+
+// adminLoginsHandler: GET /admin/logins lists the latest sign-in attempts,
+// filtered by ?username= and ?failed=1. Superadmin only.
+func (a *App) adminLoginsHandler(w http.ResponseWriter, r *http.Request) {
+	data := LoginsData{
+		Username: strings.TrimSpace(r.URL.Query().Get("username")),
+		Failed:   r.URL.Query().Get("failed") == "1",
+		Alerts:   len(a.loginAlerts.emails) > 0 || a.loginAlerts.slackURL != "",
+		Failures: a.loginAlerts.failures,
+		Window:   a.loginAlerts.window,
+	}
+	logins, err := a.listLogins(r.Context(), data.Username, data.Failed, 500)
+	if err != nil {
+		logDB.Errorf("error getting logins: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Logins = logins
+	if err := a.tmpl.ExecuteTemplate(w, "logins.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// maxImportSize bounds the uploaded satellite backup
+const maxImportSize = 64 << 20
+
+// MergeIssue is a satellite voter that could not be merged
+type MergeIssue struct {
+	Code   string
+	Name   string
+	Reason string
+}
+
+// MergeReport summarises a (dry-run or applied) merge of a satellite export
+type MergeReport struct {
+	SourceCreatedAt string
+	Applied         bool
+	VotesMerged     int // satellite votes applied to existing voters
+	VotersAdded     int // voters only present on the satellite
+	OfflineVotes    int
+	Collisions      []MergeIssue // same code, different person
+	DoubleVotes     []MergeIssue // voted on both instances
+}
+
+type MergeData struct {
+	Report *MergeReport
+	Error  string
+}
+
+var errAlreadyImported = errors.New("export ini sudah pernah diimpor")
+
+// satelliteVoter is a voters row from the other instance
+type satelliteVoter struct {
+	code, name, phone, usedAt, choice, followUp string
+	used                                        bool
+}
+
+// readSatelliteTable parses a table CSV from a backup using the manifest
+// column list, returning rows as column -> value
+func readSatelliteTable(m *BackupManifest, files map[string][]byte, table string) ([]map[string]string, error) {
+	cols, ok := m.Columns[table]
+	if !ok {
+		return nil, nil
+	}
+	r := csv.NewReader(bytes.NewReader(files[table+".csv"]))
+	var rows []map[string]string
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+		row := make(map[string]string, len(cols))
+		for i, c := range cols {
+			if i < len(rec) {
+				row[c] = rec[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// mergeSatellite merges the votes of another instance's backup into this
+// election. Voters are matched by code, and by phone (the member identity)
+// when the code is unknown. Each satellite vote is either applied to an
+// unused local voter, added as a new voter, or reported as a code collision
+// or double vote. With apply=false everything runs in a rolled-back
+// transaction, giving a dry-run report.
+func (a *App) mergeSatellite(ctx context.Context, data []byte, passphrase string, apply bool, actor string) (*MergeReport, error) {
+	manifest, files, err := openBackup(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	voterRows, err := readSatelliteTable(manifest, files, "voters")
+	if err != nil {
+		return nil, err
+	}
+	offlineRows, err := readSatelliteTable(manifest, files, "offline_voters")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MergeReport{SourceCreatedAt: manifest.CreatedAt.Format("02/01/2006 15:04")}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var seen bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM merged_imports WHERE digest = $1)`, digest).Scan(&seen); err != nil {
+		return nil, err
+	}
+	if seen {
+		return nil, errAlreadyImported
+	}
+
+	for _, row := range voterRows {
+		sv := satelliteVoter{
+			code:     row["code"],
+			name:     row["name"],
+			phone:    row["phone"],
+			used:     row["used"] == "t",
+			usedAt:   row["used_at"],
+			choice:   row["vote_choice"],
+			followUp: row["follow_up"],
+		}
+		if !sv.used {
+			continue
+		}
+		// the satellite stores names and phones the way it was configured;
+		// they are compared in the clear and stored under this instance's key
+		if err := a.pii.openAll(&sv.name, &sv.phone); err != nil {
+			return nil, err
+		}
+		issue := MergeIssue{Code: sv.code, Name: sv.name}
+
+		var localPhone string
+		var localUsed bool
+		err := tx.QueryRow(ctx, `SELECT phone, used FROM voters WHERE code = $1 FOR UPDATE`, sv.code).Scan(&localPhone, &localUsed)
+		if err == nil {
+			err = a.pii.openAll(&localPhone)
+		}
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			// unknown code: the same member may exist here under another code
+			var localCode string
+			err := tx.QueryRow(ctx, `SELECT code, used FROM voters WHERE phone = $1 FOR UPDATE`, a.pii.sealPhone(sv.phone)).Scan(&localCode, &localUsed)
+			if errors.Is(err, pgx.ErrNoRows) {
+				_, err = tx.Exec(ctx, `
+					INSERT INTO voters (code, name, phone, used, used_at, vote_choice, follow_up)
+					VALUES ($1, $2, $3, TRUE, NULLIF($4, '')::timestamptz, $5, NULLIF($6, ''))`,
+					sv.code, a.pii.seal(sv.name), a.pii.sealPhone(sv.phone), sv.usedAt, sv.choice, sv.followUp)
+				if err != nil {
+					return nil, err
+				}
+				report.VotersAdded++
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if localUsed {
+				issue.Reason = fmt.Sprintf("sudah memilih di sini dengan kode %s", localCode)
+				report.DoubleVotes = append(report.DoubleVotes, issue)
+				continue
+			}
+			if err := applySatelliteVote(ctx, tx, localCode, sv); err != nil {
+				return nil, err
+			}
+			report.VotesMerged++
+		case err != nil:
+			return nil, err
+		case localPhone != sv.phone:
+			issue.Reason = "kode sama dipakai peserta lain"
+			report.Collisions = append(report.Collisions, issue)
+		case localUsed:
+			issue.Reason = "sudah memilih di kedua instance"
+			report.DoubleVotes = append(report.DoubleVotes, issue)
+		default:
+			if err := applySatelliteVote(ctx, tx, sv.code, sv); err != nil {
+				return nil, err
+			}
+			report.VotesMerged++
+		}
+	}
+
+	for _, row := range offlineRows {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO offline_voters (vote_choice, used_at, follow_up)
+			VALUES ($1, NULLIF($2, '')::timestamptz, NULLIF($3, ''))`, row["vote_choice"], row["used_at"], row["follow_up"])
+		if err != nil {
+			return nil, err
+		}
+		report.OfflineVotes++
+	}
+
+	if !apply {
+		return report, nil
+	}
+
+	if err := meter(ctx, tx, usageVotersImported, report.VotersAdded); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO merged_imports (digest, source_created_at, imported_by, votes_merged, voters_added, offline_votes, conflicts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		digest, manifest.CreatedAt, actor, report.VotesMerged, report.VotersAdded, report.OfflineVotes,
+		len(report.Collisions)+len(report.DoubleVotes))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// applySatelliteVote records a satellite vote on a local voter that hasn't voted
+func applySatelliteVote(ctx context.Context, tx pgx.Tx, code string, sv satelliteVoter) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE voters
+		SET used = TRUE, used_at = NULLIF($2, '')::timestamptz, vote_choice = $3, follow_up = NULLIF($4, '')
+		WHERE code = $1 AND used = FALSE`, code, sv.usedAt, sv.choice, sv.followUp)
+	return err
+}
+
+// adminMergeHandler uploads another instance's backup and merges its votes.
+// "preview" runs a dry run; "apply" commits. Superadmin only.
+func (a *App) adminMergeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data MergeData
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		file, _, err := r.FormFile("backup")
+		if err != nil {
+			data.Error = "file backup diperlukan"
+			break
+		}
+		defer file.Close()
+		content, err := io.ReadAll(file)
+		if err != nil {
+			data.Error = "gagal membaca file"
+			break
+		}
+
+		passphrase := r.FormValue("passphrase")
+		if passphrase == "" {
+			passphrase = a.backupPassphrase
+		}
+		apply := r.FormValue("mode") == "apply"
+
+		report, err := a.mergeSatellite(ctx, content, passphrase, apply, actorName(r))
+		if err != nil {
+			if !errors.Is(err, errAlreadyImported) {
+				logTally.Errorf("error merging satellite export: %v", err)
+			}
+			data.Error = fmt.Sprintf("gagal mengimpor: %v", err)
+			break
+		}
+		if report.Applied {
+			a.audit(ctx, actorName(r), "election.merge", "", map[string]int{
+				"votes_merged":  report.VotesMerged,
+				"voters_added":  report.VotersAdded,
+				"offline_votes": report.OfflineVotes,
+				"collisions":    len(report.Collisions),
+				"double_votes":  len(report.DoubleVotes),
+			})
+		}
+		data.Report = report
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "merge.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
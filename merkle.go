@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+
+	"pemilihan.gkjp.id/verify"
+)
+
+// A Merkle tree over the accepted ballots lets a voter check that their
+// ballot is in the counted set without the set revealing who cast what.
+// Leaves are sorted by hash so the tree doesn't give away the cast order;
+// the root is frozen in the tally snapshot at close. The hashes are defined
+// in package verify, which checks the tree offline.
+
+// newReceipt returns the receipt handed to a voter with their ballot
+func newReceipt() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ballotLeaf is one accepted ballot in the tree
+type ballotLeaf struct {
+	Key      string // "online|<receipt>" or "offline|<id>"
+	Tag      []byte // verify.MerkleTag of Key
+	Channel  string
+	Choice   string
+	FollowUp string
+	Hash     []byte
+}
+
+// merkleLeaves loads the accepted ballots, online ones keyed by receipt
+// (ballots cast before receipts existed by row id) and offline ones by id
+func merkleLeaves(ctx context.Context, q queryer) ([]ballotLeaf, error) {
+	rows, err := q.Query(ctx, `
+		SELECT 'online', COALESCE(receipt, 'id-' || id::text), COALESCE(vote_choice, ''), COALESCE(follow_up, '')
+		FROM voters WHERE used = true
+		UNION ALL
+		SELECT 'offline', id::text, vote_choice, COALESCE(follow_up, '')
+		FROM offline_voters`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leaves []ballotLeaf
+	for rows.Next() {
+		var l ballotLeaf
+		var key string
+		if err := rows.Scan(&l.Channel, &key, &l.Choice, &l.FollowUp); err != nil {
+			return nil, err
+		}
+		l.Key = l.Channel + "|" + key
+		choice := l.Choice
+		if l.FollowUp != "" {
+			choice += "|" + l.FollowUp
+		}
+		l.Tag = verify.MerkleTag(l.Key)
+		l.Hash = verify.MerkleLeaf(l.Tag, l.Channel, choice)
+		leaves = append(leaves, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(leaves, func(i, j int) bool { return bytes.Compare(leaves[i].Hash, leaves[j].Hash) < 0 })
+	return leaves, nil
+}
+
+// merkleLevels builds the tree over the sorted leaves, see verify.MerkleLevels
+func merkleLevels(leaves []ballotLeaf) [][][]byte {
+	hashes := make([][]byte, len(leaves))
+	for i, l := range leaves {
+		hashes[i] = l.Hash
+	}
+	return verify.MerkleLevels(hashes)
+}
+
+// merkleRoot is the hex root of the tree
+func merkleRoot(levels [][][]byte) string {
+	return verify.MerkleRoot(levels)
+}
+
+// ProofStep is one sibling on the way from a leaf to the root
+type ProofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // the sibling goes on the left: node = H(0x01 || hash || current)
+}
+
+// merkleProof lists the siblings of leaf i up to the root; levels where the
+// node had no sibling are skipped
+func merkleProof(levels [][][]byte, i int) []ProofStep {
+	path := []ProofStep{}
+	for _, level := range levels[:len(levels)-1] {
+		sibling := i ^ 1
+		if sibling < len(level) {
+			path = append(path, ProofStep{Hash: hex.EncodeToString(level[sibling]), Left: sibling < i})
+		}
+		i /= 2
+	}
+	return path
+}
+
+// InclusionProof answers GET /receipt
+type InclusionProof struct {
+	Root    string      `json:"root"`
+	Leaves  int         `json:"leaves"`
+	Receipt string      `json:"receipt,omitempty"`
+	Leaf    string      `json:"leaf,omitempty"` // H(0x00 || H(0x02 || "online|<receipt>") || "online|<choice>")
+	Index   *int        `json:"index,omitempty"`
+	Path    []ProofStep `json:"path,omitempty"`
+}
+
+// receiptHandler: GET /receipt publishes the Merkle root frozen at close and,
+// given ?r=<receipt>, the inclusion proof of that ballot. Public, like the
+// root itself; the choice is never returned, the voter hashes it themselves.
+func (a *App) receiptHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	snap, err := a.loadTallySnapshot(ctx)
+	if err != nil {
+		logTally.Errorf("error getting tally snapshot: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	if snap == nil || snap.MerkleRoot == "" {
+		apiError(w, r, http.StatusNotFound, "the root is published when voting closes")
+		return
+	}
+
+	leaves, err := merkleLeaves(ctx, a.db)
+	if err != nil {
+		logTally.Errorf("error getting ballots: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	levels := merkleLevels(leaves)
+	if merkleRoot(levels) != snap.MerkleRoot {
+		apiError(w, r, http.StatusConflict, "the ballot set has changed since the root was published")
+		return
+	}
+
+	proof := InclusionProof{Root: snap.MerkleRoot, Leaves: len(leaves)}
+	if receipt := strings.TrimSpace(r.URL.Query().Get("r")); receipt != "" {
+		i := -1
+		for j, l := range leaves {
+			if l.Key == "online|"+receipt {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			apiError(w, r, http.StatusNotFound, "receipt not found")
+			return
+		}
+		proof.Receipt = receipt
+		proof.Leaf = hex.EncodeToString(leaves[i].Hash)
+		proof.Index = &i
+		proof.Path = merkleProof(levels, i)
+	}
+	writeJSON(w, http.StatusOK, proof)
+}
@@ -13,3 +13,1039 @@ INSERT INTO voters (code, name) VALUES
 ('Ht67h', 'Titus Prasetyo') ON CONFLICT DO NOTHING,
 ('Ab12X', 'Budi Santoso') ON CONFLICT DO NOTHING,
 ('Z9yQ1', 'Siti Nurhayati') ON CONFLICT DO NOTHING;
+
+-- admin accounts with roles (superadmin, operator, observer)
+CREATE TABLE IF NOT EXISTS admin_accounts (
+  id SERIAL PRIMARY KEY,
+  username TEXT UNIQUE NOT NULL,
+  password_hash TEXT NOT NULL,
+  role TEXT NOT NULL CHECK (role IN ('superadmin', 'operator', 'observer')),
+  disabled BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- archived (finished) elections; rows are sealed once archiving completes
+CREATE TABLE IF NOT EXISTS elections (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  vote_start TIMESTAMPTZ NOT NULL,
+  vote_end TIMESTAMPTZ NOT NULL,
+  total_voters INT NOT NULL DEFAULT 0,
+  voted_count INT NOT NULL DEFAULT 0,
+  archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  archived_by TEXT NOT NULL DEFAULT '',
+  sealed BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS archived_results (
+  election_id INT NOT NULL REFERENCES elections(id),
+  channel TEXT NOT NULL, -- online / offline
+  choice TEXT NOT NULL,
+  count INT NOT NULL,
+  PRIMARY KEY (election_id, channel, choice)
+);
+
+CREATE TABLE IF NOT EXISTS archived_turnout (
+  election_id INT NOT NULL REFERENCES elections(id),
+  wilayah TEXT NOT NULL,
+  voted INT NOT NULL,
+  not_voted INT NOT NULL,
+  PRIMARY KEY (election_id, wilayah)
+);
+
+-- anonymous ballot set: no code or voter reference is kept
+CREATE TABLE IF NOT EXISTS archived_ballots (
+  election_id INT NOT NULL REFERENCES elections(id),
+  channel TEXT NOT NULL,
+  choice TEXT NOT NULL,
+  cast_at TIMESTAMPTZ
+);
+
+-- reject any write to a sealed election or its archived rows
+CREATE OR REPLACE FUNCTION reject_sealed_election_write() RETURNS trigger AS $$
+BEGIN
+  IF TG_TABLE_NAME = 'elections' THEN
+    IF OLD.sealed THEN
+      RAISE EXCEPTION 'election % is archived and read-only', OLD.id;
+    END IF;
+    IF TG_OP = 'DELETE' THEN RETURN OLD; END IF;
+    RETURN NEW;
+  END IF;
+  -- the ballot retention policy may delete archived ballots
+  IF TG_OP = 'DELETE' AND TG_TABLE_NAME = 'archived_ballots'
+     AND current_setting('app.retention_purge', true) = 'on' THEN
+    RETURN OLD;
+  END IF;
+  IF TG_OP <> 'INSERT' THEN
+    RAISE EXCEPTION 'archived rows are read-only';
+  END IF;
+  IF EXISTS (SELECT 1 FROM elections WHERE id = NEW.election_id AND sealed) THEN
+    RAISE EXCEPTION 'election % is archived and read-only', NEW.election_id;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS elections_sealed ON elections;
+CREATE TRIGGER elections_sealed BEFORE UPDATE OR DELETE ON elections
+  FOR EACH ROW EXECUTE FUNCTION reject_sealed_election_write();
+DROP TRIGGER IF EXISTS archived_results_sealed ON archived_results;
+CREATE TRIGGER archived_results_sealed BEFORE INSERT OR UPDATE OR DELETE ON archived_results
+  FOR EACH ROW EXECUTE FUNCTION reject_sealed_election_write();
+DROP TRIGGER IF EXISTS archived_turnout_sealed ON archived_turnout;
+CREATE TRIGGER archived_turnout_sealed BEFORE INSERT OR UPDATE OR DELETE ON archived_turnout
+  FOR EACH ROW EXECUTE FUNCTION reject_sealed_election_write();
+DROP TRIGGER IF EXISTS archived_ballots_sealed ON archived_ballots;
+CREATE TRIGGER archived_ballots_sealed BEFORE INSERT OR UPDATE OR DELETE ON archived_ballots
+  FOR EACH ROW EXECUTE FUNCTION reject_sealed_election_write();
+
+-- append-only audit ledger of admin actions
+CREATE TABLE IF NOT EXISTS audit_events (
+  id BIGSERIAL PRIMARY KEY,
+  at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  actor TEXT NOT NULL,
+  action TEXT NOT NULL,
+  subject TEXT NOT NULL DEFAULT '',
+  detail JSONB
+);
+
+-- set when retention has replaced the voter's name/phone with pseudonyms
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS pseudonymized_at TIMESTAMPTZ;
+
+-- set when a voter's personal data was erased on request; the ballot stays counted
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS erased_at TIMESTAMPTZ;
+
+-- satellite exports merged into this election, to refuse importing one twice
+CREATE TABLE IF NOT EXISTS merged_imports (
+  id SERIAL PRIMARY KEY,
+  digest TEXT UNIQUE NOT NULL,
+  source_created_at TIMESTAMPTZ,
+  imported_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  imported_by TEXT NOT NULL,
+  votes_merged INT NOT NULL,
+  voters_added INT NOT NULL,
+  offline_votes INT NOT NULL,
+  conflicts INT NOT NULL
+);
+
+-- tally frozen when voting closes; write-once
+CREATE TABLE IF NOT EXISTS tally_snapshots (
+  id SERIAL PRIMARY KEY,
+  vote_end TIMESTAMPTZ UNIQUE NOT NULL,
+  taken_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  total_voters INT NOT NULL,
+  voted_count INT NOT NULL,
+  setuju_count INT NOT NULL,
+  tidak_setuju_count INT NOT NULL,
+  offline_setuju INT NOT NULL,
+  offline_tidak_setuju INT NOT NULL,
+  offline_tidak_sah INT NOT NULL,
+  ballot_hash TEXT NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION reject_snapshot_write() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'tally snapshots are read-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tally_snapshots_readonly ON tally_snapshots;
+CREATE TRIGGER tally_snapshots_readonly BEFORE UPDATE OR DELETE ON tally_snapshots
+  FOR EACH ROW EXECUTE FUNCTION reject_snapshot_write();
+
+-- applied retention cleanups (scheduled or manual) with rows removed per data class
+CREATE TABLE IF NOT EXISTS retention_runs (
+  id SERIAL PRIMARY KEY,
+  ran_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  trigger TEXT NOT NULL,
+  actor TEXT NOT NULL,
+  removed JSONB NOT NULL
+);
+
+-- API keys for /api/v1; only a hash of the key is stored
+CREATE TABLE IF NOT EXISTS api_keys (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  lookup TEXT UNIQUE NOT NULL,
+  key_hash TEXT NOT NULL,
+  scopes TEXT[] NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  created_by TEXT NOT NULL,
+  last_used_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ
+);
+
+-- responses of requests sent with an Idempotency-Key, replayed on retries;
+-- status stays NULL while the first attempt is running
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  scope TEXT NOT NULL,
+  key TEXT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  status INT,
+  content_type TEXT,
+  body BYTEA,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  completed_at TIMESTAMPTZ,
+  PRIMARY KEY (scope, key)
+);
+
+-- webhook subscriptions; the secret signs every delivery (HMAC-SHA256)
+CREATE TABLE IF NOT EXISTS webhooks (
+  id SERIAL PRIMARY KEY,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  events TEXT[] NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  created_by TEXT NOT NULL
+);
+
+-- queued and sent webhook events, retried with backoff until delivered or
+-- given up on (failed_at)
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id BIGSERIAL PRIMARY KEY,
+  webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+  event TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  delivered_at TIMESTAMPTZ,
+  failed_at TIMESTAMPTZ,
+  last_status INT,
+  last_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at)
+  WHERE delivered_at IS NULL AND failed_at IS NULL;
+
+-- stable row ids so the API can page through ballots; archiving inserts the
+-- ballots shuffled, so ids don't follow cast order
+ALTER TABLE archived_ballots ADD COLUMN IF NOT EXISTS id BIGSERIAL;
+CREATE UNIQUE INDEX IF NOT EXISTS archived_ballots_page_idx ON archived_ballots (election_id, id);
+
+-- certified outcome of ranked elections and the tie-break rule it applied
+ALTER TABLE tally_snapshots ADD COLUMN IF NOT EXISTS method TEXT;
+ALTER TABLE tally_snapshots ADD COLUMN IF NOT EXISTS tie_break TEXT;
+ALTER TABLE tally_snapshots ADD COLUMN IF NOT EXISTS outcome TEXT;
+
+-- answer to the follow-up question, only set when the main answer opened it
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS follow_up TEXT;
+ALTER TABLE offline_voters ADD COLUMN IF NOT EXISTS follow_up TEXT;
+
+-- online submissions the server rejected as malformed, reported as spoiled;
+-- no voter reference, the voter can still cast a valid ballot
+CREATE TABLE IF NOT EXISTS spoiled_ballots (
+  id BIGSERIAL PRIMARY KEY,
+  channel TEXT NOT NULL DEFAULT 'online',
+  reason TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- blank ballots and spoiled submissions at close
+ALTER TABLE tally_snapshots ADD COLUMN IF NOT EXISTS kosong_count INT NOT NULL DEFAULT 0;
+ALTER TABLE tally_snapshots ADD COLUMN IF NOT EXISTS offline_kosong INT NOT NULL DEFAULT 0;
+ALTER TABLE tally_snapshots ADD COLUMN IF NOT EXISTS rusak_count INT NOT NULL DEFAULT 0;
+
+-- voting shares per voter, for quorums weighted by shares present
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS shares INT NOT NULL DEFAULT 1 CHECK (shares >= 0);
+
+-- proxies: the holder's session may cast the grantor's ballot too. A voter
+-- grants at most one proxy; it goes away with either voter.
+CREATE TABLE IF NOT EXISTS proxies (
+  id SERIAL PRIMARY KEY,
+  holder_id INT NOT NULL REFERENCES voters(id) ON DELETE CASCADE,
+  grantor_id INT NOT NULL UNIQUE REFERENCES voters(id) ON DELETE CASCADE,
+  document TEXT NOT NULL, -- reference of the signed proxy form
+  created_by TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  CHECK (holder_id <> grantor_id)
+);
+CREATE INDEX IF NOT EXISTS proxies_holder_idx ON proxies (holder_id);
+
+-- receipt handed to the voter with their ballot, and the root of the ballot
+-- Merkle tree frozen at close so voters can prove their ballot was counted
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS receipt TEXT;
+ALTER TABLE tally_snapshots ADD COLUMN IF NOT EXISTS merkle_root TEXT;
+
+-- online ballots sealed to ELECTION_PUBLIC_KEY, and the trustee shares of
+-- its private key collected after close (deleted once the ballots are open)
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS sealed_choice BYTEA;
+CREATE TABLE IF NOT EXISTS trustee_shares (
+  x INT PRIMARY KEY CHECK (x BETWEEN 1 AND 255),
+  threshold INT NOT NULL,
+  share BYTEA NOT NULL,
+  submitted_by TEXT NOT NULL DEFAULT '',
+  submitted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- voter roll committed before voting opens: HMAC-SHA256 of every code under
+-- a per-election salt; write-once
+CREATE TABLE IF NOT EXISTS roll_commitments (
+  id SERIAL PRIMARY KEY,
+  vote_start TIMESTAMPTZ UNIQUE NOT NULL,
+  committed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  committed_by TEXT NOT NULL DEFAULT '',
+  voters INT NOT NULL,
+  commitment TEXT NOT NULL,
+  salt BYTEA NOT NULL,
+  leaves TEXT[] NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION reject_roll_commitment_write() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'voter roll commitments are read-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS roll_commitments_readonly ON roll_commitments;
+CREATE TRIGGER roll_commitments_readonly BEFORE UPDATE OR DELETE ON roll_commitments
+  FOR EACH ROW EXECUTE FUNCTION reject_roll_commitment_write();
+
+-- Benaloh challenge: ballots prepared ahead of the cast-or-challenge
+-- decision; open ones are dropped once the voter casts
+CREATE TABLE IF NOT EXISTS ballot_challenges (
+  id SERIAL PRIMARY KEY,
+  voter_id INT NOT NULL REFERENCES voters(id) ON DELETE CASCADE,
+  commitment TEXT UNIQUE NOT NULL,
+  nonce TEXT NOT NULL,
+  vote_choice TEXT NOT NULL,
+  follow_up TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  challenged_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS ballot_challenges_voter_idx ON ballot_challenges (voter_id);
+
+-- encrypted names and phones (PII_KEY) are longer than the plain values
+ALTER TABLE IF EXISTS vote_master ALTER COLUMN name TYPE TEXT, ALTER COLUMN phone TYPE TEXT;
+ALTER TABLE voters ALTER COLUMN phone TYPE TEXT;
+
+-- hash chain over the audit ledger, sealed periodically; write-once
+CREATE TABLE IF NOT EXISTS audit_seals (
+  id BIGSERIAL PRIMARY KEY,
+  first_event_id BIGINT NOT NULL,
+  last_event_id BIGINT NOT NULL,
+  events INT NOT NULL,
+  prev_hash TEXT NOT NULL,
+  hash TEXT NOT NULL,
+  sealed_at TIMESTAMPTZ NOT NULL,
+  public_key TEXT NOT NULL DEFAULT '',
+  signature TEXT NOT NULL DEFAULT ''
+);
+
+CREATE OR REPLACE FUNCTION reject_audit_seal_write() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit seals are read-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_seals_readonly ON audit_seals;
+CREATE TRIGGER audit_seals_readonly BEFORE UPDATE OR DELETE ON audit_seals
+  FOR EACH ROW EXECUTE FUNCTION reject_audit_seal_write();
+
+-- keyed hashes of the client IP, its network and user agent per cast ballot
+-- or unknown code, for fraud investigations; no voter reference. Purged by
+-- ACCESS_LOG_RETENTION_DAYS
+CREATE TABLE IF NOT EXISTS access_logs (
+  id BIGSERIAL PRIMARY KEY,
+  at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  kind TEXT NOT NULL CHECK (kind IN ('vote', 'proxy', 'invalid_code')),
+  ip_hash TEXT NOT NULL,
+  net_hash TEXT NOT NULL,
+  ua_hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS access_logs_at_idx ON access_logs (at);
+
+-- tell the servers to drop their cached results when ballots or the roll change
+CREATE OR REPLACE FUNCTION notify_results_changed() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify('results_changed', TG_TABLE_NAME);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS voters_results_changed ON voters;
+CREATE TRIGGER voters_results_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON voters
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_results_changed();
+DROP TRIGGER IF EXISTS offline_voters_results_changed ON offline_voters;
+CREATE TRIGGER offline_voters_results_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON offline_voters
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_results_changed();
+DROP TRIGGER IF EXISTS spoiled_ballots_results_changed ON spoiled_ballots;
+CREATE TRIGGER spoiled_ballots_results_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON spoiled_ballots
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_results_changed();
+
+-- admin page at 100k voters: the default listing order, the join to
+-- vote_master and the group dropdown
+CREATE INDEX IF NOT EXISTS voters_used_at_idx ON voters (used_at, id);
+CREATE INDEX IF NOT EXISTS voters_phone_idx ON voters (phone);
+DO $$
+BEGIN
+  IF to_regclass('vote_master') IS NOT NULL THEN
+    CREATE INDEX IF NOT EXISTS vote_master_wilayah_idx ON vote_master (wilayah);
+  END IF;
+END;
+$$;
+
+-- organizations: one database can hold the elections of several independent
+-- groups, each served by its own app process (ORG=<slug>). Every table
+-- carries org_id, filled from the session's app.org, and row-level security
+-- keeps each session to its organization's rows. Sessions without app.org
+-- belong to the default organization (id 1), as every row did before.
+CREATE TABLE IF NOT EXISTS organizations (
+  id SERIAL PRIMARY KEY,
+  slug TEXT UNIQUE NOT NULL CHECK (slug ~ '^[a-z0-9][a-z0-9-]*$'),
+  name TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+INSERT INTO organizations (id, slug, name) VALUES (1, 'default', 'Default') ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('organizations', 'id'), GREATEST(MAX(id), 1)) FROM organizations;
+
+CREATE OR REPLACE FUNCTION current_org() RETURNS INT AS $$
+  SELECT COALESCE(NULLIF(current_setting('app.org', true), '')::int, 1)
+$$ LANGUAGE sql STABLE;
+
+-- puts a table under its organization's row-level security
+CREATE OR REPLACE FUNCTION org_scope(t regclass) RETURNS void AS $$
+BEGIN
+  EXECUTE format('ALTER TABLE %s ADD COLUMN IF NOT EXISTS org_id INT NOT NULL DEFAULT current_org() REFERENCES organizations (id)', t);
+  EXECUTE format('ALTER TABLE %s ENABLE ROW LEVEL SECURITY', t);
+  EXECUTE format('ALTER TABLE %s FORCE ROW LEVEL SECURITY', t);
+  EXECUTE format('DROP POLICY IF EXISTS org_isolation ON %s', t);
+  EXECUTE format('CREATE POLICY org_isolation ON %s USING (org_id = current_org()) WITH CHECK (org_id = current_org())', t);
+END;
+$$ LANGUAGE plpgsql;
+
+SELECT org_scope(t::regclass) FROM unnest(ARRAY[
+  'vote_master', 'voters', 'votes', 'offline_voters', 'spoiled_ballots', 'proxies', 'ballot_challenges',
+  'admin_accounts', 'audit_events', 'audit_seals', 'access_logs', 'elections', 'archived_results',
+  'archived_turnout', 'archived_ballots', 'tally_snapshots', 'roll_commitments', 'retention_runs', 'api_keys',
+  'idempotency_keys', 'webhooks', 'webhook_deliveries', 'merged_imports', 'trustee_shares'
+]) t WHERE to_regclass(t) IS NOT NULL;
+
+-- what was unique per election or per deployment is unique per organization
+ALTER TABLE admin_accounts DROP CONSTRAINT IF EXISTS admin_accounts_username_key;
+CREATE UNIQUE INDEX IF NOT EXISTS admin_accounts_org_username_idx ON admin_accounts (org_id, username);
+ALTER TABLE tally_snapshots DROP CONSTRAINT IF EXISTS tally_snapshots_vote_end_key;
+CREATE UNIQUE INDEX IF NOT EXISTS tally_snapshots_org_vote_end_idx ON tally_snapshots (org_id, vote_end);
+ALTER TABLE roll_commitments DROP CONSTRAINT IF EXISTS roll_commitments_vote_start_key;
+CREATE UNIQUE INDEX IF NOT EXISTS roll_commitments_org_vote_start_idx ON roll_commitments (org_id, vote_start);
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS idempotency_keys_org_key_idx ON idempotency_keys (org_id, scope, key);
+ALTER TABLE trustee_shares DROP CONSTRAINT IF EXISTS trustee_shares_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS trustee_shares_org_x_idx ON trustee_shares (org_id, x);
+ALTER TABLE merged_imports DROP CONSTRAINT IF EXISTS merged_imports_digest_key;
+CREATE UNIQUE INDEX IF NOT EXISTS merged_imports_org_digest_idx ON merged_imports (org_id, digest);
+ALTER TABLE voters DROP CONSTRAINT IF EXISTS voters_code_key;
+CREATE UNIQUE INDEX IF NOT EXISTS voters_org_code_idx ON voters (org_id, code);
+-- receipts are unique per organization too (see merkle.go)
+DROP INDEX IF EXISTS voters_receipt_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS voters_org_receipt_idx ON voters (org_id, receipt);
+
+-- superusers and BYPASSRLS roles skip row-level security, so the app drops
+-- to this role after connecting as one of them. It can't see or change the
+-- organizations themselves.
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'pemilihan_tenant') THEN
+    CREATE ROLE pemilihan_tenant NOLOGIN;
+  END IF;
+  -- a BYPASSRLS role running this file may SET ROLE to it
+  EXECUTE format('GRANT pemilihan_tenant TO %I', current_user);
+END;
+$$;
+-- no TRUNCATE: it ignores row-level security
+GRANT USAGE ON SCHEMA public TO pemilihan_tenant;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO pemilihan_tenant;
+GRANT USAGE, SELECT, UPDATE ON ALL SEQUENCES IN SCHEMA public TO pemilihan_tenant;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO pemilihan_tenant;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT, UPDATE ON SEQUENCES TO pemilihan_tenant;
+REVOKE ALL ON organizations FROM pemilihan_tenant;
+
+-- live tally kept up to date by row triggers, so the result pages read a few
+-- rows instead of aggregating the ballot tables. Rows follow loadBallots
+-- (channel, choice, follow-up) plus the roll under channel 'roll': every
+-- voter (choice ''), those who voted ('voted') and sealed ballots ('sealed').
+-- refresh_tally_counts() rebuilds it from the ballot tables.
+CREATE TABLE IF NOT EXISTS tally_counts (
+  org_id INT NOT NULL DEFAULT current_org() REFERENCES organizations (id),
+  source TEXT NOT NULL, -- table the row counts
+  channel TEXT NOT NULL,
+  choice TEXT NOT NULL,
+  follow_up TEXT NOT NULL DEFAULT '',
+  ballots BIGINT NOT NULL DEFAULT 0,
+  shares BIGINT NOT NULL DEFAULT 0
+);
+SELECT org_scope('tally_counts');
+ALTER TABLE tally_counts DROP CONSTRAINT IF EXISTS tally_counts_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS tally_counts_key_idx ON tally_counts (org_id, source, channel, choice, follow_up);
+-- when the row last changed: Last-Modified of the public results. Rows are
+-- zeroed rather than deleted so the latest change never goes away.
+ALTER TABLE tally_counts ADD COLUMN IF NOT EXISTS changed_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp();
+
+DROP FUNCTION IF EXISTS tally_add(TEXT, TEXT, TEXT, TEXT, BIGINT, BIGINT);
+CREATE OR REPLACE FUNCTION tally_add(p_org INT, p_source TEXT, p_channel TEXT, p_choice TEXT, p_follow_up TEXT,
+  p_ballots BIGINT, p_shares BIGINT)
+RETURNS void AS $$
+  INSERT INTO tally_counts AS t (org_id, source, channel, choice, follow_up, ballots, shares)
+  VALUES (p_org, p_source, p_channel, p_choice, COALESCE(p_follow_up, ''), p_ballots, p_shares)
+  ON CONFLICT (org_id, source, channel, choice, follow_up)
+  DO UPDATE SET ballots = t.ballots + EXCLUDED.ballots, shares = t.shares + EXCLUDED.shares,
+    changed_at = clock_timestamp();
+$$ LANGUAGE sql;
+
+-- adds (sign 1) or removes (sign -1) what a voter row counts besides the roll
+CREATE OR REPLACE FUNCTION tally_voter(v voters, sign INT) RETURNS void AS $$
+BEGIN
+  IF v.used THEN
+    PERFORM tally_add(v.org_id, 'voters', 'roll', 'voted', '', sign, 0);
+  END IF;
+  IF v.sealed_choice IS NOT NULL THEN
+    PERFORM tally_add(v.org_id, 'voters', 'roll', 'sealed', '', sign, 0);
+  END IF;
+  IF v.used AND v.vote_choice IS NOT NULL THEN
+    PERFORM tally_add(v.org_id, 'voters', 'online', v.vote_choice, v.follow_up, sign, sign * v.shares);
+  END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION tally_voters() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM tally_add(NEW.org_id, 'voters', 'roll', '', '', 1, NEW.shares);
+    PERFORM tally_voter(NEW, 1);
+  ELSIF TG_OP = 'DELETE' THEN
+    PERFORM tally_add(OLD.org_id, 'voters', 'roll', '', '', -1, -OLD.shares);
+    PERFORM tally_voter(OLD, -1);
+  ELSE
+    IF NEW.shares <> OLD.shares THEN
+      PERFORM tally_add(NEW.org_id, 'voters', 'roll', '', '', 0, NEW.shares - OLD.shares);
+    END IF;
+    PERFORM tally_voter(OLD, -1);
+    PERFORM tally_voter(NEW, 1);
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION tally_offline_voters() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP IN ('UPDATE', 'DELETE') THEN
+    PERFORM tally_add(OLD.org_id, 'offline_voters', 'offline', OLD.vote_choice, OLD.follow_up, -1, -1);
+  END IF;
+  IF TG_OP IN ('INSERT', 'UPDATE') THEN
+    PERFORM tally_add(NEW.org_id, 'offline_voters', 'offline', NEW.vote_choice, NEW.follow_up, 1, 1);
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION tally_spoiled_ballots() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP IN ('UPDATE', 'DELETE') THEN
+    PERFORM tally_add(OLD.org_id, 'spoiled_ballots', OLD.channel, 'rusak', '', -1, 0);
+  END IF;
+  IF TG_OP IN ('INSERT', 'UPDATE') THEN
+    PERFORM tally_add(NEW.org_id, 'spoiled_ballots', NEW.channel, 'rusak', '', 1, 0);
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION tally_truncate() RETURNS trigger AS $$
+BEGIN
+  -- TRUNCATE empties the table for every organization
+  UPDATE tally_counts SET ballots = 0, shares = 0, changed_at = clock_timestamp() WHERE source = TG_TABLE_NAME;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS voters_tally ON voters;
+CREATE TRIGGER voters_tally AFTER INSERT OR DELETE ON voters
+  FOR EACH ROW EXECUTE FUNCTION tally_voters();
+DROP TRIGGER IF EXISTS voters_tally_update ON voters;
+CREATE TRIGGER voters_tally_update AFTER UPDATE ON voters
+  FOR EACH ROW WHEN (OLD.used IS DISTINCT FROM NEW.used OR OLD.vote_choice IS DISTINCT FROM NEW.vote_choice
+    OR OLD.follow_up IS DISTINCT FROM NEW.follow_up OR OLD.shares IS DISTINCT FROM NEW.shares
+    OR (OLD.sealed_choice IS NULL) <> (NEW.sealed_choice IS NULL))
+  EXECUTE FUNCTION tally_voters();
+DROP TRIGGER IF EXISTS offline_voters_tally ON offline_voters;
+CREATE TRIGGER offline_voters_tally AFTER INSERT OR UPDATE OR DELETE ON offline_voters
+  FOR EACH ROW EXECUTE FUNCTION tally_offline_voters();
+DROP TRIGGER IF EXISTS spoiled_ballots_tally ON spoiled_ballots;
+CREATE TRIGGER spoiled_ballots_tally AFTER INSERT OR UPDATE OR DELETE ON spoiled_ballots
+  FOR EACH ROW EXECUTE FUNCTION tally_spoiled_ballots();
+DROP TRIGGER IF EXISTS voters_tally_truncate ON voters;
+CREATE TRIGGER voters_tally_truncate AFTER TRUNCATE ON voters
+  FOR EACH STATEMENT EXECUTE FUNCTION tally_truncate();
+DROP TRIGGER IF EXISTS offline_voters_tally_truncate ON offline_voters;
+CREATE TRIGGER offline_voters_tally_truncate AFTER TRUNCATE ON offline_voters
+  FOR EACH STATEMENT EXECUTE FUNCTION tally_truncate();
+DROP TRIGGER IF EXISTS spoiled_ballots_tally_truncate ON spoiled_ballots;
+CREATE TRIGGER spoiled_ballots_tally_truncate AFTER TRUNCATE ON spoiled_ballots
+  FOR EACH STATEMENT EXECUTE FUNCTION tally_truncate();
+
+-- rebuilds the counts of the session's organization; the explicit org_id
+-- filters matter for superusers, whom row-level security doesn't restrict
+CREATE OR REPLACE FUNCTION refresh_tally_counts() RETURNS void AS $$
+BEGIN
+  -- no ballot may change while the counts are rebuilt
+  LOCK TABLE voters, offline_voters, spoiled_ballots IN SHARE MODE;
+  DELETE FROM tally_counts WHERE org_id = current_org();
+  INSERT INTO tally_counts (source, channel, choice, follow_up, ballots, shares)
+  SELECT 'voters', 'roll', '', '', COUNT(*), COALESCE(SUM(shares), 0) FROM voters WHERE org_id = current_org()
+  UNION ALL
+  SELECT 'voters', 'roll', 'voted', '', COUNT(*), 0 FROM voters WHERE org_id = current_org() AND used
+  UNION ALL
+  SELECT 'voters', 'roll', 'sealed', '', COUNT(*), 0 FROM voters
+  WHERE org_id = current_org() AND sealed_choice IS NOT NULL
+  UNION ALL
+  SELECT 'voters', 'online', vote_choice, COALESCE(follow_up, ''), COUNT(*), SUM(shares) FROM voters
+  WHERE org_id = current_org() AND used AND vote_choice IS NOT NULL GROUP BY vote_choice, COALESCE(follow_up, '')
+  UNION ALL
+  SELECT 'offline_voters', 'offline', vote_choice, COALESCE(follow_up, ''), COUNT(*), COUNT(*) FROM offline_voters
+  WHERE org_id = current_org() GROUP BY vote_choice, COALESCE(follow_up, '')
+  UNION ALL
+  SELECT 'spoiled_ballots', channel, 'rusak', '', COUNT(*), 0 FROM spoiled_ballots
+  WHERE org_id = current_org() GROUP BY channel;
+END;
+$$ LANGUAGE plpgsql;
+
+-- every organization's counts
+DO $$
+DECLARE
+  org INT;
+BEGIN
+  FOR org IN SELECT id FROM organizations ORDER BY id LOOP
+    PERFORM set_config('app.org', org::text, true);
+    PERFORM refresh_tally_counts();
+  END LOOP;
+  PERFORM set_config('app.org', '', true);
+END;
+$$;
+
+-- invitations to become an admin of the organization, accepted through a
+-- signed link that lets the invitee set a password (admin_invites.go)
+CREATE TABLE IF NOT EXISTS admin_invites (
+  id SERIAL PRIMARY KEY,
+  email TEXT NOT NULL,
+  role TEXT NOT NULL CHECK (role IN ('superadmin', 'operator', 'observer')),
+  invited_by TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  accepted_at TIMESTAMPTZ,
+  account_id INT REFERENCES admin_accounts(id) ON DELETE SET NULL,
+  revoked_at TIMESTAMPTZ
+);
+SELECT org_scope('admin_invites');
+
+-- how the organization's pages and mail look (branding.go): one row per
+-- organization, NULL fields keep the defaults
+CREATE TABLE IF NOT EXISTS org_branding (
+  org_id INT NOT NULL DEFAULT current_org() REFERENCES organizations (id),
+  logo BYTEA,
+  logo_type TEXT,
+  logo_url TEXT,
+  primary_color TEXT CHECK (primary_color ~ '^#[0-9a-fA-F]{6}$'),
+  accent_color TEXT CHECK (accent_color ~ '^#[0-9a-fA-F]{6}$'),
+  sender_name TEXT,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_by TEXT NOT NULL DEFAULT ''
+);
+SELECT org_scope('org_branding');
+CREATE UNIQUE INDEX IF NOT EXISTS org_branding_org_idx ON org_branding (org_id);
+
+-- usage of the organization per day (usage.go), for hosted deployments to
+-- bill or hold to a quota. Not in backups: a restore must not rewind what was
+-- used.
+CREATE TABLE IF NOT EXISTS usage_counters (
+  org_id INT NOT NULL DEFAULT current_org() REFERENCES organizations (id),
+  period DATE NOT NULL, -- day, UTC
+  metric TEXT NOT NULL,
+  quantity BIGINT NOT NULL DEFAULT 0,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+SELECT org_scope('usage_counters');
+CREATE UNIQUE INDEX IF NOT EXISTS usage_counters_org_period_metric_idx ON usage_counters (org_id, period, metric);
+
+-- the organization's own outgoing mail (org_mail.go): its SMTP server and
+-- From address, used instead of SMTP_URL / SMTP_FROM. The password in
+-- smtp_url is sealed with PII_KEY when one is set.
+CREATE TABLE IF NOT EXISTS org_mail (
+  org_id INT NOT NULL DEFAULT current_org() REFERENCES organizations (id),
+  smtp_url TEXT NOT NULL,
+  from_address TEXT NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_by TEXT NOT NULL DEFAULT ''
+);
+SELECT org_scope('org_mail');
+CREATE UNIQUE INDEX IF NOT EXISTS org_mail_org_idx ON org_mail (org_id);
+
+-- the organization's public list of elections (portal.go): whether it is
+-- shown, the name of the running election and whether it is listed
+CREATE TABLE IF NOT EXISTS org_portal (
+  org_id INT NOT NULL DEFAULT current_org() REFERENCES organizations (id),
+  enabled BOOLEAN NOT NULL DEFAULT FALSE,
+  title TEXT NOT NULL DEFAULT '',
+  show_current BOOLEAN NOT NULL DEFAULT TRUE,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  updated_by TEXT NOT NULL DEFAULT ''
+);
+SELECT org_scope('org_portal');
+CREATE UNIQUE INDEX IF NOT EXISTS org_portal_org_idx ON org_portal (org_id);
+
+-- archived elections published on the portal; a sealed election can't be
+-- updated, so publishing is a row here
+CREATE TABLE IF NOT EXISTS portal_elections (
+  election_id INT PRIMARY KEY REFERENCES elections(id) ON DELETE CASCADE,
+  published_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  published_by TEXT NOT NULL
+);
+SELECT org_scope('portal_elections');
+
+-- requests per minute an API key may make (quota.go); 0 leaves only the
+-- organization's QUOTA_REQUESTS_PER_MINUTE
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS requests_per_minute INT NOT NULL DEFAULT 0 CHECK (requests_per_minute >= 0);
+
+-- the directory a voter was synced from (directory.go); synced voters who
+-- leave the directory group are removed from the roll unless they voted
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS synced_from TEXT;
+
+-- admin sign-ins through /admin/login (session.go); the cookie holds a random
+-- token, the table its SHA-256. account_id is set for admin_accounts, whose
+-- current role and disabled flag apply to the session.
+CREATE TABLE IF NOT EXISTS admin_sessions (
+  id SERIAL PRIMARY KEY,
+  token_hash TEXT UNIQUE NOT NULL,
+  account_id INT REFERENCES admin_accounts(id) ON DELETE CASCADE,
+  username TEXT NOT NULL,
+  role TEXT NOT NULL,
+  method TEXT NOT NULL,
+  ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  revoked_at TIMESTAMPTZ
+);
+SELECT org_scope('admin_sessions');
+CREATE INDEX IF NOT EXISTS admin_sessions_username_idx ON admin_sessions (org_id, username);
+
+-- remembered browsers of admin_accounts (remember.go): the cookie holds the
+-- series and a token rotated at every use; prev_hash is the token before the
+-- last rotation, accepted for a moment after it
+CREATE TABLE IF NOT EXISTS admin_remember_tokens (
+  id SERIAL PRIMARY KEY,
+  series TEXT UNIQUE NOT NULL,
+  token_hash TEXT NOT NULL,
+  prev_hash TEXT,
+  rotated_at TIMESTAMPTZ,
+  account_id INT NOT NULL REFERENCES admin_accounts(id) ON DELETE CASCADE,
+  fingerprint TEXT NOT NULL,
+  user_agent TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_used_at TIMESTAMPTZ,
+  expires_at TIMESTAMPTZ NOT NULL,
+  revoked_at TIMESTAMPTZ
+);
+SELECT org_scope('admin_remember_tokens');
+-- the session the last rotation started, which requests late for it join
+ALTER TABLE admin_remember_tokens ADD COLUMN IF NOT EXISTS rotated_session INT REFERENCES admin_sessions(id) ON DELETE SET NULL;
+
+-- where a forgotten password's reset link goes (password_reset.go); invited
+-- accounts are named by their email already
+ALTER TABLE admin_accounts ADD COLUMN IF NOT EXISTS email TEXT;
+UPDATE admin_accounts SET email = lower(username) WHERE email IS NULL AND username ~ '^[^@\s]+@[^@\s]+\.[^@\s]+$';
+
+-- reset links sent for forgotten passwords; a link is signed over the account
+-- and its password hash, so it is used once and dies with any password change
+CREATE TABLE IF NOT EXISTS password_resets (
+  id SERIAL PRIMARY KEY,
+  account_id INT NOT NULL REFERENCES admin_accounts(id) ON DELETE CASCADE,
+  ip TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ
+);
+SELECT org_scope('password_resets');
+
+-- networks the admin area is limited to, besides ADMIN_ALLOW_IPS
+-- (admin_allowlist.go); none listed leaves it open
+CREATE TABLE IF NOT EXISTS admin_allowlist (
+  id SERIAL PRIMARY KEY,
+  network CIDR NOT NULL,
+  note TEXT NOT NULL DEFAULT '',
+  created_by TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+SELECT org_scope('admin_allowlist');
+CREATE UNIQUE INDEX IF NOT EXISTS admin_allowlist_org_network_idx ON admin_allowlist (org_id, network);
+
+-- every admin sign-in attempt (login_audit.go); network is the /24 or /64
+-- of the address, whose first successful sign-in while voting is open raises
+-- an alert
+CREATE TABLE IF NOT EXISTS admin_logins (
+  id BIGSERIAL PRIMARY KEY,
+  username TEXT NOT NULL,
+  method TEXT NOT NULL,
+  success BOOLEAN NOT NULL,
+  reason TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  network TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+SELECT org_scope('admin_logins');
+CREATE INDEX IF NOT EXISTS admin_logins_username_idx ON admin_logins (org_id, username, created_at);
+CREATE INDEX IF NOT EXISTS admin_logins_ip_idx ON admin_logins (org_id, ip, created_at);
+
+-- member attributes (membership status, dues, join date, ...) imported with
+-- the roll, read by ELIGIBILITY_RULE (eligibility.go)
+ALTER TABLE IF EXISTS vote_master ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+
+-- versions of the voter roll before voting opens (roll_versions.go); a
+-- version holds the voters it changed, entry NULL for a removal
+CREATE TABLE IF NOT EXISTS roll_versions (
+  id SERIAL PRIMARY KEY,
+  vote_start TIMESTAMPTZ NOT NULL,
+  number INT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  created_by TEXT NOT NULL DEFAULT '',
+  voters INT NOT NULL,
+  added INT NOT NULL,
+  removed INT NOT NULL,
+  edited INT NOT NULL,
+  digest TEXT NOT NULL
+);
+SELECT org_scope('roll_versions');
+CREATE UNIQUE INDEX IF NOT EXISTS roll_versions_org_number_idx ON roll_versions (org_id, vote_start, number);
+
+CREATE TABLE IF NOT EXISTS roll_version_entries (
+  version_id INT NOT NULL REFERENCES roll_versions (id) ON DELETE CASCADE,
+  code TEXT NOT NULL,
+  entry JSONB,
+  PRIMARY KEY (version_id, code)
+);
+SELECT org_scope('roll_version_entries');
+CREATE INDEX IF NOT EXISTS roll_version_entries_code_idx ON roll_version_entries (org_id, code);
+
+-- code activation (CODE_EXPIRES_AFTER, code_activation.go): a code left
+-- unactivated this long after issued_at expires. Codes already on the roll
+-- count as issued when this runs.
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS issued_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS activated_at TIMESTAMPTZ;
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS activation_mailed_at TIMESTAMPTZ;
+
+-- codes revoked by the committee (revoked.go), e.g. of letters known to be
+-- photographed; the servers keep them in memory and reload on codes_revoked
+CREATE TABLE IF NOT EXISTS revoked_codes (
+  id SERIAL PRIMARY KEY,
+  code TEXT NOT NULL,
+  reason TEXT NOT NULL DEFAULT '',
+  revoked_by TEXT NOT NULL DEFAULT '',
+  revoked_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+SELECT org_scope('revoked_codes');
+CREATE UNIQUE INDEX IF NOT EXISTS revoked_codes_org_code_idx ON revoked_codes (org_id, code);
+
+CREATE OR REPLACE FUNCTION notify_codes_revoked() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify('codes_revoked', '');
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS revoked_codes_changed ON revoked_codes;
+CREATE TRIGGER revoked_codes_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON revoked_codes
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_codes_revoked();
+
+-- in-person check-in (checkin.go): a voter checked in at the room votes on
+-- the paper ballot numbered ballot_ref, and their code casts nothing online.
+-- The roll's 'checked_in' row counts them toward the quorums.
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS checked_in_at TIMESTAMPTZ;
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS checked_in_by TEXT;
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS ballot_ref TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS voters_ballot_ref_idx ON voters (org_id, ballot_ref) WHERE ballot_ref IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION tally_voter(v voters, sign INT) RETURNS void AS $$
+BEGIN
+  IF v.used THEN
+    PERFORM tally_add(v.org_id, 'voters', 'roll', 'voted', '', sign, 0);
+  END IF;
+  IF v.sealed_choice IS NOT NULL THEN
+    PERFORM tally_add(v.org_id, 'voters', 'roll', 'sealed', '', sign, 0);
+  END IF;
+  IF v.checked_in_at IS NOT NULL THEN
+    PERFORM tally_add(v.org_id, 'voters', 'roll', 'checked_in', '', sign, sign * v.shares);
+  END IF;
+  IF v.used AND v.vote_choice IS NOT NULL THEN
+    PERFORM tally_add(v.org_id, 'voters', 'online', v.vote_choice, v.follow_up, sign, sign * v.shares);
+  END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS voters_tally_update ON voters;
+CREATE TRIGGER voters_tally_update AFTER UPDATE ON voters
+  FOR EACH ROW WHEN (OLD.used IS DISTINCT FROM NEW.used OR OLD.vote_choice IS DISTINCT FROM NEW.vote_choice
+    OR OLD.follow_up IS DISTINCT FROM NEW.follow_up OR OLD.shares IS DISTINCT FROM NEW.shares
+    OR (OLD.sealed_choice IS NULL) <> (NEW.sealed_choice IS NULL)
+    OR (OLD.checked_in_at IS NULL) <> (NEW.checked_in_at IS NULL))
+  EXECUTE FUNCTION tally_voters();
+
+CREATE OR REPLACE FUNCTION refresh_tally_counts() RETURNS void AS $$
+BEGIN
+  -- no ballot may change while the counts are rebuilt
+  LOCK TABLE voters, offline_voters, spoiled_ballots IN SHARE MODE;
+  DELETE FROM tally_counts WHERE org_id = current_org();
+  INSERT INTO tally_counts (source, channel, choice, follow_up, ballots, shares)
+  SELECT 'voters', 'roll', '', '', COUNT(*), COALESCE(SUM(shares), 0) FROM voters WHERE org_id = current_org()
+  UNION ALL
+  SELECT 'voters', 'roll', 'voted', '', COUNT(*), 0 FROM voters WHERE org_id = current_org() AND used
+  UNION ALL
+  SELECT 'voters', 'roll', 'sealed', '', COUNT(*), 0 FROM voters
+  WHERE org_id = current_org() AND sealed_choice IS NOT NULL
+  UNION ALL
+  SELECT 'voters', 'roll', 'checked_in', '', COUNT(*), COALESCE(SUM(shares), 0) FROM voters
+  WHERE org_id = current_org() AND checked_in_at IS NOT NULL
+  UNION ALL
+  SELECT 'voters', 'online', vote_choice, COALESCE(follow_up, ''), COUNT(*), SUM(shares) FROM voters
+  WHERE org_id = current_org() AND used AND vote_choice IS NOT NULL GROUP BY vote_choice, COALESCE(follow_up, '')
+  UNION ALL
+  SELECT 'offline_voters', 'offline', vote_choice, COALESCE(follow_up, ''), COUNT(*), COUNT(*) FROM offline_voters
+  WHERE org_id = current_org() GROUP BY vote_choice, COALESCE(follow_up, '')
+  UNION ALL
+  SELECT 'spoiled_ballots', channel, 'rusak', '', COUNT(*), 0 FROM spoiled_ballots
+  WHERE org_id = current_org() GROUP BY channel;
+END;
+$$ LANGUAGE plpgsql;
+
+DO $$
+DECLARE
+  org INT;
+BEGIN
+  FOR org IN SELECT id FROM organizations ORDER BY id LOOP
+    PERFORM set_config('app.org', org::text, true);
+    PERFORM refresh_tally_counts();
+  END LOOP;
+  PERFORM set_config('app.org', '', true);
+END;
+$$;
+
+-- shared voting terminals unlocked by an operator (kiosk.go): the terminal's
+-- cookie holds a random token, the table its SHA-256
+CREATE TABLE IF NOT EXISTS kiosk_terminals (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  unlocked_by TEXT NOT NULL,
+  unlocked_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  locked_at TIMESTAMPTZ,
+  locked_by TEXT,
+  ballots INT NOT NULL DEFAULT 0
+);
+SELECT org_scope('kiosk_terminals');
+
+-- codes mailed to the member (helpdesk.go), for the helpdesk to see whether
+-- and when a code went out
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS code_sent_at TIMESTAMPTZ;
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS code_sent_count INT NOT NULL DEFAULT 0;
+
+-- walk-in members registered while voting is open (late.go), with who
+-- approved and who entered them; the closing snapshot counts them
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS registered_late_at TIMESTAMPTZ;
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS late_approved_by TEXT;
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS late_registered_by TEXT;
+ALTER TABLE voters ADD COLUMN IF NOT EXISTS late_note TEXT;
+ALTER TABLE tally_snapshots ADD COLUMN IF NOT EXISTS late_registered INT NOT NULL DEFAULT 0;
+
+-- the admin notification center (notifications.go): a notification with a
+-- key is raised once per key; read state is kept per admin username
+CREATE TABLE IF NOT EXISTS admin_notifications (
+  id BIGSERIAL PRIMARY KEY,
+  kind TEXT NOT NULL,
+  key TEXT,
+  message TEXT NOT NULL,
+  link TEXT NOT NULL DEFAULT '',
+  superadmin_only BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+SELECT org_scope('admin_notifications');
+CREATE UNIQUE INDEX IF NOT EXISTS admin_notifications_org_key_idx ON admin_notifications (org_id, key);
+CREATE INDEX IF NOT EXISTS admin_notifications_created_idx ON admin_notifications (org_id, created_at);
+
+CREATE TABLE IF NOT EXISTS admin_notification_reads (
+  notification_id BIGINT NOT NULL REFERENCES admin_notifications (id) ON DELETE CASCADE,
+  username TEXT NOT NULL,
+  read_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (notification_id, username)
+);
+SELECT org_scope('admin_notification_reads');
+
+-- background jobs shared by the instances (scheduler.go): an instance claims
+-- a due job by leasing its row, and records the run
+CREATE TABLE IF NOT EXISTS scheduled_jobs (
+  name TEXT NOT NULL,
+  last_run_at TIMESTAMPTZ,
+  locked_by TEXT,
+  locked_until TIMESTAMPTZ,
+  last_error TEXT,
+  last_error_at TIMESTAMPTZ
+);
+SELECT org_scope('scheduled_jobs');
+CREATE UNIQUE INDEX IF NOT EXISTS scheduled_jobs_org_name_idx ON scheduled_jobs (org_id, name);
+
+-- emails and Slack messages queued with what calls for them (outbox.go),
+-- sent and retried by the outbox.deliver job until sent or given up on
+-- (failed_at)
+CREATE TABLE IF NOT EXISTS outbox_messages (
+  id BIGSERIAL PRIMARY KEY,
+  channel TEXT NOT NULL,
+  recipient TEXT NOT NULL,
+  subject TEXT NOT NULL DEFAULT '',
+  body TEXT NOT NULL,
+  source TEXT NOT NULL DEFAULT '',
+  attempts INT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  sent_at TIMESTAMPTZ,
+  failed_at TIMESTAMPTZ,
+  last_error TEXT
+);
+SELECT org_scope('outbox_messages');
+CREATE INDEX IF NOT EXISTS outbox_messages_due_idx ON outbox_messages (org_id, next_attempt_at)
+  WHERE sent_at IS NULL AND failed_at IS NULL;
+
+-- tell the servers which voters to drop from their code lookups
+-- (code_cache.go): "<org>:<voter id>" per voter whose name, code or used
+-- flag went back, or who was removed, and "<org>:*" for more than 100 at
+-- once. A vote notifies nothing; the server casting it drops the code.
+CREATE OR REPLACE FUNCTION notify_codes_changed() RETURNS trigger AS $$
+DECLARE
+  changed TEXT[];
+  orgs INT[];
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    SELECT array_agg(o.org_id || ':' || o.id), array_agg(DISTINCT o.org_id) INTO changed, orgs FROM old_rows o;
+  ELSE
+    SELECT array_agg(o.org_id || ':' || o.id), array_agg(DISTINCT o.org_id) INTO changed, orgs
+    FROM old_rows o JOIN new_rows n ON n.id = o.id
+    WHERE n.name IS DISTINCT FROM o.name OR n.code IS DISTINCT FROM o.code OR (o.used AND NOT n.used);
+  END IF;
+  IF cardinality(changed) > 100 THEN
+    PERFORM pg_notify('codes_changed', org || ':*') FROM unnest(orgs) org;
+  ELSIF changed IS NOT NULL THEN
+    PERFORM pg_notify('codes_changed', v) FROM unnest(changed) v;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS voters_codes_updated ON voters;
+CREATE TRIGGER voters_codes_updated AFTER UPDATE ON voters
+  REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_codes_changed();
+DROP TRIGGER IF EXISTS voters_codes_deleted ON voters;
+CREATE TRIGGER voters_codes_deleted AFTER DELETE ON voters
+  REFERENCING OLD TABLE AS old_rows
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_codes_changed();
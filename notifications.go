@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The notification center at /admin/notifications collects what the
+// committee should know about while the election runs, so it doesn't have
+// to watch every page: the main question reaching its quorum, voting closing
+// within closingNotice, webhook deliveries given up on, and the sign-in
+// alerts of login_audit.go. Each admin marks them read for themselves; read
+// state is kept per username, since accounts from the env, OIDC, SAML and
+// LDAP have no row in admin_accounts. Operators see the notifications about
+// the vote; delivery failures and sign-in alerts are for superadmins.
+//
+// A notification with a key is raised once per key, however many times or
+// instances notice it.
+
+const (
+	// closingNotice is how long before vote end the closing is announced
+	closingNotice = 30 * time.Minute
+	// notificationInterval is how often the quorum and the clock are checked
+	notificationInterval = time.Minute
+	// notificationHistory is how long notifications are kept
+	notificationHistory = 90 * 24 * time.Hour
+	// notificationListLimit caps the notifications listed
+	notificationListLimit = 100
+)
+
+// Kinds of notification
+const (
+	NotifyQuorum         = "quorum"
+	NotifyClosing        = "closing"
+	NotifyDeliveryFailed = "delivery_failed"
+	NotifySuspicious     = "suspicious"
+)
+
+// notification is raised by notify
+type notification struct {
+	Kind           string
+	Key            string // raised once per key; empty raises it every time
+	Message        string
+	Link           string // path within the election, e.g. /admin/webhooks
+	SuperadminOnly bool
+}
+
+// notify records n. Failing to record never fails the caller.
+func (a *App) notify(ctx context.Context, n notification) {
+	var key *string
+	if n.Key != "" {
+		key = &n.Key
+	}
+	_, err := a.db.Exec(ctx, `
+		INSERT INTO admin_notifications (kind, key, message, link, superadmin_only)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (org_id, key) DO NOTHING`, n.Kind, key, n.Message, n.Link, n.SuperadminOnly)
+	if err != nil {
+		logDB.Errorf("error recording notification: %v", err)
+	}
+}
+
+// Notification is a notification as listed for one admin
+type Notification struct {
+	ID        int64
+	Kind      string
+	Message   string
+	Link      string
+	CreatedAt time.Time
+	Read      bool
+}
+
+// listNotifications returns the latest notifications acc may see, newest
+// first, with whether acc read them
+func (a *App) listNotifications(ctx context.Context, acc *Account) ([]Notification, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT n.id, n.kind, n.message, n.link, n.created_at, r.username IS NOT NULL
+		FROM admin_notifications n
+		LEFT JOIN admin_notification_reads r ON r.notification_id = n.id AND r.username = $1
+		WHERE $2 OR NOT n.superadmin_only
+		ORDER BY n.created_at DESC, n.id DESC
+		LIMIT $3`, acc.Username, acc.Role == RoleSuperadmin, notificationListLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Message, &n.Link, &n.CreatedAt, &n.Read); err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// unreadNotifications counts the notifications acc may see and hasn't read
+func (a *App) unreadNotifications(ctx context.Context, acc *Account) (int, error) {
+	var n int
+	err := a.db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM admin_notifications n
+		WHERE ($2 OR NOT n.superadmin_only)
+		AND NOT EXISTS (SELECT 1 FROM admin_notification_reads r WHERE r.notification_id = n.id AND r.username = $1)`,
+		acc.Username, acc.Role == RoleSuperadmin).Scan(&n)
+	return n, err
+}
+
+// markNotificationsRead marks notification id read for acc, or every
+// notification acc may see with id 0
+func (a *App) markNotificationsRead(ctx context.Context, acc *Account, id int64) error {
+	_, err := a.db.Exec(ctx, `
+		INSERT INTO admin_notification_reads (notification_id, username)
+		SELECT id, $1 FROM admin_notifications
+		WHERE ($2 = 0 OR id = $2) AND ($3 OR NOT superadmin_only)
+		ON CONFLICT DO NOTHING`, acc.Username, id, acc.Role == RoleSuperadmin)
+	return err
+}
+
+// notificationJob checks the quorum and the close of voting
+func (a *App) notificationJob(ctx context.Context) error {
+	a.checkClosing(ctx, time.Now())
+	a.checkQuorum(ctx, time.Now())
+	return nil
+}
+
+// pruneNotifications drops the notifications older than notificationHistory
+func (a *App) pruneNotifications(ctx context.Context) error {
+	_, err := a.db.Exec(ctx, `DELETE FROM admin_notifications WHERE created_at < NOW() - make_interval(secs => $1)`,
+		notificationHistory.Seconds())
+	return err
+}
+
+// checkClosing announces the close of voting once it is within
+// closingNotice
+func (a *App) checkClosing(ctx context.Context, now time.Time) {
+	if now.Before(a.voteStart) || !now.Before(a.voteEnd) || a.voteEnd.Sub(now) > closingNotice {
+		return
+	}
+	a.notify(ctx, notification{
+		Kind:    NotifyClosing,
+		Key:     "closing|" + a.voteEnd.UTC().Format(time.RFC3339),
+		Message: fmt.Sprintf("Pemilihan ditutup pukul %s, kurang dari %d menit lagi.", a.voteEnd.Format("15:04"), int(closingNotice.Minutes())),
+		Link:    "/admin",
+	})
+}
+
+// checkQuorum announces the main question reaching its quorums while voting
+// is open. Without a quorum there is nothing to announce.
+func (a *App) checkQuorum(ctx context.Context, now time.Time) {
+	rule := a.ballot.Rule
+	if rule.Quorum == 0 && rule.ShareQuorum == 0 {
+		return
+	}
+	if now.Before(a.voteStart) || !now.Before(a.voteEnd) {
+		return
+	}
+	results, err := a.cachedResults(ctx)
+	if err != nil {
+		logTally.Errorf("error getting results for notifications: %v", err)
+		return
+	}
+	v := a.ballot.questions(results.Ballots, results.Electorate)[0].Validity
+	if !v.QuorumMet() || !v.ShareQuorumMet() {
+		return
+	}
+	msg := fmt.Sprintf("Kuorum pertanyaan utama tercapai: %.1f%% pemilih", v.TurnoutPct())
+	if rule.ShareQuorum > 0 {
+		msg += fmt.Sprintf(", %.1f%% bobot", v.SharePct())
+	}
+	a.notify(ctx, notification{
+		Kind:    NotifyQuorum,
+		Key:     "quorum|" + a.voteEnd.UTC().Format(time.RFC3339),
+		Message: msg + ".",
+		Link:    "/admin",
+	})
+}
+
+// NotificationsData is the data of notifications.html
+type NotificationsData struct {
+	Notifications []Notification
+	Unread        int
+	Home          string // the page of the account's role
+	Error         string
+}
+
+// adminNotificationsHandler: GET /admin/notifications lists the latest
+// notifications; POST action=read marks ?id= read, action=read_all all of
+// them. Superadmins and operators.
+func (a *App) adminNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	acc := accountFrom(ctx)
+	data := NotificationsData{Home: "/admin"}
+	if acc.Role == RoleOperator {
+		data.Home = "/count"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var id int64
+		switch r.FormValue("action") {
+		case "read":
+			var err error
+			if id, err = strconv.ParseInt(r.FormValue("id"), 10, 64); err != nil || id <= 0 {
+				data.Error = "notifikasi tidak dikenal"
+				break
+			}
+			fallthrough
+		case "read_all":
+			if err := a.markNotificationsRead(ctx, acc, id); err != nil {
+				logDB.Errorf("error marking notifications read: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			a.electionRedirect(w, r, "/admin/notifications", http.StatusSeeOther)
+			return
+		default:
+			data.Error = "aksi tidak dikenal"
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list, err := a.listNotifications(ctx, acc)
+	if err != nil {
+		logDB.Errorf("error getting notifications: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Notifications = list
+	if data.Unread, err = a.unreadNotifications(ctx, acc); err != nil {
+		logDB.Errorf("error counting notifications: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := a.tmpl.ExecuteTemplate(w, "notifications.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ObserverStats is what the observer role may see: turnout at any time,
+// choice counts only once voting has closed. It never contains voter codes.
+type ObserverStats struct {
+	TotalVoters      int       `json:"total_voters"`
+	VotedCount       int       `json:"voted_count"`
+	NotVotedCount    int       `json:"not_voted_count"`
+	Closed           bool      `json:"closed"`
+	SetujuCount      *int      `json:"setuju_count,omitempty"`
+	TidakSetujuCount *int      `json:"tidak_setuju_count,omitempty"`
+	ByGroup          ChartData `json:"by_group"`
+	GeneratedAt      string    `json:"generated_at"`
+}
+
+// observerStats builds the observer view, withholding results until close
+func (a *App) observerStats(ctx context.Context) (ObserverStats, error) {
+	stats, err := a.adminStats(ctx)
+	if err != nil {
+		return ObserverStats{}, err
+	}
+	byGroup, err := a.turnoutByGroupChart(ctx)
+	if err != nil {
+		return ObserverStats{}, err
+	}
+
+	now := time.Now()
+	s := ObserverStats{
+		TotalVoters:   stats.TotalVoters,
+		VotedCount:    stats.VotedCount,
+		NotVotedCount: stats.NotVotedCount,
+		Closed:        now.After(a.voteEnd),
+		ByGroup:       byGroup,
+		GeneratedAt:   now.Format(time.RFC3339),
+	}
+	if s.Closed {
+		s.SetujuCount = &stats.SetujuCount
+		s.TidakSetujuCount = &stats.TidakSetujuCount
+	}
+	return s, nil
+}
+
+// observerHandler renders the read-only observer dashboard. Only GET is
+// accepted; there are no forms or actions on this page.
+func (a *App) observerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := a.observerStats(r.Context())
+	if err != nil {
+		logTally.Errorf("error getting observer stats: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "observer.html", stats); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// observerStatsHandler serves the observer view as JSON for polling
+func (a *App) observerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := a.observerStats(r.Context())
+	if err != nil {
+		logTally.Errorf("error getting observer stats: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With OIDC_ISSUER set, admins can sign in through the organization's
+// identity provider (Google, Microsoft Entra ID, Keycloak, ...) with the
+// OpenID Connect authorization code flow and PKCE. The provider's groups
+// decide the role: OIDC_ROLES maps a value of the OIDC_GROUPS_CLAIM claim to
+// a role, the highest mapped role wins and a user without one is turned
+// away. The role is taken at sign-in and kept in a session cookie signed
+// with SESSION_KEY for adminSessionTTL, so removing someone from a group
+// takes effect at their next sign-in (see session.go). Basic auth with the
+// env credentials and admin_accounts keeps working next to it.
+
+const (
+	oidcStateCookie = "oidc_state"
+
+	// oidcStateTTL is how long the provider's login page may take
+	oidcStateTTL = 10 * time.Minute
+	// oidcKeysRefresh is how often an unknown key id may refetch the provider's
+	// keys, which rotate
+	oidcKeysRefresh = time.Minute
+	// oidcClockSkew is tolerated between the provider's clock and ours
+	oidcClockSkew = 2 * time.Minute
+)
+
+// oidcProvider is the identity provider configured through OIDC_*. Its
+// endpoints and keys are fetched at the first sign-in, so a provider that is
+// down doesn't keep the server from starting.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	scopes       string
+	groupsClaim  string
+	roleMap      map[string]Role
+	name         string // shown on the login button
+	client       *http.Client
+
+	mu     sync.Mutex
+	meta   *oidcMetadata
+	keys   map[string]crypto.PublicKey
+	keysAt time.Time
+}
+
+// oidcMetadata is the part of the provider's discovery document we use
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// loadOIDC reads the provider from the env; nil without OIDC_ISSUER
+func loadOIDC() (*oidcProvider, error) {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(issuer)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"))) {
+		return nil, fmt.Errorf("invalid OIDC_ISSUER %q: use the https:// address of the provider", issuer)
+	}
+	p := &oidcProvider{
+		issuer:       issuer,
+		clientID:     os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		scopes:       os.Getenv("OIDC_SCOPES"),
+		groupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		name:         os.Getenv("OIDC_NAME"),
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	if p.clientID == "" || p.clientSecret == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER needs OIDC_CLIENT_ID and OIDC_CLIENT_SECRET")
+	}
+	if p.scopes == "" {
+		p.scopes = "openid email profile"
+	}
+	if !strings.Contains(" "+p.scopes+" ", " openid ") {
+		p.scopes = "openid " + p.scopes
+	}
+	if p.groupsClaim == "" {
+		p.groupsClaim = "groups"
+	}
+	if p.name == "" {
+		p.name = "akun organisasi"
+	}
+	if p.roleMap, err = parseRoleMap(os.Getenv("OIDC_ROLES")); err != nil {
+		return nil, fmt.Errorf("invalid OIDC_ROLES: %v", err)
+	}
+	if len(p.roleMap) == 0 {
+		return nil, fmt.Errorf("OIDC_ISSUER needs OIDC_ROLES, e.g. panitia=superadmin,saksi=observer")
+	}
+	return p, nil
+}
+
+// getJSON fetches a JSON document of the provider into v
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// metadata returns the provider's endpoints, discovering them the first time
+func (p *oidcProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var m oidcMetadata
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(m.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery: issuer %q doesn't match OIDC_ISSUER", m.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery: missing endpoints")
+	}
+	p.meta = &m
+	return p.meta, nil
+}
+
+// oidcJWK is one key of the provider's key set; only RSA and P-256 keys are
+// kept
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k oidcJWK) publicKey() (crypto.PublicKey, bool) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, false
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, true
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, false
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return nil, false
+		}
+		// ecdh rejects points off the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, false
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, true
+	}
+	return nil, false
+}
+
+// key returns the provider's signing key kid, refetching the key set when
+// kid is new to us
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysAt) < oidcKeysRefresh {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("keys: %w", err)
+	}
+	p.keys, p.keysAt = map[string]crypto.PublicKey{}, time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, ok := k.publicKey(); ok {
+			p.keys[k.Kid] = pub
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// exchange trades the authorization code for the user's ID token
+func (p *oidcProvider) exchange(ctx context.Context, code, redirectURI, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token response: %s: %w", resp.Status, err)
+	}
+	if tok.Error != "" {
+		return "", fmt.Errorf("token: %s %s", tok.Error, tok.ErrorDescription)
+	}
+	if tok.IDToken == "" {
+		return "", fmt.Errorf("token response without id_token")
+	}
+	return tok.IDToken, nil
+}
+
+// verify checks the signature and claims of an ID token issued to us for
+// the sign-in started with nonce, and returns its claims
+func (p *oidcProvider) verify(ctx context.Context, idToken, nonce string) (map[string]any, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id_token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id_token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id_token signature: %w", err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("bad id_token signature (%s)", header.Alg)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("bad id_token signature (%s)", header.Alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported id_token algorithm %s", header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id_token claims: %w", err)
+	}
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != meta.Issuer {
+		return nil, fmt.Errorf("id_token from issuer %q", iss)
+	}
+	audiences := claimStrings(claims["aud"])
+	if !containsString(audiences, p.clientID) {
+		return nil, fmt.Errorf("id_token not issued to this client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.clientID {
+		return nil, fmt.Errorf("id_token authorized for another client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("id_token expired")
+	}
+	if got, _ := claims["nonce"].(string); !constantTimeEqual(got, nonce) {
+		return nil, fmt.Errorf("id_token nonce mismatch")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// claimStrings reads a claim that is either a string or a list of strings
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// identity names the user of the claims for the audit log: the verified
+// email, else the provider's username, else its subject id
+func (p *oidcProvider) identity(claims map[string]any) string {
+	if email, _ := claims["email"].(string); email != "" {
+		if verified, ok := claims["email_verified"].(bool); !ok || verified {
+			return strings.ToLower(email)
+		}
+	}
+	if name, _ := claims["preferred_username"].(string); name != "" {
+		return name
+	}
+	sub, _ := claims["sub"].(string)
+	return "oidc:" + sub
+}
+
+// role returns the highest role the user's groups map to, and the groups
+func (p *oidcProvider) role(claims map[string]any) (Role, []string, bool) {
+	groups := claimStrings(claims[p.groupsClaim])
+	role, ok := highestRole(groups, p.roleMap)
+	return role, groups, ok
+}
+
+// oidcState is what the state cookie remembers between sending the admin to
+// the provider and the callback
+type oidcState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Next     string `json:"p"`
+	Expires  int64  `json:"e"`
+}
+
+// oidcRedirectURI is the callback address registered at the provider
+func (a *App) oidcRedirectURI(r *http.Request) string {
+	return a.baseURL(r) + "/admin/oidc/callback"
+}
+
+// oidcLoginHandler: GET /admin/oidc/login sends the admin to the provider,
+// remembering state, nonce and the PKCE verifier in a signed cookie
+func (a *App) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	next := safeNext(r.URL.Query().Get("next"))
+	meta, err := a.oidc.metadata(r.Context())
+	if err != nil {
+		logHTTP.Errorf("error reaching identity provider: %v", err)
+		a.renderLogin(w, http.StatusBadGateway, LoginData{Next: next, Error: "Penyedia login tidak dapat dihubungi, coba lagi nanti."})
+		return
+	}
+	st := oidcState{
+		State:    randomToken(24),
+		Nonce:    randomToken(24),
+		Verifier: randomToken(32),
+		Next:     next,
+		Expires:  time.Now().Add(oidcStateTTL).Unix(),
+	}
+	raw, _ := json.Marshal(st)
+	a.setCookie(w, r, oidcStateCookie, a.signCookie(oidcStateCookie, base64.RawURLEncoding.EncodeToString(raw)), int(oidcStateTTL.Seconds()), http.SameSiteLaxMode)
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.oidc.clientID},
+		"redirect_uri":          {a.oidcRedirectURI(r)},
+		"scope":                 {a.oidc.scopes},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcCallbackHandler: GET /admin/oidc/callback finishes the sign-in: it
+// checks the state, trades the code for the ID token, maps the groups to a
+// role and starts the session
+func (a *App) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if a.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	failed := LoginData{Next: "/admin", Error: "Login gagal, silakan coba lagi."}
+
+	var st oidcState
+	value, ok := a.openCookie(r, oidcStateCookie)
+	if ok {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		ok = err == nil && json.Unmarshal(raw, &st) == nil && time.Now().Unix() <= st.Expires
+	}
+	a.setCookie(w, r, oidcStateCookie, "", -1, http.SameSiteLaxMode)
+	if !ok || !constantTimeEqual(r.URL.Query().Get("state"), st.State) {
+		a.recordLogin(r, "", LoginOIDC, false, "state")
+		a.renderLogin(w, http.StatusBadRequest, failed)
+		return
+	}
+	failed.Next = st.Next
+	if e := r.URL.Query().Get("error"); e != "" {
+		logHTTP.Warnf("identity provider refused sign-in: %s %s", e, r.URL.Query().Get("error_description"))
+		a.recordLogin(r, "", LoginOIDC, false, "provider")
+		a.renderLogin(w, http.StatusUnauthorized, failed)
+		return
+	}
+
+	idToken, err := a.oidc.exchange(ctx, r.URL.Query().Get("code"), a.oidcRedirectURI(r), st.Verifier)
+	if err != nil {
+		logHTTP.Errorf("error exchanging OIDC code: %v", err)
+		a.renderLogin(w, http.StatusBadGateway, failed)
+		return
+	}
+	claims, err := a.oidc.verify(ctx, idToken, st.Nonce)
+	if err != nil {
+		logHTTP.Errorf("error verifying OIDC id_token: %v", err)
+		a.recordLogin(r, "", LoginOIDC, false, "token")
+		a.renderLogin(w, http.StatusUnauthorized, failed)
+		return
+	}
+	user := a.oidc.identity(claims)
+	role, groups, ok := a.oidc.role(claims)
+	if !ok {
+		a.recordLogin(r, user, LoginOIDC, false, "group")
+		a.audit(ctx, user, "account.oidc_denied", user, map[string]any{"groups": groups})
+		failed.Error = "Akun " + user + " tidak termasuk grup yang mendapat akses admin."
+		a.renderLogin(w, http.StatusForbidden, failed)
+		return
+	}
+
+	if _, err := a.startSession(w, r, &Account{Username: user, Role: role}, "oidc"); err != nil {
+		logDB.Errorf("error starting session: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	a.recordLogin(r, user, LoginOIDC, true, "")
+	a.audit(ctx, user, "account.oidc_login", user, map[string]any{"role": role, "groups": groups})
+	a.electionRedirect(w, r, st.Next, http.StatusSeeOther)
+}
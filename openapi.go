@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiParam is a path or query parameter of an API operation
+type apiParam struct {
+	Name        string
+	In          string // path / query
+	Type        string // string / integer
+	Description string
+}
+
+// apiOperation documents one /api/v1 endpoint. Request and response schemas
+// are generated from the Go types, so the spec follows the handlers as long
+// as this table lists the types they actually use. Keep it in step with
+// apiHandler.
+type apiOperation struct {
+	Method   string
+	Path     string
+	Scopes   []Scope // any one of them will do
+	Summary  string
+	Params   []apiParam
+	Body     interface{} // request body type, nil for none
+	Status   int
+	Response interface{} // nil for an empty response
+	Errors   []int
+}
+
+var (
+	voterFilterParams = []apiParam{
+		{"status", "query", "string", "voted / not_voted"},
+		{"group", "query", "string", "wilayah"},
+		{"q", "query", "string", "search name, code or phone"},
+		{"sort", "query", "string", "name / used_at / group"},
+		{"order", "query", "string", "asc / desc"},
+		{"limit", "query", "integer", "page size, max 1000"},
+		{"offset", "query", "integer", "rows to skip; prefer cursor for large rolls"},
+		{"cursor", "query", "string", "next_cursor of the previous page"},
+	}
+	cursorParam    = apiParam{"cursor", "query", "string", "next_cursor of the previous page"}
+	codeParam      = apiParam{"code", "path", "string", "voter code"}
+	webhookIDParam = apiParam{"id", "path", "integer", "webhook id"}
+)
+
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/voters", Scopes: []Scope{ScopeManageVoters}, Summary: "List voters", Params: voterFilterParams,
+		Status: 200, Response: APIVoterList{}, Errors: []int{400}},
+	{Method: "POST", Path: "/voters", Scopes: []Scope{ScopeManageVoters}, Summary: "Add a voter to the roll", Body: APIVoterInput{},
+		Status: 201, Response: APIVoter{}, Errors: []int{400, 409, 422}},
+	{Method: "GET", Path: "/voters/{code}", Scopes: []Scope{ScopeManageVoters}, Summary: "Get a voter", Params: []apiParam{codeParam},
+		Status: 200, Response: APIVoter{}, Errors: []int{404}},
+	{Method: "DELETE", Path: "/voters/{code}", Scopes: []Scope{ScopeManageVoters}, Summary: "Remove a voter who hasn't voted", Params: []apiParam{codeParam},
+		Status: 204, Errors: []int{404, 409}},
+	{Method: "GET", Path: "/elections", Scopes: []Scope{ScopeReadResults}, Summary: "Current and archived elections",
+		Status: 200, Response: APIElectionList{}},
+	{Method: "GET", Path: "/elections/{id}", Scopes: []Scope{ScopeReadResults}, Summary: "Archived election with results and turnout",
+		Params: []apiParam{{"id", "path", "integer", "election id"}},
+		Status: 200, Response: APIElectionDetail{}, Errors: []int{404}},
+	{Method: "PUT", Path: "/elections/{id}/voters", Scopes: []Scope{ScopeManageVoters},
+		Summary: "Create or update voters in bulk (JSON array or NDJSON); rows match on code, else phone",
+		Params:  []apiParam{{"id", "path", "string", "\"current\"; archived elections are read-only"}},
+		Body:    []APIVoterInput{}, Status: 200, Response: APIBulkResponse{}, Errors: []int{400, 404, 409}},
+	{Method: "GET", Path: "/elections/{id}/ballots", Scopes: []Scope{ScopeReadResults}, Summary: "Anonymous ballots of an archived election",
+		Params: []apiParam{{"id", "path", "integer", "election id"}, {"limit", "query", "integer", "page size, max 1000"}, cursorParam},
+		Status: 200, Response: APIBallotPage{}, Errors: []int{400, 404}},
+	{Method: "GET", Path: "/results", Scopes: []Scope{ScopeReadResults, ScopeReadLive}, Summary: "Tally of the current election; choice counts and per-question validity after close",
+		Status: 200, Response: APIResults{}},
+	{Method: "GET", Path: "/turnout", Scopes: []Scope{ScopeReadResults, ScopeReadLive}, Summary: "Live turnout of the current election, in total and per group",
+		Status: 200, Response: APITurnout{}},
+	{Method: "GET", Path: "/audit", Scopes: []Scope{ScopeReadAudit}, Summary: "Audit ledger, newest first",
+		Params: []apiParam{
+			{"limit", "query", "integer", "page size, max 1000"},
+			{"before", "query", "integer", "only events with a smaller id"},
+			cursorParam,
+		},
+		Status: 200, Response: APIAuditPage{}, Errors: []int{400}},
+	{Method: "GET", Path: "/webhooks", Scopes: []Scope{ScopeManageWebhooks}, Summary: "List webhook subscriptions",
+		Status: 200, Response: WebhookList{}},
+	{Method: "POST", Path: "/webhooks", Scopes: []Scope{ScopeManageWebhooks}, Summary: "Subscribe a URL to events; the secret is only returned here",
+		Body: WebhookInput{}, Status: 201, Response: Webhook{}, Errors: []int{400, 422}},
+	{Method: "GET", Path: "/webhooks/{id}", Scopes: []Scope{ScopeManageWebhooks}, Summary: "Get a webhook subscription",
+		Params: []apiParam{webhookIDParam}, Status: 200, Response: Webhook{}, Errors: []int{404}},
+	{Method: "PUT", Path: "/webhooks/{id}", Scopes: []Scope{ScopeManageWebhooks}, Summary: "Update a subscription; a given secret replaces the old one",
+		Params: []apiParam{webhookIDParam}, Body: WebhookInput{}, Status: 200, Response: Webhook{}, Errors: []int{400, 404, 422}},
+	{Method: "DELETE", Path: "/webhooks/{id}", Scopes: []Scope{ScopeManageWebhooks}, Summary: "Delete a subscription and its pending deliveries",
+		Params: []apiParam{webhookIDParam}, Status: 204, Errors: []int{404}},
+	{Method: "GET", Path: "/webhooks/{id}/deliveries", Scopes: []Scope{ScopeManageWebhooks}, Summary: "Latest deliveries of a subscription",
+		Params: []apiParam{webhookIDParam, {"limit", "query", "integer", "page size, max 1000"}},
+		Status: 200, Response: WebhookDeliveryList{}, Errors: []int{404}},
+	{Method: "GET", Path: "/usage", Scopes: []Scope{ScopeReadUsage}, Summary: "Usage of the organization per month: voters_imported, emails_sent, elections_run",
+		Params: []apiParam{
+			{"from", "query", "string", "first month, YYYY-MM"},
+			{"to", "query", "string", "last month, YYYY-MM"},
+		},
+		Status: 200, Response: APIUsageReport{}, Errors: []int{400}},
+}
+
+// schemaGen turns Go types into OpenAPI schemas, collecting named structs
+// under components/schemas
+type schemaGen struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawJSONType:
+		return map[string]interface{}{"description": "arbitrary JSON"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, done := g.components[name]; !done {
+			g.components[name] = nil // placeholder against recursion
+			g.components[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema follows encoding/json: json tags name the fields, "-" hides
+// them and embedded structs are flattened
+func (g *schemaGen) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded := g.structSchema(f.Type)
+			for k, v := range embedded["properties"].(map[string]interface{}) {
+				props[k] = v
+			}
+			if req, ok := embedded["required"].([]string); ok {
+				required = append(required, req...)
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// openAPISpec builds the OpenAPI 3 document for /api/v1
+func openAPISpec(serverURL string) map[string]interface{} {
+	g := &schemaGen{components: map[string]interface{}{}}
+	errorResponse := map[string]interface{}{
+		"description": "error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(apiErrorBody{}))},
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		o := map[string]interface{}{
+			"summary":     op.Summary,
+			"description": fmt.Sprintf("Requires an API key with the %s scope.", scopeList(op.Scopes)),
+			"x-scope":     op.Scopes,
+		}
+
+		var params []interface{}
+		for _, p := range op.Params {
+			params = append(params, map[string]interface{}{
+				"name":        p.Name,
+				"in":          p.In,
+				"required":    p.In == "path",
+				"description": p.Description,
+				"schema":      map[string]interface{}{"type": p.Type},
+			})
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		if op.Body != nil {
+			o["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.Body))},
+				},
+			}
+		}
+
+		ok := map[string]interface{}{"description": http.StatusText(op.Status)}
+		if op.Response != nil {
+			ok["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.Response))},
+			}
+		}
+		responses := map[string]interface{}{
+			strconv.Itoa(op.Status): ok,
+			"401":                   errorResponse,
+		}
+		responses["403"] = errorResponse
+		for _, code := range op.Errors {
+			responses[strconv.Itoa(code)] = errorResponse
+		}
+		o["responses"] = responses
+
+		item, _ := paths[op.Path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = o
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Pemilihan GKJP API",
+			"version":     "1",
+			"description": "JSON API for integrations. Individual vote choices are never exposed.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": serverURL + "/api/v1"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": g.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "API key issued in the admin panel (/admin/api-keys)",
+				},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+	}
+}
+
+// openAPIHandler serves the generated spec
+func (a *App) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, openAPISpec(a.baseURL(r)))
+}
+
+// apiDocsHandler serves Swagger UI for the spec
+func (a *App) apiDocsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.tmpl.ExecuteTemplate(w, "apidocs.html", nil); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
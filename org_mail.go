@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// An organization can send its mail through its own SMTP server and From
+// address instead of the deployment's SMTP_URL / SMTP_FROM, so invites come
+// from the organization's domain. DKIM signing is the SMTP server's: use a
+// server (or a provider's SMTP relay, with its API key as the password) that
+// signs for the From domain. Sends are rare, so the settings are read at
+// each one. The page also lists the outbox (outbox.go) and retries messages
+// given up on.
+
+// redactedPassword stands for the stored password in the form
+const redactedPassword = "xxxxx"
+
+// OrgMail is the organization's own mail settings
+type OrgMail struct {
+	SMTPURL     string // password redacted
+	FromAddress string
+	UpdatedAt   time.Time
+	UpdatedBy   string
+}
+
+// MailData is the data of mail.html
+type MailData struct {
+	Mail    *OrgMail // nil while SMTP_URL is used
+	Global  bool     // SMTP_URL is set
+	Outbox  []OutboxMessage
+	Message string
+	Error   string
+}
+
+// loadOrgMail returns the organization's settings with the password in the
+// clear, or nil when it has none
+func (a *App) loadOrgMail(ctx context.Context) (*OrgMail, error) {
+	var m OrgMail
+	err := a.db.QueryRow(ctx, `
+		SELECT smtp_url, from_address, updated_at, updated_by FROM org_mail`).Scan(&m.SMTPURL, &m.FromAddress, &m.UpdatedAt, &m.UpdatedBy)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.SMTPURL, err = a.pii.open(m.SMTPURL); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// orgMailer returns the mailer of the organization: its own settings, else
+// SMTP_URL; nil when there is neither
+func (a *App) orgMailer(ctx context.Context) (*mailer, error) {
+	m, err := a.loadOrgMail(ctx)
+	if err != nil || m == nil {
+		return a.mailer, err
+	}
+	return newMailer(m.SMTPURL, m.FromAddress)
+}
+
+// adminMailHandler shows and changes the organization's mail settings,
+// sends a test mail and lists the outbox. Superadmin only.
+func (a *App) adminMailHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := MailData{Global: a.mailer != nil}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		msg, err := a.applyMailAction(ctx, r)
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Message = msg
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, err := a.loadOrgMail(ctx)
+	if err != nil {
+		logMailer.Errorf("error getting mail settings: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if m != nil {
+		m.SMTPURL = redactURL(m.SMTPURL)
+	}
+	data.Mail = m
+	if data.Outbox, err = a.listOutbox(ctx, 50); err != nil {
+		logMailer.Errorf("error getting outbox: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err := a.tmpl.ExecuteTemplate(w, "mail.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// redactURL hides the password of an SMTP URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// applyMailAction performs the form action; the returned error message is
+// shown to the admin as-is
+func (a *App) applyMailAction(ctx context.Context, r *http.Request) (string, error) {
+	switch r.FormValue("action") {
+	case "save":
+		rawURL := strings.TrimSpace(r.FormValue("smtp_url"))
+		from := strings.TrimSpace(r.FormValue("from_address"))
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return "", fmt.Errorf("URL SMTP tidak valid")
+		}
+		// the redacted password from the form keeps the stored one
+		if pass, ok := u.User.Password(); ok && pass == redactedPassword {
+			old, err := a.loadOrgMail(ctx)
+			if err != nil {
+				logMailer.Errorf("error getting mail settings: %v", err)
+				return "", fmt.Errorf("database error")
+			}
+			if old == nil {
+				return "", fmt.Errorf("isi password SMTP")
+			}
+			if oldURL, err := url.Parse(old.SMTPURL); err == nil && oldURL.User != nil {
+				oldPass, _ := oldURL.User.Password()
+				u.User = url.UserPassword(u.User.Username(), oldPass)
+			}
+			rawURL = u.String()
+		}
+		if _, err := newMailer(rawURL, from); err != nil {
+			return "", fmt.Errorf("pengaturan email tidak valid: %v", err)
+		}
+		_, err = a.db.Exec(ctx, `
+			INSERT INTO org_mail (smtp_url, from_address, updated_by) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id) DO UPDATE SET
+				smtp_url = EXCLUDED.smtp_url, from_address = EXCLUDED.from_address,
+				updated_at = NOW(), updated_by = EXCLUDED.updated_by`,
+			a.pii.seal(rawURL), from, actorName(r))
+		if err != nil {
+			logMailer.Errorf("error saving mail settings: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		a.audit(ctx, actorName(r), "mail.update", "", map[string]string{"smtp_url": redactURL(rawURL), "from": from})
+		return "Pengaturan email disimpan", nil
+
+	case "remove":
+		if _, err := a.db.Exec(ctx, `DELETE FROM org_mail`); err != nil {
+			logMailer.Errorf("error removing mail settings: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		a.audit(ctx, actorName(r), "mail.remove", "", nil)
+		return "Pengaturan email dihapus", nil
+
+	case "test":
+		addr, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("to")))
+		if err != nil {
+			return "", fmt.Errorf("alamat email tidak valid")
+		}
+		m, err := a.orgMailer(ctx)
+		if err != nil {
+			logMailer.Errorf("error getting mailer: %v", err)
+			return "", fmt.Errorf("pengaturan email tidak dapat dibaca: %v", err)
+		}
+		if m == nil {
+			return "", fmt.Errorf("belum ada pengaturan email")
+		}
+		if err := a.checkMessageQuota(ctx); errors.Is(err, errMessageQuota) {
+			return "", fmt.Errorf("kuota email hari ini (%d) sudah habis", a.quotas.MessagesPerDay)
+		} else if err != nil {
+			logMailer.Errorf("error checking message quota: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		body := fmt.Sprintf("Email uji dari %s, dikirim oleh %s.\n", a.baseURL(r), actorName(r))
+		if err := m.send(a.branding.current().SenderName, addr.Address, "Email uji pemilihan", body); err != nil {
+			return "", fmt.Errorf("email gagal dikirim: %v", err)
+		}
+		a.meterLater(ctx, usageEmailsSent, 1)
+		return fmt.Sprintf("Email uji dikirim ke %s", addr.Address), nil
+
+	case "retry":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("pesan tidak valid")
+		}
+		ok, err := a.retryOutboxMessage(ctx, id)
+		if err != nil {
+			logMailer.Errorf("error retrying outbox message: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		if !ok {
+			return "", fmt.Errorf("pesan tidak ditemukan atau belum gagal")
+		}
+		return "Pesan dijadwalkan ulang", nil
+	}
+	return "", fmt.Errorf("aksi tidak dikenal")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Outgoing messages go through an outbox. Code that sends a message writes it
+// to outbox_messages in the same transaction as what calls for it (the
+// invite, the reset link, the audit event of a sign-in alert), and the
+// outbox.deliver job sends it, retrying failures with backoff. So a crash
+// before commit loses both and a crash after still sends the message, while
+// a claimed message is leased like a webhook delivery so two instances never
+// send it at once. Webhooks have their own outbox, webhook_deliveries, queued
+// the same way.
+//
+// Messages go out by email (through orgMailer) or to a Slack incoming
+// webhook. The day's mail quota is checked when a message is sent: mail over
+// it fails instead of going out. A message given up on raises a notification.
+// The test mail of /admin/mail is sent right away, since its point is the
+// answer of the SMTP server.
+
+// Channels of outbox_messages
+const (
+	ChannelEmail = "email" // recipient is an address
+	ChannelSlack = "slack" // recipient is an incoming webhook URL
+)
+
+const (
+	outboxMaxAttempts  = 8
+	outboxPollInterval = 5 * time.Second
+	outboxLease        = 2 * time.Minute // a claimed message is retried after this if the worker dies
+	outboxKeepDays     = 30              // sent and failed messages are pruned after this
+)
+
+// outboxMessage is a message to send
+type outboxMessage struct {
+	Channel   string
+	Recipient string
+	Subject   string // email only
+	Body      string
+	Source    string // what queued it, e.g. account.invite; shown on /admin/mail
+}
+
+// enqueueMessage writes m to the outbox through db, usually the transaction
+// of what calls for it
+func enqueueMessage(ctx context.Context, db execer, m outboxMessage) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO outbox_messages (channel, recipient, subject, body, source)
+		VALUES ($1, $2, $3, $4, $5)`, m.Channel, m.Recipient, m.Subject, m.Body, m.Source)
+	return err
+}
+
+// OutboxMessage is a message as listed on /admin/mail
+type OutboxMessage struct {
+	ID            int64
+	Channel       string
+	Recipient     string // masked
+	Subject       string
+	Source        string
+	Attempts      int
+	CreatedAt     time.Time
+	NextAttemptAt *time.Time // pending only
+	SentAt        *time.Time
+	FailedAt      *time.Time // gave up
+	LastError     *string
+}
+
+// State is pending, sent or failed
+func (m OutboxMessage) State() string {
+	switch {
+	case m.SentAt != nil:
+		return "sent"
+	case m.FailedAt != nil:
+		return "failed"
+	}
+	return "pending"
+}
+
+// listOutbox returns the latest messages, newest first
+func (a *App) listOutbox(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, channel, recipient, subject, source, attempts, created_at, next_attempt_at, sent_at, failed_at, last_error
+		FROM outbox_messages
+		ORDER BY id DESC
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []OutboxMessage{}
+	for rows.Next() {
+		var m OutboxMessage
+		if err := rows.Scan(&m.ID, &m.Channel, &m.Recipient, &m.Subject, &m.Source, &m.Attempts, &m.CreatedAt,
+			&m.NextAttemptAt, &m.SentAt, &m.FailedAt, &m.LastError); err != nil {
+			return nil, err
+		}
+		if m.SentAt != nil || m.FailedAt != nil {
+			m.NextAttemptAt = nil
+		}
+		if m.Channel == ChannelEmail {
+			m.Recipient = maskEmail(m.Recipient)
+		} else {
+			m.Recipient = redactURL(m.Recipient)
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// retryOutboxMessage queues a failed message again
+func (a *App) retryOutboxMessage(ctx context.Context, id int64) (bool, error) {
+	tag, err := a.db.Exec(ctx, `
+		UPDATE outbox_messages SET failed_at = NULL, attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND failed_at IS NOT NULL`, id)
+	return tag.RowsAffected() > 0, err
+}
+
+type pendingMessage struct {
+	ID       int64
+	Attempts int
+	outboxMessage
+}
+
+// claimOutbox takes the due messages and pushes their next attempt out by
+// outboxLease, so a crashed worker's claims are retried
+func (a *App) claimOutbox(ctx context.Context) ([]pendingMessage, error) {
+	rows, err := a.db.Query(ctx, `
+		UPDATE outbox_messages
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $1 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM outbox_messages
+			WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT 20
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, attempts, channel, recipient, subject, body, source`, int(outboxLease.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var claimed []pendingMessage
+	for rows.Next() {
+		var m pendingMessage
+		if err := rows.Scan(&m.ID, &m.Attempts, &m.Channel, &m.Recipient, &m.Subject, &m.Body, &m.Source); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, m)
+	}
+	return claimed, rows.Err()
+}
+
+// errNoMailer fails mail while no SMTP server is set
+var errNoMailer = errors.New("pengiriman email belum diatur")
+
+// sendOutboxMessage sends one message; sender is nil without mail settings
+func (a *App) sendOutboxMessage(ctx context.Context, sender *mailer, m pendingMessage) error {
+	switch m.Channel {
+	case ChannelSlack:
+		return postSlack(ctx, m.Recipient, m.Body)
+	case ChannelEmail:
+		if sender == nil {
+			return errNoMailer
+		}
+		if err := a.checkMessageQuota(ctx); err != nil {
+			return err
+		}
+		if err := sender.send(a.branding.current().SenderName, m.Recipient, m.Subject, m.Body); err != nil {
+			return err
+		}
+		a.meterLater(ctx, usageEmailsSent, 1)
+		return nil
+	}
+	return fmt.Errorf("unknown channel %q", m.Channel)
+}
+
+// deliverOutbox sends the due messages and records the outcome. Messages
+// that can't go out however often they are tried, without mail settings or
+// over the quota, fail at once.
+func (a *App) deliverOutbox(ctx context.Context) error {
+	claimed, err := a.claimOutbox(ctx)
+	if err != nil || len(claimed) == 0 {
+		return err
+	}
+	sender, err := a.orgMailer(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range claimed {
+		sendErr := a.sendOutboxMessage(ctx, sender, m)
+		switch {
+		case sendErr == nil:
+			_, err = a.db.Exec(ctx, `UPDATE outbox_messages SET sent_at = NOW(), last_error = NULL WHERE id = $1`, m.ID)
+		case m.Attempts >= outboxMaxAttempts || errors.Is(sendErr, errNoMailer) || errors.Is(sendErr, errMessageQuota):
+			_, err = a.db.Exec(ctx, `UPDATE outbox_messages SET failed_at = NOW(), last_error = $2 WHERE id = $1`, m.ID, sendErr.Error())
+			if err == nil {
+				a.notify(ctx, notification{
+					Kind:           NotifyDeliveryFailed,
+					Message:        fmt.Sprintf("Pesan %s (%s) gagal dikirim setelah %d percobaan: %v", m.Channel, m.Source, m.Attempts, sendErr),
+					Link:           "/admin/mail",
+					SuperadminOnly: true,
+				})
+			}
+		default:
+			_, err = a.db.Exec(ctx, `UPDATE outbox_messages SET next_attempt_at = $2, last_error = $3 WHERE id = $1`,
+				m.ID, time.Now().Add(deliveryBackoff(m.Attempts)), sendErr.Error())
+		}
+		if err != nil {
+			return err
+		}
+		if sendErr != nil {
+			logMailer.Warnf("outbox message %d (%s): %v", m.ID, m.Channel, sendErr)
+		}
+	}
+	return nil
+}
+
+// pruneOutbox drops the sent and failed messages older than outboxKeepDays
+func (a *App) pruneOutbox(ctx context.Context) error {
+	_, err := a.db.Exec(ctx, `
+		DELETE FROM outbox_messages
+		WHERE (sent_at IS NOT NULL OR failed_at IS NOT NULL)
+		AND created_at < NOW() - $1 * interval '1 day'`, outboxKeepDays)
+	return err
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An admin_accounts admin who forgot their password asks for a reset link at
+// /admin/forgot. The link is mailed to the account's email and carries the
+// reset id and expiry signed with INVITE_KEY over the account and its current
+// password hash, so it works once, for an hour, and not after any other
+// password change. Setting the new password ends the account's sessions and
+// remembered browsers. The answer to a request is the same whether or not
+// the account exists, and requests, resets and password changes by a
+// superadmin are recorded in the audit log.
+
+const (
+	// passwordResetTTL is how long a reset link can be used
+	passwordResetTTL = time.Hour
+
+	// maxPasswordResets is how many links an account gets per hour
+	maxPasswordResets = 3
+)
+
+// PasswordResetPage is the data of password_reset.html: the request form
+// without a Token, the new password form with one
+type PasswordResetPage struct {
+	Token    string
+	Username string
+	Org      string
+	Mail     bool // reset links can be mailed
+	Sent     bool
+	Done     bool
+	Error    string
+}
+
+var errInvalidReset = errors.New("link reset password tidak valid atau sudah kedaluwarsa")
+
+// resetSignature signs which password of which account a reset replaces
+func (a *App) resetSignature(id int, expires time.Time, accountID int, passwordHash string) string {
+	mac := hmac.New(sha256.New, a.inviteKey)
+	fmt.Fprintf(mac, "reset|%s|%d|%d|%d|%s", a.org, id, expires.Unix(), accountID, passwordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// resetToken is the t parameter of a reset link: id.expiry.signature
+func (a *App) resetToken(id int, expires time.Time, accountID int, passwordHash string) string {
+	return fmt.Sprintf("%d.%d.%s", id, expires.Unix(), a.resetSignature(id, expires, accountID, passwordHash))
+}
+
+// openReset checks token against its reset, which must be unused and of an
+// enabled account. The row is locked when q is a transaction.
+func (a *App) openReset(ctx context.Context, q queryer, token string) (accountID int, username string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, "", errInvalidReset
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", errInvalidReset
+	}
+	var expires time.Time
+	var used, disabled bool
+	var passwordHash string
+	err = q.QueryRow(ctx, `
+		SELECT r.expires_at, r.used_at IS NOT NULL, acc.id, acc.username, acc.password_hash, acc.disabled
+		FROM password_resets r JOIN admin_accounts acc ON acc.id = r.account_id
+		WHERE r.id = $1
+		FOR UPDATE OF r`, id).Scan(&expires, &used, &accountID, &username, &passwordHash, &disabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, "", errInvalidReset
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if !hmac.Equal([]byte(parts[1]+"."+parts[2]), []byte(strconv.FormatInt(expires.Unix(), 10)+"."+a.resetSignature(id, expires, accountID, passwordHash))) {
+		return 0, "", errInvalidReset
+	}
+	if used || disabled || time.Now().After(expires) {
+		return 0, "", errInvalidReset
+	}
+	return accountID, username, nil
+}
+
+// forgotPasswordHandler: GET /admin/forgot asks for the username or email,
+// POST mails a reset link if that is an account with an email
+func (a *App) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := PasswordResetPage{Org: a.org}
+	m, err := a.orgMailer(ctx)
+	if err != nil {
+		logMailer.Errorf("error getting mailer: %v", err)
+	}
+	// the link goes to PUBLIC_URL, never to the Host of the request
+	base := a.mailBaseURL(r)
+	data.Mail = m != nil && base != ""
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name := strings.ToLower(strings.TrimSpace(r.FormValue("username")))
+		if name == "" || !data.Mail {
+			break
+		}
+		data.Username, data.Sent = name, true
+		var ip string
+		if addr := clientIP(r); addr != nil {
+			ip = addr.String()
+		}
+		// queued after the answer, which takes as long whether or not the
+		// account exists
+		go a.sendPasswordReset(context.WithoutCancel(ctx), base, name, ip)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := a.tmpl.ExecuteTemplate(w, "password_reset.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// sendPasswordReset queues a reset link to the enabled account named name,
+// by username or email, if it has an email and hasn't had maxPasswordResets
+// links within the hour. The reset, its audit event and the email are
+// written together.
+func (a *App) sendPasswordReset(ctx context.Context, baseURL, name, ip string) {
+	var accountID int
+	var username, email, passwordHash string
+	err := a.db.QueryRow(ctx, `
+		SELECT id, username, email, password_hash FROM admin_accounts
+		WHERE disabled = FALSE AND email IS NOT NULL AND (lower(username) = $1 OR email = $1)
+		ORDER BY lower(username) = $1 DESC, id
+		LIMIT 1`, name).Scan(&accountID, &username, &email, &passwordHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error getting account for password reset: %v", err)
+		return
+	}
+
+	var recent int
+	if err := a.db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM password_resets
+		WHERE account_id = $1 AND created_at > NOW() - INTERVAL '1 hour'`, accountID).Scan(&recent); err != nil {
+		logDB.Errorf("error counting password resets: %v", err)
+		return
+	}
+	if recent >= maxPasswordResets {
+		logMailer.Warnf("password reset for %s not sent: too many requests", username)
+		return
+	}
+	if err := a.checkMessageQuota(ctx); err != nil {
+		logMailer.Warnf("password reset for %s not sent: %v", username, err)
+		return
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		logDB.Errorf("error creating password reset: %v", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	var id int
+	var expires time.Time
+	err = tx.QueryRow(ctx, `
+		INSERT INTO password_resets (account_id, ip, expires_at)
+		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')
+		RETURNING id, expires_at`, accountID, ip, int(passwordResetTTL/time.Second)).Scan(&id, &expires)
+	if err == nil {
+		err = auditIn(ctx, tx, "system", "account.password_reset_request", strconv.Itoa(accountID),
+			map[string]string{"username": username, "reset": strconv.Itoa(id), "ip": ip})
+	}
+	if err == nil {
+		link := baseURL + "/admin/reset?t=" + a.resetToken(id, expires, accountID, passwordHash)
+		err = enqueueMessage(ctx, tx, outboxMessage{
+			Channel:   ChannelEmail,
+			Recipient: email,
+			Subject:   "Reset password admin pemilihan",
+			Body: fmt.Sprintf("Ada permintaan reset password untuk akun admin %s di %s.\n\nBuka link berikut untuk membuat "+
+				"password baru (berlaku sampai %s, sekali pakai):\n%s\n\nAbaikan email ini bila Anda tidak memintanya; "+
+				"password Anda tidak berubah.\n",
+				username, baseURL, expires.In(a.voteEnd.Location()).Format("2006-01-02 15:04"), link),
+			Source: "account.password_reset_request",
+		})
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		logDB.Errorf("error creating password reset: %v", err)
+	}
+}
+
+// resetPasswordHandler: GET /admin/reset?t= shows the new password form,
+// POST sets it. No login: the signed link is the credential.
+func (a *App) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := PasswordResetPage{Token: r.FormValue("t"), Org: a.org}
+
+	switch r.Method {
+	case http.MethodGet:
+		_, username, err := a.openReset(ctx, a.db, data.Token)
+		if errors.Is(err, errInvalidReset) {
+			a.writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			logDB.Errorf("error getting password reset: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		data.Username = username
+	case http.MethodPost:
+		username, err := a.resetPassword(ctx, data.Token, r.FormValue("password"), r.FormValue("password2"))
+		switch {
+		case errors.Is(err, errInvalidReset):
+			a.writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		case err != nil && username == "":
+			logDB.Errorf("error resetting password: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		case err != nil:
+			data.Error = err.Error()
+		default:
+			data.Done = true
+		}
+		data.Username = username
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := a.tmpl.ExecuteTemplate(w, "password_reset.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// resetPassword sets the password of the reset's account; username is empty
+// when the reset couldn't be read
+func (a *App) resetPassword(ctx context.Context, token, password, confirm string) (string, error) {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	accountID, username, err := a.openReset(ctx, tx, token)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPasswordPolicy(password, username); err != nil {
+		return username, err
+	}
+	if password != confirm {
+		return username, fmt.Errorf("konfirmasi password tidak sama")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return username, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE admin_accounts SET password_hash = $2 WHERE id = $1`, accountID, string(hash)); err != nil {
+		logDB.Errorf("error resetting password: %v", err)
+		return username, fmt.Errorf("database error")
+	}
+	// the other links of the account die with the old hash; marking them
+	// keeps the table honest
+	if _, err := tx.Exec(ctx, `UPDATE password_resets SET used_at = NOW() WHERE account_id = $1 AND used_at IS NULL`, accountID); err != nil {
+		logDB.Errorf("error resetting password: %v", err)
+		return username, fmt.Errorf("database error")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		logDB.Errorf("error resetting password: %v", err)
+		return username, fmt.Errorf("database error")
+	}
+
+	sessions, devices := a.signOutEverywhere(ctx, username)
+	a.audit(ctx, username, "account.password_reset", strconv.Itoa(accountID),
+		map[string]any{"username": username, "sessions_ended": sessions, "devices_forgotten": devices})
+	return username, nil
+}
+
+// setPassword replaces the password of an account from the accounts page and
+// signs it out everywhere
+func (a *App) setPassword(ctx context.Context, id int, username, hash string) error {
+	if _, err := a.db.Exec(ctx, `UPDATE admin_accounts SET password_hash = $2 WHERE id = $1`, id, hash); err != nil {
+		return err
+	}
+	a.signOutEverywhere(ctx, username)
+	return nil
+}
+
+// signOutEverywhere ends the sessions and remembered browsers of username
+// after its password changed, returning how many there were
+func (a *App) signOutEverywhere(ctx context.Context, username string) (sessions, devices int64) {
+	sessions, err := a.endSessions(ctx, username, 0)
+	if err != nil {
+		logDB.Errorf("error ending sessions: %v", err)
+	}
+	devices, err = a.forgetDevices(ctx, username)
+	if err != nil {
+		logDB.Errorf("error forgetting devices: %v", err)
+	}
+	return sessions, devices
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The portal (/elections) lists the organization's running election and the
+// archived ones a superadmin published, so a member who lost their link can
+// find the ballot (where they enter the code from their card) and the
+// results. It is off until a superadmin turns it on; an archived election
+// is only listed, with its results, once published and for portalRecent
+// after it closed.
+
+// portalRecent is how long a closed election stays on the portal
+const portalRecent = 365 * 24 * time.Hour
+
+// PortalSettings is what the superadmin set for the portal
+type PortalSettings struct {
+	Enabled     bool
+	Title       string // name of the running election
+	ShowCurrent bool
+	UpdatedAt   time.Time
+	UpdatedBy   string
+}
+
+// PortalElection is an archived election on the portal
+type PortalElection struct {
+	ArchivedElection
+	Results     []ArchivedResult // summed over channels
+	Published   bool
+	PublishedBy string
+}
+
+// PortalData is the data of portal.html
+type PortalData struct {
+	Title   string
+	Current *Election // nil when not listed
+	Open    bool
+	NotYet  bool
+	Closed  []PortalElection
+}
+
+// PortalAdminData is the data of portal_admin.html
+type PortalAdminData struct {
+	Settings  PortalSettings
+	Elections []PortalElection
+	Message   string
+	Error     string
+}
+
+func (a *App) loadPortalSettings(ctx context.Context) (PortalSettings, error) {
+	s := PortalSettings{ShowCurrent: true}
+	err := a.db.QueryRow(ctx, `
+		SELECT enabled, title, show_current, updated_at, updated_by FROM org_portal`).
+		Scan(&s.Enabled, &s.Title, &s.ShowCurrent, &s.UpdatedAt, &s.UpdatedBy)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s, nil
+	}
+	return s, err
+}
+
+// listPortalElections returns the archived elections, newest first, with
+// whether each is published; publishedOnly keeps the published ones that
+// closed within portalRecent and adds their results
+func (a *App) listPortalElections(ctx context.Context, publishedOnly bool) ([]PortalElection, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT e.id, e.name, e.vote_start, e.vote_end, e.total_voters, e.voted_count, e.archived_at, e.archived_by,
+			p.election_id IS NOT NULL, COALESCE(p.published_by, '')
+		FROM elections e
+		LEFT JOIN portal_elections p ON p.election_id = e.id
+		WHERE e.sealed AND (NOT $1 OR (p.election_id IS NOT NULL AND e.vote_end > NOW() - $2 * INTERVAL '1 second'))
+		ORDER BY e.vote_end DESC`, publishedOnly, int(portalRecent/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	var elections []PortalElection
+	for rows.Next() {
+		var e PortalElection
+		if err := rows.Scan(&e.ID, &e.Name, &e.VoteStart, &e.VoteEnd, &e.TotalVoters, &e.VotedCount, &e.ArchivedAt, &e.ArchivedBy,
+			&e.Published, &e.PublishedBy); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		elections = append(elections, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || !publishedOnly {
+		return elections, err
+	}
+
+	for i := range elections {
+		rows, err := a.db.Query(ctx, `
+			SELECT choice, SUM(count) FROM archived_results
+			WHERE election_id = $1
+			GROUP BY choice
+			ORDER BY SUM(count) DESC, choice`, elections[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var r ArchivedResult
+			if err := rows.Scan(&r.Choice, &r.Count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			elections[i].Results = append(elections[i].Results, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return elections, nil
+}
+
+// portalHandler: GET /elections, the public list of elections; 404 while the
+// portal is off
+func (a *App) portalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	settings, err := a.loadPortalSettings(ctx)
+	if err != nil {
+		logDB.Errorf("error getting portal settings: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if !settings.Enabled {
+		a.writeError(w, r, http.StatusNotFound, "Halaman tidak ditemukan.")
+		return
+	}
+
+	data := PortalData{Title: settings.Title}
+	if settings.ShowCurrent {
+		e := a.electionOf(r)
+		now := time.Now()
+		data.Current = e
+		data.NotYet = now.Before(e.VoteStart)
+		data.Open = !data.NotYet && !now.After(e.VoteEnd)
+	}
+	if data.Closed, err = a.listPortalElections(ctx, true); err != nil {
+		logDB.Errorf("error getting portal elections: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if err := a.tmpl.ExecuteTemplate(w, "portal.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// adminPortalHandler turns the portal on or off, names the running election
+// and publishes archived ones. Superadmin only.
+func (a *App) adminPortalHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data PortalAdminData
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		msg, err := a.applyPortalAction(ctx, r)
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Message = msg
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	if data.Settings, err = a.loadPortalSettings(ctx); err != nil {
+		logDB.Errorf("error getting portal settings: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if data.Elections, err = a.listPortalElections(ctx, false); err != nil {
+		logDB.Errorf("error getting portal elections: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err := a.tmpl.ExecuteTemplate(w, "portal_admin.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// applyPortalAction performs the form action and records it in the audit
+// log; the returned error message is shown to the admin as-is
+func (a *App) applyPortalAction(ctx context.Context, r *http.Request) (string, error) {
+	switch action := r.FormValue("action"); action {
+	case "save":
+		enabled, showCurrent := r.FormValue("enabled") != "", r.FormValue("show_current") != ""
+		title := strings.TrimSpace(r.FormValue("title"))
+		_, err := a.db.Exec(ctx, `
+			INSERT INTO org_portal (enabled, title, show_current, updated_by) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (org_id) DO UPDATE SET
+				enabled = EXCLUDED.enabled, title = EXCLUDED.title, show_current = EXCLUDED.show_current,
+				updated_at = NOW(), updated_by = EXCLUDED.updated_by`, enabled, title, showCurrent, actorName(r))
+		if err != nil {
+			logDB.Errorf("error saving portal settings: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		a.audit(ctx, actorName(r), "portal.update", "", map[string]interface{}{
+			"enabled": enabled, "title": title, "show_current": showCurrent,
+		})
+		return "Pengaturan portal disimpan", nil
+
+	case "publish", "unpublish":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return "", fmt.Errorf("pemilihan tidak valid")
+		}
+		var tag string
+		if action == "publish" {
+			tag = "ditampilkan"
+			_, err = a.db.Exec(ctx, `
+				INSERT INTO portal_elections (election_id, published_by)
+				SELECT id, $2 FROM elections WHERE id = $1 AND sealed
+				ON CONFLICT (election_id) DO NOTHING`, id, actorName(r))
+		} else {
+			tag = "disembunyikan"
+			_, err = a.db.Exec(ctx, `DELETE FROM portal_elections WHERE election_id = $1`, id)
+		}
+		if err != nil {
+			logDB.Errorf("error publishing election: %v", err)
+			return "", fmt.Errorf("database error")
+		}
+		a.audit(ctx, actorName(r), "election."+action, strconv.Itoa(id), nil)
+		return fmt.Sprintf("Pemilihan %d %s", id, tag), nil
+	}
+	return "", fmt.Errorf("aksi tidak dikenal")
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ProxyRow is a registered proxy as listed on the proxies page
+type ProxyRow struct {
+	ID          int
+	HolderCode  string
+	HolderName  string
+	GrantorCode string
+	GrantorName string
+	GrantorUsed bool
+	Document    string
+	CreatedBy   string
+	CreatedAt   string
+}
+
+type ProxiesData struct {
+	Proxies []ProxyRow
+	Message string
+	Error   string
+}
+
+// ProxyBallot is a ballot a voter may cast on someone else's behalf
+type ProxyBallot struct {
+	ID       int
+	Code     string // the grantor's code
+	Name     string
+	Document string
+	Used     bool
+}
+
+var errNoProxy = errors.New("proxy not found")
+
+func (a *App) listProxies(ctx context.Context) ([]ProxyRow, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT p.id, h.code, h.name, g.code, g.name, g.used, p.document, p.created_by,
+		       to_char(p.created_at, 'YYYY-MM-DD HH24:MI')
+		FROM proxies p
+		JOIN voters h ON h.id = p.holder_id
+		JOIN voters g ON g.id = p.grantor_id
+		ORDER BY h.name, g.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var proxies []ProxyRow
+	for rows.Next() {
+		var p ProxyRow
+		if err := rows.Scan(&p.ID, &p.HolderCode, &p.HolderName, &p.GrantorCode, &p.GrantorName, &p.GrantorUsed,
+			&p.Document, &p.CreatedBy, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := a.pii.openAll(&p.HolderName, &p.GrantorName); err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// encrypted names sort as noise in SQL
+	if a.pii.Enabled() {
+		sort.SliceStable(proxies, func(i, j int) bool {
+			if proxies[i].HolderName != proxies[j].HolderName {
+				return proxies[i].HolderName < proxies[j].HolderName
+			}
+			return proxies[i].GrantorName < proxies[j].GrantorName
+		})
+	}
+	return proxies, nil
+}
+
+// heldProxies lists the ballots the voter with code holds a proxy for
+func (a *App) heldProxies(ctx context.Context, code string) ([]ProxyBallot, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT p.id, g.code, g.name, p.document, g.used
+		FROM proxies p
+		JOIN voters h ON h.id = p.holder_id
+		JOIN voters g ON g.id = p.grantor_id
+		WHERE h.code = $1
+		ORDER BY g.name`, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ballots []ProxyBallot
+	for rows.Next() {
+		var b ProxyBallot
+		if err := rows.Scan(&b.ID, &b.Code, &b.Name, &b.Document, &b.Used); err != nil {
+			return nil, err
+		}
+		if err := a.pii.openAll(&b.Name); err != nil {
+			return nil, err
+		}
+		ballots = append(ballots, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if a.pii.Enabled() {
+		sort.SliceStable(ballots, func(i, j int) bool { return ballots[i].Name < ballots[j].Name })
+	}
+	return ballots, nil
+}
+
+// proxyBallot returns the ballot of grantor when holder holds its proxy, or
+// errNoProxy
+func (a *App) proxyBallot(ctx context.Context, holder, grantor string) (*ProxyBallot, error) {
+	var b ProxyBallot
+	err := a.db.QueryRow(ctx, `
+		SELECT p.id, g.code, g.name, p.document, g.used
+		FROM proxies p
+		JOIN voters h ON h.id = p.holder_id
+		JOIN voters g ON g.id = p.grantor_id
+		WHERE h.code = $1 AND g.code = $2`, holder, grantor).Scan(&b.ID, &b.Code, &b.Name, &b.Document, &b.Used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errNoProxy
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := a.pii.openAll(&b.Name); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// adminProxiesHandler registers and revokes proxies: the holder's session
+// can then cast the grantor's ballot as well as their own. Superadmin only.
+func (a *App) adminProxiesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data ProxiesData
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "create":
+			holder := strings.TrimSpace(r.FormValue("holder"))
+			grantor := strings.TrimSpace(r.FormValue("grantor"))
+			document := strings.TrimSpace(r.FormValue("document"))
+			id, err := a.registerProxy(ctx, holder, grantor, document, actorName(r))
+			if err != nil {
+				data.Error = err.Error()
+				break
+			}
+			a.audit(ctx, actorName(r), "proxy.create", grantor, map[string]interface{}{
+				"id": id, "holder": holder, "document": document,
+			})
+			data.Message = "Surat kuasa dicatat"
+		case "revoke":
+			id, err := strconv.Atoi(r.FormValue("id"))
+			if err != nil {
+				data.Error = "kuasa tidak valid"
+				break
+			}
+			var grantor string
+			err = a.db.QueryRow(ctx, `
+				DELETE FROM proxies p USING voters g
+				WHERE p.id = $1 AND g.id = p.grantor_id AND NOT g.used
+				RETURNING g.code`, id).Scan(&grantor)
+			if errors.Is(err, pgx.ErrNoRows) {
+				data.Error = "kuasa tidak ditemukan atau suaranya sudah masuk"
+				break
+			}
+			if err != nil {
+				logDB.Errorf("error revoking proxy: %v", err)
+				data.Error = "database error"
+				break
+			}
+			a.audit(ctx, actorName(r), "proxy.revoke", grantor, map[string]int{"id": id})
+			data.Message = "Surat kuasa dicabut"
+		default:
+			data.Error = "aksi tidak dikenal"
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	proxies, err := a.listProxies(ctx)
+	if err != nil {
+		logDB.Errorf("error getting proxies: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Proxies = proxies
+
+	if err := a.tmpl.ExecuteTemplate(w, "proxies.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// registerProxy records that holder may vote for grantor. A voter grants at
+// most one proxy and a proxy can't be passed on, so a grantor holds none and
+// a holder grants none. The returned error message is shown to the admin
+// as-is.
+func (a *App) registerProxy(ctx context.Context, holder, grantor, document, actor string) (int, error) {
+	if holder == "" || grantor == "" {
+		return 0, fmt.Errorf("kode pemegang dan pemberi kuasa diperlukan")
+	}
+	if holder == grantor {
+		return 0, fmt.Errorf("pemilih tidak dapat memberi kuasa kepada dirinya sendiri")
+	}
+	if document == "" {
+		return 0, fmt.Errorf("nomor dokumen surat kuasa diperlukan")
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		logDB.Errorf("error registering proxy: %v", err)
+		return 0, fmt.Errorf("database error")
+	}
+	defer tx.Rollback(ctx)
+
+	var holderID, grantorID int
+	var grantorUsed bool
+	if err := tx.QueryRow(ctx, `SELECT id FROM voters WHERE code = $1 FOR UPDATE`, holder).Scan(&holderID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("kode pemegang kuasa %s tidak ditemukan", holder)
+		}
+		logDB.Errorf("error registering proxy: %v", err)
+		return 0, fmt.Errorf("database error")
+	}
+	if err := tx.QueryRow(ctx, `SELECT id, used FROM voters WHERE code = $1 FOR UPDATE`, grantor).Scan(&grantorID, &grantorUsed); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("kode pemberi kuasa %s tidak ditemukan", grantor)
+		}
+		logDB.Errorf("error registering proxy: %v", err)
+		return 0, fmt.Errorf("database error")
+	}
+	if grantorUsed {
+		return 0, fmt.Errorf("pemberi kuasa %s sudah memilih", grantor)
+	}
+
+	var chained bool
+	err = tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM proxies WHERE grantor_id = $1 OR holder_id = $2)`, holderID, grantorID).Scan(&chained)
+	if err != nil {
+		logDB.Errorf("error registering proxy: %v", err)
+		return 0, fmt.Errorf("database error")
+	}
+	if chained {
+		return 0, fmt.Errorf("kuasa tidak dapat dialihkan: pemegang sudah memberi kuasa atau pemberi sudah memegang kuasa")
+	}
+
+	var id int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO proxies (holder_id, grantor_id, document, created_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (grantor_id) DO NOTHING
+		RETURNING id`, holderID, grantorID, document, actor).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("pemberi kuasa %s sudah memberi kuasa", grantor)
+	}
+	if err != nil {
+		logDB.Errorf("error registering proxy: %v", err)
+		return 0, fmt.Errorf("database error")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		logDB.Errorf("error registering proxy: %v", err)
+		return 0, fmt.Errorf("database error")
+	}
+	return id, nil
+}
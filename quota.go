@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Quotas hold an organization to what its hosting plan allows. The operator
+// sets them in the env of the organization's process:
+// QUOTA_REQUESTS_PER_MINUTE (API requests of all its keys together),
+// QUOTA_VOTERS (voters on the roll) and QUOTA_MESSAGES_PER_DAY (mail sent);
+// unset or 0 means no limit. A superadmin can hold a single API key to fewer
+// requests per minute. API requests over a limit get 429 with Retry-After;
+// a full roll turns new voters away (votes merged from a satellite are never
+// refused), and mail over the day's quota isn't sent.
+//
+// Requests are counted per minute in the memory of each process, so with
+// several instances behind a balancer each allows the full rate.
+
+// quotas are the organization's limits; 0 is unlimited
+type quotas struct {
+	RequestsPerMinute int
+	Voters            int
+	MessagesPerDay    int
+}
+
+// loadQuotas reads the QUOTA_* envs
+func loadQuotas() (quotas, error) {
+	var q quotas
+	for _, v := range []struct {
+		env string
+		dst *int
+	}{
+		{"QUOTA_REQUESTS_PER_MINUTE", &q.RequestsPerMinute},
+		{"QUOTA_VOTERS", &q.Voters},
+		{"QUOTA_MESSAGES_PER_DAY", &q.MessagesPerDay},
+	} {
+		s := os.Getenv(v.env)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid %s %q: use a number, 0 for no limit", v.env, s)
+		}
+		*v.dst = n
+	}
+	return q, nil
+}
+
+var (
+	errVoterQuota   = errors.New("voter quota reached")
+	errMessageQuota = errors.New("message quota reached")
+)
+
+// rateCheck is one limit a request counts against
+type rateCheck struct {
+	key   string
+	limit int
+}
+
+// rateWindow counts requests per key within the current minute
+type rateWindow struct {
+	mu     sync.Mutex
+	minute int64
+	counts map[string]int
+}
+
+// allow counts a request against every check, unless one of them is already
+// at its limit; then it returns that check
+func (w *rateWindow) allow(now time.Time, checks ...rateCheck) (rateCheck, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if m := now.Unix() / 60; m != w.minute || w.counts == nil {
+		w.minute, w.counts = m, map[string]int{}
+	}
+	for _, c := range checks {
+		if c.limit > 0 && w.counts[c.key] >= c.limit {
+			return c, false
+		}
+	}
+	for _, c := range checks {
+		w.counts[c.key]++
+	}
+	return rateCheck{}, true
+}
+
+// count returns the requests of key within the current minute
+func (w *rateWindow) count(now time.Time, key string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now.Unix()/60 != w.minute {
+		return 0
+	}
+	return w.counts[key]
+}
+
+const orgRateKey = "org"
+
+// apiKeyRateKey names an API key in the rate window
+func apiKeyRateKey(c *APIClient) string {
+	if c.KeyID == 0 {
+		return "api-token"
+	}
+	return "key:" + strconv.Itoa(c.KeyID)
+}
+
+// allowAPIRequest answers 429 when the organization or the client is out of
+// requests for this minute
+func (a *App) allowAPIRequest(w http.ResponseWriter, r *http.Request, c *APIClient) bool {
+	now := time.Now()
+	over, ok := a.rates.allow(now,
+		rateCheck{orgRateKey, a.quotas.RequestsPerMinute},
+		rateCheck{apiKeyRateKey(c), c.RequestsPerMinute})
+	if ok {
+		return true
+	}
+	whose := "this API key"
+	if over.key == orgRateKey {
+		whose = "the organization"
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(60-now.Second()))
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(over.limit))
+	w.Header().Set("X-RateLimit-Remaining", "0")
+	apiError(w, r, http.StatusTooManyRequests, fmt.Sprintf("rate limit exceeded: %d requests per minute for %s", over.limit, whose))
+	return false
+}
+
+// checkVoterQuota returns errVoterQuota when the roll is full. Call it in
+// the transaction adding the voter: it holds the organization's lock until
+// then, so concurrent imports can't overshoot.
+func (a *App) checkVoterQuota(ctx context.Context, tx pgx.Tx) error {
+	if a.quotas.Voters == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('voter_quota'), current_org())`); err != nil {
+		return err
+	}
+	var n int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM voters`).Scan(&n); err != nil {
+		return err
+	}
+	if n >= a.quotas.Voters {
+		return errVoterQuota
+	}
+	return nil
+}
+
+// messagesToday returns the mail sent today (UTC)
+func (a *App) messagesToday(ctx context.Context) (int, error) {
+	var n int
+	err := a.db.QueryRow(ctx, `
+		SELECT COALESCE(SUM(quantity), 0)::int FROM usage_counters
+		WHERE period = (NOW() AT TIME ZONE 'UTC')::date AND metric = $1`, usageEmailsSent).Scan(&n)
+	return n, err
+}
+
+// checkMessageQuota returns errMessageQuota when today's mail is used up
+func (a *App) checkMessageQuota(ctx context.Context) error {
+	if a.quotas.MessagesPerDay == 0 {
+		return nil
+	}
+	n, err := a.messagesToday(ctx)
+	if err != nil {
+		return err
+	}
+	if n >= a.quotas.MessagesPerDay {
+		return errMessageQuota
+	}
+	return nil
+}
+
+// QuotaUsage is one limit with what is used of it
+type QuotaUsage struct {
+	Name  string
+	Used  int
+	Limit int // 0 is unlimited
+}
+
+// Percent is the used share of the limit
+func (q QuotaUsage) Percent() float64 {
+	if q.Limit == 0 {
+		return 0
+	}
+	return float64(q.Used) * 100 / float64(q.Limit)
+}
+
+// UsageData is the data of usage.html
+type UsageData struct {
+	Quotas []QuotaUsage
+	Keys   []QuotaUsage // requests of each key this minute
+	Months []APIUsage
+}
+
+// adminUsageHandler shows the quotas with today's use and the usage per
+// month. Superadmin only.
+func (a *App) adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	now := time.Now()
+	var data UsageData
+
+	var voters int
+	if err := a.db.QueryRow(ctx, `SELECT COUNT(*) FROM voters`).Scan(&voters); err != nil {
+		logDB.Errorf("error counting voters: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	messages, err := a.messagesToday(ctx)
+	if err != nil {
+		logDB.Errorf("error getting usage: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Quotas = []QuotaUsage{
+		{"Request API per menit", a.rates.count(now, orgRateKey), a.quotas.RequestsPerMinute},
+		{"Peserta", voters, a.quotas.Voters},
+		{"Email hari ini", messages, a.quotas.MessagesPerDay},
+	}
+
+	keys, err := a.listAPIKeys(ctx)
+	if err != nil {
+		logDB.Errorf("error getting api keys: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	for _, k := range keys {
+		if k.RevokedAt == nil {
+			data.Keys = append(data.Keys, QuotaUsage{k.Name, a.rates.count(now, "key:"+strconv.Itoa(k.ID)), k.RequestsPerMinute})
+		}
+	}
+
+	rows, err := a.db.Query(ctx, `
+		SELECT to_char(period, 'YYYY-MM'), metric, SUM(quantity)::bigint, MAX(updated_at)
+		FROM usage_counters
+		WHERE period >= date_trunc('month', NOW() AT TIME ZONE 'UTC') - INTERVAL '11 months'
+		GROUP BY 1, 2
+		ORDER BY 1 DESC, 2`)
+	if err != nil {
+		logDB.Errorf("error getting usage: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u APIUsage
+		if err := rows.Scan(&u.Period, &u.Metric, &u.Quantity, &u.UpdatedAt); err != nil {
+			logDB.Errorf("error scanning usage: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		data.Months = append(data.Months, u)
+	}
+	if err := rows.Err(); err != nil {
+		logDB.Errorf("error getting usage: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "usage.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
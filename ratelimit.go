@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limits hold each client address to a number of requests per window,
+// set per group of routes since they see very different traffic: a voter
+// opens a handful of pages and casts one ballot, while the admin dashboard
+// polls its counters every few seconds. RATE_LIMIT_VOTER (voter pages),
+// RATE_LIMIT_VOTE (POST /vote), RATE_LIMIT_ADMIN (/admin) and RATE_LIMIT_API
+// (/api) each take `<requests>/<window>`, e.g. `30/1m`, optionally with a
+// burst the client may spend at once: `30/1m,burst=10`. Without a burst a
+// client may spend the whole window's requests at once. Unset groups aren't
+// limited, and static files never are. Requests over the limit get 429 with
+// Retry-After. Like the API quotas (quota.go) the counts live in the memory
+// of each instance; members behind one church wifi share an address, so
+// leave room for them.
+
+// rateGroup is a group of routes limited together
+type rateGroup string
+
+const (
+	rateVoter rateGroup = "voter"
+	rateVote  rateGroup = "vote"
+	rateAdmin rateGroup = "admin"
+	rateAPI   rateGroup = "api"
+)
+
+var rateGroups = []rateGroup{rateVoter, rateVote, rateAdmin, rateAPI}
+
+// rateGroupOf returns the group r counts against; false for requests that
+// are never limited
+func rateGroupOf(r *http.Request) (rateGroup, bool) {
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/static/"):
+		return "", false
+	case p == "/vote" && r.Method == http.MethodPost:
+		return rateVote, true
+	case p == "/admin" || strings.HasPrefix(p, "/admin/"):
+		return rateAdmin, true
+	case strings.HasPrefix(p, "/api/"):
+		return rateAPI, true
+	}
+	return rateVoter, true
+}
+
+// rateLimit is the limit of one group
+type rateLimit struct {
+	Requests int
+	Window   time.Duration
+	Burst    int
+}
+
+// parseRateLimit reads `<requests>/<window>[,burst=<n>]`
+func parseRateLimit(s string) (rateLimit, error) {
+	spec, burst, hasBurst := strings.Cut(s, ",")
+	n, window, ok := strings.Cut(spec, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("%q is not <requests>/<window>", s)
+	}
+	var l rateLimit
+	var err error
+	if l.Requests, err = strconv.Atoi(strings.TrimSpace(n)); err != nil || l.Requests < 1 {
+		return rateLimit{}, fmt.Errorf("%q: requests must be a positive number", s)
+	}
+	if l.Window, err = time.ParseDuration(strings.TrimSpace(window)); err != nil || l.Window < time.Second {
+		return rateLimit{}, fmt.Errorf("%q: window must be a duration of a second or more, e.g. 1m", s)
+	}
+	l.Burst = l.Requests
+	if hasBurst {
+		v, found := strings.CutPrefix(strings.TrimSpace(burst), "burst=")
+		if l.Burst, err = strconv.Atoi(v); !found || err != nil || l.Burst < 1 {
+			return rateLimit{}, fmt.Errorf("%q: use burst=<n> after the comma", s)
+		}
+	}
+	return l, nil
+}
+
+// loadRateLimits reads the RATE_LIMIT_* envs
+func loadRateLimits() (map[rateGroup]*rateLimiter, error) {
+	limits := map[rateGroup]*rateLimiter{}
+	for _, g := range rateGroups {
+		env := "RATE_LIMIT_" + strings.ToUpper(string(g))
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		l, err := parseRateLimit(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", env, err)
+		}
+		limits[g] = &rateLimiter{limit: l}
+	}
+	return limits, nil
+}
+
+// rateBucket is a client's tokens; one is taken per request and they refill
+// at Requests per Window up to Burst
+type rateBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// rateLimiter holds the buckets of the clients of one group
+type rateLimiter struct {
+	limit rateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+// allow takes a token of client, or returns how long until one is there
+func (l *rateLimiter) allow(now time.Time, client string) (time.Duration, bool) {
+	perSecond := float64(l.limit.Requests) / l.limit.Window.Seconds()
+	burst := float64(l.limit.Burst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*rateBucket{}
+	}
+	l.sweep(now, perSecond, burst)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &rateBucket{tokens: burst, at: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.at).Seconds()*perSecond)
+	b.at = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep forgets the clients whose bucket has filled up again, once a window
+func (l *rateLimiter) sweep(now time.Time, perSecond, burst float64) {
+	if now.Sub(l.lastSweep) < l.limit.Window {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.at).Seconds()*perSecond >= burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// withRateLimits answers 429 to a client over the limit of the request's
+// group
+func (a *App) withRateLimits(h http.Handler) http.Handler {
+	if len(a.rateLimits) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g, ok := rateGroupOf(r)
+		limiter := a.rateLimits[g]
+		if !ok || limiter == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		wait, ok := limiter.allow(time.Now(), clientIP(r).String())
+		if ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		retry := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.limit.Requests))
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("Cache-Control", "no-store")
+		msg := fmt.Sprintf("Terlalu banyak permintaan dari alamat Anda. Silakan coba lagi dalam %d detik.", retry)
+		if g == rateVote {
+			msg = fmt.Sprintf("Terlalu banyak permintaan dari alamat Anda; pilihan Anda BELUM tercatat. Kembali ke halaman sebelumnya dan kirim ulang dalam %d detik.", retry)
+		}
+		a.writeError(w, r, http.StatusTooManyRequests, msg)
+	})
+}
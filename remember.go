@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// With ADMIN_REMEMBER set, the password form offers "remember this device"
+// to admin_accounts: a long-lived cookie that starts a new session when the
+// last one ran out, so a committee member working through election night
+// signs in once. The cookie holds a series id and a token; the table keeps
+// the token's SHA-256 and a fingerprint of the browser. Every use rotates the
+// token, so a stolen cookie that is used shows up as an old token presented
+// for its series, which ends the series and the account's sessions. A
+// browser whose fingerprint doesn't match is turned away the same way.
+//
+// Only admin_accounts can be remembered: their role and disabled flag are
+// read at every use. Env, LDAP and provider sign-ins are checked where they
+// live, so those sign in again.
+
+const (
+	adminRememberCookie = "admin_remember"
+
+	maxRemember = 90 * 24 * time.Hour
+
+	// rememberGrace keeps the previous token of a series valid this long after
+	// a rotation, for requests the browser sent before it got the new cookie;
+	// they join the session that rotation started
+	rememberGrace = time.Minute
+)
+
+// loadRememberDuration reads ADMIN_REMEMBER; 0 leaves the option off
+func loadRememberDuration() (time.Duration, error) {
+	v := os.Getenv("ADMIN_REMEMBER")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Hour || d > maxRemember {
+		return 0, fmt.Errorf("invalid ADMIN_REMEMBER %q: a duration between 1h and %s", v, maxRemember)
+	}
+	return d, nil
+}
+
+// deviceFingerprint hashes what the browser sends with every request, less
+// the version numbers that change with each update
+func deviceFingerprint(r *http.Request) string {
+	noDigits := func(c rune) rune {
+		if c >= '0' && c <= '9' {
+			return -1
+		}
+		return c
+	}
+	sum := sha256.Sum256([]byte(strings.Map(noDigits, r.UserAgent()) + "\x00" + r.Header.Get("Accept-Language")))
+	return hex.EncodeToString(sum[:])
+}
+
+// rememberDevice gives this browser a remember cookie for the account
+func (a *App) rememberDevice(w http.ResponseWriter, r *http.Request, accountID int) error {
+	series, token := randomToken(16), randomToken(32)
+	userAgent := r.UserAgent()
+	if len(userAgent) > 300 {
+		userAgent = userAgent[:300]
+	}
+	_, err := a.db.Exec(r.Context(), `
+		INSERT INTO admin_remember_tokens (series, token_hash, account_id, fingerprint, user_agent, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NOW() + make_interval(secs => $6))`,
+		series, sessionTokenHash(token), accountID, deviceFingerprint(r), userAgent, a.remember.Seconds())
+	if err != nil {
+		return err
+	}
+	a.setCookie(w, r, adminRememberCookie, series+"."+token, int(a.remember.Seconds()), http.SameSiteLaxMode)
+	return nil
+}
+
+// rememberedAccount starts a new session from the remember cookie, rotating
+// its token
+func (a *App) rememberedAccount(w http.ResponseWriter, r *http.Request) (*Account, bool) {
+	if a.remember == 0 {
+		return nil, false
+	}
+	c, err := r.Cookie(adminRememberCookie)
+	if err != nil {
+		return nil, false
+	}
+	series, token, ok := strings.Cut(c.Value, ".")
+	if !ok || series == "" || token == "" {
+		return nil, false
+	}
+	ctx := r.Context()
+	acc, fresh, err := a.rotateRemember(ctx, w, r, series, token)
+	if err != nil {
+		var reused errRememberReused
+		switch {
+		case errors.Is(err, errRememberLate):
+			// the cookie this request came with was already replaced
+			return nil, false
+		case errors.As(err, &reused):
+			a.recordLogin(r, reused.username, LoginRemember, false, reused.reason)
+			a.audit(ctx, "system", "account.remember_revoke", reused.username, map[string]string{"reason": reused.reason})
+		case !errors.Is(err, pgx.ErrNoRows):
+			logDB.Errorf("error checking remember token: %v", err)
+			return nil, false
+		}
+		a.setCookie(w, r, adminRememberCookie, "", -1, http.SameSiteLaxMode)
+		return nil, false
+	}
+	if fresh {
+		a.recordLogin(r, acc.Username, LoginRemember, true, "")
+		a.audit(ctx, acc.Username, "account.remember_login", acc.Username, map[string]any{"role": acc.Role})
+	}
+	return acc, true
+}
+
+// errRememberLate is the previous token of a series within rememberGrace
+// whose rotation's session is over
+var errRememberLate = errors.New("remember token rotated already")
+
+// errRememberReused is a remember cookie that can't be the one its series
+// handed out last, or that came from another browser
+type errRememberReused struct {
+	username string
+	reason   string
+}
+
+func (e errRememberReused) Error() string {
+	return "remember token of " + e.username + " reused: " + e.reason
+}
+
+// rotateRemember checks the token of series and replaces it with a new one
+// sent as the cookie, starting a session for the account. The previous token
+// still within rememberGrace rotates nothing: the request joins the session
+// the rotation started, and fresh is false.
+func (a *App) rotateRemember(ctx context.Context, w http.ResponseWriter, r *http.Request, series, token string) (*Account, bool, error) {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var id int
+	var tokenHash, prevHash, fingerprint string
+	var rotatedAt *time.Time
+	var rotatedSession *int
+	acc := &Account{}
+	err = tx.QueryRow(ctx, `
+		SELECT t.id, t.token_hash, COALESCE(t.prev_hash, ''), t.rotated_at, t.rotated_session, t.fingerprint, acc.id, acc.username, acc.role
+		FROM admin_remember_tokens t JOIN admin_accounts acc ON acc.id = t.account_id
+		WHERE t.series = $1 AND t.revoked_at IS NULL AND t.expires_at > NOW() AND acc.disabled = FALSE
+		FOR UPDATE OF t`, series).
+		Scan(&id, &tokenHash, &prevHash, &rotatedAt, &rotatedSession, &fingerprint, &acc.ID, &acc.Username, &acc.Role)
+	if err != nil {
+		return nil, false, err
+	}
+
+	presented := sessionTokenHash(token)
+	reason := ""
+	switch {
+	case !constantTimeEqual(fingerprint, deviceFingerprint(r)):
+		reason = "device"
+	case constantTimeEqual(presented, tokenHash):
+	case prevHash != "" && constantTimeEqual(presented, prevHash) && rotatedAt != nil && time.Since(*rotatedAt) < rememberGrace:
+		if rotatedSession == nil {
+			return nil, false, errRememberLate
+		}
+		err := tx.QueryRow(ctx, `
+			SELECT id FROM admin_sessions
+			WHERE id = $1 AND username = $2 AND revoked_at IS NULL AND expires_at > NOW()`,
+			*rotatedSession, acc.Username).Scan(&acc.Session)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, false, errRememberLate
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return acc, false, tx.Commit(ctx)
+	default:
+		reason = "token"
+	}
+	if reason != "" {
+		// whoever holds the other copy is signed out too
+		if _, err := tx.Exec(ctx, `UPDATE admin_remember_tokens SET revoked_at = NOW() WHERE id = $1`, id); err != nil {
+			return nil, false, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, false, err
+		}
+		if _, err := a.endSessions(ctx, acc.Username, 0); err != nil {
+			return nil, false, err
+		}
+		return nil, false, errRememberReused{username: acc.Username, reason: reason}
+	}
+
+	// started before the row is released, so a late request waiting on it
+	// finds the session to join
+	if acc.Session, err = a.startSession(w, r, acc, "remember"); err != nil {
+		return nil, false, err
+	}
+	next := randomToken(32)
+	_, err = tx.Exec(ctx, `
+		UPDATE admin_remember_tokens
+		SET token_hash = $2, prev_hash = token_hash, rotated_at = NOW(), rotated_session = $3, last_used_at = NOW()
+		WHERE id = $1`, id, sessionTokenHash(next), acc.Session)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, false, err
+	}
+	a.setCookie(w, r, adminRememberCookie, series+"."+next, int(a.remember.Seconds()), http.SameSiteLaxMode)
+	return acc, true, nil
+}
+
+// forgetDevice revokes the remember cookie of this browser, if any
+func (a *App) forgetDevice(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(adminRememberCookie)
+	if err != nil {
+		return
+	}
+	a.setCookie(w, r, adminRememberCookie, "", -1, http.SameSiteLaxMode)
+	series, _, _ := strings.Cut(c.Value, ".")
+	if _, err := a.db.Exec(r.Context(), `UPDATE admin_remember_tokens SET revoked_at = NOW() WHERE series = $1 AND revoked_at IS NULL`, series); err != nil {
+		logDB.Errorf("error revoking remember token: %v", err)
+	}
+}
+
+// forgetDevices revokes the remember cookies of username, returning how many
+// there were
+func (a *App) forgetDevices(ctx context.Context, username string) (int64, error) {
+	tag, err := a.db.Exec(ctx, `
+		UPDATE admin_remember_tokens t SET revoked_at = NOW()
+		FROM admin_accounts acc
+		WHERE acc.id = t.account_id AND acc.username = $1 AND t.revoked_at IS NULL AND t.expires_at > NOW()`, username)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DeviceRow is a remembered browser as listed on the profile page
+type DeviceRow struct {
+	ID         int
+	UserAgent  string
+	CreatedAt  string
+	LastUsedAt string
+	ExpiresAt  string
+}
+
+// listDevices returns the remembered browsers of username
+func (a *App) listDevices(ctx context.Context, username string) ([]DeviceRow, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT t.id, t.user_agent, to_char(t.created_at, 'YYYY-MM-DD HH24:MI'),
+			COALESCE(to_char(t.last_used_at, 'YYYY-MM-DD HH24:MI'), ''), to_char(t.expires_at, 'YYYY-MM-DD HH24:MI')
+		FROM admin_remember_tokens t JOIN admin_accounts acc ON acc.id = t.account_id
+		WHERE acc.username = $1 AND t.revoked_at IS NULL AND t.expires_at > NOW()
+		ORDER BY t.created_at DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []DeviceRow
+	for rows.Next() {
+		var d DeviceRow
+		if err := rows.Scan(&d.ID, &d.UserAgent, &d.CreatedAt, &d.LastUsedAt, &d.ExpiresAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"pemilihan.gkjp.id/tally"
+)
+
+// The dashboards read the live tally on each load, which adds up while the
+// committee watches the count live. Results are cached per election
+// (keyed by vote end) until a ballot or the roll changes: the server drops
+// the cache on each accepted vote, and statement triggers on voters,
+// offline_voters and spoiled_ballots NOTIFY results_changed, so writes by
+// imports, the CLI or another instance drop it too. The roll check rides
+// along, as the roll also only changes with the voters table. Nothing is
+// cached while the LISTEN connection is down.
+
+const resultsChannel = "results_changed"
+
+// LiveResults are the aggregates of the current election
+type LiveResults struct {
+	Stats      AdminStats
+	Sealed     int            // online ballots the trustees haven't opened yet
+	Ballots    []tally.Ballot // as loadBallots returns them
+	Electorate tally.Electorate
+	ChangedAt  time.Time // last change of a count
+}
+
+type resultsEntry struct {
+	results *LiveResults
+	tally   *TallySnapshot // live tally with the ballot hash, loaded on demand
+	roll    *RollCheck     // the roll against its commitment, loaded on demand
+	closing *TallySnapshot // the snapshot at close, once taken
+}
+
+type resultsCache struct {
+	mu        sync.Mutex
+	listening bool
+	gen       uint64 // bumped on every invalidation
+	entries   map[time.Time]*resultsEntry
+
+	// the last results read, kept through invalidations for when the
+	// database is unreachable
+	last   *LiveResults
+	lastAt time.Time
+}
+
+// invalidate drops every cached result
+func (c *resultsCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = nil
+}
+
+func (c *resultsCache) setListening(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listening = on
+	c.gen++
+	c.entries = nil
+}
+
+// lookup returns a copy of the entry for an election and the generation to
+// store a freshly loaded result under
+func (c *resultsCache) lookup(key time.Time) (resultsEntry, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[key]; e != nil {
+		return *e, c.gen
+	}
+	return resultsEntry{}, c.gen
+}
+
+// current reports whether nothing changed since gen while listening, so a
+// result loaded after lookup returned gen may be shared
+func (c *resultsCache) current(gen uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.listening && gen == c.gen
+}
+
+// store updates the entry unless the cache was invalidated since gen, when
+// the result may already be stale
+func (c *resultsCache) store(key time.Time, gen uint64, fill func(*resultsEntry)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.listening || gen != c.gen {
+		return
+	}
+	if c.entries == nil {
+		c.entries = map[time.Time]*resultsEntry{}
+	}
+	if c.entries[key] == nil {
+		c.entries[key] = &resultsEntry{}
+	}
+	fill(c.entries[key])
+}
+
+// remember keeps r as the last results read
+func (c *resultsCache) remember(r *LiveResults) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last, c.lastAt = r, time.Now()
+}
+
+// lastKnown returns the last results read and when, nil before any
+func (c *resultsCache) lastKnown() (*LiveResults, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last, c.lastAt
+}
+
+// loadLiveResults reads the roll and the ballots of the current election
+// from tally_counts, which triggers keep in step with the ballot tables
+func loadLiveResults(ctx context.Context, q queryer) (*LiveResults, error) {
+	rows, err := q.Query(ctx, `
+		SELECT channel, choice, follow_up, ballots, shares, (SELECT MAX(changed_at) FROM tally_counts)
+		FROM tally_counts
+		WHERE ballots <> 0 OR shares <> 0
+		ORDER BY channel, choice, follow_up`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	r := &LiveResults{}
+	for rows.Next() {
+		var b tally.Ballot
+		if err := rows.Scan(&b.Channel, &b.Choice, &b.FollowUp, &b.Count, &b.Shares, &r.ChangedAt); err != nil {
+			return nil, err
+		}
+		if b.Channel != "roll" {
+			r.Ballots = append(r.Ballots, b)
+			continue
+		}
+		switch b.Choice {
+		case "":
+			r.Stats.TotalVoters, r.Electorate.Shares = b.Count, b.Shares
+		case "voted":
+			r.Stats.VotedCount = b.Count
+		case "sealed":
+			r.Sealed = b.Count
+		case "checked_in":
+			r.Electorate.Present, r.Electorate.PresentShares = b.Count, b.Shares
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	r.Electorate.Voters = r.Stats.TotalVoters
+	r.Stats.NotVotedCount = r.Stats.TotalVoters - r.Stats.VotedCount
+	ref := tally.Referendum{}.Tally(r.Ballots).(*tally.ReferendumResult)
+	r.Stats.SetujuCount, r.Stats.TidakSetujuCount = ref.Online.Setuju, ref.Online.TidakSetuju
+	r.Stats.KosongCount, r.Stats.RusakCount = ref.Online.Kosong, ref.Online.Rusak
+	return r, nil
+}
+
+// cachedResults returns the aggregates of the current election, from the
+// cache when nothing changed since they were loaded
+func (a *App) cachedResults(ctx context.Context) (*LiveResults, error) {
+	entry, gen := a.results.lookup(a.voteEnd)
+	if entry.results != nil {
+		return entry.results, nil
+	}
+	start := time.Now()
+	r, err := loadLiveResults(ctx, a.db)
+	if err != nil {
+		return nil, err
+	}
+	logTally.Debugf("live results recomputed in %v", time.Since(start))
+	a.results.remember(r)
+	a.results.store(a.voteEnd, gen, func(e *resultsEntry) { e.results = r })
+	return r, nil
+}
+
+// ChannelCounts are the referendum counts per channel shown while counting
+type ChannelCounts struct {
+	Voted   int // online ballots cast
+	Offline int // paper ballots entered, invalid ones included
+	Online  tally.ReferendumCount
+	Paper   tally.ReferendumCount
+}
+
+// channelCounts splits the cached results per channel for the counting
+// page
+func (a *App) channelCounts(ctx context.Context) (ChannelCounts, error) {
+	results, err := a.cachedResults(ctx)
+	if err != nil {
+		return ChannelCounts{}, err
+	}
+	return splitChannels(results), nil
+}
+
+func splitChannels(results *LiveResults) ChannelCounts {
+	ref := tally.Referendum{}.Tally(results.Ballots).(*tally.ReferendumResult)
+	c := ChannelCounts{Voted: results.Stats.VotedCount, Online: ref.Online, Paper: ref.Offline}
+	for _, b := range results.Ballots {
+		if b.Channel == "offline" {
+			c.Offline += b.Count
+		}
+	}
+	return c
+}
+
+// cachedTally is currentTally through the cache
+func (a *App) cachedTally(ctx context.Context) (TallySnapshot, error) {
+	entry, gen := a.results.lookup(a.voteEnd)
+	if entry.tally != nil {
+		return *entry.tally, nil
+	}
+	s, err := a.currentTally(ctx)
+	if err != nil {
+		return s, err
+	}
+	a.results.store(a.voteEnd, gen, func(e *resultsEntry) { e.tally = &s })
+	return s, nil
+}
+
+// cachedRollCheck is checkRoll through the cache; the commitment of an
+// election never changes once made, and changes to the roll drop the cache
+func (a *App) cachedRollCheck(ctx context.Context, c *RollCommitment) (RollCheck, error) {
+	entry, gen := a.results.lookup(a.voteEnd)
+	if entry.roll != nil {
+		return *entry.roll, nil
+	}
+	check, err := checkRoll(ctx, a.db, c)
+	if err != nil {
+		return check, err
+	}
+	a.results.store(a.voteEnd, gen, func(e *resultsEntry) { e.roll = &check })
+	return check, nil
+}
+
+// cachedClosingSnapshot is loadTallySnapshot through the cache; nil (not
+// cached) until the snapshot is taken
+func (a *App) cachedClosingSnapshot(ctx context.Context) (*TallySnapshot, error) {
+	entry, gen := a.results.lookup(a.voteEnd)
+	if entry.closing != nil {
+		return entry.closing, nil
+	}
+	s, err := a.loadTallySnapshot(ctx)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	a.results.store(a.voteEnd, gen, func(e *resultsEntry) { e.closing = s })
+	return s, nil
+}
+
+// listenResultChanges keeps a connection listening for results_changed and
+// drops the cache on each notification, reconnecting after errors
+func (a *App) listenResultChanges(ctx context.Context) {
+	for {
+		err := a.listenOnce(ctx)
+		a.results.setListening(false)
+		a.codes.setListening(false)
+		if ctx.Err() != nil {
+			return
+		}
+		logTally.Errorf("error listening for result changes: %v", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *App) listenOnce(ctx context.Context) error {
+	pooled, err := a.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// taken out of the pool: a listening connection is never handed out
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+resultsChannel+"; LISTEN "+revokedChannel+"; LISTEN "+logLevelsChannel+"; LISTEN "+codesChannel); err != nil {
+		return err
+	}
+	// notifications are database wide; codes_changed names the organization
+	var org string
+	if err := conn.QueryRow(ctx, `SELECT current_org()::text`).Scan(&org); err != nil {
+		return err
+	}
+	a.results.setListening(true)
+	a.codes.setListening(true)
+	// the revoked codes may have changed while nobody listened
+	if err := a.loadRevoked(ctx); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if n.Channel == revokedChannel {
+			if err := a.loadRevoked(ctx); err != nil {
+				logDB.Errorf("error loading revoked codes: %v", err)
+			}
+			continue
+		}
+		if n.Channel == codesChannel {
+			a.codes.changed(org, n.Payload)
+			continue
+		}
+		if n.Channel == logLevelsChannel {
+			if err := a.applyLogOverride(n.Payload); err != nil {
+				logDB.Errorf("error applying log levels: %v", err)
+			}
+			continue
+		}
+		a.results.invalidate()
+		a.resultsChanged(ctx)
+	}
+}
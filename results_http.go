@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// After the announcement everyone reloads the results at once. The public
+// results page (/status) and /api/v1/results carry an ETag and a
+// Last-Modified derived from what they show: the live tally (tally_counts,
+// with the time of its last change), the tally snapshot at close once taken,
+// and whether voting has closed. Both come from the results cache, so a
+// conditional GET that is still current is answered 304 without building
+// the page. /status may be kept by shared caches (a CDN) for a few seconds
+// while voting runs and a minute after close; the API needs a key, so only
+// the client keeps it, revalidating every time.
+
+const (
+	statusCacheControl       = "public, max-age=5"
+	statusClosedCacheControl = "public, max-age=60"
+	apiResultsCacheControl   = "private, no-cache"
+)
+
+// resultsVersion identifies the state of the public results
+type resultsVersion struct {
+	digest   string
+	modified time.Time
+}
+
+// resultsVersion returns the live results and the version they belong to
+func (a *App) resultsVersion(ctx context.Context) (*LiveResults, resultsVersion, error) {
+	live, err := a.cachedResults(ctx)
+	if err != nil {
+		return nil, resultsVersion{}, err
+	}
+	closed := time.Now().After(a.voteEnd)
+	var snapshot *TallySnapshot
+	if closed {
+		if snapshot, err = a.cachedClosingSnapshot(ctx); err != nil {
+			return nil, resultsVersion{}, err
+		}
+	}
+
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode([]interface{}{a.voteEnd.Unix(), a.ballot.Method, closed})
+	enc.Encode(live.Stats)
+	enc.Encode(live.Sealed)
+	enc.Encode(live.Ballots)
+	enc.Encode(live.Electorate)
+	enc.Encode(snapshot)
+	// the page shows the organization's logo and colors
+	enc.Encode(a.branding.current().UpdatedAt)
+	v := resultsVersion{digest: hex.EncodeToString(h.Sum(nil))[:32], modified: live.ChangedAt}
+	if closed && a.voteEnd.After(v.modified) {
+		v.modified = a.voteEnd
+	}
+	if snapshot != nil && snapshot.TakenAt.After(v.modified) {
+		v.modified = snapshot.TakenAt
+	}
+	return live, v, nil
+}
+
+// notModified sets the validators of one representation of v ("status",
+// "api") and answers 304 when the client's copy is still current
+func notModified(w http.ResponseWriter, r *http.Request, v resultsVersion, kind string) bool {
+	etag := `W/"` + kind + "-" + v.digest + `"`
+	w.Header().Set("ETag", etag)
+	if !v.modified.IsZero() {
+		w.Header().Set("Last-Modified", v.modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	current := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// weak comparison; If-Modified-Since is ignored next to it
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				current = true
+				break
+			}
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !v.modified.IsZero() {
+		current = !v.modified.Truncate(time.Second).After(ims)
+	}
+	if current {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return current
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Data classes with their own retention period
+const (
+	ClassContact   = "contact"    // names and phone numbers on the roll
+	ClassAccessLog = "access_log" // IP address / user agent logs
+	ClassAudit     = "audit"      // audit ledger entries
+	ClassBallots   = "ballots"    // anonymous ballots of archived elections
+)
+
+// retentionClass describes a data class and where its period is configured
+type retentionClass struct {
+	Key   string
+	Label string
+	Env   string
+	Basis string // what the period is counted from
+}
+
+var retentionClasses = []retentionClass{
+	{ClassContact, "Kontak peserta (nama, no HP)", "PII_RETENTION_DAYS", "sejak pemilihan ditutup"},
+	{ClassAccessLog, "Log IP / user agent", "ACCESS_LOG_RETENTION_DAYS", "sejak dicatat"},
+	{ClassAudit, "Log audit", "AUDIT_RETENTION_DAYS", "sejak dicatat"},
+	{ClassBallots, "Surat suara anonim (arsip)", "BALLOT_RETENTION_DAYS", "sejak pemilihan ditutup"},
+}
+
+// defaultRetentionSchedule is when the scheduled cleanup runs without
+// RETENTION_SCHEDULE
+const defaultRetentionSchedule = "@every 24h"
+
+// loadRetentionPolicy reads the per-class retention periods from the
+// environment; classes without a value are kept forever
+func loadRetentionPolicy() (map[string]time.Duration, error) {
+	policy := map[string]time.Duration{}
+	for _, c := range retentionClasses {
+		days := os.Getenv(c.Env)
+		if days == "" {
+			continue
+		}
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid %s: %q", c.Env, days)
+		}
+		policy[c.Key] = time.Duration(n) * 24 * time.Hour
+	}
+	return policy, nil
+}
+
+// RetentionResult is what a cleanup did (or would do) for one data class
+type RetentionResult struct {
+	Class      string    `json:"class"`
+	Label      string    `json:"-"`
+	Env        string    `json:"-"`
+	Basis      string    `json:"-"`
+	Days       int       `json:"days"`
+	Configured bool      `json:"configured"`
+	Cutoff     time.Time `json:"cutoff"`
+	Due        bool      `json:"due"`
+	Removed    int64     `json:"removed"`
+}
+
+// RetentionReport is one (dry-run or applied) cleanup across all classes
+type RetentionReport struct {
+	RanAt   time.Time         `json:"ran_at"`
+	Trigger string            `json:"trigger"` // scheduled / manual / preview
+	Actor   string            `json:"actor"`
+	Applied bool              `json:"applied"`
+	Results []RetentionResult `json:"results"`
+}
+
+// RetentionRun is a stored report of an applied cleanup
+type RetentionRun struct {
+	RanAt   time.Time
+	Trigger string
+	Actor   string
+	Removed map[string]int64
+}
+
+type RetentionData struct {
+	Preview RetentionReport
+	Runs    []RetentionRun
+	Message string
+	Error   string
+}
+
+// applyRetention removes or pseudonymizes data whose retention period has
+// passed. Every class runs in one transaction; with apply=false it is rolled
+// back, so the report doubles as a dry-run preview.
+func (a *App) applyRetention(ctx context.Context, apply bool, trigger, actor string) (*RetentionReport, error) {
+	report := &RetentionReport{RanAt: time.Now(), Trigger: trigger, Actor: actor}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, c := range retentionClasses {
+		res := RetentionResult{Class: c.Key, Label: c.Label, Env: c.Env, Basis: c.Basis}
+		period, ok := a.retention[c.Key]
+		if ok {
+			res.Configured = true
+			res.Days = int(period / (24 * time.Hour))
+			res.Cutoff = report.RanAt.Add(-period)
+			if res.Removed, err = purgeClass(ctx, tx, c.Key, a.voteEnd, res.Cutoff); err != nil {
+				return nil, fmt.Errorf("%s: %w", c.Key, err)
+			}
+			res.Due = res.Removed > 0
+		}
+		report.Results = append(report.Results, res)
+	}
+
+	if !apply {
+		return report, nil
+	}
+
+	removed := map[string]int64{}
+	for _, res := range report.Results {
+		if res.Configured {
+			removed[res.Class] = res.Removed
+		}
+	}
+	payload, err := json.Marshal(removed)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO retention_runs (ran_at, trigger, actor, removed)
+		VALUES ($1, $2, $3, $4)`, report.RanAt, trigger, actor, payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// purgeClass cleans one data class older than cutoff and returns the number
+// of rows removed or pseudonymized
+func purgeClass(ctx context.Context, tx pgx.Tx, class string, voteEnd, cutoff time.Time) (int64, error) {
+	switch class {
+	case ClassContact:
+		// names and phones are replaced by pseudonyms rather than deleted: the
+		// stable phone hash keeps the voters/vote_master join (and with it the
+		// per-wilayah statistics) working
+		if !voteEnd.Before(cutoff) {
+			return 0, nil
+		}
+		tag, err := tx.Exec(ctx, `
+			UPDATE vote_master vm
+			SET name = 'Anggota ' || substr(md5(vm.phone), 1, 8),
+				phone = 'anon-' || md5(vm.phone)
+			WHERE EXISTS (SELECT 1 FROM voters v WHERE v.phone = vm.phone AND v.pseudonymized_at IS NULL)`)
+		if err != nil {
+			return 0, err
+		}
+		master := tag.RowsAffected()
+		tag, err = tx.Exec(ctx, `
+			UPDATE voters
+			SET name = 'Peserta ' || id,
+				phone = 'anon-' || md5(phone),
+				pseudonymized_at = NOW()
+			WHERE pseudonymized_at IS NULL`)
+		if err != nil {
+			return 0, err
+		}
+		pseudonymized := master + tag.RowsAffected()
+		// the versions of the roll get one pseudonym per code, so they
+		// still diff as before
+		tag, err = tx.Exec(ctx, `
+			UPDATE roll_version_entries
+			SET entry = entry || jsonb_build_object('name', 'Peserta ' || code, 'phone', 'anon-' || md5(code))
+			WHERE entry IS NOT NULL AND entry->>'phone' <> '' AND NOT starts_with(entry->>'phone', 'anon-')`)
+		if err != nil {
+			return 0, err
+		}
+		return pseudonymized + tag.RowsAffected(), nil
+
+	case ClassAccessLog:
+		tag, err := tx.Exec(ctx, `DELETE FROM access_logs WHERE at < $1`, cutoff)
+		return tag.RowsAffected(), err
+
+	case ClassAudit:
+		tag, err := tx.Exec(ctx, `DELETE FROM audit_events WHERE at < $1`, cutoff)
+		return tag.RowsAffected(), err
+
+	case ClassBallots:
+		// archived ballots are sealed; the trigger lets this one purge through.
+		// The archived totals per choice are kept.
+		if _, err := tx.Exec(ctx, `SET LOCAL app.retention_purge = 'on'`); err != nil {
+			return 0, err
+		}
+		tag, err := tx.Exec(ctx, `
+			DELETE FROM archived_ballots b
+			USING elections e
+			WHERE b.election_id = e.id AND e.vote_end < $1`, cutoff)
+		return tag.RowsAffected(), err
+	}
+	return 0, fmt.Errorf("unknown data class %q", class)
+}
+
+// listRetentionRuns returns the latest applied cleanups
+func (a *App) listRetentionRuns(ctx context.Context) ([]RetentionRun, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT ran_at, trigger, actor, removed FROM retention_runs
+		ORDER BY ran_at DESC
+		LIMIT 20`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []RetentionRun
+	for rows.Next() {
+		var run RetentionRun
+		var removed []byte
+		if err := rows.Scan(&run.RanAt, &run.Trigger, &run.Actor, &removed); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(removed, &run.Removed); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// retentionJob cleans up the data past its retention period, recording the
+// cleanup in the audit log when it removed something
+func (a *App) retentionJob(ctx context.Context) error {
+	report, err := a.applyRetention(ctx, false, "scheduled", "system")
+	if err != nil || report.removedTotal() == 0 {
+		return err
+	}
+	if report, err = a.applyRetention(ctx, true, "scheduled", "system"); err != nil {
+		return err
+	}
+	a.audit(ctx, "system", "retention.run", "", report.Results)
+	return nil
+}
+
+func (r *RetentionReport) removedTotal() int64 {
+	var n int64
+	for _, res := range r.Results {
+		n += res.Removed
+	}
+	return n
+}
+
+// adminRetentionHandler shows the retention policy per data class with a
+// dry-run preview and the latest cleanup reports, and runs the cleanup on
+// POST. Superadmin only.
+func (a *App) adminRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data RetentionData
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if r.FormValue("confirm") != "PURGE" {
+			data.Error = "ketik PURGE untuk konfirmasi"
+			break
+		}
+		report, err := a.applyRetention(ctx, true, "manual", actorName(r))
+		if err != nil {
+			logDB.Errorf("error applying retention: %v", err)
+			data.Error = "gagal menjalankan pembersihan"
+			break
+		}
+		a.audit(ctx, actorName(r), "retention.run", "", report.Results)
+		data.Message = fmt.Sprintf("Pembersihan selesai: %d baris dihapus atau dipseudonimkan", report.removedTotal())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	preview, err := a.applyRetention(ctx, false, "preview", actorName(r))
+	if err != nil {
+		logDB.Errorf("error getting retention preview: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Preview = *preview
+
+	data.Runs, err = a.listRetentionRuns(ctx)
+	if err != nil {
+		logDB.Errorf("error getting retention runs: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "retention.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
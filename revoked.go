@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// When invitation letters are known to be photographed and shared, the
+// committee revokes their codes at /admin/revoked: a revoked code opens no
+// ballot and casts none, until a superadmin restores it. The table
+// revoked_codes is read into memory, so the check costs the ballot page and
+// the vote nothing; a statement trigger NOTIFYs codes_revoked and every
+// instance reloads the set on it (over the results LISTEN connection, see
+// results_cache.go), and every revokedRefresh in case a notification was
+// missed. A ballot already cast with a code stays cast.
+
+const (
+	revokedChannel = "codes_revoked"
+	revokedRefresh = time.Minute
+
+	// maxRevokeBatch caps the codes revoked at once
+	maxRevokeBatch = 10000
+)
+
+// blocklist is the in-memory set of revoked codes
+type blocklist struct {
+	mu    sync.RWMutex
+	codes map[string]bool
+}
+
+// has reports whether code is revoked
+func (b *blocklist) has(code string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.codes[code]
+}
+
+// loadRevoked reads revoked_codes into memory
+func (a *App) loadRevoked(ctx context.Context) error {
+	rows, err := a.db.Query(ctx, `SELECT code FROM revoked_codes`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	codes := map[string]bool{}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return err
+		}
+		codes[code] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	a.revoked.mu.Lock()
+	a.revoked.codes = codes
+	a.revoked.mu.Unlock()
+	return nil
+}
+
+// RevokedCode is a code the committee revoked
+type RevokedCode struct {
+	Code      string
+	Name      string
+	Used      bool // voted before it was revoked
+	Reason    string
+	RevokedBy string
+	RevokedAt time.Time
+}
+
+// RevokedData is the data of revoked.html
+type RevokedData struct {
+	Codes   []RevokedCode
+	Message string
+	Error   string
+}
+
+// adminRevokedHandler lists the revoked codes, revokes a batch
+// (action=revoke) and restores one (action=restore). Superadmin only.
+func (a *App) adminRevokedHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var data RevokedData
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var err error
+		switch r.FormValue("action") {
+		case "revoke":
+			data.Message, err = a.revokeCodes(ctx, r.FormValue("codes"), strings.TrimSpace(r.FormValue("reason")), actorName(r))
+		case "restore":
+			data.Message, err = a.restoreCode(ctx, strings.TrimSpace(r.FormValue("code")), actorName(r))
+		default:
+			err = errors.New("aksi tidak dikenal")
+		}
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+		// this instance doesn't wait for the notification
+		if err := a.loadRevoked(ctx); err != nil {
+			logDB.Errorf("error loading revoked codes: %v", err)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	codes, err := a.listRevoked(ctx)
+	if err != nil {
+		logDB.Errorf("error getting revoked codes: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data.Codes = codes
+
+	if err := a.tmpl.ExecuteTemplate(w, "revoked.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// revokeCodes revokes the codes listed in text, separated by spaces, commas
+// or lines, all or none; every code must be on the roll. The error message
+// is shown to the admin as-is.
+func (a *App) revokeCodes(ctx context.Context, text, reason, actor string) (string, error) {
+	seen := map[string]bool{}
+	var codes []string
+	for _, code := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		if !seen[code] {
+			seen[code] = true
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) == 0 {
+		return "", errors.New("isi kode yang dicabut")
+	}
+	if len(codes) > maxRevokeBatch {
+		return "", fmt.Errorf("paling banyak %d kode sekaligus", maxRevokeBatch)
+	}
+	if len(reason) > 200 {
+		reason = reason[:200]
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		logDB.Errorf("error revoking codes: %v", err)
+		return "", errors.New("database error")
+	}
+	defer tx.Rollback(ctx)
+
+	unknown, err := unknownCodes(ctx, tx, codes)
+	if err != nil {
+		logDB.Errorf("error revoking codes: %v", err)
+		return "", errors.New("database error")
+	}
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("kode tidak ada di daftar pemilih: %s", strings.Join(unknown, ", "))
+	}
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO revoked_codes (code, reason, revoked_by)
+		SELECT code, $2, $3 FROM unnest($1::text[]) AS code
+		ON CONFLICT (org_id, code) DO NOTHING`, codes, reason, actor)
+	if err != nil {
+		logDB.Errorf("error revoking codes: %v", err)
+		return "", errors.New("database error")
+	}
+	var used int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM voters WHERE code = ANY($1) AND used`, codes).Scan(&used); err != nil {
+		logDB.Errorf("error revoking codes: %v", err)
+		return "", errors.New("database error")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		logDB.Errorf("error revoking codes: %v", err)
+		return "", errors.New("database error")
+	}
+
+	revoked := int(tag.RowsAffected())
+	a.audit(ctx, actor, "code.revoke", "", map[string]interface{}{"codes": codes, "revoked": revoked, "reason": reason})
+	msg := fmt.Sprintf("%d kode dicabut", revoked)
+	if n := len(codes) - revoked; n > 0 {
+		msg += fmt.Sprintf(", %d sudah dicabut sebelumnya", n)
+	}
+	if used > 0 {
+		msg += fmt.Sprintf("; %d di antaranya sudah dipakai memilih dan suaranya tetap masuk", used)
+	}
+	return msg, nil
+}
+
+// restoreCode lifts the revocation of code
+func (a *App) restoreCode(ctx context.Context, code, actor string) (string, error) {
+	var reason string
+	err := a.db.QueryRow(ctx, `DELETE FROM revoked_codes WHERE code = $1 RETURNING reason`, code).Scan(&reason)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("kode %s tidak dicabut", code)
+	}
+	if err != nil {
+		logDB.Errorf("error restoring code: %v", err)
+		return "", errors.New("database error")
+	}
+	a.audit(ctx, actor, "code.restore", code, map[string]string{"reason": reason})
+	return fmt.Sprintf("Kode %s dipulihkan", code), nil
+}
+
+func (a *App) listRevoked(ctx context.Context) ([]RevokedCode, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT rc.code, COALESCE(vm.name, v.name, ''), COALESCE(v.used, FALSE), rc.reason, rc.revoked_by, rc.revoked_at
+		FROM revoked_codes rc
+		LEFT JOIN voters v ON v.code = rc.code
+		LEFT JOIN vote_master vm ON v.phone = vm.phone
+		ORDER BY rc.revoked_at DESC, rc.code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []RevokedCode
+	for rows.Next() {
+		var c RevokedCode
+		if err := rows.Scan(&c.Code, &c.Name, &c.Used, &c.Reason, &c.RevokedBy, &c.RevokedAt); err != nil {
+			return nil, err
+		}
+		if err := a.pii.openAll(&c.Name); err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Until voting opens the roll is versioned: every rollVersionInterval the
+// roll is compared with its latest version and, when a voter was added,
+// removed or edited, a new version is recorded, and a last one at the
+// opening. A version stores only the voters it changed (roll_version_entries,
+// NULL for a removal), so any version is rebuilt from the ones before it and
+// two versions can be diffed at /admin/roll/versions to settle who was on
+// the roll, and with which group and attributes, at any point. Names and
+// phones are kept as the roll stores them, sealed under PII_KEY when set, and
+// are erased and pseudonymized along with the roll.
+
+const rollVersionInterval = time.Minute
+
+// RollVersion is one recorded state of the roll
+type RollVersion struct {
+	ID        int
+	Number    int // from 1, per election
+	CreatedAt time.Time
+	CreatedBy string
+	Voters    int
+	Added     int
+	Removed   int
+	Edited    int
+	Digest    string // SHA-256 of the opened entries, to tell whether the roll changed
+}
+
+// RollEntry is a voter as a version records them
+type RollEntry struct {
+	Name       string            `json:"name"`
+	Phone      string            `json:"phone"`
+	Group      string            `json:"group"`
+	Shares     int               `json:"shares"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func (e RollEntry) equal(o RollEntry) bool {
+	return e.Name == o.Name && e.Phone == o.Phone && e.Group == o.Group && e.Shares == o.Shares &&
+		maps.Equal(e.Attributes, o.Attributes)
+}
+
+// changes describes what changed from e to o, one line per field; phones
+// are only said to have changed
+func (e RollEntry) changes(o RollEntry) []string {
+	var lines []string
+	if e.Name != o.Name {
+		lines = append(lines, fmt.Sprintf("Nama: %s → %s", e.Name, o.Name))
+	}
+	if e.Phone != o.Phone {
+		lines = append(lines, "No HP diubah")
+	}
+	if e.Group != o.Group {
+		lines = append(lines, fmt.Sprintf("Wilayah: %s → %s", e.Group, o.Group))
+	}
+	if e.Shares != o.Shares {
+		lines = append(lines, fmt.Sprintf("Bobot: %d → %d", e.Shares, o.Shares))
+	}
+	keys := slices.Collect(maps.Keys(e.Attributes))
+	for k := range o.Attributes {
+		if _, ok := e.Attributes[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		before, had := e.Attributes[k]
+		after, has := o.Attributes[k]
+		switch {
+		case !had:
+			lines = append(lines, fmt.Sprintf("%s: (kosong) → %s", k, after))
+		case !has:
+			lines = append(lines, fmt.Sprintf("%s: %s → (dihapus)", k, before))
+		case before != after:
+			lines = append(lines, fmt.Sprintf("%s: %s → %s", k, before, after))
+		}
+	}
+	return lines
+}
+
+// RollChange is a voter added, removed or edited between two versions
+type RollChange struct {
+	Code    string
+	Entry   RollEntry // as of the later version; the earlier one for a removal
+	Changes []string  // edits only
+}
+
+// RollDiff is what changed from one version to another
+type RollDiff struct {
+	From, To *RollVersion
+	Added    []RollChange
+	Removed  []RollChange
+	Edited   []RollChange
+}
+
+// diffRolls compares two opened rolls, listing the changes by code
+func diffRolls(from, to map[string]RollEntry) (added, removed, edited []RollChange) {
+	for _, code := range slices.Sorted(maps.Keys(to)) {
+		e := to[code]
+		before, ok := from[code]
+		switch {
+		case !ok:
+			added = append(added, RollChange{Code: code, Entry: e})
+		case !before.equal(e):
+			edited = append(edited, RollChange{Code: code, Entry: e, Changes: before.changes(e)})
+		}
+	}
+	for _, code := range slices.Sorted(maps.Keys(from)) {
+		if _, ok := to[code]; !ok {
+			removed = append(removed, RollChange{Code: code, Entry: from[code]})
+		}
+	}
+	return added, removed, edited
+}
+
+// rollDigest fingerprints an opened roll
+func rollDigest(roll map[string]RollEntry) string {
+	h := sha256.New()
+	for _, code := range slices.Sorted(maps.Keys(roll)) {
+		b, _ := json.Marshal(roll[code])
+		fmt.Fprintf(h, "%s\t%s\n", code, b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadCurrentRoll reads the roll as stored, names and phones still sealed
+func loadCurrentRoll(ctx context.Context, q queryer) (map[string]RollEntry, error) {
+	rows, err := q.Query(ctx, `
+		SELECT v.code, COALESCE(vm.name, v.name), v.phone, COALESCE(vm.wilayah, ''), v.shares, COALESCE(vm.attributes, '{}')
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roll := map[string]RollEntry{}
+	for rows.Next() {
+		var code string
+		var e RollEntry
+		if err := rows.Scan(&code, &e.Name, &e.Phone, &e.Group, &e.Shares, &e.Attributes); err != nil {
+			return nil, err
+		}
+		if len(e.Attributes) == 0 {
+			e.Attributes = nil
+		}
+		roll[code] = e
+	}
+	return roll, rows.Err()
+}
+
+// openRoll decrypts the names, phones and sealed attributes of a stored roll
+// into a copy
+func (a *App) openRoll(stored map[string]RollEntry) (map[string]RollEntry, error) {
+	roll := make(map[string]RollEntry, len(stored))
+	for code, e := range stored {
+		if err := a.pii.openAll(&e.Name, &e.Phone); err != nil {
+			return nil, err
+		}
+		var err error
+		if e.Attributes, err = a.pii.openAttributes(e.Attributes); err != nil {
+			return nil, err
+		}
+		roll[code] = e
+	}
+	return roll, nil
+}
+
+// loadRollAt rebuilds the roll of version number of the election, opened
+func (a *App) loadRollAt(ctx context.Context, q queryer, number int) (map[string]RollEntry, error) {
+	rows, err := q.Query(ctx, `
+		SELECT DISTINCT ON (e.code) e.code, e.entry
+		FROM roll_version_entries e JOIN roll_versions v ON v.id = e.version_id
+		WHERE v.vote_start = $1 AND v.number <= $2
+		ORDER BY e.code, v.number DESC`, a.voteStart, number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := map[string]RollEntry{}
+	for rows.Next() {
+		var code string
+		var entry []byte
+		if err := rows.Scan(&code, &entry); err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue // removed
+		}
+		var e RollEntry
+		if err := json.Unmarshal(entry, &e); err != nil {
+			return nil, err
+		}
+		stored[code] = e
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return a.openRoll(stored)
+}
+
+const rollVersionColumns = `id, number, created_at, created_by, voters, added, removed, edited, digest`
+
+func scanRollVersion(row pgx.Row) (*RollVersion, error) {
+	var v RollVersion
+	err := row.Scan(&v.ID, &v.Number, &v.CreatedAt, &v.CreatedBy, &v.Voters, &v.Added, &v.Removed, &v.Edited, &v.Digest)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// listRollVersions returns the versions of the election, latest first
+func (a *App) listRollVersions(ctx context.Context) ([]RollVersion, error) {
+	rows, err := a.db.Query(ctx, `SELECT `+rollVersionColumns+` FROM roll_versions WHERE vote_start = $1 ORDER BY number DESC`, a.voteStart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []RollVersion
+	for rows.Next() {
+		v, err := scanRollVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *v)
+	}
+	return versions, rows.Err()
+}
+
+// snapshotRoll records a new version if the roll differs from the latest
+// one, returning nil when it doesn't or another instance just did
+func (a *App) snapshotRoll(ctx context.Context, actor string) (*RollVersion, error) {
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	stored, err := loadCurrentRoll(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	current, err := a.openRoll(stored)
+	if err != nil {
+		return nil, err
+	}
+	digest := rollDigest(current)
+	latest, err := scanRollVersion(tx.QueryRow(ctx, `
+		SELECT `+rollVersionColumns+` FROM roll_versions WHERE vote_start = $1 ORDER BY number DESC LIMIT 1`, a.voteStart))
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil && latest.Digest == digest {
+		return nil, nil
+	}
+	var previous map[string]RollEntry
+	if latest != nil {
+		if previous, err = a.loadRollAt(ctx, tx, latest.Number); err != nil {
+			return nil, err
+		}
+	}
+	added, removed, edited := diffRolls(previous, current)
+
+	v := &RollVersion{Number: 1, CreatedBy: actor, Voters: len(current), Added: len(added), Removed: len(removed),
+		Edited: len(edited), Digest: digest}
+	if latest != nil {
+		v.Number = latest.Number + 1
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO roll_versions (vote_start, number, created_by, voters, added, removed, edited, digest)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`,
+		a.voteStart, v.Number, actor, v.Voters, v.Added, v.Removed, v.Edited, digest).Scan(&v.ID, &v.CreatedAt)
+	if isUniqueViolation(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := &pgx.Batch{}
+	for _, changes := range [][]RollChange{added, edited} {
+		for _, c := range changes {
+			entry, err := json.Marshal(stored[c.Code])
+			if err != nil {
+				return nil, err
+			}
+			b.Queue(`INSERT INTO roll_version_entries (version_id, code, entry) VALUES ($1, $2, $3)`, v.ID, c.Code, string(entry))
+		}
+	}
+	for _, c := range removed {
+		b.Queue(`INSERT INTO roll_version_entries (version_id, code, entry) VALUES ($1, $2, NULL)`, v.ID, c.Code)
+	}
+	if err := tx.SendBatch(ctx, b).Close(); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	a.audit(ctx, actor, "roll.version", strconv.Itoa(v.Number), map[string]int{
+		"voters": v.Voters, "added": v.Added, "removed": v.Removed, "edited": v.Edited,
+	})
+	return v, nil
+}
+
+// RollVersionsData is the data of roll_versions.html
+type RollVersionsData struct {
+	Versions []RollVersion
+	From, To int // version numbers diffed; from 0 is the empty roll
+	Diff     *RollDiff
+	Error    string
+}
+
+// adminRollVersionsHandler: GET /admin/roll/versions lists the versions of
+// the roll and diffs ?from= to ?to= (by default the latest against the one
+// before)
+func (a *App) adminRollVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	versions, err := a.listRollVersions(ctx)
+	if err != nil {
+		logDB.Errorf("error getting roll versions: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	data := RollVersionsData{Versions: versions}
+
+	if len(versions) > 0 {
+		byNumber := make(map[int]*RollVersion, len(versions))
+		for i := range versions {
+			byNumber[versions[i].Number] = &versions[i]
+		}
+		to := versions[0].Number
+		from := to - 1
+		if s := strings.TrimSpace(r.FormValue("to")); s != "" {
+			to, _ = strconv.Atoi(s)
+		}
+		if s := strings.TrimSpace(r.FormValue("from")); s != "" {
+			from, _ = strconv.Atoi(s)
+		}
+		data.From, data.To = from, to
+		diff := &RollDiff{From: byNumber[from], To: byNumber[to]}
+		switch {
+		case diff.To == nil || (diff.From == nil && from != 0):
+			data.Error = "versi tidak ditemukan"
+		default:
+			// from 0 is the empty roll before the first version
+			var before map[string]RollEntry
+			if diff.From != nil {
+				before, err = a.loadRollAt(ctx, a.db, from)
+			}
+			var after map[string]RollEntry
+			if err == nil {
+				after, err = a.loadRollAt(ctx, a.db, to)
+			}
+			if err != nil {
+				logDB.Errorf("error getting roll version: %v", err)
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			diff.Added, diff.Removed, diff.Edited = diffRolls(before, after)
+			data.Diff = diff
+		}
+	}
+
+	if err := a.tmpl.ExecuteTemplate(w, "roll_versions.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
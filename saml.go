@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With SAML_IDP_METADATA set, admins can sign in through an identity
+// provider speaking SAML 2.0 (ADFS, Entra ID, Okta, Keycloak, ...). The
+// login is SP-initiated: /admin/saml/login sends an AuthnRequest by the
+// HTTP-Redirect binding and the IdP posts the signed response to
+// /admin/saml/acs. The role comes from the values of SAML_ROLE_ATTRIBUTE
+// mapped by SAML_ROLES, the highest mapped role winning, and is kept in the
+// session of session.go. Our metadata for registering at the IdP is served
+// at /admin/saml/metadata.
+//
+// The response must answer the request this browser started (its ID is in
+// a signed cookie), come from the IdP's entity ID, be addressed to our ACS
+// and audience, be within its validity window and carry exactly one
+// unencrypted assertion signed (itself, or through the response) with the
+// certificate from the IdP's metadata. Each assertion is accepted once.
+
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	samlRequestCookie = "saml_request"
+	// samlRequestTTL is how long the IdP's login page may take
+	samlRequestTTL = 10 * time.Minute
+	// samlClockSkew is tolerated between the IdP's clock and ours
+	samlClockSkew = 2 * time.Minute
+	// maxSAMLResponse bounds the posted response
+	maxSAMLResponse = 1 << 20
+)
+
+// samlProvider is the IdP configured through SAML_* and our side of it
+type samlProvider struct {
+	entityID string // ours
+	acsURL   string
+
+	idpEntityID string
+	ssoURL      string // HTTP-Redirect binding
+	certs       []*x509.Certificate
+
+	roleAttribute string
+	roleMap       map[string]Role
+	nameAttribute string // the name of the admin; the NameID when empty
+	name          string // shown on the login button
+
+	mu   sync.Mutex
+	used map[string]time.Time // IDs of accepted assertions, until they expire
+}
+
+// loadSAML reads the IdP from the env; nil without SAML_IDP_METADATA. Our
+// addresses must be fixed, so it needs PUBLIC_URL.
+func loadSAML(publicURL string, election *Election) (*samlProvider, error) {
+	metadataFile := os.Getenv("SAML_IDP_METADATA")
+	if metadataFile == "" {
+		return nil, nil
+	}
+	if publicURL == "" {
+		return nil, fmt.Errorf("SAML_IDP_METADATA needs PUBLIC_URL for the addresses registered at the IdP")
+	}
+	base := strings.TrimSuffix(publicURL, "/") + election.Base
+	p := &samlProvider{
+		entityID:      os.Getenv("SAML_SP_ENTITY_ID"),
+		acsURL:        base + "/admin/saml/acs",
+		roleAttribute: os.Getenv("SAML_ROLE_ATTRIBUTE"),
+		nameAttribute: os.Getenv("SAML_NAME_ATTRIBUTE"),
+		name:          os.Getenv("SAML_NAME"),
+		used:          map[string]time.Time{},
+	}
+	if p.entityID == "" {
+		p.entityID = base + "/admin/saml/metadata"
+	}
+	if p.name == "" {
+		p.name = "SAML"
+	}
+
+	data, err := os.ReadFile(metadataFile)
+	if err != nil {
+		return nil, fmt.Errorf("SAML_IDP_METADATA: %v", err)
+	}
+	if err := p.readIdPMetadata(data); err != nil {
+		return nil, fmt.Errorf("SAML_IDP_METADATA: %v", err)
+	}
+
+	if p.roleAttribute == "" {
+		return nil, fmt.Errorf("SAML_IDP_METADATA needs SAML_ROLE_ATTRIBUTE, the attribute carrying the groups")
+	}
+	if p.roleMap, err = parseRoleMap(os.Getenv("SAML_ROLES")); err != nil {
+		return nil, fmt.Errorf("invalid SAML_ROLES: %v", err)
+	}
+	if len(p.roleMap) == 0 {
+		return nil, fmt.Errorf("SAML_IDP_METADATA needs SAML_ROLES, e.g. panitia=superadmin,saksi=observer")
+	}
+	return p, nil
+}
+
+// readIdPMetadata takes the entity ID, the HTTP-Redirect sign-on address and
+// the signing certificates from the IdP's metadata
+func (p *samlProvider) readIdPMetadata(data []byte) error {
+	root, err := parseXML(data)
+	if err != nil {
+		return err
+	}
+	var idp *xmlNode
+	root.walk(func(n *xmlNode) {
+		if idp == nil && n.local == "EntityDescriptor" && n.ns() == samlMetadataNS && n.element(samlMetadataNS, "IDPSSODescriptor") != nil {
+			idp = n
+		}
+	})
+	if idp == nil {
+		return errors.New("no IDPSSODescriptor found")
+	}
+	p.idpEntityID = idp.attr("entityID")
+	sso := idp.element(samlMetadataNS, "IDPSSODescriptor")
+	for _, s := range sso.elements(samlMetadataNS, "SingleSignOnService") {
+		if s.attr("Binding") == samlBindingRedirect {
+			p.ssoURL = s.attr("Location")
+		}
+	}
+	for _, kd := range sso.elements(samlMetadataNS, "KeyDescriptor") {
+		if use := kd.attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		kd.walk(func(n *xmlNode) {
+			if n.local != "X509Certificate" || n.ns() != dsigNS {
+				return
+			}
+			der, err := decodeBase64Text(n.text())
+			if err != nil {
+				return
+			}
+			if cert, err := x509.ParseCertificate(der); err == nil {
+				p.certs = append(p.certs, cert)
+			}
+		})
+	}
+	switch {
+	case p.idpEntityID == "":
+		return errors.New("IdP without entityID")
+	case p.ssoURL == "":
+		return errors.New("IdP without an HTTP-Redirect SingleSignOnService")
+	case len(p.certs) == 0:
+		return errors.New("IdP without a signing certificate")
+	}
+	return nil
+}
+
+// metadata is our SP metadata for the IdP
+func (p *samlProvider) metadata() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="%s" entityID="%s">
+  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">
+    <md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>
+`, samlMetadataNS, xmlEscapeString(p.entityID), samlProtocolNS, samlBindingPOST, xmlEscapeString(p.acsURL))
+	return b.Bytes()
+}
+
+// authnRequest returns the address sending the browser to the IdP with a
+// new AuthnRequest id
+func (p *samlProvider) authnRequest(id string, now time.Time) (string, error) {
+	var req bytes.Buffer
+	fmt.Fprintf(&req, `<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s"><saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`,
+		samlProtocolNS, samlAssertionNS, id, now.UTC().Format(time.RFC3339),
+		xmlEscapeString(p.ssoURL), xmlEscapeString(p.acsURL), samlBindingPOST, xmlEscapeString(p.entityID))
+
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	fw.Write(req.Bytes())
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+	q := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(deflated.Bytes())}}
+	sep := "?"
+	if strings.Contains(p.ssoURL, "?") {
+		sep = "&"
+	}
+	return p.ssoURL + sep + q.Encode(), nil
+}
+
+func xmlEscapeString(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// samlTime reads an xs:dateTime attribute; zero when absent
+func samlTime(n *xmlNode, name string) (time.Time, error) {
+	v := n.attr(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad %s %q", name, v)
+	}
+	return t, nil
+}
+
+// samlAssertion is what a verified response says about the admin
+type samlAssertion struct {
+	Name   string
+	Groups []string
+}
+
+// readResponse verifies the posted SAMLResponse answering requestID
+func (p *samlProvider) readResponse(encoded, requestID string, now time.Time) (*samlAssertion, error) {
+	data, err := decodeBase64Text(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("bad SAMLResponse encoding: %v", err)
+	}
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if root.local != "Response" || root.ns() != samlProtocolNS {
+		return nil, errors.New("not a SAML response")
+	}
+	if dest := root.attr("Destination"); dest != "" && dest != p.acsURL {
+		return nil, fmt.Errorf("response for %q", dest)
+	}
+	if root.attr("InResponseTo") != requestID {
+		return nil, errors.New("response to another request")
+	}
+	if iss := root.element(samlAssertionNS, "Issuer"); iss != nil && iss.text() != p.idpEntityID {
+		return nil, fmt.Errorf("response from issuer %q", iss.text())
+	}
+	status := ""
+	if s := root.element(samlProtocolNS, "Status"); s != nil {
+		if code := s.element(samlProtocolNS, "StatusCode"); code != nil {
+			status = code.attr("Value")
+		}
+	}
+	if status != samlStatusSuccess {
+		return nil, fmt.Errorf("IdP status %q", status)
+	}
+	if len(root.elements(samlAssertionNS, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted assertions are not supported; turn assertion encryption off at the IdP")
+	}
+	assertions := root.elements(samlAssertionNS, "Assertion")
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("expected one assertion, found %d", len(assertions))
+	}
+	as := assertions[0]
+
+	// the assertion counts when it or the response around it is signed
+	responseSigned := len(root.elements(dsigNS, "Signature")) > 0
+	assertionSigned := len(as.elements(dsigNS, "Signature")) > 0
+	if !responseSigned && !assertionSigned {
+		return nil, errors.New("unsigned response")
+	}
+	if responseSigned {
+		if err := verifyEnveloped(root, root, p.certs); err != nil {
+			return nil, err
+		}
+	}
+	if assertionSigned {
+		if err := verifyEnveloped(root, as, p.certs); err != nil {
+			return nil, err
+		}
+	}
+
+	if iss := as.element(samlAssertionNS, "Issuer"); iss == nil || iss.text() != p.idpEntityID {
+		return nil, errors.New("assertion from another issuer")
+	}
+	subject := as.element(samlAssertionNS, "Subject")
+	if subject == nil {
+		return nil, errors.New("assertion without subject")
+	}
+	var expires time.Time
+	for _, sc := range subject.elements(samlAssertionNS, "SubjectConfirmation") {
+		data := sc.element(samlAssertionNS, "SubjectConfirmationData")
+		if sc.attr("Method") != samlBearer || data == nil {
+			continue
+		}
+		notOnOrAfter, err := samlTime(data, "NotOnOrAfter")
+		if err != nil {
+			return nil, err
+		}
+		if data.attr("Recipient") == p.acsURL && !notOnOrAfter.IsZero() && now.Before(notOnOrAfter.Add(samlClockSkew)) &&
+			(data.attr("InResponseTo") == "" || data.attr("InResponseTo") == requestID) {
+			expires = notOnOrAfter
+			break
+		}
+	}
+	if expires.IsZero() {
+		return nil, errors.New("no valid bearer subject confirmation")
+	}
+
+	conditions := as.element(samlAssertionNS, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("assertion without conditions")
+	}
+	notBefore, err := samlTime(conditions, "NotBefore")
+	if err != nil {
+		return nil, err
+	}
+	notOnOrAfter, err := samlTime(conditions, "NotOnOrAfter")
+	if err != nil {
+		return nil, err
+	}
+	if (!notBefore.IsZero() && now.Add(samlClockSkew).Before(notBefore)) ||
+		(!notOnOrAfter.IsZero() && !now.Before(notOnOrAfter.Add(samlClockSkew))) {
+		return nil, errors.New("assertion outside its validity window")
+	}
+	restrictions := conditions.elements(samlAssertionNS, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, errors.New("assertion without audience")
+	}
+	for _, ar := range restrictions {
+		ours := false
+		for _, aud := range ar.elements(samlAssertionNS, "Audience") {
+			ours = ours || aud.text() == p.entityID
+		}
+		if !ours {
+			return nil, errors.New("assertion for another audience")
+		}
+	}
+
+	result := &samlAssertion{}
+	if id := subject.element(samlAssertionNS, "NameID"); id != nil {
+		result.Name = id.text()
+	}
+	for _, st := range as.elements(samlAssertionNS, "AttributeStatement") {
+		for _, attr := range st.elements(samlAssertionNS, "Attribute") {
+			var values []string
+			for _, v := range attr.elements(samlAssertionNS, "AttributeValue") {
+				values = append(values, v.text())
+			}
+			name := attr.attr("Name")
+			if name == p.roleAttribute || attr.attr("FriendlyName") == p.roleAttribute {
+				result.Groups = append(result.Groups, values...)
+			}
+			if p.nameAttribute != "" && (name == p.nameAttribute || attr.attr("FriendlyName") == p.nameAttribute) && len(values) > 0 {
+				result.Name = values[0]
+			}
+		}
+	}
+	if result.Name == "" {
+		return nil, errors.New("assertion without a name for the admin")
+	}
+
+	// each assertion signs in once
+	id := as.attr("ID")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, until := range p.used {
+		if now.After(until.Add(samlClockSkew)) {
+			delete(p.used, k)
+		}
+	}
+	if _, ok := p.used[id]; ok {
+		return nil, errors.New("assertion already used")
+	}
+	p.used[id] = expires
+	return result, nil
+}
+
+// samlRequestState is what the request cookie remembers between sending
+// the admin to the IdP and the response
+type samlRequestState struct {
+	ID      string `json:"i"`
+	Next    string `json:"p"`
+	Expires int64  `json:"e"`
+}
+
+// samlMetadataHandler: GET /admin/saml/metadata serves our SP metadata
+func (a *App) samlMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if a.saml == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(a.saml.metadata())
+}
+
+// samlLoginHandler: GET /admin/saml/login sends the admin to the IdP
+func (a *App) samlLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.saml == nil {
+		http.NotFound(w, r)
+		return
+	}
+	st := samlRequestState{
+		ID:      "_" + randomToken(20), // an ID must not start with a digit
+		Next:    safeNext(r.URL.Query().Get("next")),
+		Expires: time.Now().Add(samlRequestTTL).Unix(),
+	}
+	dest, err := a.saml.authnRequest(st.ID, time.Now())
+	if err != nil {
+		logHTTP.Errorf("error building SAML request: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	raw, _ := json.Marshal(st)
+	// the IdP posts back from its own site, so the cookie must be SameSite=None
+	a.setCookie(w, r, samlRequestCookie, a.signCookie(samlRequestCookie, base64.RawURLEncoding.EncodeToString(raw)), int(samlRequestTTL.Seconds()), http.SameSiteNoneMode)
+	http.Redirect(w, r, dest, http.StatusFound)
+}
+
+// samlACSHandler: POST /admin/saml/acs takes the IdP's response, maps the
+// groups to a role and starts the session
+func (a *App) samlACSHandler(w http.ResponseWriter, r *http.Request) {
+	if a.saml == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	failed := LoginData{Next: "/admin", Error: "Login gagal, silakan coba lagi."}
+
+	var st samlRequestState
+	value, ok := a.openCookie(r, samlRequestCookie)
+	if ok {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		ok = err == nil && json.Unmarshal(raw, &st) == nil && time.Now().Unix() <= st.Expires
+	}
+	a.setCookie(w, r, samlRequestCookie, "", -1, http.SameSiteNoneMode)
+	if !ok {
+		a.recordLogin(r, "", LoginSAML, false, "state")
+		a.renderLogin(w, http.StatusBadRequest, failed)
+		return
+	}
+	failed.Next = st.Next
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSAMLResponse)
+	if err := r.ParseForm(); err != nil {
+		a.renderLogin(w, http.StatusBadRequest, failed)
+		return
+	}
+	assertion, err := a.saml.readResponse(r.PostFormValue("SAMLResponse"), st.ID, time.Now())
+	if err != nil {
+		logHTTP.Errorf("error verifying SAML response: %v", err)
+		a.recordLogin(r, "", LoginSAML, false, "assertion")
+		a.renderLogin(w, http.StatusUnauthorized, failed)
+		return
+	}
+	user := assertion.Name
+	role, ok := highestRole(assertion.Groups, a.saml.roleMap)
+	if !ok {
+		a.recordLogin(r, user, LoginSAML, false, "group")
+		a.audit(ctx, user, "account.saml_denied", user, map[string]any{"groups": assertion.Groups})
+		failed.Error = "Akun " + user + " tidak termasuk grup yang mendapat akses admin."
+		a.renderLogin(w, http.StatusForbidden, failed)
+		return
+	}
+
+	if _, err := a.startSession(w, r, &Account{Username: user, Role: role}, "saml"); err != nil {
+		logDB.Errorf("error starting session: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	a.recordLogin(r, user, LoginSAML, true, "")
+	a.audit(ctx, user, "account.saml_login", user, map[string]any{"role": role, "groups": assertion.Groups})
+	a.electionRedirect(w, r, st.Next, http.StatusSeeOther)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Background work runs as jobs of one scheduler instead of a goroutine and a
+// ticker each. A job has a schedule: `@every <duration>`, `@hourly`,
+// `@daily`, a cron line of minute, hour, day of month, month and day of week
+// (`0 3 * * *`, in the server's time zone), or a fixed time such as the
+// opening of voting. Most jobs are shared: they run on one instance at a
+// time per organization, and once per due time whatever the number of
+// instances, claimed through their row in scheduled_jobs. The claim is a
+// lease the running instance keeps renewing, so the job of an instance that
+// died is picked up again once it lapses. Jobs that refresh what an instance
+// keeps in memory (branding, allowlist, revoked codes) are local and run on
+// every instance.
+//
+// A run that fails is retried after jobRetry, without waiting for the next
+// due time. A job whose run returns errJobDone isn't scheduled again by this
+// instance.
+
+const (
+	jobLease = 5 * time.Minute  // a claim lapses this long after its last renewal
+	jobRetry = 30 * time.Second // wait before retrying a failed run
+	jobPoll  = time.Minute      // longest sleep before re-reading a shared job's last run
+)
+
+// errJobDone ends a job, e.g. the directory sync once the roll is committed
+var errJobDone = errors.New("job done")
+
+// jobSchedule is when a job is due
+type jobSchedule interface {
+	// next is the first due time after last, the last run; zero last means
+	// the job never ran. A zero time means never again.
+	next(last time.Time) time.Time
+}
+
+// everySchedule is due every interval, and at once when the job never ran
+type everySchedule time.Duration
+
+func (s everySchedule) next(last time.Time) time.Time {
+	if last.IsZero() {
+		return time.Now()
+	}
+	return last.Add(time.Duration(s))
+}
+
+// atSchedule is due once, at a time
+type atSchedule time.Time
+
+func (s atSchedule) next(last time.Time) time.Time {
+	if !last.IsZero() && !last.Before(time.Time(s)) {
+		return time.Time{}
+	}
+	return time.Time(s)
+}
+
+// untilSchedule is due every interval until a time, and once more at it
+type untilSchedule struct {
+	every time.Duration
+	until time.Time
+}
+
+func (s untilSchedule) next(last time.Time) time.Time {
+	switch {
+	case last.IsZero():
+		return time.Now()
+	case !last.Before(s.until):
+		return time.Time{}
+	}
+	return minTime(last.Add(s.every), s.until)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// cronSchedule is a cron line; each field holds the values it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	anyDOM, anyDOW                bool // * in the day fields, see matchDay
+}
+
+// next is the first matching minute after last, or from now if the job
+// never ran. A run missed while no instance was up is due at once.
+func (s *cronSchedule) next(last time.Time) time.Time {
+	if last.IsZero() {
+		last = time.Now()
+	}
+	t := last.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0) // e.g. 30 2 * never matches
+	for t.Before(limit) {
+		switch {
+		case !s.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchDay matches the day fields as cron does: when both are restricted a
+// day matching either will do
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.anyDOM && s.anyDOW:
+		return true
+	case s.anyDOM:
+		return dow
+	case s.anyDOW:
+		return dom
+	}
+	return dom || dow
+}
+
+// parseSchedule reads `@every <duration>`, `@hourly`, `@daily` or a cron
+// line
+func parseSchedule(spec string) (jobSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	}
+	if v, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("%q: @every takes a duration of a second or more, e.g. @every 6h", spec)
+		}
+		return everySchedule(d), nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: use @every <duration>, @hourly, @daily or minute hour day month weekday", spec)
+	}
+	s := &cronSchedule{anyDOM: fields[2] == "*", anyDOW: fields[4] == "*"}
+	for i, f := range []struct {
+		dst      *map[int]bool
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7}} {
+		values, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", spec, err)
+		}
+		*f.dst = values
+	}
+	if s.dow[7] {
+		s.dow[0] = true // Sunday either way
+	}
+	return s, nil
+}
+
+// parseCronField reads a comma separated list of *, n, n-m, each optionally
+// with a step: */15, 8-18/2
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// job is a piece of background work
+type job struct {
+	name     string // row of scheduled_jobs, e.g. retention
+	schedule jobSchedule
+	local    bool // runs on every instance, without a claim
+	run      func(ctx context.Context) error
+}
+
+// jobs are the background work of the server. auditSealInterval is
+// AUDIT_SEAL_INTERVAL.
+func (a *App) jobs(auditSealInterval time.Duration, retentionSchedule jobSchedule) []job {
+	jobs := []job{
+		// commit to the voter roll when voting opens, unless an admin did before
+		{name: "roll.commit", schedule: atSchedule(a.voteStart), run: a.commitRollJob},
+		// record the versions of the roll until it opens, and the roll as it opened
+		{name: "roll.version", schedule: untilSchedule{every: rollVersionInterval, until: a.voteStart}, run: a.rollVersionJob},
+		// freeze the tally as soon as voting closes
+		{name: "tally.snapshot", schedule: atSchedule(a.voteEnd), run: a.tallySnapshotJob},
+		// send queued webhook deliveries, retrying failures with backoff
+		{name: "webhook.deliver", schedule: everySchedule(webhookPollInterval), run: a.deliverWebhooks},
+		{name: "webhook.prune", schedule: everySchedule(time.Hour), run: a.pruneWebhookDeliveries},
+		// send queued emails and Slack messages, the same way
+		{name: "outbox.deliver", schedule: everySchedule(outboxPollInterval), run: a.deliverOutbox},
+		{name: "outbox.prune", schedule: everySchedule(time.Hour), run: a.pruneOutbox},
+		// seal new audit events into the signed hash chain
+		{name: "audit.seal", schedule: everySchedule(auditSealInterval), run: a.auditSealJob},
+		// notify the admins when the quorum is reached and voting is about to close
+		{name: "notifications", schedule: everySchedule(notificationInterval), run: a.notificationJob},
+		{name: "notifications.prune", schedule: everySchedule(24 * time.Hour), run: a.pruneNotifications},
+		// keep what this instance holds in memory in step with changes made
+		// through other instances, and the revoked codes should a
+		// notification be missed
+		{name: "branding.refresh", schedule: everySchedule(brandingRefresh), local: true, run: a.loadBranding},
+		{name: "allowlist.refresh", schedule: everySchedule(allowlistRefresh), local: true, run: a.loadAllowlist},
+		{name: "revoked.refresh", schedule: everySchedule(revokedRefresh), local: true, run: a.loadRevoked},
+	}
+	// scheduled cleanup of data past its retention period
+	if len(a.retention) > 0 {
+		jobs = append(jobs, job{name: "retention", schedule: retentionSchedule, run: a.retentionJob})
+	}
+	// keep the roll in step with the directory group until it is committed
+	if a.directory != nil {
+		jobs = append(jobs, job{name: "directory.sync", schedule: everySchedule(a.directory.interval), run: a.directorySyncJob})
+	}
+	return jobs
+}
+
+// runScheduler runs jobs on their schedules until ctx is done
+func (a *App) runScheduler(ctx context.Context, jobs []job) {
+	owner := jobOwner()
+	for _, j := range jobs {
+		go a.runJob(ctx, j, owner)
+	}
+}
+
+// jobOwner names this instance in the claims
+func jobOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// runJob runs one job on its schedule until ctx is done or the job is over
+func (a *App) runJob(ctx context.Context, j job, owner string) {
+	var last time.Time // the last run, from scheduled_jobs for shared jobs
+	var retryAt time.Time
+	for {
+		if !j.local {
+			var err error
+			if last, err = a.lastJobRun(ctx, j.name); err != nil {
+				logJobs.Errorf("error reading job %s: %v", j.name, err)
+				last, retryAt = time.Time{}, time.Now().Add(jobRetry)
+			}
+		}
+		due := j.schedule.next(last)
+		if due.IsZero() {
+			return
+		}
+		if retryAt.After(due) {
+			due = retryAt
+		}
+		if wait := time.Until(due); wait > 0 {
+			if !j.local && wait > jobPoll {
+				wait = jobPoll // another instance may have run it meanwhile
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			if !j.local && time.Now().Before(due) {
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := a.runJobOnce(ctx, j, owner, last)
+		retryAt = time.Time{}
+		switch {
+		case errors.Is(err, errJobDone):
+			return
+		case errors.Is(err, errJobClaimed):
+			// the other instance's run shows up as a new last run; until
+			// then, don't ask again right away
+			retryAt = time.Now().Add(jobRetry)
+		case err != nil:
+			logJobs.Errorf("error running job %s: %v", j.name, err)
+			retryAt = time.Now().Add(jobRetry)
+		case j.local:
+			last = time.Now()
+		}
+	}
+}
+
+// errJobClaimed means another instance ran or is running the job
+var errJobClaimed = errors.New("job claimed by another instance")
+
+// runJobOnce runs j, for a shared job under a claim on its row that is
+// renewed while it runs
+func (a *App) runJobOnce(ctx context.Context, j job, owner string, last time.Time) error {
+	if j.local {
+		return j.run(ctx)
+	}
+	claimed, err := a.claimJob(ctx, j.name, owner, last)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return errJobClaimed
+	}
+
+	renewCtx, stopRenew := context.WithCancel(ctx)
+	go a.renewJobClaim(renewCtx, j.name, owner)
+	runErr := j.run(ctx)
+	stopRenew()
+
+	if err := a.finishJob(context.WithoutCancel(ctx), j.name, owner, runErr); err != nil {
+		logJobs.Errorf("error recording run of job %s: %v", j.name, err)
+	}
+	return runErr
+}
+
+// lastJobRun reads when a shared job last ran; zero if never
+func (a *App) lastJobRun(ctx context.Context, name string) (time.Time, error) {
+	var last *time.Time
+	err := a.db.QueryRow(ctx, `
+		INSERT INTO scheduled_jobs (name) VALUES ($1)
+		ON CONFLICT (org_id, name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING last_run_at`, name).Scan(&last)
+	if err != nil || last == nil {
+		return time.Time{}, err
+	}
+	return *last, nil
+}
+
+// claimJob takes the lease on a shared job, provided nobody holds it and
+// nobody ran it since last
+func (a *App) claimJob(ctx context.Context, name, owner string, last time.Time) (bool, error) {
+	var lastRun *time.Time
+	if !last.IsZero() {
+		lastRun = &last
+	}
+	tag, err := a.db.Exec(ctx, `
+		UPDATE scheduled_jobs SET locked_by = $2, locked_until = NOW() + make_interval(secs => $3)
+		WHERE name = $1 AND (locked_until IS NULL OR locked_until < NOW())
+		AND last_run_at IS NOT DISTINCT FROM $4`, name, owner, jobLease.Seconds(), lastRun)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// renewJobClaim extends the lease on a running job until ctx is done
+func (a *App) renewJobClaim(ctx context.Context, name, owner string) {
+	ticker := time.NewTicker(jobLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		_, err := a.db.Exec(ctx, `
+			UPDATE scheduled_jobs SET locked_until = NOW() + make_interval(secs => $3)
+			WHERE name = $1 AND locked_by = $2`, name, owner, jobLease.Seconds())
+		if err != nil && ctx.Err() == nil {
+			logJobs.Errorf("error renewing claim on job %s: %v", name, err)
+		}
+	}
+}
+
+// finishJob releases the claim and records the run; a failed run keeps the
+// last successful run, so the job stays due
+func (a *App) finishJob(ctx context.Context, name, owner string, runErr error) error {
+	if runErr != nil && !errors.Is(runErr, errJobDone) {
+		_, err := a.db.Exec(ctx, `
+			UPDATE scheduled_jobs SET locked_by = NULL, locked_until = NULL, last_error = $3, last_error_at = NOW()
+			WHERE name = $1 AND locked_by = $2`, name, owner, runErr.Error())
+		return err
+	}
+	_, err := a.db.Exec(ctx, `
+		UPDATE scheduled_jobs SET locked_by = NULL, locked_until = NULL, last_run_at = NOW(), last_error = NULL
+		WHERE name = $1 AND locked_by = $2`, name, owner)
+	return err
+}
+
+func (a *App) commitRollJob(ctx context.Context) error {
+	created, err := a.commitRoll(ctx, "system")
+	if err == nil && created {
+		logJobs.Infof("voter roll committed at opening")
+	}
+	return err
+}
+
+func (a *App) rollVersionJob(ctx context.Context) error {
+	v, err := a.snapshotRoll(ctx, "system")
+	if err == nil && v != nil {
+		logJobs.Infof("voter roll version %d recorded (%d voters)", v.Number, v.Voters)
+	}
+	return err
+}
+
+func (a *App) tallySnapshotJob(ctx context.Context) error {
+	created, err := a.takeTallySnapshot(ctx)
+	if err == nil && created {
+		logTally.Infof("tally snapshot taken at close")
+	}
+	return err
+}
+
+func (a *App) auditSealJob(ctx context.Context) error {
+	_, err := a.sealAudit(ctx)
+	return err
+}
+
+func (a *App) directorySyncJob(ctx context.Context) error {
+	report, err := a.syncDirectory(ctx)
+	switch {
+	case errors.Is(err, errRollFrozen):
+		logJobs.Infof("directory sync stopped: the roll is committed")
+		return errJobDone
+	case err != nil:
+		return err
+	case report != nil && report.Created+report.Updated+report.Removed+report.Failed > 0:
+		a.audit(ctx, "system", "voter.sync", report.Source, report)
+	}
+	return nil
+}
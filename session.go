@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Browsers opening an admin page without credentials are sent to
+// /admin/login, where admins sign in with a username and password (checked
+// like basic auth) or through the organization's identity provider (OIDC in
+// oidc.go, SAML in saml.go). A sign-in starts a session stored in
+// admin_sessions: the cookie holds a random token, the table its SHA-256. A
+// session ends after ADMIN_SESSION_IDLE without requests, ADMIN_SESSION_MAX
+// after the sign-in, at logout, or when revoked from the profile page
+// (admin_profile.go). Sessions of admin_accounts follow the account: they get
+// its current role and end when it is disabled. Other clients keep using
+// basic auth, which has no session.
+
+const (
+	adminSessionCookie = "admin_session"
+
+	defaultSessionIdle = time.Hour
+	defaultSessionMax  = 8 * time.Hour
+	maxSessionMax      = 30 * 24 * time.Hour
+
+	// sessionTouchInterval is how stale last_seen_at may get before a request
+	// updates it, so not every admin request writes
+	sessionTouchInterval = time.Minute
+)
+
+// sessionLimits are the idle and absolute lifetimes of admin sessions
+type sessionLimits struct {
+	idle time.Duration
+	max  time.Duration
+}
+
+// loadSessionLimits reads ADMIN_SESSION_IDLE and ADMIN_SESSION_MAX
+func loadSessionLimits() (sessionLimits, error) {
+	l := sessionLimits{idle: defaultSessionIdle, max: defaultSessionMax}
+	for _, v := range []struct {
+		env string
+		d   *time.Duration
+	}{{"ADMIN_SESSION_IDLE", &l.idle}, {"ADMIN_SESSION_MAX", &l.max}} {
+		s := os.Getenv(v.env)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < time.Minute || d > maxSessionMax {
+			return l, fmt.Errorf("invalid %s %q: a duration between 1m and %s", v.env, s, maxSessionMax)
+		}
+		*v.d = d
+	}
+	if l.idle > l.max {
+		l.idle = l.max
+	}
+	return l, nil
+}
+
+// loadSessionKey returns the key signing the cookies of a sign-in through
+// a provider; without SESSION_KEY such a sign-in has to finish on the
+// instance it started on, within the same server run
+func loadSessionKey() []byte {
+	if key := os.Getenv("SESSION_KEY"); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	log.Println("SESSION_KEY not set: sign-ins through OIDC or SAML only finish on the instance they started on")
+	return key
+}
+
+// signCookie signs value for cookie name, tying it to the organization
+func (a *App) signCookie(name, value string) string {
+	mac := hmac.New(sha256.New, a.sessionKey)
+	fmt.Fprintf(mac, "%s|%s|%s", name, a.org, value)
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// openCookie returns the value of the signed cookie name, if it is valid
+func (a *App) openCookie(r *http.Request, name string) (string, bool) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	i := strings.LastIndexByte(c.Value, '.')
+	if i < 0 {
+		return "", false
+	}
+	value := c.Value[:i]
+	if !hmac.Equal([]byte(c.Value), []byte(a.signCookie(name, value))) {
+		return "", false
+	}
+	return value, true
+}
+
+// setCookie sets (or with maxAge < 0 clears) a cookie of the election's
+// pages. Lax keeps it off cross-site form posts but on a provider's redirect
+// back; a cookie that has to come along with a provider's form post (SAML)
+// needs None, which browsers only take on secure cookies.
+func (a *App) setCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int, sameSite http.SameSite) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     a.electionOf(r).Path("/"),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   sameSite == http.SameSiteNoneMode || strings.HasPrefix(a.baseURL(r), "https://"),
+		SameSite: sameSite,
+	})
+}
+
+// sessionTokenHash is what admin_sessions keeps of a session cookie
+func sessionTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionAccount returns the account of the admin session cookie, if the
+// session is still open
+func (a *App) sessionAccount(r *http.Request) (*Account, bool) {
+	c, err := r.Cookie(adminSessionCookie)
+	if err != nil || c.Value == "" {
+		return nil, false
+	}
+	ctx := r.Context()
+	var acc Account
+	var accountID *int
+	var lastSeen time.Time
+	err = a.db.QueryRow(ctx, `
+		SELECT s.id, s.account_id, s.username, COALESCE(acc.role, s.role), s.last_seen_at
+		FROM admin_sessions s LEFT JOIN admin_accounts acc ON acc.id = s.account_id
+		WHERE s.token_hash = $1 AND s.revoked_at IS NULL AND s.expires_at > NOW()
+			AND s.last_seen_at > NOW() - make_interval(secs => $2)
+			AND (s.account_id IS NULL OR acc.disabled = FALSE)`,
+		sessionTokenHash(c.Value), a.sessions.idle.Seconds()).
+		Scan(&acc.Session, &accountID, &acc.Username, &acc.Role, &lastSeen)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			logDB.Errorf("error getting session: %v", err)
+		}
+		return nil, false
+	}
+	if !validRole(acc.Role) {
+		return nil, false
+	}
+	if accountID != nil {
+		acc.ID = *accountID
+	}
+	if time.Since(lastSeen) > sessionTouchInterval {
+		if _, err := a.db.Exec(ctx, `UPDATE admin_sessions SET last_seen_at = NOW() WHERE id = $1`, acc.Session); err != nil {
+			logDB.Errorf("error updating session: %v", err)
+		}
+	}
+	return &acc, true
+}
+
+// startSession signs acc in and returns the session id; method is how:
+// password, oidc, saml or remember (remember.go)
+func (a *App) startSession(w http.ResponseWriter, r *http.Request, acc *Account, method string) (int, error) {
+	ctx := r.Context()
+	token := randomToken(32)
+	var accountID *int
+	if acc.ID != 0 {
+		accountID = &acc.ID
+	}
+	var ip string
+	if addr := clientIP(r); addr != nil {
+		ip = addr.String()
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > 300 {
+		userAgent = userAgent[:300]
+	}
+	var id int
+	err := a.db.QueryRow(ctx, `
+		INSERT INTO admin_sessions (token_hash, account_id, username, role, method, ip, user_agent, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW() + make_interval(secs => $8))
+		RETURNING id`,
+		sessionTokenHash(token), accountID, acc.Username, acc.Role, method, ip, userAgent, a.sessions.max.Seconds()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	a.setCookie(w, r, adminSessionCookie, token, int(a.sessions.max.Seconds()), http.SameSiteLaxMode)
+
+	// sessions unused this long ended one way or another
+	if _, err := a.db.Exec(ctx, `DELETE FROM admin_sessions WHERE last_seen_at < NOW() - make_interval(secs => $1)`, maxSessionMax.Seconds()); err != nil {
+		logDB.Errorf("error pruning sessions: %v", err)
+	}
+	return id, nil
+}
+
+// endSessions revokes the open sessions of username but except, returning
+// how many there were
+func (a *App) endSessions(ctx context.Context, username string, except int) (int64, error) {
+	tag, err := a.db.Exec(ctx, `
+		UPDATE admin_sessions SET revoked_at = NOW()
+		WHERE username = $1 AND id <> $2 AND revoked_at IS NULL AND expires_at > NOW()`, username, except)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// safeNext returns next if it is a path of this site to go back to after
+// signing in, /admin otherwise
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n") {
+		return "/admin"
+	}
+	return next
+}
+
+// randomToken returns n random bytes, base64url encoded
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// LoginData is the data of login.html
+type LoginData struct {
+	OIDC     string // name of the OIDC provider, if on
+	SAML     string // name of the SAML provider, if on
+	Next     string
+	Username string
+	Remember bool // offer to remember the browser (remember.go)
+	Error    string
+}
+
+func (a *App) renderLogin(w http.ResponseWriter, status int, data LoginData) {
+	if a.oidc != nil {
+		data.OIDC = a.oidc.name
+	}
+	if a.saml != nil {
+		data.SAML = a.saml.name
+	}
+	data.Remember = a.remember > 0
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := a.tmpl.ExecuteTemplate(w, "login.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+	}
+}
+
+// loginHandler: GET /admin/login offers the password form and the
+// providers; POST signs in with a username and password
+func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	next := safeNext(r.FormValue("next"))
+	switch r.Method {
+	case http.MethodGet:
+		a.renderLogin(w, http.StatusOK, LoginData{Next: next})
+	case http.MethodPost:
+		user := strings.TrimSpace(r.PostFormValue("username"))
+		acc, ok := a.checkPassword(ctx, user, r.PostFormValue("password"))
+		if !ok {
+			a.recordLogin(r, user, LoginPassword, false, "password")
+			a.renderLogin(w, http.StatusUnauthorized, LoginData{Next: next, Username: user, Error: "Username atau password salah."})
+			return
+		}
+		if _, err := a.startSession(w, r, acc, "password"); err != nil {
+			logDB.Errorf("error starting session: %v", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if r.PostFormValue("remember") != "" && a.remember > 0 && acc.ID != 0 {
+			if err := a.rememberDevice(w, r, acc.ID); err != nil {
+				logDB.Errorf("error remembering device: %v", err)
+			}
+		}
+		a.recordLogin(r, acc.Username, LoginPassword, true, "")
+		a.audit(ctx, acc.Username, "account.login", acc.Username, map[string]any{"role": acc.Role})
+		a.electionRedirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// logoutHandler: GET /admin/logout ends the session of this browser and
+// forgets it; basic auth has nothing to end
+func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	a.endBrowserSession(w, r)
+	a.electionRedirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// endBrowserSession ends the admin session of this browser and forgets the
+// browser
+func (a *App) endBrowserSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	a.forgetDevice(w, r)
+	if c, err := r.Cookie(adminSessionCookie); err == nil && c.Value != "" {
+		var user string
+		err := a.db.QueryRow(ctx, `
+			UPDATE admin_sessions SET revoked_at = NOW()
+			WHERE token_hash = $1 AND revoked_at IS NULL
+			RETURNING username`, sessionTokenHash(c.Value)).Scan(&user)
+		switch {
+		case err == nil:
+			a.audit(ctx, user, "account.logout", user, nil)
+		case !errors.Is(err, pgx.ErrNoRows):
+			logDB.Errorf("error ending session: %v", err)
+		}
+	}
+	a.setCookie(w, r, adminSessionCookie, "", -1, http.SameSiteLaxMode)
+}
+
+// wantsLoginPage reports whether an unauthenticated r is a browser opening a
+// page, which goes to the login page instead of the basic auth challenge
+func (a *App) wantsLoginPage(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
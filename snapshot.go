@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+
+	"pemilihan.gkjp.id/verify"
+)
+
+// TallySnapshot is the tally frozen the moment voting closed, as published
+// in the bulletin board. Rows are write-once; the database rejects updates
+// and deletes.
+type TallySnapshot = verify.Snapshot
+
+// tallySnapshotOf counts the current ballots and hashes the ballot set. The
+// hash covers every online ballot (code and choice) and every offline ballot
+// (id and choice) in a fixed order, so any later edit shows up as a mismatch.
+// A follow-up answer is hashed with its choice.
+func tallySnapshotOf(ctx context.Context, tx pgx.Tx) (TallySnapshot, error) {
+	var s TallySnapshot
+	err := tx.QueryRow(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM voters),
+			(SELECT COUNT(*) FROM voters WHERE used = true),
+			(SELECT COUNT(*) FROM voters WHERE registered_late_at IS NOT NULL)
+	`).Scan(&s.TotalVoters, &s.VotedCount, &s.LateRegistered)
+	if err != nil {
+		return s, err
+	}
+	ref, err := countReferendum(ctx, tx)
+	if err != nil {
+		return s, err
+	}
+	s.SetujuCount, s.TidakSetujuCount = ref.Online.Setuju, ref.Online.TidakSetuju
+	s.OfflineSetuju, s.OfflineTidakSetuju, s.OfflineTidakSah = ref.Offline.Setuju, ref.Offline.TidakSetuju, ref.Offline.TidakSah
+	s.KosongCount, s.OfflineKosong, s.RusakCount = ref.Online.Kosong, ref.Offline.Kosong, ref.Online.Rusak
+
+	rows, err := tx.Query(ctx, `
+		SELECT 'online', code, COALESCE(vote_choice, '') || COALESCE('|' || follow_up, '') FROM voters WHERE used = true
+		UNION ALL
+		SELECT 'offline', id::text, vote_choice || COALESCE('|' || follow_up, '') FROM offline_voters
+		ORDER BY 1, 2`)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	h := sha256.New()
+	for rows.Next() {
+		var channel, key, choice string
+		if err := rows.Scan(&channel, &key, &choice); err != nil {
+			return s, err
+		}
+		fmt.Fprintf(h, "%s|%s|%s\n", channel, key, choice)
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+	s.BallotHash = hex.EncodeToString(h.Sum(nil))
+
+	leaves, err := merkleLeaves(ctx, tx)
+	if err != nil {
+		return s, err
+	}
+	s.MerkleRoot = merkleRoot(merkleLevels(leaves))
+	return s, nil
+}
+
+// currentTally computes the live tally in a consistent read
+func (a *App) currentTally(ctx context.Context) (TallySnapshot, error) {
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return TallySnapshot{}, err
+	}
+	defer tx.Rollback(ctx)
+	return tallySnapshotOf(ctx, tx)
+}
+
+// takeTallySnapshot stores the snapshot for the current election unless one
+// already exists. It reports whether this call created it.
+func (a *App) takeTallySnapshot(ctx context.Context) (bool, error) {
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// sealed ballots aren't counted yet; the snapshot is taken once the
+	// trustees open them
+	var sealed bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM voters WHERE sealed_choice IS NOT NULL)`).Scan(&sealed); err != nil {
+		return false, err
+	}
+	if sealed {
+		logTally.Infof("tally snapshot waits for the trustees to open the sealed ballots")
+		return false, nil
+	}
+
+	s, err := tallySnapshotOf(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	s.Method = a.ballot.Method
+	if a.ballot.Ranked() {
+		s.TieBreak = a.ballot.TieBreak.String()
+	}
+	questions, err := a.questionResults(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	s.Outcome = a.ballot.certifiedOutcome(questions)
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO tally_snapshots (vote_end, total_voters, voted_count, setuju_count, tidak_setuju_count,
+			offline_setuju, offline_tidak_setuju, offline_tidak_sah, ballot_hash, method, tie_break, outcome,
+			kosong_count, offline_kosong, rusak_count, merkle_root, late_registered)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), NULLIF($12, ''), $13, $14, $15, $16, $17
+		WHERE NOT EXISTS (SELECT 1 FROM elections WHERE vote_end = $1) -- roll already archived and cleared
+		ON CONFLICT (org_id, vote_end) DO NOTHING`,
+		a.voteEnd, s.TotalVoters, s.VotedCount, s.SetujuCount, s.TidakSetujuCount,
+		s.OfflineSetuju, s.OfflineTidakSetuju, s.OfflineTidakSah, s.BallotHash, s.Method, s.TieBreak, s.Outcome,
+		s.KosongCount, s.OfflineKosong, s.RusakCount, s.MerkleRoot, s.LateRegistered)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 1 {
+		a.audit(ctx, "system", "tally.snapshot", "", map[string]string{"ballot_hash": s.BallotHash, "merkle_root": s.MerkleRoot})
+		return true, nil
+	}
+	return false, nil
+}
+
+// loadTallySnapshot returns the snapshot of the current election, or nil
+// while none has been taken
+func (a *App) loadTallySnapshot(ctx context.Context) (*TallySnapshot, error) {
+	return scanTallySnapshot(a.db.QueryRow(ctx, tallySnapshotQuery, a.voteEnd))
+}
+
+const tallySnapshotQuery = `
+	SELECT taken_at, vote_end, total_voters, voted_count, setuju_count, tidak_setuju_count,
+		offline_setuju, offline_tidak_setuju, offline_tidak_sah, ballot_hash,
+		COALESCE(method, ''), COALESCE(tie_break, ''), COALESCE(outcome, ''),
+		kosong_count, offline_kosong, rusak_count, COALESCE(merkle_root, ''), late_registered
+	FROM tally_snapshots WHERE vote_end = $1`
+
+// scanTallySnapshot reads the row of tallySnapshotQuery
+func scanTallySnapshot(row pgx.Row) (*TallySnapshot, error) {
+	var s TallySnapshot
+	err := row.Scan(
+		&s.TakenAt, &s.VoteEnd, &s.TotalVoters, &s.VotedCount, &s.SetujuCount, &s.TidakSetujuCount,
+		&s.OfflineSetuju, &s.OfflineTidakSetuju, &s.OfflineTidakSah, &s.BallotHash,
+		&s.Method, &s.TieBreak, &s.Outcome,
+		&s.KosongCount, &s.OfflineKosong, &s.RusakCount, &s.MerkleRoot, &s.LateRegistered)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
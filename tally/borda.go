@@ -0,0 +1,96 @@
+package tally
+
+import "sort"
+
+// BordaResult is a Borda count of ranked ballots
+type BordaResult struct {
+	Candidates []string
+	Valid      int
+	Uncounted
+	SharesCast int   // shares behind the cast ballots
+	Points     []int // per candidate
+	Winner     int   // after the tie-break; -1 when a runoff is needed
+	Runoff     []int
+	TieBreak   string
+	TieNote    string
+}
+
+// Borda is a single-winner Borda count
+type Borda struct {
+	Candidates []string // in order of nomination
+	TieBreak   TieBreak
+}
+
+// Tally scores the ranked ballots; the result is a *BordaResult. With n
+// candidates a first preference is worth n-1 points, a second n-2 and so
+// on; unranked candidates get none.
+func (m Borda) Tally(ballots []Ballot) Result {
+	candidates, tb := m.Candidates, m.TieBreak
+	n := len(candidates)
+	res := &BordaResult{Candidates: candidates, Points: make([]int, n)}
+	var valid []rankedBallot
+	valid, res.Uncounted = parseRanked(ballots, n)
+	res.SharesCast = castShares(ballots)
+	for _, b := range valid {
+		res.Valid += b.count
+		for i, c := range b.prefs {
+			res.Points[c] += (n - 1 - i) * b.count
+		}
+	}
+	res.TieBreak = tb.String()
+	res.Winner, res.Runoff, res.TieNote = tb.decide(candidates, res.mostPoints())
+	return res
+}
+
+// BordaScore is a candidate's line in the Borda report
+type BordaScore struct {
+	Place     int    `json:"place"` // 1 = winner; equal points share a place
+	Candidate string `json:"candidate"`
+	Points    int    `json:"points"`
+}
+
+// Ranking is the candidates by points, highest first
+func (r BordaResult) Ranking() []BordaScore {
+	scores := make([]BordaScore, len(r.Candidates))
+	for c, name := range r.Candidates {
+		scores[c] = BordaScore{Candidate: name, Points: r.Points[c]}
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Points > scores[j].Points })
+	for i := range scores {
+		if i > 0 && scores[i].Points == scores[i-1].Points {
+			scores[i].Place = scores[i-1].Place
+		} else {
+			scores[i].Place = i + 1
+		}
+	}
+	return scores
+}
+
+// mostPoints are the candidates with the most points; more than one means
+// a tie
+func (r BordaResult) mostPoints() []int {
+	var w []int
+	best := -1
+	for c, p := range r.Points {
+		switch {
+		case p > best:
+			w, best = []int{c}, p
+		case p == best:
+			w = append(w, c)
+		}
+	}
+	return w
+}
+
+// Winners is the winner after the tie-break, if any
+func (r BordaResult) Winners() []string {
+	if r.Winner < 0 {
+		return nil
+	}
+	return []string{r.Candidates[r.Winner]}
+}
+
+// Outcome names the winner and how any tie was settled
+func (r BordaResult) Outcome() string {
+	return singleOutcome(r.Candidates, r.Winner, r.Runoff, r.TieNote)
+}
@@ -0,0 +1,72 @@
+package tally
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBorda(t *testing.T) {
+	candidates := []string{"A", "B", "C"}
+	// A and B tie on 4 points: 2×2 + 0 and 2×1 + 2
+	tied := []Ballot{
+		{Channel: "online", Choice: "1>2", Count: 2},
+		{Channel: "online", Choice: "2>3>1", Count: 1},
+		{Channel: "online", Choice: BlankChoice, Count: 1},
+		{Channel: "offline", Choice: "1>1", Count: 1},
+		{Channel: "online", Choice: SpoiledChoice, Count: 1},
+	}
+	for _, c := range []struct {
+		name     string
+		ballots  []Ballot
+		tieBreak string
+		points   []int
+		winners  []string
+		runoff   []int
+	}{
+		{
+			name:    "clear winner",
+			ballots: []Ballot{{Channel: "online", Choice: "3>1>2", Count: 3}, {Channel: "online", Choice: "1>3>2", Count: 2}},
+			points:  []int{3 + 4, 0, 6 + 2},
+			winners: []string{"C"},
+		},
+		{name: "tie by nomination", ballots: tied, points: []int{4, 4, 1}, winners: []string{"A"}},
+		{name: "tie to a runoff", ballots: tied, tieBreak: "runoff", points: []int{4, 4, 1}, runoff: []int{0, 1}},
+		{
+			name: "tie by draw", ballots: tied, tieBreak: "random:rapat-panitia", points: []int{4, 4, 1},
+			winners: []string{drawWinner("rapat-panitia", "A", "B")},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tb, err := ParseTieBreak(c.tieBreak)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := Borda{Candidates: candidates, TieBreak: tb}.Tally(c.ballots).(*BordaResult)
+			if !reflect.DeepEqual(res.Points, c.points) {
+				t.Errorf("points = %v, want %v", res.Points, c.points)
+			}
+			if got := res.Winners(); !reflect.DeepEqual(got, c.winners) {
+				t.Errorf("winners = %v, want %v", got, c.winners)
+			}
+			if !reflect.DeepEqual(res.Runoff, c.runoff) {
+				t.Errorf("runoff = %v, want %v", res.Runoff, c.runoff)
+			}
+		})
+	}
+}
+
+func TestBordaUncounted(t *testing.T) {
+	res := Borda{Candidates: []string{"A", "B"}}.Tally([]Ballot{
+		{Channel: "online", Choice: "1>2", Count: 2},
+		{Channel: "online", Choice: BlankChoice, Count: 1},
+		{Channel: "offline", Choice: "1>1", Count: 1},
+		{Channel: "offline", Choice: "3", Count: 1},
+		{Channel: "online", Choice: SpoiledChoice, Count: 1},
+	}).(*BordaResult)
+	if res.Valid != 2 {
+		t.Errorf("valid = %d, want 2", res.Valid)
+	}
+	if want := (Uncounted{Blank: 1, Invalid: 2, Spoiled: 1}); res.Uncounted != want {
+		t.Errorf("uncounted = %+v, want %+v", res.Uncounted, want)
+	}
+}
@@ -0,0 +1,87 @@
+package tally
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FollowUp counts a question asked only of voters whose main answer was
+// When, e.g. the implementation date of an approved merger
+type FollowUp struct {
+	When    string
+	Options []string
+}
+
+// OptionCount is the number of answers for one option
+type OptionCount struct {
+	Option string
+	Count  int
+}
+
+// FollowUpResult is the count of a follow-up question
+type FollowUpResult struct {
+	When           string
+	Asked          int // ballots whose main answer was When
+	Options        []OptionCount
+	AskedShares    int // shares behind the asked ballots
+	AnsweredShares int // shares behind the answered ones
+}
+
+// Tally counts the follow-up answers of ballots whose main answer was When.
+// The result is a *FollowUpResult.
+func (m FollowUp) Tally(ballots []Ballot) Result {
+	res := &FollowUpResult{When: m.When, Options: make([]OptionCount, len(m.Options))}
+	index := map[string]int{}
+	for i, o := range m.Options {
+		res.Options[i].Option = o
+		index[o] = i
+	}
+	for _, b := range ballots {
+		if b.Choice != m.When {
+			continue
+		}
+		res.Asked += b.Count
+		res.AskedShares += b.Shares
+		if i, ok := index[b.FollowUp]; ok {
+			res.Options[i].Count += b.Count
+			res.AnsweredShares += b.Shares
+		}
+	}
+	return res
+}
+
+// Unanswered are ballots that were asked but carry no valid answer, e.g.
+// paper ballots with the follow-up left blank
+func (r *FollowUpResult) Unanswered() int {
+	n := r.Asked
+	for _, o := range r.Options {
+		n -= o.Count
+	}
+	return n
+}
+
+// Winners is the option with the most answers; none on a tie
+func (r *FollowUpResult) Winners() []string {
+	best, tied := -1, false
+	for i, o := range r.Options {
+		switch {
+		case best < 0 || o.Count > r.Options[best].Count:
+			best, tied = i, false
+		case o.Count == r.Options[best].Count:
+			tied = true
+		}
+	}
+	if best < 0 || tied || r.Options[best].Count == 0 {
+		return nil
+	}
+	return []string{r.Options[best].Option}
+}
+
+// Outcome lists the answers per option
+func (r *FollowUpResult) Outcome() string {
+	parts := make([]string, len(r.Options))
+	for i, o := range r.Options {
+		parts[i] = fmt.Sprintf("%s %d", o.Option, o.Count)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,82 @@
+package tally
+
+import "fmt"
+
+// Referendum choices
+const (
+	ChoiceSetuju      = "setuju"
+	ChoiceTidakSetuju = "tidak_setuju"
+)
+
+// Referendum counts a setuju / tidak setuju question
+type Referendum struct{}
+
+// ReferendumCount is the count of one channel
+type ReferendumCount struct {
+	Setuju      int
+	TidakSetuju int
+	TidakSah    int // offline only
+	Kosong      int // blank
+	Rusak       int // spoiled submissions, online only
+}
+
+// ReferendumResult is a referendum count per channel
+type ReferendumResult struct {
+	Online     ReferendumCount
+	Offline    ReferendumCount
+	SharesCast int // shares behind the cast ballots
+}
+
+// Tally counts the ballots per channel; other choices are ignored
+func (Referendum) Tally(ballots []Ballot) Result {
+	res := &ReferendumResult{SharesCast: castShares(ballots)}
+	for _, b := range ballots {
+		c := &res.Online
+		if b.Channel == "offline" {
+			c = &res.Offline
+		}
+		switch b.Choice {
+		case ChoiceSetuju:
+			c.Setuju += b.Count
+		case ChoiceTidakSetuju:
+			c.TidakSetuju += b.Count
+		case InvalidChoice:
+			c.TidakSah += b.Count
+		case BlankChoice:
+			c.Kosong += b.Count
+		case SpoiledChoice:
+			c.Rusak += b.Count
+		}
+	}
+	return res
+}
+
+// Total adds up both channels
+func (r *ReferendumResult) Total() ReferendumCount {
+	return ReferendumCount{
+		Setuju:      r.Online.Setuju + r.Offline.Setuju,
+		TidakSetuju: r.Online.TidakSetuju + r.Offline.TidakSetuju,
+		TidakSah:    r.Online.TidakSah + r.Offline.TidakSah,
+		Kosong:      r.Online.Kosong + r.Offline.Kosong,
+		Rusak:       r.Online.Rusak + r.Offline.Rusak,
+	}
+}
+
+// Winners is the choice with the most votes; none on a tie
+func (r *ReferendumResult) Winners() []string {
+	t := r.Total()
+	switch {
+	case t.Setuju > t.TidakSetuju:
+		return []string{ChoiceSetuju}
+	case t.TidakSetuju > t.Setuju:
+		return []string{ChoiceTidakSetuju}
+	}
+	return nil
+}
+
+// Outcome states the totals
+func (r *ReferendumResult) Outcome() string {
+	t := r.Total()
+	return fmt.Sprintf("Setuju %d, tidak setuju %d, kosong %d, tidak sah %d, rusak %d",
+		t.Setuju, t.TidakSetuju, t.Kosong, t.TidakSah, t.Rusak)
+}
@@ -0,0 +1,60 @@
+package tally
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReferendumCounts(t *testing.T) {
+	ballots := []Ballot{
+		{Channel: "online", Choice: ChoiceSetuju, Count: 3, Shares: 3},
+		{Channel: "online", Choice: ChoiceTidakSetuju, Count: 2, Shares: 5},
+		{Channel: "online", Choice: BlankChoice, Count: 1, Shares: 1},
+		{Channel: "online", Choice: SpoiledChoice, Count: 2, Shares: 2},
+		{Channel: "offline", Choice: ChoiceSetuju, Count: 1, Shares: 1},
+		{Channel: "offline", Choice: InvalidChoice, Count: 1, Shares: 1},
+		{Channel: "offline", Choice: "1>2", Count: 4, Shares: 4}, // not a referendum choice
+	}
+	res := Referendum{}.Tally(ballots).(*ReferendumResult)
+
+	if want := (ReferendumCount{Setuju: 3, TidakSetuju: 2, Kosong: 1, Rusak: 2}); res.Online != want {
+		t.Errorf("online = %+v, want %+v", res.Online, want)
+	}
+	if want := (ReferendumCount{Setuju: 1, TidakSah: 1}); res.Offline != want {
+		t.Errorf("offline = %+v, want %+v", res.Offline, want)
+	}
+	// spoiled submissions weren't cast
+	if res.SharesCast != 15 {
+		t.Errorf("shares cast = %d, want 15", res.SharesCast)
+	}
+	if got, want := res.Outcome(), "Setuju 4, tidak setuju 2, kosong 1, tidak sah 1, rusak 2"; got != want {
+		t.Errorf("outcome = %q, want %q", got, want)
+	}
+}
+
+func TestReferendumWinners(t *testing.T) {
+	for _, c := range []struct {
+		name                string
+		setuju, tidakSetuju int
+		offlineTidakSetuju  int
+		want                []string
+	}{
+		{"setuju", 5, 3, 0, []string{ChoiceSetuju}},
+		{"tidak setuju", 2, 3, 0, []string{ChoiceTidakSetuju}},
+		{"tie", 4, 4, 0, nil},
+		{"tie across channels", 4, 3, 1, nil},
+		{"offline decides", 4, 3, 2, []string{ChoiceTidakSetuju}},
+		{"no ballots", 0, 0, 0, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			res := Referendum{}.Tally([]Ballot{
+				{Channel: "online", Choice: ChoiceSetuju, Count: c.setuju},
+				{Channel: "online", Choice: ChoiceTidakSetuju, Count: c.tidakSetuju},
+				{Channel: "offline", Choice: ChoiceTidakSetuju, Count: c.offlineTidakSetuju},
+			})
+			if got := res.Winners(); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("winners = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package tally
+
+import "sort"
+
+// SchulzeResult is a Condorcet count resolved with the Schulze method
+type SchulzeResult struct {
+	Candidates []string
+	Valid      int
+	Uncounted
+	SharesCast int     // shares behind the cast ballots
+	Pairwise   [][]int // Pairwise[i][j]: voters preferring i over j
+	Strongest  [][]int // Strongest[i][j]: strength of the strongest path from i to j
+	Places     []int   // per candidate, 1 = winner; candidates may share a place
+	Winner     int     // after the tie-break; -1 when a runoff is needed
+	Runoff     []int
+	TieBreak   string
+	TieNote    string
+}
+
+// Schulze is a single-winner Condorcet count resolved with the Schulze
+// method
+type Schulze struct {
+	Candidates []string // in order of nomination
+	TieBreak   TieBreak
+}
+
+// Tally builds the pairwise matrix from the ranked ballots and resolves it;
+// the result is a *SchulzeResult. A ballot prefers every ranked candidate
+// over every unranked one and says nothing between unranked candidates.
+func (m Schulze) Tally(ballots []Ballot) Result {
+	candidates, tb := m.Candidates, m.TieBreak
+	n := len(candidates)
+	res := &SchulzeResult{Candidates: candidates, Pairwise: newMatrix(n), Strongest: newMatrix(n)}
+	var valid []rankedBallot
+	valid, res.Uncounted = parseRanked(ballots, n)
+	res.SharesCast = castShares(ballots)
+	for _, b := range valid {
+		res.Valid += b.count
+		ranked := make([]bool, n)
+		for i, c := range b.prefs {
+			ranked[c] = true
+			for _, below := range b.prefs[i+1:] {
+				res.Pairwise[c][below] += b.count
+			}
+		}
+		for _, c := range b.prefs {
+			for other := 0; other < n; other++ {
+				if !ranked[other] {
+					res.Pairwise[c][other] += b.count
+				}
+			}
+		}
+	}
+
+	// widest paths (Floyd–Warshall)
+	d, p := res.Pairwise, res.Strongest
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i != j && d[i][j] > d[j][i] {
+				p[i][j] = d[i][j]
+			}
+		}
+	}
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			if i == k {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				if j != i && j != k {
+					p[i][j] = max(p[i][j], min(p[i][k], p[k][j]))
+				}
+			}
+		}
+	}
+
+	// a candidate's place is one more than the number of candidates that
+	// beat it on strongest paths
+	res.Places = make([]int, n)
+	for i := 0; i < n; i++ {
+		res.Places[i] = 1
+		for j := 0; j < n; j++ {
+			if p[j][i] > p[i][j] {
+				res.Places[i]++
+			}
+		}
+	}
+	res.TieBreak = tb.String()
+	res.Winner, res.Runoff, res.TieNote = tb.decide(candidates, res.firstPlace())
+	return res
+}
+
+func newMatrix(n int) [][]int {
+	m := make([][]int, n)
+	for i := range m {
+		m[i] = make([]int, n)
+	}
+	return m
+}
+
+// firstPlace are the candidates in first place; more than one means a tie
+func (r SchulzeResult) firstPlace() []int {
+	var w []int
+	for c, place := range r.Places {
+		if place == 1 {
+			w = append(w, c)
+		}
+	}
+	return w
+}
+
+// SchulzeCell is one entry of a matrix in the report
+type SchulzeCell struct {
+	Value int
+	Self  bool // diagonal
+	Wins  bool // the row candidate beats the column candidate here
+}
+
+// SchulzeRow is one candidate's line of a matrix in the report
+type SchulzeRow struct {
+	Name  string
+	Cells []SchulzeCell
+}
+
+func (r SchulzeResult) matrixRows(m [][]int) []SchulzeRow {
+	rows := make([]SchulzeRow, len(r.Candidates))
+	for i, name := range r.Candidates {
+		rows[i].Name = name
+		for j := range r.Candidates {
+			rows[i].Cells = append(rows[i].Cells, SchulzeCell{Value: m[i][j], Self: i == j, Wins: m[i][j] > m[j][i]})
+		}
+	}
+	return rows
+}
+
+// PairwiseRows is the pairwise preference matrix for the report
+func (r SchulzeResult) PairwiseRows() []SchulzeRow {
+	return r.matrixRows(r.Pairwise)
+}
+
+// StrongestRows is the strongest path matrix for the report
+func (r SchulzeResult) StrongestRows() []SchulzeRow {
+	return r.matrixRows(r.Strongest)
+}
+
+// SchulzePlace is a line of the final order
+type SchulzePlace struct {
+	Place int
+	Name  string
+}
+
+// Ranking is the final order, winner first
+func (r SchulzeResult) Ranking() []SchulzePlace {
+	order := make([]SchulzePlace, len(r.Candidates))
+	for c, name := range r.Candidates {
+		order[c] = SchulzePlace{Place: r.Places[c], Name: name}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].Place < order[j].Place })
+	return order
+}
+
+// Winners is the winner after the tie-break, if any
+func (r SchulzeResult) Winners() []string {
+	if r.Winner < 0 {
+		return nil
+	}
+	return []string{r.Candidates[r.Winner]}
+}
+
+// Outcome names the winner and how any tie was settled
+func (r SchulzeResult) Outcome() string {
+	return singleOutcome(r.Candidates, r.Winner, r.Runoff, r.TieNote)
+}
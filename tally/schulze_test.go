@@ -0,0 +1,75 @@
+package tally
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A Condorcet cycle A > B > C > A: A's weakest link is the strongest
+func TestSchulzeCycle(t *testing.T) {
+	res := Schulze{Candidates: []string{"A", "B", "C"}}.Tally([]Ballot{
+		{Channel: "online", Choice: "1>2>3", Count: 3},
+		{Channel: "online", Choice: "2>3>1", Count: 2},
+		{Channel: "offline", Choice: "3>1>2", Count: 2},
+	}).(*SchulzeResult)
+
+	wantPairwise := [][]int{{0, 5, 3}, {2, 0, 5}, {4, 2, 0}}
+	if !reflect.DeepEqual(res.Pairwise, wantPairwise) {
+		t.Errorf("pairwise = %v, want %v", res.Pairwise, wantPairwise)
+	}
+	wantStrongest := [][]int{{0, 5, 5}, {4, 0, 5}, {4, 4, 0}}
+	if !reflect.DeepEqual(res.Strongest, wantStrongest) {
+		t.Errorf("strongest = %v, want %v", res.Strongest, wantStrongest)
+	}
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(res.Places, want) {
+		t.Errorf("places = %v, want %v", res.Places, want)
+	}
+	if got := res.Winners(); !reflect.DeepEqual(got, []string{"A"}) {
+		t.Errorf("winners = %v, want [A]", got)
+	}
+}
+
+// An unranked candidate is below every ranked one
+func TestSchulzeUnranked(t *testing.T) {
+	res := Schulze{Candidates: []string{"A", "B", "C"}}.Tally([]Ballot{
+		{Channel: "online", Choice: "2", Count: 1},
+	}).(*SchulzeResult)
+	wantPairwise := [][]int{{0, 0, 0}, {1, 0, 1}, {0, 0, 0}}
+	if !reflect.DeepEqual(res.Pairwise, wantPairwise) {
+		t.Errorf("pairwise = %v, want %v", res.Pairwise, wantPairwise)
+	}
+	if got := res.Winners(); !reflect.DeepEqual(got, []string{"B"}) {
+		t.Errorf("winners = %v, want [B]", got)
+	}
+}
+
+func TestSchulzeTie(t *testing.T) {
+	ballots := []Ballot{
+		{Channel: "online", Choice: "1>2", Count: 2},
+		{Channel: "online", Choice: "2>1", Count: 2},
+	}
+	for _, c := range []struct {
+		tieBreak string
+		winners  []string
+		runoff   []int
+	}{
+		{"", []string{"A"}, nil},
+		{"runoff", nil, []int{0, 1}},
+		{"random:2025", []string{drawWinner("2025", "A", "B")}, nil},
+	} {
+		tb, err := ParseTieBreak(c.tieBreak)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := Schulze{Candidates: []string{"A", "B"}, TieBreak: tb}.Tally(ballots).(*SchulzeResult)
+		if want := []int{1, 1}; !reflect.DeepEqual(res.Places, want) {
+			t.Errorf("%q: places = %v, want %v", c.tieBreak, res.Places, want)
+		}
+		if got := res.Winners(); !reflect.DeepEqual(got, c.winners) {
+			t.Errorf("%q: winners = %v, want %v", c.tieBreak, got, c.winners)
+		}
+		if !reflect.DeepEqual(res.Runoff, c.runoff) {
+			t.Errorf("%q: runoff = %v, want %v", c.tieBreak, res.Runoff, c.runoff)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package tally
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// STV counts in fixed point so transfers are exact and reproducible:
+// one vote is stvScale units, fractions below 1/stvScale are dropped.
+const stvScale = 1000000
+
+// STVRound is the state of the count at one stage and what was decided
+type STVRound struct {
+	Votes     []int64 // per candidate, in stvScale units
+	Exhausted int64   // value of ballots with no continuing preference left
+	Elected   []int
+	Excluded  int    // -1 when nobody was excluded
+	Note      string // e.g. how a tie was broken
+}
+
+// STVResult is a complete STV count
+type STVResult struct {
+	Candidates []string
+	Seats      int
+	Valid      int
+	Uncounted
+	SharesCast int   // shares behind the cast ballots
+	Quota      int64 // Droop quota in stvScale units
+	Rounds     []STVRound
+	Elected    []int // in order of election
+	Runoff     []int // candidates left for a runoff, when the count stopped on a tie
+	TieBreak   string
+}
+
+// STV is a single transferable vote count for Seats seats
+type STV struct {
+	Candidates []string // in order of nomination
+	Seats      int
+	TieBreak   TieBreak
+}
+
+// Tally runs the count; the result is an *STVResult
+func (m STV) Tally(ballots []Ballot) Result {
+	ranked, uncounted := parseRanked(ballots, len(m.Candidates))
+	res := countSTV(m.Candidates, m.Seats, ranked, m.TieBreak)
+	res.Uncounted = uncounted
+	res.SharesCast = castShares(ballots)
+	return res
+}
+
+type stvBallot struct {
+	prefs  []int
+	pos    int   // index in prefs of the candidate holding the ballots
+	weight int64 // current value in stvScale units
+}
+
+const (
+	stvContinuing = iota
+	stvElected
+	stvExcluded
+)
+
+// countSTV runs a single transferable vote count with the Droop quota.
+// A candidate reaching the quota is elected and the surplus moves on at a
+// fractional value (Gregory method): every ballot held by the candidate
+// continues to its next preference at value × surplus / total. When nobody
+// reaches the quota the lowest candidate is excluded and their ballots
+// move on at their current value. Once the continuing candidates just fill
+// the remaining seats they are all elected.
+//
+// Ties are decided by the most recent earlier round in which the tied
+// candidates differ, then by tb. When tb calls for a runoff and a tie
+// decides a seat the count stops and Runoff lists the tied candidates;
+// other ties for exclusion fall back to nomination order.
+func countSTV(candidates []string, seats int, ballots []rankedBallot, tb TieBreak) *STVResult {
+	res := &STVResult{Candidates: candidates, Seats: seats, TieBreak: tb.String()}
+	var piles []*stvBallot
+	for _, b := range ballots {
+		// identical ballots travel together, so a pile weighs count votes
+		piles = append(piles, &stvBallot{prefs: b.prefs, weight: int64(b.count) * stvScale})
+		res.Valid += b.count
+	}
+	res.Quota = (int64(res.Valid)/int64(seats+1) + 1) * stvScale
+
+	prio := tb.priority(candidates)
+	status := make([]int, len(candidates))
+	kept := make([]int64, len(candidates)) // votes of elected candidates, frozen at election
+	advance := func(b *stvBallot) {
+		for b.pos < len(b.prefs) && status[b.prefs[b.pos]] != stvContinuing {
+			b.pos++
+		}
+	}
+
+	for len(res.Elected) < seats {
+		round := STVRound{Votes: make([]int64, len(candidates)), Excluded: -1}
+		for _, b := range piles {
+			advance(b)
+			if b.pos < len(b.prefs) {
+				round.Votes[b.prefs[b.pos]] += b.weight
+			} else {
+				round.Exhausted += b.weight
+			}
+		}
+		var continuing []int
+		for c := range candidates {
+			switch status[c] {
+			case stvElected:
+				round.Votes[c] = kept[c]
+			case stvContinuing:
+				continuing = append(continuing, c)
+			}
+		}
+
+		byVotes := func(desc bool) []int {
+			order := append([]int(nil), continuing...)
+			for i := 1; i < len(order); i++ {
+				for j := i; j > 0 && stvBefore(res.Rounds, round, prio, order[j], order[j-1], desc); j-- {
+					order[j], order[j-1] = order[j-1], order[j]
+				}
+			}
+			return order
+		}
+		// tiedWith lists the candidates of order level with c in this and
+		// every earlier round, c included
+		tiedWith := func(c int, order []int) []int {
+			var tied []int
+			for _, o := range order {
+				level := round.Votes[o] == round.Votes[c]
+				for _, r := range res.Rounds {
+					level = level && r.Votes[o] == r.Votes[c]
+				}
+				if level {
+					tied = append(tied, o)
+				}
+			}
+			return tied
+		}
+
+		remaining := seats - len(res.Elected)
+		switch {
+		case len(continuing) <= remaining:
+			for _, c := range byVotes(true) {
+				status[c], kept[c] = stvElected, round.Votes[c]
+				round.Elected = append(round.Elected, c)
+				res.Elected = append(res.Elected, c)
+			}
+			round.Note = "sisa kandidat mengisi kursi yang tersisa"
+		case round.Votes[byVotes(true)[0]] >= res.Quota:
+			order := byVotes(true)
+			c := order[0]
+			if tied := tiedWith(c, order); len(tied) > remaining && tb.Rule == TieRunoff {
+				// more candidates level on the quota than seats left
+				res.Runoff = tied
+				round.Note = stvTieNote(candidates, tied, -1, "", "")
+				res.Rounds = append(res.Rounds, round)
+				return res
+			} else if len(tied) > 1 {
+				round.Note = stvTieNote(candidates, tied, c, "terpilih", tb.Short())
+			} else if round.Votes[order[1]] == round.Votes[c] {
+				round.Note = stvTieNote(candidates, []int{c, order[1]}, c, "terpilih", "suara di putaran sebelumnya")
+			}
+			total := round.Votes[c]
+			surplus := total - res.Quota
+			status[c], kept[c] = stvElected, res.Quota
+			round.Elected = []int{c}
+			res.Elected = append(res.Elected, c)
+			for _, b := range piles {
+				if b.pos < len(b.prefs) && b.prefs[b.pos] == c {
+					b.weight = mulDiv(b.weight, surplus, total)
+				}
+			}
+		default:
+			order := byVotes(false)
+			c := order[0]
+			tied := tiedWith(c, order)
+			if len(tied) > 1 && tb.Rule == TieRunoff && len(continuing)-len(tied) < remaining {
+				// the tied candidates are competing for the last seats
+				res.Runoff = tied
+				round.Note = stvTieNote(candidates, tied, -1, "", "")
+				res.Rounds = append(res.Rounds, round)
+				return res
+			}
+			if len(tied) > 1 {
+				rule := tb.Short()
+				if tb.Rule == TieRunoff {
+					rule = TieBreak{Rule: TieNomination}.Short()
+				}
+				round.Note = stvTieNote(candidates, tied, c, "tersisih", rule)
+			} else if round.Votes[order[1]] == round.Votes[c] {
+				round.Note = stvTieNote(candidates, []int{c, order[1]}, c, "tersisih", "suara di putaran sebelumnya")
+			}
+			status[c] = stvExcluded
+			round.Excluded = c
+		}
+		res.Rounds = append(res.Rounds, round)
+	}
+	return res
+}
+
+// mulDiv is a × b / c, rounded down, for non-negative a ≤ c and b; the
+// product is taken in 128 bits, since a pile of a few thousand ballots times
+// a surplus passes int64 at stvScale
+func mulDiv(a, b, c int64) int64 {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	q, _ := bits.Div64(hi, lo, uint64(c))
+	return int64(q)
+}
+
+// stvBefore orders a before b by votes in the current round (descending
+// when desc), falling back to the most recent earlier round in which they
+// differ, then to the tie-break priority (the favoured candidate first
+// when desc, last otherwise)
+func stvBefore(rounds []STVRound, cur STVRound, prio []int, a, b int, desc bool) bool {
+	cmp := func(r STVRound) int {
+		switch {
+		case r.Votes[a] > r.Votes[b]:
+			return 1
+		case r.Votes[a] < r.Votes[b]:
+			return -1
+		}
+		return 0
+	}
+	d := cmp(cur)
+	for i := len(rounds) - 1; d == 0 && i >= 0; i-- {
+		d = cmp(rounds[i])
+	}
+	if d == 0 {
+		return (prio[a] < prio[b]) == desc
+	}
+	return (d > 0) == desc
+}
+
+// stvTieNote explains how a tie among tied was settled: c was elected or
+// excluded (outcome) by rule, or c is -1 when a runoff is needed
+func stvTieNote(candidates []string, tied []int, c int, outcome, rule string) string {
+	tiedNames := strings.Join(names(candidates, tied), ", ")
+	if c < 0 {
+		return fmt.Sprintf("%s seri; perlu pemilihan ulang", tiedNames)
+	}
+	return fmt.Sprintf("%s seri; %s %s berdasarkan %s", tiedNames, candidates[c], outcome, rule)
+}
+
+// formatVotes shows a vote value with two decimals, or as a whole number
+// when it is one
+func formatVotes(v int64) string {
+	if v%stvScale == 0 {
+		return fmt.Sprint(v / stvScale)
+	}
+	return fmt.Sprintf("%.2f", float64(v)/stvScale)
+}
+
+// STVRow is one candidate's line in the round-by-round report
+type STVRow struct {
+	Name    string
+	Cells   []string
+	Elected bool
+}
+
+// QuotaText is the quota for display
+func (r STVResult) QuotaText() string {
+	return formatVotes(r.Quota)
+}
+
+// RoundNumbers are the column headers of the report
+func (r STVResult) RoundNumbers() []int {
+	n := make([]int, len(r.Rounds))
+	for i := range n {
+		n[i] = i + 1
+	}
+	return n
+}
+
+// Table is the round-by-round report: votes per candidate and round, with
+// the round a candidate was elected or excluded marked
+func (r STVResult) Table() []STVRow {
+	rows := make([]STVRow, len(r.Candidates))
+	for c, name := range r.Candidates {
+		rows[c].Name = name
+	}
+	done := make([]bool, len(r.Candidates))
+	for _, round := range r.Rounds {
+		for c := range rows {
+			cell := ""
+			if !done[c] || contains(round.Elected, c) {
+				cell = formatVotes(round.Votes[c])
+			}
+			if contains(round.Elected, c) {
+				cell += " ✔ terpilih"
+				rows[c].Elected = true
+				done[c] = true
+			} else if round.Excluded == c {
+				cell += " ✘ tersisih"
+				done[c] = true
+			}
+			rows[c].Cells = append(rows[c].Cells, cell)
+		}
+	}
+	return rows
+}
+
+// ExhaustedCells is the exhausted value per round
+func (r STVResult) ExhaustedCells() []string {
+	cells := make([]string, len(r.Rounds))
+	for i, round := range r.Rounds {
+		cells[i] = formatVotes(round.Exhausted)
+	}
+	return cells
+}
+
+// Notes lists the remarks of each round, e.g. broken ties
+func (r STVResult) Notes() []string {
+	var notes []string
+	for i, round := range r.Rounds {
+		if round.Note != "" {
+			notes = append(notes, fmt.Sprintf("Putaran %d: %s", i+1, round.Note))
+		}
+	}
+	return notes
+}
+
+// ElectedNames are the winners in order of election
+func (r STVResult) ElectedNames() string {
+	return strings.Join(r.Winners(), ", ")
+}
+
+// Winners are the elected candidates in order of election
+func (r STVResult) Winners() []string {
+	return names(r.Candidates, r.Elected)
+}
+
+// Outcome lists the elected candidates, any runoff and the round notes
+func (r STVResult) Outcome() string {
+	out := "Terpilih: " + r.ElectedNames()
+	if len(r.Elected) == 0 {
+		out = "Terpilih: -"
+	}
+	if len(r.Runoff) > 0 {
+		out += "; pemilihan ulang: " + r.RunoffNames()
+	}
+	for _, n := range r.Notes() {
+		out += ". " + n
+	}
+	return out
+}
+
+// RunoffNames are the candidates left for a runoff
+func (r STVResult) RunoffNames() string {
+	return strings.Join(names(r.Candidates, r.Runoff), ", ")
+}
+
+func contains(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
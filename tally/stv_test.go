@@ -0,0 +1,94 @@
+package tally
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A surplus of a large pile moves on without overflowing the fixed point
+// weights: 5000 × 2833 votes is past int64 at stvScale
+func TestSTVLargeSurplusTransfer(t *testing.T) {
+	ballots := []Ballot{
+		{Channel: "online", Choice: "1>2", Count: 5000},
+		{Channel: "online", Choice: "3", Count: 1000},
+		{Channel: "online", Choice: "2", Count: 500},
+	}
+	res := STV{Candidates: []string{"A", "B", "C"}, Seats: 2}.Tally(ballots).(*STVResult)
+
+	if got, want := res.Winners(), []string{"A", "B"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("winners = %v, want %v", got, want)
+	}
+	// B holds its own 500 and the whole surplus of A, 5000 - 2167
+	if got, want := res.Rounds[1].Votes[1], int64(3333)*stvScale; got != want {
+		t.Errorf("votes of B in round 2 = %d, want %d", got, want)
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	for _, c := range []struct{ a, b, c, want int64 }{
+		{6, 4, 8, 3},
+		{5000 * stvScale, 2833 * stvScale, 5000 * stvScale, 2833 * stvScale},
+		{7, 1, 3, 2},
+	} {
+		if got := mulDiv(c.a, c.b, c.c); got != c.want {
+			t.Errorf("mulDiv(%d, %d, %d) = %d, want %d", c.a, c.b, c.c, got, c.want)
+		}
+	}
+}
+
+// A and B stay level after C is excluded, so the tie decides the seat
+func TestSTVTie(t *testing.T) {
+	ballots := []Ballot{
+		{Channel: "online", Choice: "1", Count: 2},
+		{Channel: "online", Choice: "2", Count: 2},
+		{Channel: "offline", Choice: "3", Count: 1},
+	}
+	for _, c := range []struct {
+		tieBreak string
+		winners  []string
+		runoff   []int
+	}{
+		{"", []string{"A"}, nil},
+		{"runoff", []string{}, []int{1, 0}},
+		{"random:undian", []string{drawWinner("undian", "A", "B")}, nil},
+	} {
+		tb, err := ParseTieBreak(c.tieBreak)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := STV{Candidates: []string{"A", "B", "C"}, Seats: 1, TieBreak: tb}.Tally(ballots).(*STVResult)
+		if got := res.Winners(); !reflect.DeepEqual(got, c.winners) {
+			t.Errorf("%q: winners = %v, want %v", c.tieBreak, got, c.winners)
+		}
+		if !reflect.DeepEqual(res.Runoff, c.runoff) {
+			t.Errorf("%q: runoff = %v, want %v", c.tieBreak, res.Runoff, c.runoff)
+		}
+		if got := res.Rounds[0].Excluded; got != 2 {
+			t.Errorf("%q: excluded in round 1 = %d, want C", c.tieBreak, got)
+		}
+	}
+}
+
+// A tie in the current round goes to whoever was ahead in the latest round
+// where the tied candidates differed
+func TestSTVTieByEarlierRound(t *testing.T) {
+	// quota 4. Round 1: A elected on 4, no surplus; round 2: B 3, C 2, D 1,
+	// D out to C; round 3: B 3, C 3, and B was ahead in round 2, so C is
+	// excluded rather than a runoff called
+	ballots := []Ballot{
+		{Channel: "online", Choice: "1", Count: 4},
+		{Channel: "online", Choice: "2", Count: 3},
+		{Channel: "online", Choice: "3", Count: 2},
+		{Channel: "online", Choice: "4>3", Count: 1},
+	}
+	res := STV{Candidates: []string{"A", "B", "C", "D"}, Seats: 2, TieBreak: TieBreak{Rule: TieRunoff}}.Tally(ballots).(*STVResult)
+	if got := res.Rounds[2].Excluded; got != 2 {
+		t.Fatalf("excluded in round 3 = %d, want C", got)
+	}
+	if got, want := res.Winners(), []string{"A", "B"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("winners = %v, want %v", got, want)
+	}
+	if res.Runoff != nil {
+		t.Errorf("runoff = %v, want none", res.Runoff)
+	}
+}
@@ -0,0 +1,161 @@
+// Package tally counts ballots. Every counting method implements Tally:
+// the caller loads the ballots and hands them over, so a method can be
+// added and tested without a database or HTTP handler.
+package tally
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Ballot is a group of identical ballots, as stored
+type Ballot struct {
+	Channel  string // online / offline
+	Choice   string // e.g. setuju, tidak_sah, or a ranking such as "3>1>4"
+	FollowUp string // answer to the follow-up question, if it was asked
+	Count    int
+	Shares   int // voting shares behind the ballots, for weighted quorums
+}
+
+// castShares are the shares behind the cast ballots; spoiled submissions
+// weren't cast
+func castShares(ballots []Ballot) int {
+	n := 0
+	for _, b := range ballots {
+		if b.Choice != SpoiledChoice {
+			n += b.Shares
+		}
+	}
+	return n
+}
+
+// Result is the outcome of a count
+type Result interface {
+	// Winners are the elected choices or candidates; empty when nobody
+	// won, e.g. when a tie calls for a runoff
+	Winners() []string
+	// Outcome states who won and how any tie was settled, for the
+	// certified results
+	Outcome() string
+}
+
+// Tally is a counting method
+type Tally interface {
+	Tally(ballots []Ballot) Result
+}
+
+// ForMethod is the counting method an election names, as in
+// ELECTION_METHOD: stv, schulze or borda over the candidates, and the
+// referendum otherwise
+func ForMethod(method string, candidates []string, seats int, tieBreak TieBreak) Tally {
+	switch method {
+	case "stv":
+		return STV{Candidates: candidates, Seats: seats, TieBreak: tieBreak}
+	case "schulze":
+		return Schulze{Candidates: candidates, TieBreak: tieBreak}
+	case "borda":
+		return Borda{Candidates: candidates, TieBreak: tieBreak}
+	}
+	return Referendum{}
+}
+
+// Choices that carry no vote for any option
+const (
+	InvalidChoice = "tidak_sah" // spoilt paper ballot entered at the count
+	BlankChoice   = "kosong"    // ballot the voter submitted blank on purpose
+	SpoiledChoice = "rusak"     // online submission the server rejected as malformed
+)
+
+// Uncounted are the ballots without a vote for any option, by kind. Blank
+// and invalid ballots were cast and count toward turnout; spoiled
+// submissions were rejected, so the voter could still cast a ballot, and
+// are only reported.
+type Uncounted struct {
+	Blank   int
+	Invalid int
+	Spoiled int
+}
+
+// ErrBadRanking is returned for a ranking that doesn't parse
+var ErrBadRanking = errors.New("invalid ranking")
+
+// ParseRanking reads a stored ranking of n candidates: 1-based candidate
+// numbers in order of preference, e.g. "3>1>4". It returns 0-based
+// candidate indexes.
+func ParseRanking(s string, n int) ([]int, error) {
+	var ranking []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ">") {
+		c, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || c < 1 || c > n || seen[c] {
+			return nil, ErrBadRanking
+		}
+		seen[c] = true
+		ranking = append(ranking, c-1)
+	}
+	return ranking, nil
+}
+
+// FormatRanking is the stored form of a ranking
+func FormatRanking(ranking []int) string {
+	parts := make([]string, len(ranking))
+	for i, c := range ranking {
+		parts[i] = strconv.Itoa(c + 1)
+	}
+	return strings.Join(parts, ">")
+}
+
+// rankedBallot is a group of identical valid rankings
+type rankedBallot struct {
+	prefs []int
+	count int
+}
+
+// parseRanked reads the rankings of n candidates out of ballots and counts
+// the ballots that aren't valid rankings
+func parseRanked(ballots []Ballot, n int) ([]rankedBallot, Uncounted) {
+	var ranked []rankedBallot
+	var u Uncounted
+	for _, b := range ballots {
+		switch b.Choice {
+		case BlankChoice:
+			u.Blank += b.Count
+			continue
+		case SpoiledChoice:
+			u.Spoiled += b.Count
+			continue
+		}
+		prefs, err := ParseRanking(b.Choice, n)
+		if err != nil {
+			u.Invalid += b.Count
+			continue
+		}
+		ranked = append(ranked, rankedBallot{prefs, b.Count})
+	}
+	return ranked, u
+}
+
+// names maps candidate indexes to names
+func names(candidates []string, list []int) []string {
+	s := make([]string, len(list))
+	for i, c := range list {
+		s[i] = candidates[c]
+	}
+	return s
+}
+
+// singleOutcome is the Outcome of a single-winner ranked count
+func singleOutcome(candidates []string, winner int, runoff []int, note string) string {
+	out := "Terpilih: -"
+	if winner >= 0 {
+		out = "Terpilih: " + candidates[winner]
+	}
+	if len(runoff) > 0 {
+		out += "; pemilihan ulang: " + strings.Join(names(candidates, runoff), ", ")
+	}
+	if note != "" {
+		out += ". " + note
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package tally
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tie-break rules
+const (
+	TieNomination = "nomination" // earliest nominated (first in the candidate list) wins
+	TieRandom     = "random"     // draw from a seed published before the count
+	TieRunoff     = "runoff"     // no winner; the tied candidates go to a runoff
+)
+
+// TieBreak is how a tie the count itself can't resolve is decided
+type TieBreak struct {
+	Rule string
+	Seed string // random only
+}
+
+// ParseTieBreak reads a rule: nomination (the default for ""),
+// random:<seed> or runoff
+func ParseTieBreak(v string) (TieBreak, error) {
+	v = strings.TrimSpace(v)
+	rule, seed, _ := strings.Cut(v, ":")
+	t := TieBreak{Rule: strings.ToLower(rule), Seed: strings.TrimSpace(seed)}
+	switch t.Rule {
+	case "":
+		t.Rule = TieNomination
+	case TieNomination, TieRunoff:
+	case TieRandom:
+		if t.Seed == "" {
+			return t, errors.New("random tie-break needs a published seed, e.g. random:2025-09-01-rapat-panitia")
+		}
+	default:
+		return t, fmt.Errorf("invalid tie-break rule %q", v)
+	}
+	if t.Rule != TieRandom && t.Seed != "" {
+		return t, fmt.Errorf("tie-break rule %q takes no seed", t.Rule)
+	}
+	return t, nil
+}
+
+// String describes the rule for the results and the snapshot
+func (t TieBreak) String() string {
+	switch t.Rule {
+	case TieRandom:
+		return fmt.Sprintf("undian dengan seed %q: SHA-256 dari \"seed|nama\", nilai terkecil menang", t.Seed)
+	case TieRunoff:
+		return "pemilihan ulang antara kandidat yang seri (seri saat penyisihan STV yang tidak menentukan kursi diputus dengan urutan pencalonan)"
+	}
+	return "urutan pencalonan"
+}
+
+// Short names the rule in a tie note
+func (t TieBreak) Short() string {
+	switch t.Rule {
+	case TieRandom:
+		return "undian"
+	case TieRunoff:
+		return "pemilihan ulang"
+	}
+	return "urutan pencalonan"
+}
+
+// priority ranks the candidates for breaking ties, lowest first wins. A
+// runoff doesn't rank anyone, so it gets nomination order for the cases
+// where the order doesn't decide a seat.
+func (t TieBreak) priority(candidates []string) []int {
+	prio := make([]int, len(candidates))
+	for c := range prio {
+		prio[c] = c
+	}
+	if t.Rule != TieRandom {
+		return prio
+	}
+	draws := make([]string, len(candidates))
+	for c, name := range candidates {
+		sum := sha256.Sum256([]byte(t.Seed + "|" + name))
+		draws[c] = hex.EncodeToString(sum[:])
+	}
+	order := make([]int, len(candidates))
+	copy(order, prio)
+	sort.SliceStable(order, func(i, j int) bool { return draws[order[i]] < draws[order[j]] })
+	for place, c := range order {
+		prio[c] = place
+	}
+	return prio
+}
+
+// decide settles a single-winner count whose top place is shared by
+// winners. It returns the winner, or the candidates for a runoff, with a
+// note on how a tie was settled.
+func (t TieBreak) decide(candidates []string, winners []int) (int, []int, string) {
+	if len(winners) == 1 {
+		return winners[0], nil, ""
+	}
+	names := make([]string, len(winners))
+	for i, c := range winners {
+		names[i] = candidates[c]
+	}
+	tied := strings.Join(names, ", ")
+	if t.Rule == TieRunoff {
+		return -1, winners, fmt.Sprintf("%s seri; perlu pemilihan ulang", tied)
+	}
+	prio := t.priority(candidates)
+	best := winners[0]
+	for _, c := range winners[1:] {
+		if prio[c] < prio[best] {
+			best = c
+		}
+	}
+	return best, nil, fmt.Sprintf("%s seri; %s menang berdasarkan %s", tied, candidates[best], t.Short())
+}
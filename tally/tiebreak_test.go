@@ -0,0 +1,52 @@
+package tally
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseTieBreak(t *testing.T) {
+	for _, c := range []struct {
+		in      string
+		want    TieBreak
+		wantErr bool
+	}{
+		{"", TieBreak{Rule: TieNomination}, false},
+		{"nomination", TieBreak{Rule: TieNomination}, false},
+		{"  Nomination ", TieBreak{Rule: TieNomination}, false},
+		{"runoff", TieBreak{Rule: TieRunoff}, false},
+		{"random:rapat-2025-09-01", TieBreak{Rule: TieRandom, Seed: "rapat-2025-09-01"}, false},
+		{"RANDOM: seed ", TieBreak{Rule: TieRandom, Seed: "seed"}, false},
+		{"random:a:b", TieBreak{Rule: TieRandom, Seed: "a:b"}, false},
+		{"random", TieBreak{}, true},
+		{"random:", TieBreak{}, true},
+		{"runoff:seed", TieBreak{}, true},
+		{"nomination:seed", TieBreak{}, true},
+		{"coin", TieBreak{}, true},
+	} {
+		got, err := ParseTieBreak(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("ParseTieBreak(%q) = %+v, want an error", c.in, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("ParseTieBreak(%q) = %+v, %v, want %+v", c.in, got, err, c.want)
+		}
+	}
+}
+
+// drawWinner is the candidate the random rule favours: the smallest
+// SHA-256 of "seed|name", as TieBreak.String states it
+func drawWinner(seed string, candidates ...string) string {
+	best, bestDraw := "", ""
+	for _, name := range candidates {
+		sum := sha256.Sum256([]byte(seed + "|" + name))
+		if draw := hex.EncodeToString(sum[:]); best == "" || draw < bestDraw {
+			best, bestDraw = name, draw
+		}
+	}
+	return best
+}
@@ -0,0 +1,214 @@
+package tally
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule is what a question's result must meet to stand. Zero values set no
+// requirement.
+type Rule struct {
+	Quorum      float64 // minimum turnout, percent of those entitled to answer
+	ShareQuorum float64 // minimum shares present, percent of the entitled shares
+	Threshold   float64 // minimum share of the valid answers for the winner, percent
+}
+
+// IsZero reports whether the rule sets no requirement
+func (r Rule) IsZero() bool {
+	return r.Quorum == 0 && r.ShareQuorum == 0 && r.Threshold == 0
+}
+
+// Electorate is who may answer the main question
+type Electorate struct {
+	Voters int // head count
+	Shares int // voting shares
+
+	Present       int // checked in to vote on paper in the room
+	PresentShares int // their shares
+}
+
+// Validity is a question's result measured against its Rule
+type Validity struct {
+	Rule
+	Entitled    int    // voters entitled to answer
+	Turnout     int    // ballots that answered, spoilt ones included
+	Shares      int    // shares entitled to answer
+	SharesCast  int    // shares behind the ballots that answered
+	Valid       int    // valid answers, the base of the threshold
+	Winner      string // "" when nobody won, e.g. on a tie
+	WinnerVotes int
+}
+
+// WithPresent counts the voters checked in at the room toward the quorums
+// of the main question. Paper ballots are anonymous and carry one share, so
+// the room counts for whichever is more, the paper ballots answering or the
+// voters checked in, with their shares: a voter checked in is present whether
+// or not their ballot has been entered yet.
+func (v Validity) WithPresent(e Electorate, ballots []Ballot) Validity {
+	var paper int
+	for _, b := range ballots {
+		if b.Channel == "offline" && b.Choice != SpoiledChoice {
+			paper += b.Count
+		}
+	}
+	v.Turnout += max(0, e.Present-paper)
+	v.SharesCast += max(0, e.PresentShares-paper)
+	return v
+}
+
+// Measurable is a Result that can be checked against a Rule
+type Measurable interface {
+	Result
+	Validity(rule Rule, e Electorate) Validity
+}
+
+// TurnoutPct is the turnout in percent of those entitled
+func (v Validity) TurnoutPct() float64 {
+	if v.Entitled == 0 {
+		return 0
+	}
+	return float64(v.Turnout) * 100 / float64(v.Entitled)
+}
+
+// SharePct is the shares present in percent of the entitled shares
+func (v Validity) SharePct() float64 {
+	if v.Shares == 0 {
+		return 0
+	}
+	return float64(v.SharesCast) * 100 / float64(v.Shares)
+}
+
+// WinnerPct is the winner's share of the valid answers in percent
+func (v Validity) WinnerPct() float64 {
+	if v.Valid == 0 {
+		return 0
+	}
+	return float64(v.WinnerVotes) * 100 / float64(v.Valid)
+}
+
+// QuorumMet reports whether enough of those entitled answered
+func (v Validity) QuorumMet() bool {
+	return float64(v.Turnout)*100 >= v.Quorum*float64(v.Entitled)
+}
+
+// ShareQuorumMet reports whether enough of the entitled shares answered
+func (v Validity) ShareQuorumMet() bool {
+	return float64(v.SharesCast)*100 >= v.ShareQuorum*float64(v.Shares)
+}
+
+// ThresholdMet reports whether there is a winner with a large enough share
+func (v Validity) ThresholdMet() bool {
+	return v.Winner != "" && float64(v.WinnerVotes)*100 >= v.Threshold*float64(v.Valid)
+}
+
+// Stands reports whether the result meets its rule
+func (v Validity) Stands() bool {
+	return v.QuorumMet() && v.ShareQuorumMet() && v.ThresholdMet()
+}
+
+// String describes the checks that were made, e.g. "sah (kuorum 50%
+// tercapai: 62.5%; ambang 66.7% tidak tercapai: 60.1%)"
+func (v Validity) String() string {
+	var checks []string
+	if v.Quorum > 0 {
+		checks = append(checks, fmt.Sprintf("kuorum %g%% %s: %.1f%%", v.Quorum, met(v.QuorumMet()), v.TurnoutPct()))
+	}
+	if v.ShareQuorum > 0 {
+		checks = append(checks, fmt.Sprintf("kuorum bobot %g%% %s: %.1f%%", v.ShareQuorum, met(v.ShareQuorumMet()), v.SharePct()))
+	}
+	if v.Threshold > 0 {
+		checks = append(checks, fmt.Sprintf("ambang %g%% %s: %.1f%%", v.Threshold, met(v.ThresholdMet()), v.WinnerPct()))
+	}
+	if v.Winner == "" {
+		checks = append(checks, "tidak ada pemenang")
+	}
+	verdict := "sah"
+	if !v.Stands() {
+		verdict = "tidak sah"
+	}
+	if len(checks) == 0 {
+		return verdict
+	}
+	return verdict + " (" + strings.Join(checks, "; ") + ")"
+}
+
+func met(ok bool) string {
+	if ok {
+		return "tercapai"
+	}
+	return "tidak tercapai"
+}
+
+// Validity measures a referendum: the electorate is entitled, every cast
+// ballot counts toward turnout (blank and invalid ones too, spoiled
+// submissions not) and setuju / tidak setuju are the valid answers
+func (r *ReferendumResult) Validity(rule Rule, e Electorate) Validity {
+	t := r.Total()
+	v := Validity{
+		Rule:       rule,
+		Entitled:   e.Voters,
+		Turnout:    t.Setuju + t.TidakSetuju + t.Kosong + t.TidakSah,
+		Shares:     e.Shares,
+		SharesCast: r.SharesCast,
+		Valid:      t.Setuju + t.TidakSetuju,
+	}
+	if w := r.Winners(); len(w) > 0 {
+		v.Winner = w[0]
+		v.WinnerVotes = max(t.Setuju, t.TidakSetuju)
+	}
+	return v
+}
+
+// Validity measures a follow-up question: only voters whose main answer
+// opened it are entitled, so the electorate is ignored
+func (r *FollowUpResult) Validity(rule Rule, e Electorate) Validity {
+	answered := r.Asked - r.Unanswered()
+	v := Validity{
+		Rule:       rule,
+		Entitled:   r.Asked,
+		Turnout:    answered,
+		Shares:     r.AskedShares,
+		SharesCast: r.AnsweredShares,
+		Valid:      answered,
+	}
+	if w := r.Winners(); len(w) > 0 {
+		v.Winner = w[0]
+		for _, o := range r.Options {
+			v.WinnerVotes = max(v.WinnerVotes, o.Count)
+		}
+	}
+	return v
+}
+
+// rankedValidity measures a ranked count. A winner's share has no single
+// meaning across the ranked methods, so no threshold applies: the winners
+// carry all the valid ballots and only the quorum decides.
+func rankedValidity(rule Rule, e Electorate, valid, sharesCast int, u Uncounted, winners []string) Validity {
+	v := Validity{
+		Rule:       rule,
+		Entitled:   e.Voters,
+		Turnout:    valid + u.Blank + u.Invalid,
+		Shares:     e.Shares,
+		SharesCast: sharesCast,
+		Valid:      valid,
+	}
+	if len(winners) > 0 {
+		v.Winner, v.WinnerVotes = strings.Join(winners, ", "), valid
+	}
+	return v
+}
+
+// Validity measures an STV count
+func (r STVResult) Validity(rule Rule, e Electorate) Validity {
+	return rankedValidity(rule, e, r.Valid, r.SharesCast, r.Uncounted, r.Winners())
+}
+
+// Validity measures a Schulze count
+func (r SchulzeResult) Validity(rule Rule, e Electorate) Validity {
+	return rankedValidity(rule, e, r.Valid, r.SharesCast, r.Uncounted, r.Winners())
+}
+
+// Validity measures a Borda count
+func (r BordaResult) Validity(rule Rule, e Electorate) Validity {
+	return rankedValidity(rule, e, r.Valid, r.SharesCast, r.Uncounted, r.Winners())
+}
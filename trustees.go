@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// With ELECTION_PUBLIC_KEY set, online ballots are sealed (NaCl anonymous
+// box, X25519) the moment they are accepted and stored without a readable
+// choice. The private key exists only as Shamir shares held by the
+// trustees; after close, once a threshold of them submit their shares, the
+// key is rebuilt in memory, every ballot is opened and the tally snapshot is
+// taken. Paper ballots are counted in the open and aren't sealed.
+
+// trusteeSharePrefix starts every share string
+const trusteeSharePrefix = "gkjp-share"
+
+// TrusteeShare is one trustee's part of the election private key
+type TrusteeShare struct {
+	Threshold int
+	X         byte // the share's point, 1..255
+	Y         []byte
+}
+
+func (s TrusteeShare) String() string {
+	return fmt.Sprintf("%s-%d-%d-%s", trusteeSharePrefix, s.Threshold, s.X, hex.EncodeToString(s.Y))
+}
+
+// parseTrusteeShare reads a share as printed by trustee-keygen
+func parseTrusteeShare(v string) (TrusteeShare, error) {
+	var s TrusteeShare
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(v), trusteeSharePrefix+"-"), "-")
+	if len(parts) != 3 {
+		return s, errors.New("format share tidak dikenal")
+	}
+	k, err1 := strconv.Atoi(parts[0])
+	x, err2 := strconv.Atoi(parts[1])
+	y, err3 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil || k < 1 || x < 1 || x > 255 || len(y) != curve25519.ScalarSize {
+		return s, errors.New("format share tidak dikenal")
+	}
+	return TrusteeShare{Threshold: k, X: byte(x), Y: y}, nil
+}
+
+// Shamir secret sharing over GF(2^8), byte by byte
+
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b // x^8 + x^4 + x^3 + x + 1
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv is a^254, the inverse of a non-zero a
+func gfInv(a byte) byte {
+	r := byte(1)
+	for i := 0; i < 254; i++ {
+		r = gfMul(r, a)
+	}
+	return r
+}
+
+// splitSecret deals n shares of secret, any threshold of which rebuild it
+func splitSecret(secret []byte, n, threshold int) ([]TrusteeShare, error) {
+	if threshold < 1 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("need 1 <= threshold <= trustees <= 255")
+	}
+	shares := make([]TrusteeShare, n)
+	for i := range shares {
+		shares[i] = TrusteeShare{Threshold: threshold, X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+	coeffs := make([]byte, threshold)
+	for b, s := range secret {
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			// Horner's rule at x
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, shares[i].X) ^ coeffs[c]
+			}
+			shares[i].Y[b] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares rebuilds the secret from shares with distinct points
+// (Lagrange interpolation at 0)
+func combineShares(shares []TrusteeShare) []byte {
+	secret := make([]byte, len(shares[0].Y))
+	for i, si := range shares {
+		l := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				l = gfMul(l, gfMul(sj.X, gfInv(sj.X^si.X)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(si.Y[b], l)
+		}
+	}
+	return secret
+}
+
+// loadElectionKey reads ELECTION_PUBLIC_KEY (base64 X25519); ballots aren't
+// sealed without it
+func loadElectionKey() (*[32]byte, error) {
+	v := os.Getenv("ELECTION_PUBLIC_KEY")
+	if v == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(b) != 32 {
+		return nil, errors.New("ELECTION_PUBLIC_KEY must be a base64 32-byte X25519 key from trustee-keygen")
+	}
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
+
+// sealBallot encrypts a ballot to the election key
+func sealBallot(key *[32]byte, choice, followUp string) ([]byte, error) {
+	return box.SealAnonymous(nil, []byte(choice+"\n"+followUp), key, rand.Reader)
+}
+
+// openBallot reverses sealBallot
+func openBallot(pub, priv *[32]byte, sealed []byte) (choice, followUp string, ok bool) {
+	msg, ok := box.OpenAnonymous(nil, sealed, pub, priv)
+	if !ok {
+		return "", "", false
+	}
+	choice, followUp, _ = strings.Cut(string(msg), "\n")
+	return choice, followUp, true
+}
+
+// TrusteesData is the trustees page
+type TrusteesData struct {
+	Enabled   bool
+	Closed    bool
+	Sealed    int // online ballots still sealed
+	Submitted []int
+	Threshold int
+	Message   string
+	Error     string
+}
+
+// adminTrusteesHandler collects trustee shares after close and opens the
+// sealed ballots once enough are in
+func (a *App) adminTrusteesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := TrusteesData{Enabled: a.electionKey != nil, Closed: time.Now().After(a.voteEnd)}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if r.FormValue("action") == "reset" {
+			// drop the shares collected so far, e.g. after one turned out wrong
+			if _, err := a.db.Exec(ctx, `DELETE FROM trustee_shares`); err != nil {
+				logTally.Errorf("error clearing trustee shares: %v", err)
+				data.Error = "database error"
+				break
+			}
+			a.audit(ctx, actorName(r), "trustee.reset", "", nil)
+			data.Message = "Share yang sudah masuk dihapus"
+			break
+		}
+		msg, err := a.submitTrusteeShare(ctx, r.FormValue("share"), actorName(r))
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Message = msg
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := a.db.QueryRow(ctx, `SELECT COUNT(*) FROM voters WHERE sealed_choice IS NOT NULL`).Scan(&data.Sealed)
+	if err == nil {
+		err = a.db.QueryRow(ctx, `
+			SELECT COALESCE(array_agg(x ORDER BY x), '{}'), COALESCE(MAX(threshold), 0)
+			FROM trustee_shares`).Scan(&data.Submitted, &data.Threshold)
+	}
+	if err != nil {
+		logTally.Errorf("error getting trustee status: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := a.tmpl.ExecuteTemplate(w, "trustees.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// submitTrusteeShare stores a share and, once the threshold is reached,
+// opens the ballots. The returned error message is shown as-is.
+func (a *App) submitTrusteeShare(ctx context.Context, v, actor string) (string, error) {
+	if a.electionKey == nil {
+		return "", errors.New("surat suara tidak dienkripsi (ELECTION_PUBLIC_KEY kosong)")
+	}
+	if !time.Now().After(a.voteEnd) {
+		return "", errors.New("share hanya diterima setelah pemilihan ditutup")
+	}
+	share, err := parseTrusteeShare(v)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		logTally.Errorf("error storing trustee share: %v", err)
+		return "", errors.New("database error")
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `LOCK TABLE trustee_shares IN EXCLUSIVE MODE`); err != nil {
+		logTally.Errorf("error storing trustee share: %v", err)
+		return "", errors.New("database error")
+	}
+	rows, err := tx.Query(ctx, `SELECT threshold, x, share FROM trustee_shares`)
+	if err != nil {
+		logTally.Errorf("error storing trustee share: %v", err)
+		return "", errors.New("database error")
+	}
+	shares := []TrusteeShare{share}
+	for rows.Next() {
+		var s TrusteeShare
+		var x int
+		if err := rows.Scan(&s.Threshold, &x, &s.Y); err != nil {
+			rows.Close()
+			logTally.Errorf("error storing trustee share: %v", err)
+			return "", errors.New("database error")
+		}
+		s.X = byte(x)
+		if s.X == share.X {
+			rows.Close()
+			return "", fmt.Errorf("share trustee %d sudah diterima", share.X)
+		}
+		if s.Threshold != share.Threshold {
+			rows.Close()
+			return "", errors.New("share ini berasal dari pembagian kunci yang berbeda")
+		}
+		shares = append(shares, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logTally.Errorf("error storing trustee share: %v", err)
+		return "", errors.New("database error")
+	}
+
+	if len(shares) < share.Threshold {
+		_, err := tx.Exec(ctx, `INSERT INTO trustee_shares (x, threshold, share, submitted_by) VALUES ($1, $2, $3, $4)`,
+			int(share.X), share.Threshold, share.Y, actor)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			logTally.Errorf("error storing trustee share: %v", err)
+			return "", errors.New("database error")
+		}
+		a.audit(ctx, actor, "trustee.share", strconv.Itoa(int(share.X)), map[string]int{"received": len(shares), "threshold": share.Threshold})
+		return fmt.Sprintf("Share trustee %d diterima (%d dari %d)", share.X, len(shares), share.Threshold), nil
+	}
+
+	// threshold reached: rebuild the key, check it against the public key
+	// and open every sealed ballot in this transaction
+	var priv [32]byte
+	copy(priv[:], combineShares(shares[:share.Threshold]))
+	pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil || subtle.ConstantTimeCompare(pub, a.electionKey[:]) != 1 {
+		return "", errors.New("share tidak cocok dengan kunci publik pemilihan; periksa share yang sudah masuk")
+	}
+	opened, err := a.openSealedBallots(ctx, tx, &priv)
+	if err != nil {
+		logTally.Errorf("error opening ballots: %v", err)
+		return "", errors.New("gagal membuka surat suara")
+	}
+	// the shares have done their job; don't leave them lying around
+	if _, err := tx.Exec(ctx, `DELETE FROM trustee_shares`); err != nil {
+		logTally.Errorf("error clearing trustee shares: %v", err)
+		return "", errors.New("database error")
+	}
+	if err := tx.Commit(ctx); err != nil {
+		logTally.Errorf("error opening ballots: %v", err)
+		return "", errors.New("database error")
+	}
+	a.audit(ctx, actor, "trustee.decrypt", "", map[string]int{"ballots": opened, "threshold": share.Threshold})
+	if _, err := a.takeTallySnapshot(ctx); err != nil {
+		logTally.Errorf("error taking tally snapshot: %v", err)
+	}
+	return fmt.Sprintf("Threshold tercapai: %d surat suara dibuka", opened), nil
+}
+
+// openSealedBallots decrypts the sealed ballots into vote_choice and
+// follow_up. One ballot that doesn't open fails them all.
+func (a *App) openSealedBallots(ctx context.Context, tx pgx.Tx, priv *[32]byte) (int, error) {
+	type sealedBallot struct {
+		id     int
+		sealed []byte
+	}
+	rows, err := tx.Query(ctx, `SELECT id, sealed_choice FROM voters WHERE sealed_choice IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+	var ballots []sealedBallot
+	for rows.Next() {
+		var b sealedBallot
+		if err := rows.Scan(&b.id, &b.sealed); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ballots = append(ballots, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, b := range ballots {
+		choice, followUp, ok := openBallot(a.electionKey, priv, b.sealed)
+		if !ok {
+			return 0, fmt.Errorf("ballot of voter %d doesn't open", b.id)
+		}
+		_, err := tx.Exec(ctx, `
+			UPDATE voters SET vote_choice = $2, follow_up = NULLIF($3, ''), sealed_choice = NULL
+			WHERE id = $1`, b.id, choice, followUp)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ballots), nil
+}
+
+// runTrusteeKeygen creates the election key pair, prints the public key
+// and one share per trustee, and forgets the private key. Run it on an
+// offline machine during the key ceremony.
+// Usage: pemilihan trustee-keygen -trustees 5 -threshold 3
+func runTrusteeKeygen(args []string) {
+	fs := flag.NewFlagSet("trustee-keygen", flag.ExitOnError)
+	trustees := fs.Int("trustees", 5, "number of trustees")
+	threshold := fs.Int("threshold", 3, "shares needed to open the ballots")
+	fs.Parse(args)
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("trustee-keygen: %v", err)
+	}
+	shares, err := splitSecret(priv[:], *trustees, *threshold)
+	if err != nil {
+		log.Fatalf("trustee-keygen: %v", err)
+	}
+	for i := range priv {
+		priv[i] = 0
+	}
+	fmt.Printf("ELECTION_PUBLIC_KEY=%s\n\n", base64.StdEncoding.EncodeToString(pub[:]))
+	fmt.Printf("%d of %d shares open the ballots. Hand each trustee their share only:\n", *threshold, *trustees)
+	for _, s := range shares {
+		fmt.Printf("trustee %d: %s\n", s.X, s)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// The organization's usage is counted per day (UTC) in usage_counters and
+// reported per month, for hosted deployments to bill or to hold an
+// organization to a quota (quota.go):
+// voters added to the roll (API, bulk upsert, gRPC, satellite merge), mail
+// sent and elections run to the archive. A count is written in the
+// transaction of what it counts where there is one, so a rolled back import
+// isn't billed. seed, bench-vote and restore load data without counting it.
+
+// Usage metrics
+const (
+	usageVotersImported = "voters_imported"
+	usageEmailsSent     = "emails_sent"
+	usageElectionsRun   = "elections_run"
+)
+
+// execer runs a statement on the pool or within a transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+// meter adds n to metric for today
+func meter(ctx context.Context, db execer, metric string, n int) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO usage_counters (period, metric, quantity)
+		VALUES ((NOW() AT TIME ZONE 'UTC')::date, $1, $2)
+		ON CONFLICT (org_id, period, metric) DO UPDATE SET
+			quantity = usage_counters.quantity + EXCLUDED.quantity, updated_at = NOW()`, metric, n)
+	return err
+}
+
+// meterLater counts what happened outside a transaction; like the audit log,
+// a failure is logged rather than failing what was done
+func (a *App) meterLater(ctx context.Context, metric string, n int) {
+	if err := meter(ctx, a.db, metric, n); err != nil {
+		logDB.Errorf("error metering usage: %v", err)
+	}
+}
+
+// APIUsage is one metric of one month
+type APIUsage struct {
+	Period    string    `json:"period"` // YYYY-MM
+	Metric    string    `json:"metric"`
+	Quantity  int64     `json:"quantity"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// APIUsageReport answers GET /api/v1/usage
+type APIUsageReport struct {
+	Org   string     `json:"org"`
+	Usage []APIUsage `json:"usage"`
+}
+
+// apiUsage: GET /api/v1/usage?from=YYYY-MM&to=YYYY-MM lists the
+// organization's usage per month, oldest first; both bounds are inclusive
+// and optional
+func (a *App) apiUsage(w http.ResponseWriter, r *http.Request) {
+	from, to := time.Time{}, time.Date(9999, 12, 1, 0, 0, 0, 0, time.UTC)
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01", v)
+		if err != nil {
+			apiError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid %s: use YYYY-MM", p.name))
+			return
+		}
+		*p.dst = t
+	}
+
+	rows, err := a.db.Query(r.Context(), `
+		SELECT to_char(period, 'YYYY-MM'), metric, SUM(quantity)::bigint, MAX(updated_at)
+		FROM usage_counters
+		WHERE period >= $1 AND period < $2::date + INTERVAL '1 month'
+		GROUP BY 1, 2
+		ORDER BY 1, 2`, from, to)
+	if err != nil {
+		logDB.Errorf("error getting usage: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+	report := APIUsageReport{Org: a.org, Usage: []APIUsage{}}
+	for rows.Next() {
+		var u APIUsage
+		if err := rows.Scan(&u.Period, &u.Metric, &u.Quantity, &u.UpdatedAt); err != nil {
+			logDB.Errorf("error scanning usage: %v", err)
+			apiError(w, r, http.StatusInternalServerError, "database error")
+			return
+		}
+		report.Usage = append(report.Usage, u)
+	}
+	if err := rows.Err(); err != nil {
+		logDB.Errorf("error getting usage: %v", err)
+		apiError(w, r, http.StatusInternalServerError, "database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
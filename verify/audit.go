@@ -0,0 +1,164 @@
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The audit ledger is sealed into a hash chain: each seal covers the events
+// since the previous one, in id order, and its hash is
+//
+//	h = prev; for each event: h = SHA256(h || SHA256(canonical event))
+//
+// starting from the previous seal's hash (AuditGenesis for the first seal).
+
+// AuditFormat names the layout of the audit log export
+const AuditFormat = "gkjp-audit/1"
+
+// AuditGenesis is the hash the first seal follows
+var AuditGenesis = strings.Repeat("0", 64)
+
+// AuditSeal is one link of the chain
+type AuditSeal struct {
+	ID        int64     `json:"id"`
+	FirstID   int64     `json:"first_event_id"`
+	LastID    int64     `json:"last_event_id"`
+	Events    int       `json:"events"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+	SealedAt  time.Time `json:"sealed_at"`
+	PublicKey string    `json:"public_key,omitempty"` // base64
+	Signature string    `json:"signature,omitempty"`  // base64, over Message()
+}
+
+// AuditEvent is an audit event as hashed: the time is RFC 3339 in UTC and
+// detail the stored JSON text, so the export reproduces the hash input
+// exactly
+type AuditEvent struct {
+	ID      int64  `json:"id"`
+	At      string `json:"at"`
+	Actor   string `json:"actor"`
+	Action  string `json:"action"`
+	Subject string `json:"subject"`
+	Detail  string `json:"detail"`
+}
+
+// AuditExport is the downloadable ledger with its seals
+type AuditExport struct {
+	Format     string       `json:"format"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Events     []AuditEvent `json:"events"`
+	Seals      []AuditSeal  `json:"seals"`
+}
+
+// digest hashes the canonical form of the event
+func (e AuditEvent) digest() []byte {
+	canonical, _ := json.Marshal([]string{
+		fmt.Sprint(e.ID), e.At, e.Actor, e.Action, e.Subject, e.Detail,
+	})
+	sum := sha256.Sum256(canonical)
+	return sum[:]
+}
+
+// AuditChain extends the chain at prev (hex) over events
+func AuditChain(prev string, events []AuditEvent) (string, error) {
+	h, err := hex.DecodeString(prev)
+	if err != nil {
+		return "", fmt.Errorf("bad chain hash %q", prev)
+	}
+	for _, e := range events {
+		sum := sha256.Sum256(append(h, e.digest()...))
+		h = sum[:]
+	}
+	return hex.EncodeToString(h), nil
+}
+
+// Message is what the seal signature covers
+func (s AuditSeal) Message() []byte {
+	return []byte(fmt.Sprintf("gkjp-audit-seal/1\n%d\n%d\n%d\n%s\n%s\n%s",
+		s.FirstID, s.LastID, s.Events, s.PrevHash, s.Hash, s.SealedAt.UTC().Format(time.RFC3339Nano)))
+}
+
+// CheckAudit verifies an audit log export, writing one line per check to w:
+// seal signatures (against pubkey, the announced base64 key, when given),
+// the links between seals and the hash of every sealed range. It reports
+// whether every check passed; err is for a file it can't read as an export.
+func CheckAudit(w io.Writer, raw []byte, pubkey string) (bool, error) {
+	var exp AuditExport
+	if err := json.Unmarshal(raw, &exp); err != nil {
+		return false, fmt.Errorf("not an audit export: %v", err)
+	}
+	if exp.Format != AuditFormat {
+		return false, fmt.Errorf("unsupported format %q", exp.Format)
+	}
+	c := &checker{w: w}
+
+	byID := make(map[int64]AuditEvent, len(exp.Events))
+	firstEvent := int64(1<<63 - 1) // everything removed when there are no events
+	for i, e := range exp.Events {
+		if i == 0 {
+			firstEvent = e.ID
+		} else if e.ID <= exp.Events[i-1].ID {
+			return false, fmt.Errorf("events out of order at id %d", e.ID)
+		}
+		byID[e.ID] = e
+	}
+
+	covered := 0
+	var lastSealed int64
+	for i, s := range exp.Seals {
+		label := fmt.Sprintf("seal %d (events %d-%d)", s.ID, s.FirstID, s.LastID)
+		switch {
+		case s.Signature != "":
+			key := s.PublicKey
+			if pubkey != "" {
+				c.check(key == pubkey, label+": public key matches the announced key")
+				key = pubkey
+			}
+			c.check(verifySignature(key, s.Signature, s.Message()), label+": signature")
+		case pubkey != "":
+			c.check(false, label+": signed")
+		}
+
+		if i > 0 {
+			prev := exp.Seals[i-1]
+			c.check(s.PrevHash == prev.Hash && s.FirstID > prev.LastID, label+": follows seal "+fmt.Sprint(prev.ID))
+		} else if s.PrevHash != AuditGenesis {
+			c.note("%s: earlier seals are not in the export", label)
+		}
+
+		var events []AuditEvent
+		for id := s.FirstID; id <= s.LastID; id++ {
+			if e, ok := byID[id]; ok {
+				events = append(events, e)
+			}
+		}
+		covered += len(events)
+		lastSealed = s.LastID
+		if s.FirstID < firstEvent {
+			// retention removed the oldest events; the chain still links
+			// through the seal hashes
+			c.note("%s: %d events removed by retention, not rehashed", label, s.Events-len(events))
+			continue
+		}
+		hash, err := AuditChain(s.PrevHash, events)
+		c.check(err == nil && len(events) == s.Events && hash == s.Hash, fmt.Sprintf("%s: %d events hash to %s", label, s.Events, s.Hash))
+	}
+
+	unsealed := 0
+	for _, e := range exp.Events {
+		if e.ID > lastSealed {
+			unsealed++
+		}
+	}
+	c.check(covered+unsealed == len(exp.Events), "no events outside the sealed ranges")
+	if unsealed > 0 {
+		c.note("%d newest events are not sealed yet", unsealed)
+	}
+	return !c.failed, nil
+}
@@ -0,0 +1,189 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"pemilihan.gkjp.id/tally"
+)
+
+// BulletinFormat names the layout of the bulletin board export; bump it when
+// the layout changes
+const BulletinFormat = "gkjp-bulletin/2"
+
+// Snapshot is the tally frozen the moment voting closed
+type Snapshot struct {
+	TakenAt            time.Time `json:"taken_at"`
+	VoteEnd            time.Time `json:"vote_end"`
+	TotalVoters        int       `json:"total_voters"`
+	VotedCount         int       `json:"voted_count"`
+	SetujuCount        int       `json:"setuju_count"`
+	TidakSetujuCount   int       `json:"tidak_setuju_count"`
+	OfflineSetuju      int       `json:"offline_setuju"`
+	OfflineTidakSetuju int       `json:"offline_tidak_setuju"`
+	OfflineTidakSah    int       `json:"offline_tidak_sah"`
+	KosongCount        int       `json:"kosong_count"`   // blank, online
+	OfflineKosong      int       `json:"offline_kosong"` // blank, offline
+	RusakCount         int       `json:"rusak_count"`    // spoiled submissions
+	BallotHash         string    `json:"ballot_hash"`
+	MerkleRoot         string    `json:"merkle_root,omitempty"` // root of the ballot Merkle tree
+	Method             string    `json:"method,omitempty"`
+	TieBreak           string    `json:"tie_break,omitempty"`       // rule applied to ties, ranked elections only
+	Outcome            string    `json:"outcome,omitempty"`         // certified outcome per question, one per line
+	LateRegistered     int       `json:"late_registered,omitempty"` // voters added while voting was open
+}
+
+// Bulletin is the public record of a closed election: what was on the
+// ballot, the totals announced at close and every accepted ballot without
+// any voter reference, enough for an observer to recount offline
+type Bulletin struct {
+	Format   string           `json:"format"`
+	Election BulletinElection `json:"election"`
+	Snapshot Snapshot         `json:"snapshot"`
+	Spoiled  int              `json:"spoiled"` // rejected submissions, not in ballots
+	Ballots  []BulletinBallot `json:"ballots"`
+}
+
+// BulletinElection is the ballot configuration the count applies
+type BulletinElection struct {
+	VoteStart  time.Time         `json:"vote_start"`
+	VoteEnd    time.Time         `json:"vote_end"`
+	Method     string            `json:"method"`
+	Candidates []string          `json:"candidates,omitempty"`
+	Seats      int               `json:"seats,omitempty"`
+	TieBreak   string            `json:"tie_break,omitempty"` // as in TIE_BREAK
+	FollowUp   *BulletinFollowUp `json:"follow_up,omitempty"`
+}
+
+type BulletinFollowUp struct {
+	When     string   `json:"when"`
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+}
+
+// BulletinBallot is one accepted ballot, in Merkle leaf order. The leaf
+// commits to the tag and the other fields, see MerkleLeaf.
+type BulletinBallot struct {
+	Leaf     string `json:"leaf"`
+	Tag      string `json:"tag"`
+	Channel  string `json:"channel"`
+	Choice   string `json:"choice"`
+	FollowUp string `json:"follow_up,omitempty"`
+}
+
+// SignedBulletin wraps the bulletin with its digest and, when the server
+// has a signing key, an Ed25519 signature. Both cover the exact bytes of
+// the "bulletin" value.
+type SignedBulletin struct {
+	Bulletin  json.RawMessage `json:"bulletin"`
+	SHA256    string          `json:"sha256"`
+	PublicKey string          `json:"public_key,omitempty"` // base64
+	Signature string          `json:"signature,omitempty"`  // base64
+}
+
+// CheckBulletin verifies a bulletin board export, writing one line per
+// check to w: digest, signature (against pubkey, the announced base64 key,
+// when given; then an unsigned bulletin fails), each leaf against its
+// ballot, Merkle root and a recount against the announced totals. It
+// reports whether every check passed; err is for a file it can't read as a
+// bulletin.
+func CheckBulletin(w io.Writer, raw []byte, pubkey string) (bool, error) {
+	var signed SignedBulletin
+	if err := json.Unmarshal(raw, &signed); err != nil || signed.Bulletin == nil {
+		return false, fmt.Errorf("not a bulletin: %v", err)
+	}
+	var b Bulletin
+	if err := json.Unmarshal(signed.Bulletin, &b); err != nil {
+		return false, err
+	}
+	if b.Format != BulletinFormat {
+		return false, fmt.Errorf("unsupported format %q", b.Format)
+	}
+	tieBreak, err := tally.ParseTieBreak(b.Election.TieBreak)
+	if err != nil {
+		return false, err
+	}
+	// the server refuses the same in SEATS; STV wouldn't finish counting
+	if e := b.Election; e.Method == "stv" && (e.Seats < 1 || e.Seats >= len(e.Candidates)) {
+		return false, fmt.Errorf("invalid seats %d: must be between 1 and the number of candidates - 1", e.Seats)
+	}
+	c := &checker{w: w}
+
+	sum := sha256.Sum256(signed.Bulletin)
+	c.check(hex.EncodeToString(sum[:]) == signed.SHA256, "sha256 "+signed.SHA256)
+	key := signed.PublicKey
+	if pubkey != "" {
+		c.check(key == pubkey, "public key matches the announced key")
+		key = pubkey
+	}
+	switch {
+	case signed.Signature != "":
+		c.check(verifySignature(key, signed.Signature, signed.Bulletin), "signature")
+	case pubkey != "":
+		c.check(false, "signature")
+	default:
+		c.note("bulletin is not signed")
+	}
+
+	// the root covers the leaves, and each leaf the ballot counted from it
+	leaves := make([][]byte, len(b.Ballots))
+	counts := map[[3]string]int{}
+	committed := 0
+	for i, ballot := range b.Ballots {
+		h, err := hex.DecodeString(ballot.Leaf)
+		if err != nil {
+			return false, fmt.Errorf("ballot %d: bad leaf", i)
+		}
+		tag, err := hex.DecodeString(ballot.Tag)
+		if err != nil {
+			return false, fmt.Errorf("ballot %d: bad tag", i)
+		}
+		choice := ballot.Choice
+		if ballot.FollowUp != "" {
+			choice += "|" + ballot.FollowUp
+		}
+		if bytes.Equal(MerkleLeaf(tag, ballot.Channel, choice), h) {
+			committed++
+		} else {
+			c.note("ballot %d: leaf %s doesn't match its fields", i, ballot.Leaf)
+		}
+		leaves[i] = h
+		counts[[3]string{ballot.Channel, ballot.Choice, ballot.FollowUp}]++
+	}
+	c.check(committed == len(b.Ballots), fmt.Sprintf("%d of %d leaves match their ballots", committed, len(b.Ballots)))
+	c.check(MerkleRoot(MerkleLevels(leaves)) == b.Snapshot.MerkleRoot, "merkle root "+b.Snapshot.MerkleRoot)
+
+	var ballots []tally.Ballot
+	for k, n := range counts {
+		ballots = append(ballots, tally.Ballot{Channel: k[0], Choice: k[1], FollowUp: k[2], Count: n, Shares: n})
+	}
+	if b.Spoiled > 0 {
+		ballots = append(ballots, tally.Ballot{Channel: "online", Choice: tally.SpoiledChoice, Count: b.Spoiled})
+	}
+	e := b.Election
+	result := tally.ForMethod(e.Method, e.Candidates, e.Seats, tieBreak).Tally(ballots)
+
+	s := b.Snapshot
+	if ref, ok := result.(*tally.ReferendumResult); ok {
+		c.check(ref.Online.Setuju == s.SetujuCount && ref.Offline.Setuju == s.OfflineSetuju, "setuju count")
+		c.check(ref.Online.TidakSetuju == s.TidakSetujuCount && ref.Offline.TidakSetuju == s.OfflineTidakSetuju, "tidak setuju count")
+		c.check(ref.Offline.TidakSah == s.OfflineTidakSah, "tidak sah count")
+		c.check(ref.Online.Kosong == s.KosongCount && ref.Offline.Kosong == s.OfflineKosong, "kosong count")
+		c.check(ref.Online.Rusak == s.RusakCount, "rusak count")
+	} else if s.Outcome != "" {
+		// the first line of a ranked outcome is the main question's result
+		announced, _, _ := strings.Cut(s.Outcome, "\n")
+		c.check(strings.HasPrefix(announced, result.Outcome()), "ranked outcome")
+	}
+	fmt.Fprintf(w, "recount: %s\n", result.Outcome())
+	if s.Outcome != "" {
+		fmt.Fprintf(w, "announced: %s\n", s.Outcome)
+	}
+	return !c.failed, nil
+}
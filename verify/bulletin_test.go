@@ -0,0 +1,99 @@
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+// signedBulletin wraps b as the server exports it, unsigned
+func signedBulletin(t *testing.T, b Bulletin) []byte {
+	t.Helper()
+	body, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+	raw, err := json.Marshal(SignedBulletin{Bulletin: body, SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// A hostile seat count is refused before STV counts, where it would loop
+// forever or divide by zero
+func TestCheckBulletinSeats(t *testing.T) {
+	candidates := []string{"A", "B", "C"}
+	for _, c := range []struct {
+		seats int
+		ok    bool
+	}{
+		{-1, false},
+		{0, false},
+		{1, true},
+		{2, true},
+		{3, false},
+		{4, false},
+	} {
+		raw := signedBulletin(t, Bulletin{
+			Format:   BulletinFormat,
+			Election: BulletinElection{Method: "stv", Candidates: candidates, Seats: c.seats},
+		})
+		_, err := CheckBulletin(io.Discard, raw, "")
+		if got := err == nil; got != c.ok {
+			t.Errorf("seats %d: err = %v, want ok %v", c.seats, err, c.ok)
+		}
+	}
+}
+
+// An announced key makes the signature mandatory
+func TestCheckBulletinUnsigned(t *testing.T) {
+	raw := signedBulletin(t, Bulletin{
+		Format:   BulletinFormat,
+		Election: BulletinElection{Method: "referendum"},
+		Snapshot: Snapshot{MerkleRoot: MerkleRoot(MerkleLevels(nil))},
+	})
+	if ok, err := CheckBulletin(io.Discard, raw, ""); err != nil || !ok {
+		t.Errorf("without a key: ok = %v, err = %v, want ok", ok, err)
+	}
+	if ok, err := CheckBulletin(io.Discard, raw, "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); err != nil || ok {
+		t.Errorf("with a key: ok = %v, err = %v, want a failed check", ok, err)
+	}
+}
+
+// Editing a choice while keeping the published leaves fails the check, as
+// the leaf commits to the choice
+func TestCheckBulletinLeafCommitsToChoice(t *testing.T) {
+	var ballots []BulletinBallot
+	var leaves [][]byte
+	for _, b := range []struct{ key, channel, choice string }{
+		{"online|aa11", "online", "setuju"},
+		{"online|bb22", "online", "tidak_setuju"},
+		{"offline|1", "offline", "setuju"},
+	} {
+		tag := MerkleTag(b.key)
+		leaf := MerkleLeaf(tag, b.channel, b.choice)
+		ballots = append(ballots, BulletinBallot{
+			Leaf: hex.EncodeToString(leaf), Tag: hex.EncodeToString(tag), Channel: b.channel, Choice: b.choice,
+		})
+		leaves = append(leaves, leaf)
+	}
+	bulletin := Bulletin{
+		Format:   BulletinFormat,
+		Election: BulletinElection{Method: "referendum"},
+		Snapshot: Snapshot{MerkleRoot: MerkleRoot(MerkleLevels(leaves)), SetujuCount: 1, TidakSetujuCount: 1, OfflineSetuju: 1},
+		Ballots:  ballots,
+	}
+	if ok, err := CheckBulletin(io.Discard, signedBulletin(t, bulletin), ""); err != nil || !ok {
+		t.Fatalf("as published: ok = %v, err = %v, want ok", ok, err)
+	}
+
+	bulletin.Ballots[1].Choice = "setuju"
+	bulletin.Snapshot.SetujuCount, bulletin.Snapshot.TidakSetujuCount = 2, 0
+	if ok, err := CheckBulletin(io.Discard, signedBulletin(t, bulletin), ""); err != nil || ok {
+		t.Errorf("with an edited choice: ok = %v, err = %v, want a failed check", ok, err)
+	}
+}
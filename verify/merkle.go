@@ -0,0 +1,70 @@
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// The ballot Merkle tree: leaves are sorted by hash, and leaves, nodes and
+// tags get different prefixes so one can't pass for another.
+
+// MerkleTag blinds the key of a ballot, "online|<receipt>" or
+// "offline|<id>". The bulletin publishes tags, so anyone can recompute a
+// leaf from the ballot it lists without learning the receipt.
+func MerkleTag(key string) []byte {
+	h := sha256.New()
+	h.Write([]byte{2})
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
+// MerkleLeaf hashes a ballot: its tag, then the channel and the stored
+// choice with any follow-up answer after a "|"
+func MerkleLeaf(tag []byte, channel, choice string) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(tag)
+	fmt.Fprintf(h, "%s|%s", channel, choice)
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// MerkleLevels builds the tree bottom-up over sorted leaf hashes: levels[0]
+// holds the leaves and the last level the root. A node without a sibling is
+// carried up unchanged.
+func MerkleLevels(leaves [][]byte) [][][]byte {
+	level := leaves
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// MerkleRoot is the hex root of the tree, the hash of nothing when there are
+// no ballots
+func MerkleRoot(levels [][][]byte) string {
+	top := levels[len(levels)-1]
+	if len(top) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+	return hex.EncodeToString(top[0])
+}
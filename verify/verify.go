@@ -0,0 +1,41 @@
+// Package verify checks the published records of an election offline: the
+// bulletin board export (ballots and announced totals) and the audit log
+// export (a signed hash chain). It holds the formats of both and needs no
+// database, so observers can build the checks on their own as
+// cmd/pemilihan-verify.
+package verify
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// checker prints one line per check and remembers whether any failed
+type checker struct {
+	w      io.Writer
+	failed bool
+}
+
+func (c *checker) check(ok bool, what string) {
+	status := "OK  "
+	if !ok {
+		status, c.failed = "FAIL", true
+	}
+	fmt.Fprintf(c.w, "%s %s\n", status, what)
+}
+
+// note prints a finding that is neither a pass nor a failure
+func (c *checker) note(format string, args ...interface{}) {
+	fmt.Fprintf(c.w, "--   "+format+"\n", args...)
+}
+
+// verifySignature reports whether sig (base64) is key's (base64) Ed25519
+// signature of msg
+func verifySignature(key, sig string, msg []byte) bool {
+	pk, err1 := base64.StdEncoding.DecodeString(key)
+	s, err2 := base64.StdEncoding.DecodeString(sig)
+	return err1 == nil && err2 == nil && len(pk) == ed25519.PublicKeySize &&
+		ed25519.Verify(ed25519.PublicKey(pk), msg, s)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// VoterBundle is everything stored about one voter
+type VoterBundle struct {
+	ExportedAt  time.Time         `json:"exported_at"`
+	Roll        map[string]string `json:"roll"`
+	Member      map[string]string `json:"member,omitempty"`
+	AuditEvents []AuditEvent      `json:"audit_events"`
+}
+
+// AuditEvent is one row of the audit ledger
+type AuditEvent struct {
+	ID      int64           `json:"id"`
+	At      time.Time       `json:"at"`
+	Actor   string          `json:"actor"`
+	Action  string          `json:"action"`
+	Subject string          `json:"subject"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+// rowToMap reads a single row into column -> text value
+func rowToMap(rows pgx.Rows) (map[string]string, error) {
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, pgx.ErrNoRows
+	}
+	values, err := rows.Values()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(values))
+	for i, fd := range rows.FieldDescriptions() {
+		if values[i] == nil {
+			m[string(fd.Name)] = ""
+			continue
+		}
+		m[string(fd.Name)] = fmt.Sprint(values[i])
+	}
+	return m, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// voterBundle collects the roll entry, member record and audit events for a code
+func (a *App) voterBundle(ctx context.Context, code string) (*VoterBundle, error) {
+	b := &VoterBundle{ExportedAt: time.Now(), AuditEvents: []AuditEvent{}}
+
+	// select every column so new fields are exported without code changes
+	rows, err := a.db.Query(ctx, `SELECT * FROM voters WHERE code = $1`, code)
+	if err != nil {
+		return nil, err
+	}
+	b.Roll, err = rowToMap(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = a.db.Query(ctx, `SELECT * FROM vote_master WHERE phone = $1`, b.Roll["phone"])
+	if err != nil {
+		return nil, err
+	}
+	b.Member, err = rowToMap(rows)
+	rows.Close()
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	// the subject gets their data in the clear, not as stored
+	for _, m := range []map[string]string{b.Roll, b.Member} {
+		for _, col := range []string{"name", "phone"} {
+			if v, ok := m[col]; ok {
+				if m[col], err = a.pii.open(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	rows, err = a.db.Query(ctx, `
+		SELECT id, at, actor, action, subject, COALESCE(detail, 'null'::jsonb)
+		FROM audit_events
+		WHERE subject = $1
+		ORDER BY id`, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.Subject, &e.Detail); err != nil {
+			return nil, err
+		}
+		b.AuditEvents = append(b.AuditEvents, e)
+	}
+	return b, rows.Err()
+}
+
+// adminVoterExportHandler downloads everything stored about one voter as
+// JSON (default) or CSV (?format=csv), e.g. to answer a data access request.
+func (a *App) adminVoterExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	code := strings.TrimSpace(r.URL.Query().Get("code"))
+	if code == "" {
+		http.Error(w, "kode diperlukan", http.StatusBadRequest)
+		return
+	}
+
+	bundle, err := a.voterBundle(ctx, code)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "kode tidak ditemukan", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logDB.Errorf("error exporting voter: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	a.audit(ctx, actorName(r), "voter.export", code, nil)
+
+	filename := fmt.Sprintf("data-peserta-%s", code)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") != "csv" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(bundle); err != nil {
+			logHTTP.Errorf("error encoding json: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Write([]byte("\xEF\xBB\xBF"))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"bagian", "kolom", "nilai"})
+	for _, k := range sortedKeys(bundle.Roll) {
+		cw.Write([]string{"roll", csvSafe(k), exportCell(k, bundle.Roll[k])})
+	}
+	for _, k := range sortedKeys(bundle.Member) {
+		cw.Write([]string{"member", csvSafe(k), exportCell(k, bundle.Member[k])})
+	}
+	for _, e := range bundle.AuditEvents {
+		cw.Write([]string{"audit", e.At.Format(time.RFC3339) + " " + e.Action, csvSafe(e.Actor + " " + string(e.Detail))})
+	}
+	cw.Flush()
+}
+
+// exportCell escapes a value of column k for the CSV export, see csvSafe
+func exportCell(k, v string) string {
+	if k == "phone" {
+		return csvPhone(v)
+	}
+	return csvSafe(v)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"pemilihan.gkjp.id/eligibility"
+)
+
+// Custom fields are extra columns of the roll that differ per deployment:
+// member ID, branch, seat class. VOTER_FIELDS names them, e.g.
+//
+//	VOTER_FIELDS="member_id:No. Anggota|branch:Cabang|seat_class:Kelas"
+//
+// and their values live in the member attributes (vote_master.attributes,
+// see eligibility.go), so adding one needs no migration. They are shown as
+// columns of the admin voter list, filtered on with ?field.<name>=, written
+// to the CSV export, and imported through the voter API either in
+// "attributes" or as top-level keys of their own name.
+
+// maxVoterFields caps VOTER_FIELDS; every field is a column of the list
+const maxVoterFields = 10
+
+// fieldParamPrefix starts the query parameters filtering on an attribute
+const fieldParamPrefix = "field."
+
+// VoterField is a custom column of the roll
+type VoterField struct {
+	Key   string // attribute name
+	Label string // column heading; the key when not given
+}
+
+// loadVoterFields reads VOTER_FIELDS: key:Label pairs separated by "|"
+func loadVoterFields() ([]VoterField, error) {
+	var fields []VoterField
+	seen := map[string]bool{}
+	for _, s := range strings.Split(os.Getenv("VOTER_FIELDS"), "|") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		key, label, _ := strings.Cut(s, ":")
+		f := VoterField{Key: strings.ToLower(strings.TrimSpace(key)), Label: strings.TrimSpace(label)}
+		if !eligibility.ValidName(f.Key) || reservedVoterKeys[f.Key] {
+			return nil, fmt.Errorf("invalid VOTER_FIELDS name %q: use letters, digits and _, not a built-in column", f.Key)
+		}
+		if seen[f.Key] {
+			return nil, fmt.Errorf("VOTER_FIELDS lists %q twice", f.Key)
+		}
+		seen[f.Key] = true
+		if f.Label == "" {
+			f.Label = f.Key
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) > maxVoterFields {
+		return nil, fmt.Errorf("VOTER_FIELDS: at most %d fields", maxVoterFields)
+	}
+	return fields, nil
+}
+
+// reservedVoterKeys are the keys of APIVoterInput, which a custom field
+// can't take over
+var reservedVoterKeys = map[string]bool{"code": true, "name": true, "phone": true, "group": true, "shares": true, "attributes": true}
+
+// fieldValues lists the values of the custom fields in attrs, in order
+func fieldValues(fields []VoterField, attrs map[string]string) []string {
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		values[i] = attrs[f.Key]
+	}
+	return values
+}
+
+// mapFieldKeys moves the custom fields given as top-level keys of the raw
+// voter object into in.Attributes; a value under "attributes" wins. Values
+// that aren't strings or numbers are an error.
+func (a *App) mapFieldKeys(raw json.RawMessage, in *APIVoterInput) error {
+	if len(a.voterFields) == 0 {
+		return nil
+	}
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &top); err != nil {
+		return err
+	}
+	for _, f := range a.voterFields {
+		v, ok := top[f.Key]
+		if !ok {
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(v, &value); err != nil {
+			var n json.Number
+			if err := json.Unmarshal(v, &n); err != nil {
+				return fmt.Errorf("%s must be a string", f.Key)
+			}
+			value = n.String()
+		}
+		if _, set := in.Attributes[f.Key]; set {
+			continue
+		}
+		if in.Attributes == nil {
+			in.Attributes = map[string]string{}
+		}
+		in.Attributes[f.Key] = value
+	}
+	return nil
+}
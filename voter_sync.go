@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// apiMaxBulk caps the rows of one bulk upsert
+const apiMaxBulk = 10000
+
+// Row outcomes of a bulk upsert
+const (
+	bulkCreated   = "created"
+	bulkUpdated   = "updated"
+	bulkUnchanged = "unchanged"
+	bulkError     = "error"
+)
+
+var errPhoneAfterVote = errors.New("voter has already voted, phone can't change")
+
+// APIBulkResult is the outcome of one row of a bulk upsert
+type APIBulkResult struct {
+	Index  int    `json:"index"`
+	Code   string `json:"code,omitempty"`
+	Status string `json:"status"` // created / updated / unchanged / error
+	Error  string `json:"error,omitempty"`
+}
+
+// APIBulkResponse answers PUT /api/v1/elections/{id}/voters
+type APIBulkResponse struct {
+	Created   int             `json:"created"`
+	Updated   int             `json:"updated"`
+	Unchanged int             `json:"unchanged"`
+	Failed    int             `json:"failed"`
+	Results   []APIBulkResult `json:"results"`
+}
+
+// readBulkVoters reads a JSON array of voters or an NDJSON stream (one
+// voter per line). Rows of the wrong shape are reported by index instead of
+// failing the whole request; only broken JSON does.
+func (a *App) readBulkVoters(body io.Reader) ([]APIVoterInput, map[int]string, error) {
+	br := bufio.NewReader(body)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(br)
+	array := first == '['
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var rows []APIVoterInput
+	bad := map[int]string{}
+	for i := 0; ; i++ {
+		if array && !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if !array && errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if i >= apiMaxBulk {
+			return nil, nil, fmt.Errorf("at most %d voters per request", apiMaxBulk)
+		}
+		var in APIVoterInput
+		if err := json.Unmarshal(raw, &in); err != nil {
+			bad[i] = "row is not a voter object"
+		} else if err := a.mapFieldKeys(raw, &in); err != nil {
+			bad[i] = err.Error()
+		}
+		rows = append(rows, in)
+	}
+	return rows, bad, nil
+}
+
+// peekNonSpace returns the first non-whitespace byte of br without
+// consuming it
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			return b[0], nil
+		}
+		br.ReadByte()
+	}
+}
+
+// apiBulkVoters: PUT /api/v1/elections/{id}/voters creates or updates voters
+// in bulk. Rows are matched on code, or on phone when they carry no code;
+// name, phone and group replace the stored values, shares and attributes
+// only when given.
+// Each row is applied on its own, so one bad row doesn't hold up the rest.
+// Only the current election ("current") has an editable roll.
+func (a *App) apiBulkVoters(w http.ResponseWriter, r *http.Request, electionID string) {
+	ctx := r.Context()
+	if electionID != "current" {
+		id, err := strconv.Atoi(electionID)
+		if err != nil {
+			apiError(w, r, http.StatusNotFound, "election not found")
+			return
+		}
+		var exists bool
+		err = a.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM elections WHERE id = $1)`, id).Scan(&exists)
+		if err != nil {
+			logDB.Errorf("error getting election: %v", err)
+			apiError(w, r, http.StatusInternalServerError, "database error")
+			return
+		}
+		if !exists {
+			apiError(w, r, http.StatusNotFound, "election not found")
+			return
+		}
+		apiError(w, r, http.StatusConflict, "election is archived and read-only")
+		return
+	}
+
+	rows, bad, err := a.readBulkVoters(http.MaxBytesReader(w, r.Body, 8<<20))
+	if errors.Is(err, io.EOF) {
+		apiError(w, r, http.StatusBadRequest, "empty body")
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, "invalid JSON or NDJSON body: "+err.Error())
+		return
+	}
+
+	resp := APIBulkResponse{Results: []APIBulkResult{}}
+	for i, in := range rows {
+		res := APIBulkResult{Index: i}
+		in.Code = strings.TrimSpace(in.Code)
+		in.Name = strings.TrimSpace(in.Name)
+		in.Phone = strings.TrimSpace(in.Phone)
+		in.Group = strings.TrimSpace(in.Group)
+		switch {
+		case bad[i] != "":
+			res.Status, res.Error = bulkError, bad[i]
+		case in.Name == "" || in.Phone == "":
+			res.Status, res.Error = bulkError, "name and phone are required"
+		case in.Shares != nil && *in.Shares < 0:
+			res.Status, res.Error = bulkError, "shares can't be negative"
+		default:
+			if in.Attributes, err = normalizeAttributes(in.Attributes); err != nil {
+				res.Status, res.Error = bulkError, err.Error()
+				break
+			}
+			res.Code, res.Status, err = a.upsertVoter(ctx, in)
+			if errors.Is(err, errVoterExists) || errors.Is(err, errCodeTaken) || errors.Is(err, errPhoneAfterVote) || errors.Is(err, errVoterQuota) || errors.Is(err, errIneligible) {
+				res.Status, res.Error = bulkError, err.Error()
+			} else if err != nil {
+				logDB.Errorf("error upserting voter: %v", err)
+				res.Status, res.Error = bulkError, "database error"
+			}
+		}
+		switch res.Status {
+		case bulkCreated:
+			resp.Created++
+		case bulkUpdated:
+			resp.Updated++
+		case bulkUnchanged:
+			resp.Unchanged++
+		default:
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, res)
+	}
+
+	a.audit(ctx, actorName(r), "voter.import", "", map[string]int{
+		"created":   resp.Created,
+		"updated":   resp.Updated,
+		"unchanged": resp.Unchanged,
+		"failed":    resp.Failed,
+	})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// upsertVoter updates the voter matching in (by code, else by phone) or adds
+// it to the roll, returning its code and whether it was created, updated or
+// already up to date
+func (a *App) upsertVoter(ctx context.Context, in APIVoterInput) (string, string, error) {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	match, arg := "v.code = $1", in.Code
+	if in.Code == "" {
+		match, arg = "v.phone = $1", a.pii.sealPhone(in.Phone)
+	}
+	var id, shares int
+	var code, phone, name, group string
+	var attrs map[string]string
+	var used bool
+	err = tx.QueryRow(ctx, `
+		SELECT v.id, v.code, v.phone, COALESCE(vm.name, v.name), COALESCE(vm.wilayah, ''), v.shares,
+			COALESCE(vm.attributes, '{}'), v.used
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE `+match+`
+		FOR UPDATE OF v`, arg).Scan(&id, &code, &phone, &name, &group, &shares, &attrs, &used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		tx.Rollback(ctx)
+		code, err := a.createVoter(ctx, in)
+		if err != nil {
+			return "", "", err
+		}
+		return code, bulkCreated, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if err := a.pii.openAll(&phone, &name); err != nil {
+		return "", "", err
+	}
+	if attrs, err = a.pii.openAttributes(attrs); err != nil {
+		return "", "", err
+	}
+	sameShares := in.Shares == nil || *in.Shares == shares
+	merged := mergeAttributes(attrs, in.Attributes)
+	sameAttrs := maps.Equal(merged, attrs)
+	if phone == in.Phone && name == in.Name && group == in.Group && sameShares && sameAttrs {
+		return code, bulkUnchanged, nil
+	}
+	if in.Shares != nil {
+		shares = *in.Shares
+	}
+
+	sealedName, sealedPhone, sealedAttrs := a.pii.seal(in.Name), a.pii.sealPhone(in.Phone), a.pii.sealAttributes(merged)
+	if phone != in.Phone {
+		if used {
+			return "", "", errPhoneAfterVote
+		}
+		var taken bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM voters WHERE phone = $1)`, sealedPhone).Scan(&taken); err != nil {
+			return "", "", err
+		}
+		if taken {
+			return "", "", errVoterExists
+		}
+	}
+	if _, err := tx.Exec(ctx, `UPDATE voters SET phone = $2, name = $3, shares = $4 WHERE id = $1`, id, sealedPhone, sealedName, shares); err != nil {
+		return "", "", err
+	}
+	tag, err := tx.Exec(ctx, `UPDATE vote_master SET name = $2, wilayah = $3, attributes = $4 WHERE phone = $1`,
+		sealedPhone, sealedName, in.Group, attributesJSON(sealedAttrs))
+	if err != nil {
+		return "", "", err
+	}
+	if tag.RowsAffected() == 0 {
+		_, err = tx.Exec(ctx, `INSERT INTO vote_master (name, wilayah, phone, attributes) VALUES ($1, $2, $3, $4)`,
+			sealedName, in.Group, sealedPhone, attributesJSON(sealedAttrs))
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return code, bulkUpdated, tx.Commit(ctx)
+}
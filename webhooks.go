@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Events a webhook can subscribe to. Apart from vote.cast and audit.seal
+// these are the audit actions of the same name.
+var webhookEvents = []string{
+	"vote.cast",  // a ballot was recorded; data.channel is online or offline
+	"audit.seal", // the audit log was sealed; subscribers anchor data.hash outside this server
+	"tally.snapshot",
+	"election.archive",
+	"election.merge",
+	"voter.create",
+	"voter.delete",
+	"voter.import",
+	"voter.sync",
+	"voter.erase",
+	"retention.run",
+	"account.login_alert", // repeated failed admin sign-ins, or one from a new network while voting is open
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	webhookSecretPrefix = "whsec_"
+	webhookMaxAttempts  = 8
+	webhookPollInterval = 5 * time.Second
+	webhookTimeout      = 10 * time.Second
+	webhookLease        = 2 * time.Minute // a claimed delivery is retried after this if the worker dies
+	webhookKeepDays     = 30              // finished deliveries are pruned after this
+)
+
+// deliveryBackoff is the wait before the next attempt: 30s, 1m, 2m, ... up
+// to 6h
+func deliveryBackoff(attempts int) time.Duration {
+	if attempts > 10 {
+		return 6 * time.Hour
+	}
+	return min(30*time.Second<<(attempts-1), 6*time.Hour)
+}
+
+// Webhook is a subscription. The secret is only returned when it is set.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+	Secret    string    `json:"secret,omitempty"`
+}
+
+// Subscribed reports whether the webhook receives event
+func (h Webhook) Subscribed(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookInput creates or updates a subscription
+type WebhookInput struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"` // generated on create when empty; rotated on update when set
+	Events []string `json:"events"`
+	Active *bool    `json:"active,omitempty"` // defaults to true
+}
+
+// WebhookDelivery is one event sent (or to be sent) to a subscription
+type WebhookDelivery struct {
+	ID            int        `json:"id"`
+	WebhookID     int        `json:"webhook_id"`
+	Event         string     `json:"event"`
+	Attempts      int        `json:"attempts"`
+	CreatedAt     time.Time  `json:"created_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	FailedAt      *time.Time `json:"failed_at"` // gave up after webhookMaxAttempts
+	LastStatus    *int       `json:"last_status"`
+	LastError     *string    `json:"last_error"`
+}
+
+// State is pending, delivered or failed
+func (d WebhookDelivery) State() string {
+	switch {
+	case d.DeliveredAt != nil:
+		return "delivered"
+	case d.FailedAt != nil:
+		return "failed"
+	}
+	return "pending"
+}
+
+type WebhookList struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type WebhookDeliveryList struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+type WebhooksData struct {
+	Webhooks   []Webhook
+	Events     []string
+	Deliveries []WebhookDelivery
+	NewSecret  string
+	Message    string
+	Error      string
+}
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// normalize trims and checks the input
+func (in *WebhookInput) normalize() error {
+	in.URL = strings.TrimSpace(in.URL)
+	u, err := url.Parse(in.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	seen := map[string]bool{}
+	var events []string
+	for _, e := range in.Events {
+		e = strings.TrimSpace(e)
+		if !validWebhookEvent(e) {
+			return fmt.Errorf("unknown event %q", e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			events = append(events, e)
+		}
+	}
+	if len(events) == 0 {
+		return errors.New("at least one event is required")
+	}
+	in.Events = events
+	in.Secret = strings.TrimSpace(in.Secret)
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + hex.EncodeToString(b), nil
+}
+
+// signWebhook is the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+const webhookColumns = `id, url, events, active, created_at, created_by`
+
+func scanWebhook(row pgx.Row) (Webhook, error) {
+	var h Webhook
+	err := row.Scan(&h.ID, &h.URL, &h.Events, &h.Active, &h.CreatedAt, &h.CreatedBy)
+	return h, err
+}
+
+func (a *App) listWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := a.db.Query(ctx, `SELECT `+webhookColumns+` FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+func (a *App) getWebhook(ctx context.Context, id int) (Webhook, error) {
+	h, err := scanWebhook(a.db.QueryRow(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return h, errWebhookNotFound
+	}
+	return h, err
+}
+
+func (a *App) createWebhook(ctx context.Context, in WebhookInput, actor string) (Webhook, error) {
+	if in.Secret == "" {
+		var err error
+		if in.Secret, err = newWebhookSecret(); err != nil {
+			return Webhook{}, err
+		}
+	}
+	active := in.Active == nil || *in.Active
+	h, err := scanWebhook(a.db.QueryRow(ctx, `
+		INSERT INTO webhooks (url, secret, events, active, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+webhookColumns, in.URL, in.Secret, in.Events, active, actor))
+	if err != nil {
+		return h, err
+	}
+	h.Secret = in.Secret
+	a.audit(ctx, actor, "webhook.create", strconv.Itoa(h.ID), map[string]interface{}{"url": h.URL, "events": h.Events})
+	return h, nil
+}
+
+// updateWebhook replaces URL, events and active flag, and the secret when
+// one is given
+func (a *App) updateWebhook(ctx context.Context, id int, in WebhookInput, actor string) (Webhook, error) {
+	h, err := scanWebhook(a.db.QueryRow(ctx, `
+		UPDATE webhooks
+		SET url = $2, events = $3, active = COALESCE($4, active), secret = COALESCE(NULLIF($5, ''), secret)
+		WHERE id = $1
+		RETURNING `+webhookColumns, id, in.URL, in.Events, in.Active, in.Secret))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return h, errWebhookNotFound
+	}
+	if err != nil {
+		return h, err
+	}
+	h.Secret = in.Secret
+	a.audit(ctx, actor, "webhook.update", strconv.Itoa(id), map[string]interface{}{
+		"url": h.URL, "events": h.Events, "active": h.Active, "secret_rotated": in.Secret != "",
+	})
+	return h, nil
+}
+
+// deleteWebhook removes a subscription with its pending deliveries
+func (a *App) deleteWebhook(ctx context.Context, id int, actor string) error {
+	tag, err := a.db.Exec(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errWebhookNotFound
+	}
+	a.audit(ctx, actor, "webhook.delete", strconv.Itoa(id), nil)
+	return nil
+}
+
+// listWebhookDeliveries returns the latest deliveries, of one webhook or
+// (webhookID 0) of all
+func (a *App) listWebhookDeliveries(ctx context.Context, webhookID, limit int) ([]WebhookDelivery, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT id, webhook_id, event, attempts, created_at, next_attempt_at, delivered_at, failed_at, last_status, last_error
+		FROM webhook_deliveries
+		WHERE $1 = 0 OR webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Attempts, &d.CreatedAt, &d.NextAttemptAt,
+			&d.DeliveredAt, &d.FailedAt, &d.LastStatus, &d.LastError); err != nil {
+			return nil, err
+		}
+		if d.DeliveredAt != nil || d.FailedAt != nil {
+			d.NextAttemptAt = nil
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// enqueueWebhooks queues event for every active subscription to it through
+// db, usually the transaction that records the event; the delivery worker
+// sends them.
+func enqueueWebhooks(ctx context.Context, db execer, event, subject string, data interface{}) error {
+	if !validWebhookEvent(event) {
+		return nil
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":       event,
+		"occurred_at": time.Now(),
+		"subject":     subject,
+		"data":        data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT id, $1, $2 FROM webhooks WHERE active AND $1 = ANY(events)`, event, payload)
+	return err
+}
+
+type pendingDelivery struct {
+	ID       int
+	Event    string
+	Payload  []byte
+	Attempts int
+	URL      string
+	Secret   string
+}
+
+// claimWebhookDeliveries takes the due deliveries and pushes their next
+// attempt out by webhookLease, so a crashed worker's claims are retried
+func (a *App) claimWebhookDeliveries(ctx context.Context) ([]pendingDelivery, error) {
+	rows, err := a.db.Query(ctx, `
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1, next_attempt_at = NOW() + $1 * interval '1 second'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT 20
+			FOR UPDATE SKIP LOCKED)
+		RETURNING d.id, d.event, d.payload, d.attempts, w.url, w.secret`, int(webhookLease.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var claimed []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.ID, &d.Event, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, d)
+	}
+	return claimed, rows.Err()
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// sendWebhook POSTs one delivery with its signature headers
+func sendWebhook(ctx context.Context, d pendingDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pemilihan-gkjp-webhook/1")
+	req.Header.Set("X-Webhook-Id", strconv.Itoa(d.ID))
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(d.Secret, timestamp, d.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliverWebhooks sends the due deliveries and records the outcome
+func (a *App) deliverWebhooks(ctx context.Context) error {
+	claimed, err := a.claimWebhookDeliveries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, d := range claimed {
+		status, sendErr := sendWebhook(ctx, d)
+		var lastStatus *int
+		if status != 0 {
+			lastStatus = &status
+		}
+		switch {
+		case sendErr == nil:
+			_, err = a.db.Exec(ctx, `
+				UPDATE webhook_deliveries SET delivered_at = NOW(), last_status = $2, last_error = NULL
+				WHERE id = $1`, d.ID, lastStatus)
+		case d.Attempts >= webhookMaxAttempts:
+			_, err = a.db.Exec(ctx, `
+				UPDATE webhook_deliveries SET failed_at = NOW(), last_status = $2, last_error = $3
+				WHERE id = $1`, d.ID, lastStatus, sendErr.Error())
+			if err == nil {
+				a.notify(ctx, notification{
+					Kind:           NotifyDeliveryFailed,
+					Message:        fmt.Sprintf("Webhook %s ke %s gagal dikirim setelah %d percobaan: %v", d.Event, d.URL, d.Attempts, sendErr),
+					Link:           "/admin/webhooks",
+					SuperadminOnly: true,
+				})
+			}
+		default:
+			_, err = a.db.Exec(ctx, `
+				UPDATE webhook_deliveries SET next_attempt_at = $2, last_status = $3, last_error = $4
+				WHERE id = $1`, d.ID, time.Now().Add(deliveryBackoff(d.Attempts)), lastStatus, sendErr.Error())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneWebhookDeliveries drops the finished deliveries older than
+// webhookKeepDays
+func (a *App) pruneWebhookDeliveries(ctx context.Context) error {
+	_, err := a.db.Exec(ctx, `
+		DELETE FROM webhook_deliveries
+		WHERE (delivered_at IS NOT NULL OR failed_at IS NOT NULL)
+		AND created_at < NOW() - $1 * interval '1 day'`, webhookKeepDays)
+	return err
+}
+
+// retryWebhookDelivery queues a failed delivery again
+func (a *App) retryWebhookDelivery(ctx context.Context, id int) (bool, error) {
+	tag, err := a.db.Exec(ctx, `
+		UPDATE webhook_deliveries SET failed_at = NULL, attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND failed_at IS NOT NULL`, id)
+	return tag.RowsAffected() > 0, err
+}
+
+// apiWebhooks handles /api/v1/webhooks[/{id}[/deliveries]]
+func (a *App) apiWebhooks(w http.ResponseWriter, r *http.Request, rest string) {
+	ctx := r.Context()
+	idStr, sub, _ := strings.Cut(rest, "/")
+
+	if idStr == "" {
+		switch r.Method {
+		case http.MethodGet:
+			hooks, err := a.listWebhooks(ctx)
+			if err != nil {
+				logMailer.Errorf("error getting webhooks: %v", err)
+				apiError(w, r, http.StatusInternalServerError, "database error")
+				return
+			}
+			writeJSON(w, http.StatusOK, WebhookList{Webhooks: hooks})
+		case http.MethodPost:
+			in, ok := decodeWebhookInput(w, r)
+			if !ok {
+				return
+			}
+			h, err := a.createWebhook(ctx, in, actorName(r))
+			if err != nil {
+				logMailer.Errorf("error creating webhook: %v", err)
+				apiError(w, r, http.StatusInternalServerError, "database error")
+				return
+			}
+			w.Header().Set("Location", fmt.Sprintf("/api/v1/webhooks/%d", h.ID))
+			writeJSON(w, http.StatusCreated, h)
+		default:
+			apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		apiError(w, r, http.StatusNotFound, "webhook not found")
+		return
+	}
+	switch {
+	case sub == "deliveries" && r.Method == http.MethodGet:
+		if _, err := a.getWebhook(ctx, id); err != nil {
+			a.apiWebhookError(w, r, err)
+			return
+		}
+		limit, _ := pageParams(r)
+		deliveries, err := a.listWebhookDeliveries(ctx, id, limit)
+		if err != nil {
+			logMailer.Errorf("error getting webhook deliveries: %v", err)
+			apiError(w, r, http.StatusInternalServerError, "database error")
+			return
+		}
+		writeJSON(w, http.StatusOK, WebhookDeliveryList{Deliveries: deliveries})
+	case sub != "":
+		apiError(w, r, http.StatusNotFound, "not found")
+	case r.Method == http.MethodGet:
+		h, err := a.getWebhook(ctx, id)
+		if err != nil {
+			a.apiWebhookError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, h)
+	case r.Method == http.MethodPut:
+		in, ok := decodeWebhookInput(w, r)
+		if !ok {
+			return
+		}
+		h, err := a.updateWebhook(ctx, id, in, actorName(r))
+		if err != nil {
+			a.apiWebhookError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, h)
+	case r.Method == http.MethodDelete:
+		if err := a.deleteWebhook(ctx, id, actorName(r)); err != nil {
+			a.apiWebhookError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func decodeWebhookInput(w http.ResponseWriter, r *http.Request) (WebhookInput, bool) {
+	var in WebhookInput
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&in); err != nil {
+		apiError(w, r, http.StatusBadRequest, "invalid JSON body")
+		return in, false
+	}
+	if err := in.normalize(); err != nil {
+		apiError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return in, false
+	}
+	return in, true
+}
+
+func (a *App) apiWebhookError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errWebhookNotFound) {
+		apiError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	logMailer.Errorf("error handling webhook: %v", err)
+	apiError(w, r, http.StatusInternalServerError, "database error")
+}
+
+// adminWebhooksHandler manages webhook subscriptions and shows the latest
+// deliveries. Superadmin only.
+func (a *App) adminWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := WebhooksData{Events: webhookEvents}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.ParseForm()
+		in := WebhookInput{URL: r.FormValue("url"), Secret: r.FormValue("secret"), Events: r.Form["event"]}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		switch r.FormValue("action") {
+		case "create", "update":
+			if err := in.normalize(); err != nil {
+				data.Error = err.Error()
+				break
+			}
+			if r.FormValue("action") == "create" {
+				h, err := a.createWebhook(ctx, in, actorName(r))
+				if err != nil {
+					logMailer.Errorf("error creating webhook: %v", err)
+					data.Error = "database error"
+					break
+				}
+				data.NewSecret = h.Secret
+				data.Message = "Webhook dibuat. Simpan secret ini sekarang; secret tidak akan ditampilkan lagi."
+				break
+			}
+			active := r.FormValue("active") == "on"
+			in.Active = &active
+			if _, err := a.updateWebhook(ctx, id, in, actorName(r)); err != nil {
+				if errors.Is(err, errWebhookNotFound) {
+					data.Error = "webhook tidak ditemukan"
+					break
+				}
+				logMailer.Errorf("error updating webhook: %v", err)
+				data.Error = "database error"
+				break
+			}
+			data.Message = "Webhook disimpan"
+		case "delete":
+			if err := a.deleteWebhook(ctx, id, actorName(r)); err != nil {
+				if errors.Is(err, errWebhookNotFound) {
+					data.Error = "webhook tidak ditemukan"
+					break
+				}
+				logMailer.Errorf("error deleting webhook: %v", err)
+				data.Error = "database error"
+				break
+			}
+			data.Message = "Webhook dihapus"
+		case "retry":
+			ok, err := a.retryWebhookDelivery(ctx, id)
+			if err != nil {
+				logMailer.Errorf("error retrying webhook delivery: %v", err)
+				data.Error = "database error"
+				break
+			}
+			if !ok {
+				data.Error = "pengiriman tidak ditemukan atau belum gagal"
+				break
+			}
+			data.Message = "Pengiriman dijadwalkan ulang"
+		default:
+			data.Error = "aksi tidak dikenal"
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	if data.Webhooks, err = a.listWebhooks(ctx); err != nil {
+		logMailer.Errorf("error getting webhooks: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if data.Deliveries, err = a.listWebhookDeliveries(ctx, 0, 50); err != nil {
+		logMailer.Errorf("error getting webhook deliveries: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := a.tmpl.ExecuteTemplate(w, "webhooks.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A voter's weight (voters.shares: shares held, votes represented) is what
+// the ballot counts for in SHARE_QUORUM; the count itself stays one ballot,
+// one vote. The voter API sets it per voter; /admin/weights lets the superadmin set it by hand
+// or from a CSV of codes and weights, checked against TOTAL_SHARES when the
+// organization knows how many shares there are. Weights are frozen once
+// voting opens, as changing them would move the quorums mid-election.
+
+const (
+	// maxShares caps a single weight and TOTAL_SHARES
+	maxShares = 1_000_000_000
+	// maxWeightImport caps the rows of a weight CSV
+	maxWeightImport = 100000
+	// maxWeightFile caps the size of the uploaded CSV
+	maxWeightFile = 8 << 20
+	// weightListLimit caps the voters listed with a weight other than 1
+	weightListLimit = 500
+)
+
+// WeightRow is a voter with a weight other than the default 1
+type WeightRow struct {
+	Code   string
+	Name   string
+	Shares int
+	Used   bool
+}
+
+// WeightsData is the data of weights.html
+type WeightsData struct {
+	Voters    []WeightRow // weights other than 1, heaviest first
+	Truncated bool        // more than weightListLimit of them
+	Count     int         // voters on the roll
+	Sum       int         // their weights together
+	Total     int         // TOTAL_SHARES, or 0
+	Locked    bool        // voting has opened
+	Message   string
+	Error     string
+}
+
+// Missing is how far the roll's weights fall short of TOTAL_SHARES
+func (d WeightsData) Missing() int {
+	if d.Total == 0 || d.Sum >= d.Total {
+		return 0
+	}
+	return d.Total - d.Sum
+}
+
+// adminWeightsHandler: GET /admin/weights shows the weights of the roll;
+// POST sets one (action=set) or imports a CSV of them (action=import).
+// Superadmin only.
+func (a *App) adminWeightsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := WeightsData{Total: a.ballot.TotalShares, Locked: !time.Now().Before(a.voteStart)}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxWeightFile+64<<10)
+		if data.Locked {
+			data.Error = "bobot tidak dapat diubah setelah pemilihan dibuka"
+			break
+		}
+		switch r.FormValue("action") {
+		case "set":
+			code := strings.TrimSpace(r.FormValue("code"))
+			shares, err := parseShares(r.FormValue("shares"))
+			if code == "" {
+				err = errors.New("kode pemilih diperlukan")
+			}
+			if err != nil {
+				data.Error = err.Error()
+				break
+			}
+			if _, err := a.applyWeights(ctx, map[string]int{code: shares}); err != nil {
+				data.Error = err.Error()
+				break
+			}
+			a.audit(ctx, actorName(r), "voter.weight", code, map[string]int{"shares": shares})
+			data.Message = fmt.Sprintf("Bobot %s menjadi %d", code, shares)
+		case "import":
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				data.Error = "file CSV diperlukan"
+				break
+			}
+			defer file.Close()
+			weights, err := readWeights(file)
+			if err != nil {
+				data.Error = err.Error()
+				break
+			}
+			changed, err := a.applyWeights(ctx, weights)
+			if err != nil {
+				data.Error = err.Error()
+				break
+			}
+			a.audit(ctx, actorName(r), "voter.weight_import", "", map[string]int{"rows": len(weights), "changed": changed})
+			data.Message = fmt.Sprintf("%d baris dibaca, bobot %d pemilih diubah", len(weights), changed)
+		default:
+			data.Error = "aksi tidak dikenal"
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := a.loadWeights(ctx, &data); err != nil {
+		logDB.Errorf("error getting weights: %v", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if err := a.tmpl.ExecuteTemplate(w, "weights.html", data); err != nil {
+		logHTTP.Errorf("error executing template: %v", err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+	}
+}
+
+// parseShares reads a weight typed by the admin; the error is shown as-is
+func parseShares(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > maxShares {
+		return 0, fmt.Errorf("bobot %q tidak valid: isi bilangan bulat 0 sampai %d", s, maxShares)
+	}
+	return n, nil
+}
+
+// readWeights reads a CSV of code and weight per row, separated by , or ;
+// (as Excel writes it in Indonesian locales). A first row whose weight isn't
+// a number is taken as the header. The error is shown to the admin as-is.
+func readWeights(f io.Reader) (map[string]int, error) {
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, errors.New("gagal membaca file")
+	}
+	content := strings.TrimPrefix(string(b), "\xEF\xBB\xBF") // Excel's BOM
+	cr := csv.NewReader(strings.NewReader(content))
+	firstLine, _, _ := strings.Cut(content, "\n")
+	if strings.Contains(firstLine, ";") && !strings.Contains(firstLine, ",") {
+		cr.Comma = ';'
+	}
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	weights := map[string]int{}
+	for first := true; ; first = false {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("baris %d: CSV tidak valid", perr.Line)
+		}
+		if err != nil {
+			return nil, errors.New("gagal membaca file")
+		}
+		line, _ := cr.FieldPos(0)
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("baris %d: isi kode dan bobot", line)
+		}
+		code := strings.TrimSpace(rec[0])
+		if first {
+			if _, err := strconv.Atoi(strings.TrimSpace(rec[1])); err != nil {
+				continue // header
+			}
+		}
+		shares, err := parseShares(rec[1])
+		if err != nil {
+			return nil, fmt.Errorf("baris %d: %v", line, err)
+		}
+		if code == "" {
+			return nil, fmt.Errorf("baris %d: kode kosong", line)
+		}
+		if _, dup := weights[code]; dup {
+			return nil, fmt.Errorf("baris %d: kode %s muncul dua kali", line, code)
+		}
+		if len(weights) == maxWeightImport {
+			return nil, fmt.Errorf("paling banyak %d baris", maxWeightImport)
+		}
+		weights[code] = shares
+	}
+	if len(weights) == 0 {
+		return nil, errors.New("file tidak berisi bobot")
+	}
+	return weights, nil
+}
+
+// applyWeights sets the weights of the voters by code, all or none: every
+// code must be on the roll, and the roll's weights together may not exceed
+// TOTAL_SHARES afterwards. It returns how many weights changed; the error is
+// shown to the admin as-is.
+func (a *App) applyWeights(ctx context.Context, weights map[string]int) (int, error) {
+	codes := make([]string, 0, len(weights))
+	for code := range weights {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	shares := make([]int32, len(codes))
+	for i, code := range codes {
+		shares[i] = int32(weights[code])
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		logDB.Errorf("error setting weights: %v", err)
+		return 0, errors.New("database error")
+	}
+	defer tx.Rollback(ctx)
+
+	// no voter comes or goes while the sum is checked
+	if _, err := tx.Exec(ctx, `LOCK TABLE voters IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		logDB.Errorf("error setting weights: %v", err)
+		return 0, errors.New("database error")
+	}
+	unknown, err := unknownCodes(ctx, tx, codes)
+	if err != nil {
+		logDB.Errorf("error setting weights: %v", err)
+		return 0, errors.New("database error")
+	}
+	if len(unknown) > 0 {
+		return 0, fmt.Errorf("kode tidak ada di daftar pemilih: %s", strings.Join(unknown, ", "))
+	}
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE voters v SET shares = w.shares
+		FROM unnest($1::text[], $2::int[]) AS w (code, shares)
+		WHERE v.code = w.code AND v.shares <> w.shares`, codes, shares)
+	if err != nil {
+		logDB.Errorf("error setting weights: %v", err)
+		return 0, errors.New("database error")
+	}
+	if a.ballot.TotalShares > 0 {
+		var sum int
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(shares), 0) FROM voters`).Scan(&sum); err != nil {
+			logDB.Errorf("error setting weights: %v", err)
+			return 0, errors.New("database error")
+		}
+		if sum > a.ballot.TotalShares {
+			return 0, fmt.Errorf("jumlah bobot menjadi %d, melebihi TOTAL_SHARES %d; tidak ada yang diubah", sum, a.ballot.TotalShares)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		logDB.Errorf("error setting weights: %v", err)
+		return 0, errors.New("database error")
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// unknownCodes lists up to five of codes that aren't on the roll
+func unknownCodes(ctx context.Context, q queryer, codes []string) ([]string, error) {
+	rows, err := q.Query(ctx, `
+		SELECT w.code FROM unnest($1::text[]) AS w (code)
+		WHERE NOT EXISTS (SELECT 1 FROM voters v WHERE v.code = w.code)
+		ORDER BY w.code LIMIT 5`, codes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unknown []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		unknown = append(unknown, code)
+	}
+	return unknown, rows.Err()
+}
+
+// loadWeights fills the roll's totals and the voters weighing other than 1
+func (a *App) loadWeights(ctx context.Context, data *WeightsData) error {
+	err := a.db.QueryRow(ctx, `SELECT COUNT(*), COALESCE(SUM(shares), 0) FROM voters`).Scan(&data.Count, &data.Sum)
+	if err != nil {
+		return err
+	}
+	rows, err := a.db.Query(ctx, `
+		SELECT v.code, COALESCE(vm.name, v.name), v.shares, v.used
+		FROM voters v LEFT JOIN vote_master vm ON v.phone = vm.phone
+		WHERE v.shares <> 1
+		ORDER BY v.shares DESC, v.code
+		LIMIT $1`, weightListLimit+1)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v WeightRow
+		if err := rows.Scan(&v.Code, &v.Name, &v.Shares, &v.Used); err != nil {
+			return err
+		}
+		if err := a.pii.openAll(&v.Name); err != nil {
+			return err
+		}
+		data.Voters = append(data.Voters, v)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(data.Voters) > weightListLimit {
+		data.Voters, data.Truncated = data.Voters[:weightListLimit], true
+	}
+	return nil
+}
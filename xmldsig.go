@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// A SAML response is trusted for the XML signature over it (XML-DSig): the
+// digest of the signed element after exclusive XML canonicalization, and
+// the signature over the canonical SignedInfo, checked with the IdP's
+// certificate from its metadata (never with a key the document brings
+// along). Only what identity providers use for SAML is implemented:
+// enveloped signatures referring to an element's ID, exc-c14n without
+// comments, SHA-256 digests and RSA or ECDSA with SHA-256. Documents are
+// parsed into xmlNode trees that keep the prefixes as written, which the
+// canonicalization needs.
+
+const (
+	dsigNS             = "http://www.w3.org/2000/09/xmldsig#"
+	dsigExcC14N        = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	dsigEnveloped      = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	dsigDigestSHA256   = "http://www.w3.org/2001/04/xmlenc#sha256"
+	dsigRSASHA256      = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	dsigECDSASHA256    = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	xmlNamespacePrefix = "http://www.w3.org/XML/1998/namespace"
+)
+
+// xmlNode is an element; its children are *xmlNode and string (text)
+type xmlNode struct {
+	prefix   string
+	local    string
+	attrs    []xml.Attr // as written; Name.Space is the prefix
+	children []any
+	parent   *xmlNode
+}
+
+// parseXML reads a document into a tree. DTDs are refused.
+func parseXML(data []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *xmlNode
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{prefix: t.Name.Space, local: t.Name.Local, attrs: append([]xml.Attr(nil), t.Attr...), parent: cur}
+			if cur == nil {
+				if root != nil {
+					return nil, errors.New("xml: more than one root element")
+				}
+				root = n
+			} else {
+				cur.children = append(cur.children, n)
+			}
+			cur = n
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.prefix || t.Name.Local != cur.local {
+				return nil, errors.New("xml: mismatched end tag")
+			}
+			cur = cur.parent
+		case xml.CharData:
+			if cur != nil {
+				cur.children = append(cur.children, string(t))
+			}
+		case xml.Directive:
+			return nil, errors.New("xml: DTDs are not accepted")
+		case xml.ProcInst:
+			if cur != nil {
+				return nil, errors.New("xml: unexpected processing instruction")
+			}
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("xml: incomplete document")
+	}
+	return root, nil
+}
+
+// lookup resolves prefix ("" for the default namespace) at n
+func (n *xmlNode) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespacePrefix, true
+	}
+	for e := n; e != nil; e = e.parent {
+		for _, a := range e.attrs {
+			if (prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns") ||
+				(prefix != "" && a.Name.Space == "xmlns" && a.Name.Local == prefix) {
+				return a.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ns is the namespace of n
+func (n *xmlNode) ns() string {
+	uri, _ := n.lookup(n.prefix)
+	return uri
+}
+
+// attr returns the unprefixed attribute name
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// elements returns the child elements local in namespace ns
+func (n *xmlNode) elements(ns, local string) []*xmlNode {
+	var out []*xmlNode
+	for _, c := range n.children {
+		if e, ok := c.(*xmlNode); ok && e.local == local && e.ns() == ns {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// element returns the first child element local in namespace ns, or nil
+func (n *xmlNode) element(ns, local string) *xmlNode {
+	if els := n.elements(ns, local); len(els) > 0 {
+		return els[0]
+	}
+	return nil
+}
+
+// text returns the text directly inside n, trimmed
+func (n *xmlNode) text() string {
+	var b strings.Builder
+	for _, c := range n.children {
+		if s, ok := c.(string); ok {
+			b.WriteString(s)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// walk calls fn for n and every element below it
+func (n *xmlNode) walk(fn func(*xmlNode)) {
+	fn(n)
+	for _, c := range n.children {
+		if e, ok := c.(*xmlNode); ok {
+			e.walk(fn)
+		}
+	}
+}
+
+func (n *xmlNode) qname() string {
+	if n.prefix == "" {
+		return n.local
+	}
+	return n.prefix + ":" + n.local
+}
+
+// excC14N canonicalizes n with exclusive XML canonicalization, leaving out
+// the element exclude (the enveloped signature). inclusive lists the
+// prefixes of the InclusiveNamespaces PrefixList (#default for the default
+// namespace).
+func excC14N(n, exclude *xmlNode, inclusive []string) []byte {
+	var b bytes.Buffer
+	writeC14N(&b, n, exclude, inclusive, map[string]string{})
+	return b.Bytes()
+}
+
+func writeC14N(b *bytes.Buffer, n, exclude *xmlNode, inclusive []string, rendered map[string]string) {
+	// the namespaces visibly used by n, and those the prefix list asks for
+	used := map[string]bool{n.prefix: true}
+	var attrs []xml.Attr
+	for _, a := range n.attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		attrs = append(attrs, a)
+		if a.Name.Space != "" && a.Name.Space != "xml" {
+			used[a.Name.Space] = true
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if _, ok := n.lookup(p); ok {
+			used[p] = true
+		}
+	}
+
+	type nsDecl struct{ prefix, uri string }
+	var decls []nsDecl
+	for p := range used {
+		uri, found := n.lookup(p)
+		prev, had := rendered[p]
+		switch {
+		case p == "" && uri == "" && prev == "":
+			continue // no default namespace, and none to undo
+		case p != "" && !found:
+			continue
+		case had && prev == uri:
+			continue
+		}
+		decls = append(decls, nsDecl{p, uri})
+	}
+	sort.Slice(decls, func(i, j int) bool { return decls[i].prefix < decls[j].prefix })
+	if len(decls) > 0 {
+		inner := make(map[string]string, len(rendered)+len(decls))
+		for k, v := range rendered {
+			inner[k] = v
+		}
+		for _, d := range decls {
+			inner[d.prefix] = d.uri
+		}
+		rendered = inner
+	}
+
+	attrNS := func(a xml.Attr) string {
+		if a.Name.Space == "" {
+			return ""
+		}
+		uri, _ := n.lookup(a.Name.Space)
+		return uri
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		ni, nj := attrNS(attrs[i]), attrNS(attrs[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+
+	b.WriteString("<" + n.qname())
+	for _, d := range decls {
+		if d.prefix == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:` + d.prefix + `="`)
+		}
+		b.WriteString(c14nAttrEscaper.Replace(d.uri) + `"`)
+	}
+	for _, a := range attrs {
+		name := a.Name.Local
+		if a.Name.Space != "" {
+			name = a.Name.Space + ":" + name
+		}
+		b.WriteString(" " + name + `="` + c14nAttrEscaper.Replace(a.Value) + `"`)
+	}
+	b.WriteString(">")
+	for _, c := range n.children {
+		switch c := c.(type) {
+		case *xmlNode:
+			if c != exclude {
+				writeC14N(b, c, exclude, inclusive, rendered)
+			}
+		case string:
+			b.WriteString(c14nTextEscaper.Replace(c))
+		}
+	}
+	b.WriteString("</" + n.qname() + ">")
+}
+
+var (
+	c14nTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	c14nAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+// inclusivePrefixes reads the PrefixList of an exc-c14n transform or
+// canonicalization method
+func inclusivePrefixes(method *xmlNode) []string {
+	if in := method.element(dsigExcC14N, "InclusiveNamespaces"); in != nil {
+		return strings.Fields(in.attr("PrefixList"))
+	}
+	return nil
+}
+
+// decodeBase64Text decodes base64 that may be wrapped over lines
+func decodeBase64Text(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// verifyEnveloped checks the signature el carries over itself with the
+// certificates. el's ID must be unique in the document root, so the
+// signature can't be moved onto another element.
+func verifyEnveloped(root, el *xmlNode, certs []*x509.Certificate) error {
+	sigs := el.elements(dsigNS, "Signature")
+	if len(sigs) != 1 {
+		return fmt.Errorf("%s: expected one signature, found %d", el.local, len(sigs))
+	}
+	sig := sigs[0]
+	signedInfo := sig.element(dsigNS, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("signature without SignedInfo")
+	}
+	c14nMethod := signedInfo.element(dsigNS, "CanonicalizationMethod")
+	if c14nMethod == nil || c14nMethod.attr("Algorithm") != dsigExcC14N {
+		return errors.New("unsupported canonicalization (use exclusive c14n)")
+	}
+	sigMethod := signedInfo.element(dsigNS, "SignatureMethod")
+	if sigMethod == nil {
+		return errors.New("signature without SignatureMethod")
+	}
+
+	id := el.attr("ID")
+	if id == "" {
+		return fmt.Errorf("%s without ID", el.local)
+	}
+	seen := 0
+	root.walk(func(n *xmlNode) {
+		if n.attr("ID") == id {
+			seen++
+		}
+	})
+	if seen != 1 {
+		return fmt.Errorf("ID %q is not unique", id)
+	}
+	refs := signedInfo.elements(dsigNS, "Reference")
+	if len(refs) != 1 || refs[0].attr("URI") != "#"+id {
+		return fmt.Errorf("signature doesn't refer to %s %q", el.local, id)
+	}
+	ref := refs[0]
+
+	var inclusive []string
+	var excC14NTransform bool
+	if transforms := ref.element(dsigNS, "Transforms"); transforms != nil {
+		for _, t := range transforms.elements(dsigNS, "Transform") {
+			switch t.attr("Algorithm") {
+			case dsigEnveloped:
+			case dsigExcC14N:
+				excC14NTransform = true
+				inclusive = inclusivePrefixes(t)
+			default:
+				return fmt.Errorf("unsupported transform %s", t.attr("Algorithm"))
+			}
+		}
+	}
+	if !excC14NTransform {
+		return errors.New("unsupported transforms (use exclusive c14n)")
+	}
+	digestMethod := ref.element(dsigNS, "DigestMethod")
+	if digestMethod == nil || digestMethod.attr("Algorithm") != dsigDigestSHA256 {
+		return errors.New("unsupported digest (use SHA-256)")
+	}
+	digestValue := ref.element(dsigNS, "DigestValue")
+	if digestValue == nil {
+		return errors.New("reference without DigestValue")
+	}
+	want, err := decodeBase64Text(digestValue.text())
+	if err != nil {
+		return fmt.Errorf("bad DigestValue: %v", err)
+	}
+	got := sha256.Sum256(excC14N(el, sig, inclusive))
+	if subtle.ConstantTimeCompare(got[:], want) != 1 {
+		return fmt.Errorf("digest of %s doesn't match", el.local)
+	}
+
+	sigValue := sig.element(dsigNS, "SignatureValue")
+	if sigValue == nil {
+		return errors.New("signature without SignatureValue")
+	}
+	value, err := decodeBase64Text(sigValue.text())
+	if err != nil {
+		return fmt.Errorf("bad SignatureValue: %v", err)
+	}
+	hashed := sha256.Sum256(excC14N(signedInfo, nil, inclusivePrefixes(c14nMethod)))
+	alg := sigMethod.attr("Algorithm")
+	for _, cert := range certs {
+		switch pub := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			if alg == dsigRSASHA256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], value) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if alg == dsigECDSASHA256 && len(value)%2 == 0 {
+				half := len(value) / 2
+				if ecdsa.Verify(pub, hashed[:], new(big.Int).SetBytes(value[:half]), new(big.Int).SetBytes(value[half:])) {
+					return nil
+				}
+			}
+		}
+	}
+	if alg != dsigRSASHA256 && alg != dsigECDSASHA256 {
+		return fmt.Errorf("unsupported signature algorithm %s", alg)
+	}
+	return errors.New("signature doesn't verify with the IdP's certificate")
+}